@@ -0,0 +1,537 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/sparse"
+)
+
+// BoundaryConditions specify the concentrations of pollutants just outside
+// of the model domain, which are carried into the domain by advection
+// and mixing.
+type BoundaryConditions interface {
+	// Concentrations returns the concentration of each chemical species
+	// in boundary cell c at time t [μg/m³], in the order and form used in
+	// the concentration arrays of the chemical mechanism, or nil if all
+	// of the concentrations are zero. In steady-state simulations,
+	// t is the zero time.
+	Concentrations(c *Cell, t time.Time) []float64
+}
+
+// ZeroBoundaryConditions are boundary conditions where the concentrations
+// of all species outside of the model domain are zero. They are
+// used if no other boundary conditions are specified.
+type ZeroBoundaryConditions struct{}
+
+// Concentrations returns nil.
+func (ZeroBoundaryConditions) Concentrations(*Cell, time.Time) []float64 { return nil }
+
+// SetBoundaryConditions returns a function that sets the concentrations
+// in the boundary cells just outside of the model domain using bc.
+// If clock is not nil, the concentrations are for the current simulation
+// time of clock; otherwise they are for the zero time, which indicates a
+// steady-state simulation. Boundary cells that are added later, for example
+// when the grid is mutated, are also given concentrations from bc.
+// SetBoundaryConditions should be run after the grid has been created
+// and, for time-varying boundary conditions, periodically thereafter
+// (see RunPeriodically).
+//
+// Mass that enters the domain through the boundaries is recorded as
+// negative outflow in the mass budget (see TrackBudget).
+// The boundary conditions only apply to the total concentrations,
+// not to the concentrations for source tags (see TrackTags), and
+// they can not be used in distributed simulations.
+func SetBoundaryConditions(bc BoundaryConditions, clock *Clock) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.cluster != nil {
+			return fmt.Errorf("inmap: boundary conditions can not be used in distributed simulations")
+		}
+		d.boundaryConditions = bc
+		d.boundaryTime = time.Time{}
+		if clock != nil {
+			d.boundaryTime = clock.Time()
+		}
+		for _, g := range d.boundaries() {
+			for _, c := range *g {
+				d.setBoundaryConcentrations(c)
+			}
+		}
+		return nil
+	}
+}
+
+// setBoundaryConcentrations sets the concentrations of boundary cell c
+// using the boundary conditions of d, if there are any.
+func (d *InMAP) setBoundaryConcentrations(c *Cell) {
+	if d.boundaryConditions == nil {
+		return
+	}
+	conc := d.boundaryConditions.Concentrations(c, d.boundaryTime)
+	for i := range c.Ci {
+		if conc == nil {
+			c.Ci[i] = 0
+		} else {
+			c.Ci[i] = conc[i]
+		}
+	}
+}
+
+// boundarySnapshot returns the concentrations in boundary cell c from
+// a single set of gridded concentrations, or nil if the
+// gridded concentrations do not overlap c.
+type boundarySnapshot func(c *Cell) []float64
+
+// interpolatedBoundaryConditions are boundary conditions that are spatially
+// interpolated from one or more snapshots of gridded concentrations and
+// linearly interpolated in time between the snapshots.
+type interpolatedBoundaryConditions struct {
+	times     []time.Time
+	snapshots []boundarySnapshot
+}
+
+// newInterpolatedBoundaryConditions returns boundary conditions that are
+// interpolated from snapshots, which occur at the given times. times may
+// be empty if there is only one snapshot.
+func newInterpolatedBoundaryConditions(times []time.Time, snapshots []boundarySnapshot) (*interpolatedBoundaryConditions, error) {
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("inmap: no boundary condition files were specified")
+	}
+	if len(times) != len(snapshots) && !(len(times) == 0 && len(snapshots) == 1) {
+		return nil, fmt.Errorf("inmap: there are %d boundary condition files but %d boundary condition times",
+			len(snapshots), len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if !times[i].After(times[i-1]) {
+			return nil, fmt.Errorf("inmap: boundary condition times must be in increasing order")
+		}
+	}
+	return &interpolatedBoundaryConditions{times: times, snapshots: snapshots}, nil
+}
+
+// Concentrations returns the concentrations in c at time t, which are
+// interpolated between the snapshots before and after t. Times before
+// the first snapshot or after the last snapshot use the concentrations from
+// the first or last snapshot, respectively. For steady-state simulations,
+// where t is the zero time, the average of the snapshots is used.
+func (b *interpolatedBoundaryConditions) Concentrations(c *Cell, t time.Time) []float64 {
+	n := len(b.snapshots)
+	if t.IsZero() {
+		weights := make([]float64, n)
+		for i := range weights {
+			weights[i] = 1 / float64(n)
+		}
+		return combineSnapshots(c, b.snapshots, weights)
+	}
+	if n == 1 || !t.After(b.times[0]) {
+		return b.snapshots[0](c)
+	}
+	if !t.Before(b.times[n-1]) {
+		return b.snapshots[n-1](c)
+	}
+	i := sort.Search(n, func(i int) bool { return b.times[i].After(t) }) - 1
+	f := t.Sub(b.times[i]).Seconds() / b.times[i+1].Sub(b.times[i]).Seconds()
+	return combineSnapshots(c, b.snapshots[i:i+2], []float64{1 - f, f})
+}
+
+// combineSnapshots returns the weighted sum of the concentrations in c from
+// snapshots, or nil if none of the snapshots overlap c.
+func combineSnapshots(c *Cell, snapshots []boundarySnapshot, weights []float64) []float64 {
+	var o []float64
+	for i, s := range snapshots {
+		if weights[i] == 0 {
+			continue
+		}
+		conc := s(c)
+		if conc == nil {
+			continue
+		}
+		if o == nil {
+			o = make([]float64, len(conc))
+		}
+		for j, v := range conc {
+			o[j] += v * weights[i]
+		}
+	}
+	return o
+}
+
+// boundaryFeature holds the concentrations in an area of a
+// gridded snapshot.
+type boundaryFeature struct {
+	geom.Polygonal
+
+	// bottom and top are the heights of the bottom and top of
+	// the feature above the ground [m].
+	bottom, top float64
+
+	// conc holds the concentrations in the form used in the
+	// concentration arrays of the chemical mechanism [μg/m³].
+	conc []float64
+}
+
+// interpolateFeatures returns the average of the concentrations in
+// features, weighted by their area of overlap with c. Only the features
+// whose vertical extent is closest to the vertical center of c are used.
+// It returns nil if none of the features overlap c.
+func interpolateFeatures(c *Cell, features []*boundaryFeature) []float64 {
+	z := c.LayerHeight + c.Dz/2
+	var o []float64
+	var totalWeight float64
+	minDist := math.Inf(1)
+	for _, f := range features {
+		isect := f.Intersection(c)
+		if isect == nil {
+			continue
+		}
+		w := isect.Area()
+		if w == 0 {
+			continue
+		}
+		dist := math.Max(0, math.Max(f.bottom-z, z-f.top))
+		if dist > minDist {
+			continue
+		} else if dist < minDist {
+			minDist = dist
+			o = make([]float64, len(f.conc))
+			totalWeight = 0
+		}
+		for i, v := range f.conc {
+			o[i] += v * w
+		}
+		totalWeight += w
+	}
+	for i := range o {
+		o[i] /= totalWeight
+	}
+	return o
+}
+
+// arraySpecies returns the name of the species of m that corresponds to
+// each element of the concentration arrays, and the factor that converts the
+// concentration in the array to the concentration of the species itself,
+// for example from the mass of sulfur to the mass of sulfate. Species
+// that do not correspond to exactly one array element, such as emissions
+// or total PM2.5, are ignored, and array elements that do not correspond
+// to any species have an empty name.
+func arraySpecies(m Mechanism) (names []string, conv []float64, err error) {
+	n := m.Len()
+	names = make([]string, n)
+	conv = make([]float64, n)
+	for _, s := range m.Species() {
+		index := -1
+		var factor float64
+		for i := 0; i < n; i++ {
+			c := &Cell{Cf: make([]float64, n), EmisFlux: make([]float64, n)}
+			c.Cf[i] = 1
+			v, err := m.Value(c, s)
+			if err != nil {
+				return nil, nil, err
+			}
+			if v == 0 {
+				continue
+			}
+			if index >= 0 {
+				index = -1
+				break
+			}
+			index, factor = i, v
+		}
+		if index >= 0 && names[index] == "" {
+			names[index], conv[index] = s, factor
+		}
+	}
+	return names, conv, nil
+}
+
+// boundaryColumn returns the name of the shapefile column holding the
+// concentration of species s, which is truncated to the 10 characters
+// allowed in shapefile column names.
+func boundaryColumn(s string) string {
+	if len(s) > 10 {
+		return s[:10]
+	}
+	return s
+}
+
+// BoundaryOutputVariables returns the output variables (see NewOutputter)
+// that are needed for the results of a simulation with chemical
+// mechanism m to be used as boundary conditions by
+// NewInMAPBoundaryConditions: the concentration of each species and
+// the height and thickness of each grid cell.
+func BoundaryOutputVariables(m Mechanism) (map[string]string, error) {
+	species, _, err := arraySpecies(m)
+	if err != nil {
+		return nil, err
+	}
+	o := map[string]string{
+		"LayerHt": "LayerHeight",
+		"Dz":      "Dz",
+	}
+	for _, s := range species {
+		if s != "" {
+			o[boundaryColumn(s)] = s
+		}
+	}
+	return o, nil
+}
+
+// NewInMAPBoundaryConditions returns boundary conditions that are spatially
+// interpolated from the results of previous InMAP simulations of larger
+// domains, which are read from the shapefiles in files.
+// Each shapefile must have a column named after at least one of the
+// species of m (see Mechanism.Species), truncated to 10 characters,
+// holding its concentration [μg/m³]; missing species are assumed to be zero.
+// If the shapefiles also have columns "LayerHt" and "Dz" holding the
+// LayerHeight and Dz of each grid cell, the concentrations from the layer
+// closest to each boundary cell are used; otherwise the same concentrations
+// are used for all layers. BoundaryOutputVariables returns the output
+// variables that are needed, which should be output for all layers.
+// gridSR is the spatial reference of the model grid.
+//
+// If there is more than one file, times must hold the time of each and the
+// boundary conditions are interpolated in time between them; steady-state
+// simulations use their average. Boundary cells that do not overlap the
+// shapes in the files have concentrations of zero.
+func NewInMAPBoundaryConditions(files []string, times []time.Time, gridSR *proj.SR, m Mechanism) (BoundaryConditions, error) {
+	species, conv, err := arraySpecies(m)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]boundarySnapshot, len(files))
+	for i, f := range files {
+		index, err := readBoundaryShapefile(f, gridSR, species, conv)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[i] = func(c *Cell) []float64 {
+			var features []*boundaryFeature
+			for _, item := range index.SearchIntersect(c.Bounds()) {
+				features = append(features, item.(*boundaryFeature))
+			}
+			return interpolateFeatures(c, features)
+		}
+	}
+	return newInterpolatedBoundaryConditions(times, snapshots)
+}
+
+// readBoundaryShapefile reads the concentrations of species from shapefile
+// fname into a spatial index of *boundaryFeatures with the spatial
+// reference gridSR, dividing each by the corresponding factor in conv.
+// species and conv are as returned by arraySpecies.
+func readBoundaryShapefile(fname string, gridSR *proj.SR, species []string, conv []float64) (*rtree.Rtree, error) {
+	f, err := shp.NewDecoder(fname)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening boundary condition file %s: %v", fname, err)
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading projection of boundary condition file %s: %v", fname, err)
+	}
+	trans, err := sr.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: boundary condition file %s: %v", fname, err)
+	}
+	fields := f.Reader.Fields()
+	names := make([]string, len(fields))
+	columns := make(map[string]bool)
+	for i, field := range fields {
+		names[i] = field.String()
+		columns[names[i]] = true
+	}
+	var hasSpecies bool
+	for _, s := range species {
+		hasSpecies = hasSpecies || (s != "" && columns[boundaryColumn(s)])
+	}
+	if !hasSpecies {
+		return nil, fmt.Errorf("inmap: boundary condition file %s does not have a column for any of the species %v",
+			fname, species)
+	}
+	hasLayers := columns["LayerHt"] && columns["Dz"]
+
+	index := rtree.NewTree(25, 50)
+	for {
+		g, data, more := f.DecodeRowFields(names...)
+		if !more {
+			break
+		}
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: boundary condition file %s: %v", fname, err)
+		}
+		p, ok := gg.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("inmap: boundary condition file %s: shapes need to be polygons", fname)
+		}
+		bf := &boundaryFeature{
+			Polygonal: p,
+			bottom:    math.Inf(-1),
+			top:       math.Inf(1),
+			conc:      make([]float64, len(species)),
+		}
+		for i, s := range species {
+			col := boundaryColumn(s)
+			if s == "" || !columns[col] {
+				continue
+			}
+			v, err := s2f(data[col])
+			if err != nil {
+				return nil, fmt.Errorf("inmap: boundary condition file %s column %s: %v", fname, col, err)
+			}
+			bf.conc[i] = v / conv[i]
+		}
+		if hasLayers {
+			h, err := s2f(data["LayerHt"])
+			if err != nil {
+				return nil, fmt.Errorf("inmap: boundary condition file %s column LayerHt: %v", fname, err)
+			}
+			dz, err := s2f(data["Dz"])
+			if err != nil {
+				return nil, fmt.Errorf("inmap: boundary condition file %s column Dz: %v", fname, err)
+			}
+			bf.bottom, bf.top = h, h+dz
+		}
+		index.Insert(bf)
+	}
+	if err := f.Error(); err != nil {
+		return nil, fmt.Errorf("inmap: reading boundary condition file %s: %v", fname, err)
+	}
+	return index, nil
+}
+
+// ctmBaselineVariables are the names of the CTM data variables holding
+// the baseline concentrations of each of the pollutants in PolNames.
+var ctmBaselineVariables = [...]string{
+	igOrg:  "aVOC",
+	ipOrg:  "aSOA",
+	iPM2_5: "TotalPM25",
+	igNH:   "gNH",
+	ipNH:   "pNH",
+	igS:    "gS",
+	ipS:    "pS",
+	igNO:   "gNO",
+	ipNO:   "pNO",
+}
+
+// NewCTMBoundaryConditions returns boundary conditions that are spatially
+// interpolated from the baseline concentrations in chemical transport model
+// (CTM) data, for example from a simulation of a larger domain that has been
+// processed by the preprocessor and loaded using VarGridConfig.LoadCTMData.
+// The concentrations from the CTM layer closest to each boundary cell are
+// used. Species of m are matched to the baseline concentrations by name
+// (for example, species "pSO4" matches "BaselinePSO4"); species without
+// baseline concentrations, such as primary PM2.5, are assumed to be zero,
+// and a warning is written to the log for each of them.
+//
+// times has the same meaning as for NewInMAPBoundaryConditions.
+func NewCTMBoundaryConditions(data []*CTMData, times []time.Time, m Mechanism) (BoundaryConditions, error) {
+	species, conv, err := arraySpecies(m)
+	if err != nil {
+		return nil, err
+	}
+	// Find the baseline concentration label for each species.
+	labels := make([]string, len(species))
+	for i, s := range species {
+		if s == "" {
+			continue
+		}
+		for l := range baselinePolLabels {
+			if strings.EqualFold(l, "Baseline"+s) {
+				labels[i] = l
+			}
+		}
+		if labels[i] == "" {
+			log.Printf("inmap: warning: CTM boundary conditions have no baseline "+
+				"concentrations for species %s; its boundary concentrations will be zero", s)
+		}
+	}
+	snapshots := make([]boundarySnapshot, len(data))
+	for i, d := range data {
+		snapshots[i], err = ctmBoundarySnapshot(d, labels, conv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newInterpolatedBoundaryConditions(times, snapshots)
+}
+
+// ctmBoundarySnapshot returns the concentrations in each boundary cell from
+// data, where labels holds the key in baselinePolLabels for each element
+// of the concentration arrays (or "" if there is none) and conv holds
+// the conversion factors returned by arraySpecies.
+func ctmBoundarySnapshot(data *CTMData, labels []string, conv []float64) (boundarySnapshot, error) {
+	get := func(name string) (*sparse.DenseArray, error) {
+		v, ok := data.Data[name]
+		if !ok {
+			return nil, fmt.Errorf("inmap: boundary condition CTM data is missing variable %s", name)
+		}
+		return v.Data, nil
+	}
+	layerHeights, err := get("LayerHeights")
+	if err != nil {
+		return nil, err
+	}
+	dz, err := get("Dz")
+	if err != nil {
+		return nil, err
+	}
+	var baselineData [len(ctmBaselineVariables)]*sparse.DenseArray
+	for i, v := range ctmBaselineVariables {
+		if baselineData[i], err = get(v); err != nil {
+			return nil, err
+		}
+	}
+	return func(c *Cell) []float64 {
+		var features []*boundaryFeature
+		for _, cc := range data.gridTree.SearchIntersect(c.Bounds()) {
+			g := cc.(*gridCellLight)
+			k, row, col := g.layer, g.Row, g.Col
+			bottom := layerHeights.Get(k, row, col)
+			f := &boundaryFeature{
+				Polygonal: g.Polygonal,
+				bottom:    bottom,
+				top:       bottom + dz.Get(k, row, col),
+				conc:      make([]float64, len(labels)),
+			}
+			for i, l := range labels {
+				if l == "" {
+					continue
+				}
+				polConv := baselinePolLabels[l]
+				for ii, j := range polConv.index {
+					f.conc[i] += baselineData[j].Get(k, row, col) * polConv.conversion[ii]
+				}
+				f.conc[i] /= conv[i]
+			}
+			features = append(features, f)
+		}
+		return interpolateFeatures(c, features)
+	}, nil
+}
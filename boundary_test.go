@@ -0,0 +1,229 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// constantBoundaryConditions are boundary conditions with the same
+// concentrations everywhere.
+type constantBoundaryConditions []float64
+
+func (b constantBoundaryConditions) Concentrations(*Cell, time.Time) []float64 { return b }
+
+func TestSetBoundaryConditions(t *testing.T) {
+	const (
+		testTolerance      = 1.e-8
+		gridMutateInterval = 3600. // interval between grid mutations in seconds.
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	var m Mech
+
+	run := func(t *testing.T, bc BoundaryConditions) *InMAP {
+		popConcMutator := NewPopConcMutator(cfg, popIndices)
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				SetBoundaryConditions(bc, nil),
+				TrackBudget(m, 0),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(UpwindAdvection(), Mixing(), MeanderMixing()),
+				RunPeriodically(gridMutateInterval,
+					cfg.MutateGrid(popConcMutator.Mutate(), ctmdata, pop, mr, emis, m, nil)),
+				RunPeriodically(gridMutateInterval, SetTimestepCFL()),
+				SteadyStateConvergenceCheck(200, cfg.PopGridColumn, m, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("zero", func(t *testing.T) {
+		d := run(t, ZeroBoundaryConditions{})
+		for i, c := range *d.cells {
+			for j, v := range c.Cf {
+				if v != 0 {
+					t.Errorf("cell %d species %d: concentration should be zero but is %g", i, j, v)
+				}
+			}
+		}
+	})
+
+	t.Run("constant", func(t *testing.T) {
+		bc := make(constantBoundaryConditions, m.Len())
+		for i := range bc {
+			bc[i] = 1
+		}
+		d := run(t, bc)
+		for _, g := range d.boundaries() {
+			for _, c := range *g {
+				for j, v := range c.Ci {
+					if v != 1 {
+						t.Errorf("boundary cell species %d: concentration should be 1 but is %g", j, v)
+					}
+				}
+			}
+		}
+		var sum float64
+		for i, c := range *d.cells {
+			for j, v := range c.Cf {
+				if v < 0 || v > 1+testTolerance {
+					t.Errorf("cell %d species %d: concentration %g should be between 0 and 1", i, j, v)
+				}
+				sum += v
+			}
+		}
+		if sum == 0 {
+			t.Error("concentrations should be greater than zero")
+		}
+
+		b := d.Budget()
+		for i := range b.Change {
+			var outflow float64
+			for _, o := range b.Outflow {
+				outflow += o[i]
+			}
+			if outflow >= 0 {
+				t.Errorf("species %d: outflow should be negative: %g", i, outflow)
+			}
+			if math.Abs(b.Residual[i]) > math.Abs(b.Change[i])*testTolerance {
+				t.Errorf("species %d: residual %g should be zero", i, b.Residual[i])
+			}
+		}
+	})
+}
+
+func TestCTMBoundaryConditions(t *testing.T) {
+	const testTolerance = 1.e-8
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	var m Mech
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("steady", func(t *testing.T) {
+		var logBuf bytes.Buffer
+		log.SetOutput(&logBuf)
+		bc, err := NewCTMBoundaryConditions([]*CTMData{ctmdata}, nil, m)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only primary PM2.5 has no baseline concentrations.
+		if warning := logBuf.String(); !strings.Contains(warning, "species PrimaryPM25") || strings.Count(warning, "warning") != 1 {
+			t.Errorf("unexpected warnings: %q", warning)
+		}
+		// Grid cells have the same location as the boundary cells next
+		// to them, so their boundary concentrations should match their
+		// baseline concentrations.
+		for i, c := range *d.cells {
+			conc := bc.Concentrations(c, time.Time{})
+			if len(conc) != m.Len() {
+				t.Fatalf("cell %d: have %d concentrations, want %d", i, len(conc), m.Len())
+			}
+			for j, v := range conc {
+				want := c.CBaseline[j]
+				if j == iPM2_5 { // There is no baseline primary PM2.5.
+					want = 0
+				}
+				if different(v, want, testTolerance) {
+					t.Errorf("cell %d species %d: %g != %g", i, j, v, want)
+				}
+			}
+		}
+	})
+
+	t.Run("time-varying", func(t *testing.T) {
+		// The second snapshot has three times the particulate sulfate
+		// of the first.
+		ctmdata2 := &CTMData{gridTree: ctmdata.gridTree}
+		for name, v := range ctmdata.Data {
+			data := sparse.ZerosDense(v.Data.Shape...)
+			copy(data.Elements, v.Data.Elements)
+			if name == "pS" {
+				for i, val := range data.Elements {
+					data.Elements[i] = val * 3
+				}
+			}
+			ctmdata2.AddVariable(name, v.Dims, v.Description, v.Units, data)
+		}
+		start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+		end := start.Add(2 * time.Hour)
+		bc, err := NewCTMBoundaryConditions([]*CTMData{ctmdata, ctmdata2}, []time.Time{start, end}, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := (*d.cells)[0]
+		base := c.CBaseline[ipS]
+		if base == 0 {
+			t.Fatal("baseline particulate sulfate should not be zero")
+		}
+		for _, test := range []struct {
+			t      time.Time
+			factor float64
+		}{
+			{t: time.Time{}, factor: 2},
+			{t: start.Add(-time.Hour), factor: 1},
+			{t: start, factor: 1},
+			{t: start.Add(30 * time.Minute), factor: 1.5},
+			{t: end, factor: 3},
+			{t: end.Add(time.Hour), factor: 3},
+		} {
+			conc := bc.Concentrations(c, test.t)
+			if different(conc[ipS], base*test.factor, testTolerance) {
+				t.Errorf("%v: %g != %g", test.t, conc[ipS], base*test.factor)
+			}
+			if different(conc[igS], c.CBaseline[igS], testTolerance) {
+				t.Errorf("%v: gaseous sulfur %g != %g", test.t, conc[igS], c.CBaseline[igS])
+			}
+		}
+
+		if _, err := NewCTMBoundaryConditions([]*CTMData{ctmdata, ctmdata2}, nil, m); err == nil {
+			t.Error("expected an error for missing times")
+		}
+		if _, err := NewCTMBoundaryConditions([]*CTMData{ctmdata, ctmdata2}, []time.Time{end, start}, m); err == nil {
+			t.Error("expected an error for times that are out of order")
+		}
+	})
+}
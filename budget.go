@@ -0,0 +1,316 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// BudgetProcess is a process that changes the mass of pollutants in the
+// model domain, for tracking the mass budget using TrackBudget.
+type BudgetProcess int
+
+// These are the processes whose contributions to the mass budget are tracked.
+// Mass that leaves the domain through the boundaries is calculated from the
+// concentrations in the boundary cells.
+const (
+	EmissionsBudget     BudgetProcess = iota // Emissions
+	DryDepositionBudget                      // Dry deposition
+	WetDepositionBudget                      // Wet deposition
+	ChemistryBudget                          // Chemical transformation
+)
+
+// CellBudget holds the cumulative change in the mass of each chemical
+// species in a grid cell caused by each BudgetProcess since the budget
+// started being tracked [μg]. Decreases in mass, for example from
+// deposition, are negative. The species are in the order of the
+// concentration arrays of the chemical mechanism.
+type CellBudget struct {
+	Emissions     []float64
+	DryDeposition []float64
+	WetDeposition []float64
+	Chemistry     []float64
+}
+
+// newCellBudget returns a new CellBudget for n species.
+func newCellBudget(n int) *CellBudget {
+	return &CellBudget{
+		Emissions:     make([]float64, n),
+		DryDeposition: make([]float64, n),
+		WetDeposition: make([]float64, n),
+		Chemistry:     make([]float64, n),
+	}
+}
+
+// process returns the values for process p.
+func (b *CellBudget) process(p BudgetProcess) []float64 {
+	switch p {
+	case EmissionsBudget:
+		return b.Emissions
+	case DryDepositionBudget:
+		return b.DryDeposition
+	case WetDepositionBudget:
+		return b.WetDeposition
+	case ChemistryBudget:
+		return b.Chemistry
+	default:
+		panic(fmt.Errorf("inmap: invalid budget process %d", p))
+	}
+}
+
+// add adds the values in o to b.
+func (b *CellBudget) add(o *CellBudget) {
+	for _, p := range []BudgetProcess{EmissionsBudget, DryDepositionBudget, WetDepositionBudget, ChemistryBudget} {
+		bp, op := b.process(p), o.process(p)
+		for i, v := range op {
+			bp[i] += v
+		}
+	}
+}
+
+// AddToBudget adds a change in the concentration of species i
+// in c caused by process p [μg/m³] to the mass budget of c.
+// It has no effect if the budget is not being tracked (see TrackBudget).
+// It is intended to be called by CellManipulators.
+func (c *Cell) AddToBudget(p BudgetProcess, i int, Δc float64) {
+	if c.Budget == nil {
+		return
+	}
+	c.Budget.process(p)[i] += Δc * c.Volume
+}
+
+// budgetBoundaries are the names of the domain boundaries
+// in MassBudget.Outflow.
+var budgetBoundaries = []string{"West", "East", "South", "North", "Top"}
+
+// boundaries returns the boundary cells of d in the
+// order of budgetBoundaries.
+func (d *InMAP) boundaries() []*cellList {
+	return []*cellList{d.westBoundary, d.eastBoundary, d.southBoundary, d.northBoundary, d.topBoundary}
+}
+
+// budgetState holds the information needed to calculate the
+// mass budget of the domain.
+type budgetState struct {
+	m Mechanism
+
+	// initialMass is the mass of each species in the domain when budget
+	// tracking started [μg].
+	initialMass []float64
+
+	// removed holds the budgets of grid cells that have been removed from the
+	// grid, and removedOutflow holds the outflow recorded by boundary cells
+	// that have been removed, in the order of budgetBoundaries.
+	removed        *CellBudget
+	removedOutflow [][]float64
+
+	// reportInterval is the simulation time between budget reports
+	// in SimulationStatus [s], and timeSinceReport is the simulation time
+	// since the last report.
+	reportInterval, timeSinceReport float64
+}
+
+// remove adds the budget of c, which is being removed from the grid,
+// to the budget of the domain.
+func (b *budgetState) remove(c *Cell) {
+	if c.Budget != nil {
+		b.removed.add(c.Budget)
+	}
+}
+
+// removeBoundary adds the outflow recorded by boundary cell c, which is on
+// the boundary with index i in budgetBoundaries and is being removed from
+// the grid, to the budget of the domain if it is being tracked.
+func (d *InMAP) removeBoundary(i int, c *Cell) {
+	if d.budget == nil {
+		return
+	}
+	for j, v := range c.Cf {
+		d.budget.removedOutflow[i][j] += v * c.Volume
+	}
+}
+
+// TrackBudget returns a function that starts tracking the mass budget of
+// each chemical species in the domain: the changes in mass caused by each
+// BudgetProcess, which are recorded by the CellManipulators for those
+// processes using Cell.AddToBudget, and the net mass that leaves the domain
+// through each boundary. The cumulative budget of each grid cell is stored
+// in its Budget field, and the budget of the whole domain is available from
+// InMAP.Budget. If reportInterval is greater than zero, the budget of the
+// domain is included in the SimulationStatus sent by Log with a period of
+// reportInterval seconds of simulation time.
+//
+// TrackBudget resets the concentrations of the boundary cells, which only
+// record the mass that has left the domain, and it resets the budgets of any
+// grid cells that have been loaded from a checkpoint.
+// The budget is only tracked for the total concentrations, not for
+// source tags (see TrackTags), and it can not be tracked
+// in distributed simulations.
+func TrackBudget(m Mechanism, reportInterval float64) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.cluster != nil {
+			return fmt.Errorf("inmap: the mass budget can not be tracked in distributed simulations")
+		}
+		n := m.Len()
+		b := &budgetState{
+			m:              m,
+			initialMass:    make([]float64, n),
+			removed:        newCellBudget(n),
+			removedOutflow: make([][]float64, len(budgetBoundaries)),
+			reportInterval: reportInterval,
+		}
+		for i := range b.removedOutflow {
+			b.removedOutflow[i] = make([]float64, n)
+		}
+		for _, g := range d.boundaries() {
+			for _, c := range *g {
+				c.Cf = make([]float64, n)
+			}
+		}
+		for _, c := range *d.cells {
+			c.Budget = newCellBudget(n)
+			for i, v := range c.Cf {
+				b.initialMass[i] += v * c.Volume
+			}
+		}
+		d.budget = b
+		return nil
+	}
+}
+
+// MassBudget holds the mass budget of each chemical species in the model
+// domain since budget tracking started (see TrackBudget) [μg].
+// The species are in the order of the concentration arrays of the
+// chemical mechanism, and their mass is in the form
+// used in the concentration arrays; for example, in the simplechem
+// mechanism the mass of NOx is the mass of nitrogen.
+type MassBudget struct {
+	// Species holds the names of the chemical species.
+	Species []string
+
+	// Emissions, DryDeposition, WetDeposition, and Chemistry hold the
+	// change in the mass of each species caused by each process.
+	Emissions, DryDeposition, WetDeposition, Chemistry []float64
+
+	// Outflow holds the net mass of each species that has left the domain
+	// through the "West", "East", "South", "North", and "Top" boundaries.
+	Outflow map[string][]float64
+
+	// Change holds the change in the mass of each species in the domain.
+	Change []float64
+
+	// Residual holds the mass of each species that is not accounted for by
+	// the processes above: the sum of the changes caused by the processes,
+	// minus the outflow, minus the change in mass. It should be close to zero
+	// if the mass budget is closed.
+	Residual []float64
+}
+
+// Budget returns the mass budget of the domain, or nil if the budget is not
+// being tracked (see TrackBudget).
+func (d *InMAP) Budget() *MassBudget {
+	if d.budget == nil {
+		return nil
+	}
+	d.cellLock.RLock()
+	defer d.cellLock.RUnlock()
+	return d.massBudget()
+}
+
+// massBudget calculates the mass budget of the domain. The caller is
+// responsible for holding d.cellLock.
+func (d *InMAP) massBudget() *MassBudget {
+	n := d.budget.m.Len()
+	total := newCellBudget(n)
+	total.add(d.budget.removed)
+	mass := make([]float64, n)
+	for _, c := range *d.cells {
+		if c.Budget != nil {
+			total.add(c.Budget)
+		}
+		for i, v := range c.Cf {
+			mass[i] += v * c.Volume
+		}
+	}
+	b := &MassBudget{
+		Species:       d.budget.m.Species(),
+		Emissions:     total.Emissions,
+		DryDeposition: total.DryDeposition,
+		WetDeposition: total.WetDeposition,
+		Chemistry:     total.Chemistry,
+		Outflow:       make(map[string][]float64),
+		Change:        make([]float64, n),
+		Residual:      make([]float64, n),
+	}
+	for j, g := range d.boundaries() {
+		outflow := make([]float64, n)
+		copy(outflow, d.budget.removedOutflow[j])
+		for _, c := range *g {
+			for i, v := range c.Cf {
+				outflow[i] += v * c.Volume
+			}
+		}
+		b.Outflow[budgetBoundaries[j]] = outflow
+	}
+	for i := range mass {
+		b.Change[i] = mass[i] - d.budget.initialMass[i]
+		b.Residual[i] = b.Emissions[i] + b.DryDeposition[i] + b.WetDeposition[i] +
+			b.Chemistry[i] - b.Change[i]
+		for _, o := range b.Outflow {
+			b.Residual[i] -= o[i]
+		}
+	}
+	return b
+}
+
+func (b *MassBudget) String() string {
+	const kgPerμg = 1.e-9
+	buf := bytes.NewBufferString("Mass budget (kg):\n")
+	w := tabwriter.NewWriter(buf, 0, 8, 1, '\t', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Species\tEmissions\tDryDep\tWetDep\tChemistry\t%s\tChange\tResidual\t\n",
+		strings.Join(budgetBoundaries, "\t"))
+	for i, s := range b.Species {
+		fmt.Fprintf(w, "%s\t%.4g\t%.4g\t%.4g\t%.4g\t", s, b.Emissions[i]*kgPerμg,
+			b.DryDeposition[i]*kgPerμg, b.WetDeposition[i]*kgPerμg, b.Chemistry[i]*kgPerμg)
+		for _, bound := range budgetBoundaries {
+			fmt.Fprintf(w, "%.4g\t", b.Outflow[bound][i]*kgPerμg)
+		}
+		fmt.Fprintf(w, "%.4g\t%.4g\t\n", b.Change[i]*kgPerμg, b.Residual[i]*kgPerμg)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// reportBudget returns the mass budget of the domain if the budget is being
+// tracked and it is time to report it after a time step of length dt,
+// otherwise it returns nil.
+func (d *InMAP) reportBudget(dt float64) *MassBudget {
+	if d.budget == nil || d.budget.reportInterval <= 0 {
+		return nil
+	}
+	d.budget.timeSinceReport += dt
+	if d.budget.timeSinceReport < d.budget.reportInterval {
+		return nil
+	}
+	d.budget.timeSinceReport = 0
+	return d.Budget()
+}
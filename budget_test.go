@@ -0,0 +1,168 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/science/chem/simplechem"
+)
+
+func TestTrackBudget(t *testing.T) {
+	const (
+		testTolerance      = 1.e-8
+		gridMutateInterval = 3600. // interval between grid mutations in seconds.
+	)
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+	emis.Add(&inmap.EmisRecord{
+		SOx:    E,
+		NOx:    E,
+		PM25:   E,
+		VOC:    E,
+		NH3:    E,
+		Height: 20,
+		Geom:   geom.Point{X: 1000, Y: 1000.},
+	}) // elevated emissions
+
+	var m simplechem.Mechanism
+	drydep, err := m.DryDep("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wetdep, err := m.WetDep("emep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, transport ...inmap.CellManipulator) *inmap.InMAP {
+		popConcMutator := inmap.NewPopConcMutator(cfg, popIndices)
+		d := &inmap.InMAP{
+			InitFuncs: []inmap.DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				inmap.TrackBudget(m, 0),
+				inmap.SetTimestepCFL(),
+			},
+			RunFuncs: []inmap.DomainManipulator{
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.Calculations(append(transport, drydep, wetdep, m.Chemistry())...),
+				inmap.RunPeriodically(gridMutateInterval,
+					cfg.MutateGrid(popConcMutator.Mutate(), ctmdata, pop, mr, emis, m, nil)),
+				inmap.RunPeriodically(gridMutateInterval, inmap.SetTimestepCFL()),
+				inmap.SteadyStateConvergenceCheck(-1, cfg.PopGridColumn, m, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("no transport", func(t *testing.T) {
+		d := run(t)
+		b := d.Budget()
+		var totalEmis, totalDryDep, totalWetDep, totalChem float64
+		for i := range b.Species {
+			totalEmis += b.Emissions[i]
+			totalDryDep += b.DryDeposition[i]
+			totalWetDep += b.WetDeposition[i]
+			totalChem += b.Chemistry[i]
+		}
+		if totalEmis <= 0 {
+			t.Errorf("emissions should be greater than zero: %g", totalEmis)
+		}
+		if totalDryDep >= 0 || totalWetDep >= 0 {
+			t.Errorf("deposition should be less than zero: dry=%g, wet=%g", totalDryDep, totalWetDep)
+		}
+		if math.Abs(totalChem) > totalEmis*testTolerance {
+			t.Errorf("chemistry should not change the total mass: %g", totalChem)
+		}
+		for i, s := range b.Species {
+			if math.Abs(b.Residual[i]) > totalEmis*testTolerance {
+				t.Errorf("%s: residual %g should be zero; budget: %+v", s, b.Residual[i], b)
+			}
+			for bound, o := range b.Outflow {
+				if o[i] != 0 {
+					t.Errorf("%s: outflow through the %s boundary should be zero but is %g", s, bound, o[i])
+				}
+			}
+		}
+		if !strings.Contains(b.String(), "Mass budget (kg):") {
+			t.Errorf("invalid budget string: %s", b)
+		}
+
+		o, err := inmap.NewOutputter("", false, map[string]string{
+			"DryDeppSO4": "DryDeppSO4",
+			"WetDeppSO4": "WetDeppSO4",
+			"SDep":       "SDep",
+		}, nil, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = o.CheckOutputVars(m)(d); err != nil {
+			t.Fatal(err)
+		}
+		r, err := d.Results(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"DryDeppSO4", "WetDeppSO4", "SDep"} {
+			var sum float64
+			for _, val := range r[v] {
+				if val < 0 {
+					t.Errorf("%s should not be negative: %g", v, val)
+				}
+				sum += val
+			}
+			if sum == 0 {
+				t.Errorf("%s should be greater than zero", v)
+			}
+		}
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		d := run(t, inmap.UpwindAdvection(), inmap.Mixing(), inmap.MeanderMixing())
+		b := d.Budget()
+		var outflow float64
+		for _, o := range b.Outflow {
+			for _, v := range o {
+				outflow += v
+			}
+		}
+		if outflow <= 0 {
+			t.Errorf("outflow should be greater than zero: %g", outflow)
+		}
+	})
+}
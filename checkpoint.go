@@ -0,0 +1,208 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+
+	"github.com/ctessum/geom"
+)
+
+// checkpoint holds the full state of a simulation.
+type checkpoint struct {
+	// DataVersion holds the checkpoint data version of the software
+	// that saved this data, and should match the CheckpointDataVersion
+	// global variable.
+	DataVersion string
+
+	// GridConfig holds the variable resolution grid configuration
+	// that the simulation was run with.
+	GridConfig VarGridConfig
+
+	// Mechanism is the type name of the chemical mechanism,
+	// and Species are the names of its species.
+	Mechanism string
+	Species   []string
+
+	// EmisTotals holds the total emissions flux of each species
+	// in the domain [μg/s].
+	EmisTotals []float64
+
+	Cells       []*Cell
+	Dt          float64
+	Convergence *convergenceState
+}
+
+// checkpointGridConfig returns a copy of the fields in c that determine
+// the variable resolution grid, for checking whether a checkpoint
+// is compatible with the current configuration.
+// File paths are not included because input files may be stored
+// in different locations when a simulation is restarted.
+func checkpointGridConfig(c *VarGridConfig) VarGridConfig {
+	return VarGridConfig{
+		VariableGridXo:       c.VariableGridXo,
+		VariableGridYo:       c.VariableGridYo,
+		VariableGridDx:       c.VariableGridDx,
+		VariableGridDy:       c.VariableGridDy,
+		Xnests:               c.Xnests,
+		Ynests:               c.Ynests,
+		HiResLayers:          c.HiResLayers,
+		PopDensityThreshold:  c.PopDensityThreshold,
+		PopThreshold:         c.PopThreshold,
+		PopConcThreshold:     c.PopConcThreshold,
+		CensusPopColumns:     c.CensusPopColumns,
+		PopGridColumn:        c.PopGridColumn,
+		MortalityRateColumns: c.MortalityRateColumns,
+		RefinementNestLevel:  c.RefinementNestLevel,
+		GridProj:             c.GridProj,
+	}
+}
+
+// emisTotals returns the total emissions flux of each species in the
+// domain [μg/s].
+func (d *InMAP) emisTotals() []float64 {
+	var totals []float64
+	for _, c := range *d.cells {
+		if totals == nil {
+			totals = make([]float64, len(c.EmisFlux))
+		}
+		for i, e := range c.EmisFlux {
+			totals[i] += e * c.Volume
+		}
+	}
+	return totals
+}
+
+// Checkpoint returns a function that writes the full state of the simulation,
+// including grid cell concentrations, the timestep, and the progress of
+// SteadyStateConvergenceCheck, to a gob file at fileName
+// (format description at https://golang.org/pkg/encoding/gob/),
+// replacing any previous checkpoint. config and m are saved
+// so that they can be checked when the simulation is restarted.
+// Checkpoint is typically used with RunPeriodically, and the simulation can
+// be resumed using Restart.
+func Checkpoint(fileName string, config *VarGridConfig, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.cells.len() == 0 {
+			return fmt.Errorf("inmap: checkpoint: no grid cells to save")
+		}
+		if d.cluster != nil {
+			if err := d.cluster.Gather()(d); err != nil {
+				return err
+			}
+		}
+		data := checkpoint{
+			DataVersion: CheckpointDataVersion,
+			GridConfig:  checkpointGridConfig(config),
+			Mechanism:   fmt.Sprintf("%T", m),
+			Species:     m.Species(),
+			EmisTotals:  d.emisTotals(),
+			Cells:       d.cells.array(),
+			Dt:          d.Dt,
+			Convergence: d.convergence,
+		}
+
+		// Write to a temporary file first so that the previous checkpoint
+		// is not lost if the simulation is stopped while writing.
+		tmpName := fileName + ".tmp"
+		f, err := os.Create(tmpName)
+		if err != nil {
+			return fmt.Errorf("inmap: creating checkpoint file: %v", err)
+		}
+		if err := gob.NewEncoder(f).Encode(data); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		if err := os.Rename(tmpName, fileName); err != nil {
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		return nil
+	}
+}
+
+// Restart returns a function that loads the simulation state
+// from a checkpoint created by Checkpoint so that the simulation can
+// be resumed where it left off. Restart is used in place of the
+// functions that would otherwise create or load the grid.
+// It returns an error if the grid configuration, emissions,
+// or chemical mechanism are different from those used to create
+// the checkpoint.
+func Restart(r io.Reader, config *VarGridConfig, emis *Emissions, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		var data checkpoint
+		if err := gob.NewDecoder(r).Decode(&data); err != nil {
+			return fmt.Errorf("inmap: reading checkpoint: %v", err)
+		}
+		if data.DataVersion != CheckpointDataVersion {
+			return fmt.Errorf("inmap: checkpoint data version %s is not compatible with "+
+				"the required version %s", data.DataVersion, CheckpointDataVersion)
+		}
+		if fmt.Sprintf("%+v", data.GridConfig) != fmt.Sprintf("%+v", checkpointGridConfig(config)) {
+			return fmt.Errorf("inmap: the variable grid configuration does not match " +
+				"the configuration used to create the checkpoint")
+		}
+		if mech := fmt.Sprintf("%T", m); data.Mechanism != mech || !reflect.DeepEqual(data.Species, m.Species()) {
+			return fmt.Errorf("inmap: chemical mechanism %s does not match mechanism "+
+				"%s used to create the checkpoint", mech, data.Mechanism)
+		}
+		if err := d.initFromCells(data.Cells, emis, config, m); err != nil {
+			return err
+		}
+		totals := d.emisTotals()
+		if len(totals) != len(data.EmisTotals) {
+			return fmt.Errorf("inmap: the emissions do not match the emissions " +
+				"used to create the checkpoint")
+		}
+		for i, t := range totals {
+			if t != data.EmisTotals[i] && math.Abs(t-data.EmisTotals[i]) > 1.e-8*math.Abs(t+data.EmisTotals[i]) {
+				return fmt.Errorf("inmap: total %s emissions (%g μg/s) do not match the emissions "+
+					"used to create the checkpoint (%g μg/s)", m.Species()[i], t, data.EmisTotals[i])
+			}
+		}
+		d.Dt = data.Dt
+		d.convergence = data.Convergence
+		return nil
+	}
+}
+
+// CheckpointGeometry returns the geometry of the grid cells in the specified
+// vertical layer of a checkpoint created by Checkpoint, in the same
+// order as InMAP.GetGeometry. It can be used to allocate emissions to
+// the grid before the simulation is resumed using Restart.
+func CheckpointGeometry(r io.Reader, layer int) ([]geom.Polygonal, error) {
+	var data checkpoint
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("inmap: reading checkpoint: %v", err)
+	}
+	var o []geom.Polygonal
+	for _, c := range data.Cells {
+		if c.Layer == layer {
+			o = append(o, c.Polygonal)
+		}
+	}
+	return o, nil
+}
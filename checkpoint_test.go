@@ -0,0 +1,175 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/science/chem/simplechem"
+)
+
+func TestCheckpointRestart(t *testing.T) {
+	const (
+		fileName      = "testCheckpoint.gob"
+		testTolerance = 1.e-10
+	)
+	defer os.Remove(fileName)
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	var m simplechem.Mechanism
+	drydep, err := m.DryDep("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wetdep, err := m.WetDep("emep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run runs a simulation for a total of numIterations iterations.
+	run := func(initFuncs []inmap.DomainManipulator, numIterations int, cleanupFuncs ...inmap.DomainManipulator) *inmap.InMAP {
+		d := &inmap.InMAP{
+			InitFuncs: initFuncs,
+			RunFuncs: []inmap.DomainManipulator{
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.Calculations(drydep, wetdep),
+				inmap.SteadyStateConvergenceCheck(numIterations, cfg.PopGridColumn, m, nil),
+			},
+			CleanupFuncs: cleanupFuncs,
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	newGrid := []inmap.DomainManipulator{
+		cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		inmap.SetTimestepCFL(),
+	}
+
+	// Run for 4 iterations and save a checkpoint, then restart and
+	// run until iteration 8.
+	run(newGrid, 4, inmap.Checkpoint(fileName, cfg, m))
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := run([]inmap.DomainManipulator{inmap.Restart(f, cfg, emis, m)}, 8)
+	f.Close()
+
+	// The results should be the same as running for 8 iterations
+	// without stopping.
+	uninterrupted := run(newGrid, 8)
+
+	o, err := inmap.NewOutputter("", false, map[string]string{"PrimPM25": "PrimaryPM25", "pNO3": "pNO3"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := restarted.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := uninterrupted.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, w := range want {
+		h := have[v]
+		if len(h) != len(w) {
+			t.Fatalf("%s: number of cells %d != %d", v, len(h), len(w))
+		}
+		for i := range w {
+			if different(h[i], w[i], testTolerance) {
+				t.Errorf("%s cell %d: %g != %g", v, i, h[i], w[i])
+			}
+		}
+	}
+
+	t.Run("emissions mismatch", func(t *testing.T) {
+		emis2 := inmap.NewEmissions()
+		emis2.Add(&inmap.EmisRecord{
+			PM25: E,
+			Geom: geom.Point{X: -3999, Y: -3999.},
+		})
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		d := &inmap.InMAP{InitFuncs: []inmap.DomainManipulator{inmap.Restart(f, cfg, emis2, m)}}
+		if err := d.Init(); err == nil {
+			t.Error("restarting with different emissions should cause an error")
+		}
+	})
+
+	t.Run("geometry", func(t *testing.T) {
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		have, err := inmap.CheckpointGeometry(f, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := restarted.GetGeometry(0, false)
+		if len(have) != len(want) {
+			t.Fatalf("number of ground-level cells %d != %d", len(have), len(want))
+		}
+		for i, w := range want {
+			if !reflect.DeepEqual(have[i].Bounds(), w.Bounds()) {
+				t.Errorf("cell %d: bounds %v != %v", i, have[i].Bounds(), w.Bounds())
+			}
+		}
+	})
+
+	t.Run("grid mismatch", func(t *testing.T) {
+		cfg2 := *cfg
+		cfg2.HiResLayers++
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		d := &inmap.InMAP{InitFuncs: []inmap.DomainManipulator{inmap.Restart(f, &cfg2, emis, m)}}
+		if err := d.Init(); err == nil {
+			t.Error("restarting with a different grid configuration should cause an error")
+		}
+	})
+}
@@ -65,7 +65,22 @@ func TestRunInputFromViper(t *testing.T) {
 		"--VarGrid.PopDensityThreshold":  "0.0055",
 		"--VarGrid.VariableGridDy":       "4000",
 		"--EmissionUnits":                "tons/year",
+		"--EmissionsColumns":             "{}\n",
 		"--LogFile":                      "",
+		"--OutputProj":                   "",
+		"--Checkpoint.File":              "",
+		"--Checkpoint.Interval":          "24h",
+		"--Mechanism":                    "simplechem",
+		"--ExtendedChem.OxidantScale":    "1",
+		"--Workers":                      "",
+		"--SourceTags":                   "",
+		"--SourceTagOutputVariables":     "",
+		"--BudgetInterval":               "",
+		"--BoundaryConditions.Type":      "zero",
+		"--BoundaryConditions.Files":     "",
+		"--BoundaryConditions.Times":     "",
+		"--VarGrid.RefinementFiles":      "",
+		"--VarGrid.RefinementNestLevel":  "0",
 	}
 	if len(js.Args) != len(wantArgs)*2 {
 		t.Errorf("wrong number of arguments: %d != %d", len(js.Args)/2, len(wantArgs))
@@ -139,8 +154,10 @@ func TestSRPredictInputFromViper(t *testing.T) {
 
 	wantArgs := map[string]string{
 		"--EmissionUnits":       "tons/year",
+		"--EmissionsColumns":    "{}\n",
 		"--EmissionsShapefiles": "258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp",
 		"--OutputFile":          "inmap_output.shp",
+		"--OutputProj":          "",
 		"--OutputVariables":     "{\"PrimPM25\":\"PrimaryPM25\"}",
 		"--SR.OutputFile":       "${INMAP_ROOT_DIR}/cmd/inmap/testdata/output_${InMAPRunType}.shp",
 		"--VarGrid.GridProj":    "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
@@ -0,0 +1,469 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// CMAQ variables currently used:
+/* METCRO3D: TA,PRES,DENS,ZF,QR,QC,CFRAC_3D,WWIND; METCRO2D: PBL,USTAR,HFX,
+RGRND,GLW,ZRUF; METDOT3D: UWINDC,VWINDC; GRIDCRO2D: DLUSE; CONC: OH,H2O2 and
+the species in the chemical species groups. */
+
+const cmaqFormat = "20060102"
+
+// cmaqAERO6 returns the species groups for CMAQ simulations using
+// the AERO6 aerosol module. Gas-phase concentrations are in [ppmv] and
+// particle-phase concentrations are in [μg/m3].
+func cmaqAERO6() SpeciesGroups {
+	ppmv := func(mw float64) Species { return Species{Units: "ppmv", MW: mw} }
+	ugm3 := func(factor float64) Species { return Species{Units: "ug/m3", Factor: factor} }
+	g := SpeciesGroups{
+		// Anthropogenic precursors to SOA, including the
+		// semi-volatile gas-phase SOA species.
+		"AVOC": {
+			"BENZENE": ppmv(78), "TOL": ppmv(92), "XYLMN": ppmv(106), "NAPH": ppmv(128),
+			"SV_ALK1": ppmv(225), "SV_ALK2": ppmv(205.1), "SV_XYL1": ppmv(192), "SV_XYL2": ppmv(194),
+			"SV_TOL1": ppmv(168), "SV_TOL2": ppmv(168), "SV_BNZ1": ppmv(144), "SV_BNZ2": ppmv(144),
+			"SV_PAH1": ppmv(243), "SV_PAH2": ppmv(243),
+		},
+		// Biogenic precursors to SOA, including the
+		// semi-volatile gas-phase SOA species.
+		"BVOC": {
+			"ISOP": ppmv(68), "TERP": ppmv(136), "SESQ": ppmv(204),
+			"SV_ISO1": ppmv(132), "SV_ISO2": ppmv(133), "SV_TRP1": ppmv(168), "SV_TRP2": ppmv(168),
+			"SV_SQT": ppmv(378),
+		},
+		"ASOA": {},
+		"BSOA": {},
+		// We are only interested in the mass of Nitrogen or Sulfur,
+		// rather than the mass of the whole molecule, so we use the
+		// molecular weight of Nitrogen or Sulfur.
+		"NOx": {"NO": ppmv(mwN), "NO2": ppmv(mwN)},
+		"PNO": {"ANO3I": ugm3(mwN / mwNO3), "ANO3J": ugm3(mwN / mwNO3)},
+		"SOx": {"SO2": ppmv(mwS), "SULF": ppmv(mwS)},
+		"PS":  {"ASO4I": ugm3(mwS / mwSO4), "ASO4J": ugm3(mwS / mwSO4)},
+		"NH3": {"NH3": ppmv(mwN)},
+		"PNH": {"ANH4I": ugm3(mwN / mwNH4), "ANH4J": ugm3(mwN / mwNH4)},
+		// TotalPM25 is approximated as the sum of the Aitken (I) and
+		// accumulation (J) mode species.
+		"TotalPM25": {},
+	}
+	for _, s := range []string{"AALK1J", "AALK2J", "AXYL1J", "AXYL2J", "AXYL3J",
+		"ATOL1J", "ATOL2J", "ATOL3J", "ABNZ1J", "ABNZ2J", "ABNZ3J", "APAH1J",
+		"APAH2J", "APAH3J", "AOLGAJ"} {
+		g["ASOA"][s] = ugm3(1)
+		g["TotalPM25"][s] = ugm3(1)
+	}
+	for _, s := range []string{"AISO1J", "AISO2J", "AISO3J", "ATRP1J", "ATRP2J", "ASQTJ", "AOLGBJ"} {
+		g["BSOA"][s] = ugm3(1)
+		g["TotalPM25"][s] = ugm3(1)
+	}
+	for _, s := range []string{"ASO4I", "ASO4J", "ANO3I", "ANO3J", "ANH4I", "ANH4J",
+		"AECI", "AECJ", "APOCI", "APOCJ", "APNCOMI", "APNCOMJ", "AOTHRI", "AOTHRJ",
+		"ANAI", "ANAJ", "ACLI", "ACLJ", "AFEJ", "AALJ", "ASIJ", "ATIJ", "ACAJ",
+		"AMGJ", "AKJ", "AMNJ"} {
+		g["TotalPM25"][s] = ugm3(1)
+	}
+	return g
+}
+
+// CMAQ is an InMAP preprocessor for output from the CMAQ chemical transport
+// model and meteorology processed by MCIP version 4 or later.
+type CMAQ struct {
+	groups SpeciesGroups
+
+	start, end time.Time
+
+	metCro3D, metCro2D, metDot3D, gridCro2D, conc string
+
+	recordDelta, fileDelta time.Duration
+
+	msgChan chan string
+}
+
+// NewCMAQ initializes a CMAQ preprocessor from the given
+// configuration information.
+//
+// METCRO3D, METCRO2D, and METDOT3D are the locations of the MCIP
+// 3-D cross-point, 2-D cross-point, and 3-D dot-point meteorology files,
+// and CONC is the location of the CMAQ concentration files.
+// These files are expected to contain one day of hourly records each, and
+// [DATE] should be used as a wild card for the simulation date, in the
+// format "YYYYMMDD". METCRO3D must include the vertical wind
+// speed (WWIND), METDOT3D must include the C-staggered horizontal wind
+// speeds (UWINDC and VWINDC), and CONC must include all model layers.
+//
+// GRIDCRO2D is the location of the MCIP 2-D cross-point grid file, whose
+// dominant land use (DLUSE) must use the USGS 24-category classification.
+// It can contain a [DATE] wild card, in which case the file for
+// startDate will be used.
+//
+// startDate and endDate are the dates of the beginning and end of the
+// simulation, respectively, in the format "YYYYMMDD" or "YYYYMMDDTHH".
+//
+// groups specifies the CMAQ species that make up the chemical
+// species groups. If it is nil, the "CMAQ:AERO6" preset will be used
+// (see SpeciesGroupPresets). It is an error if any of the species are
+// not in the first CMAQ concentration file.
+//
+// If msgChan is not nil, status messages will be sent to it.
+func NewCMAQ(METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CONC, startDate, endDate string, groups SpeciesGroups, msgChan chan string) (*CMAQ, error) {
+	c := CMAQ{
+		metCro3D:  METCRO3D,
+		metCro2D:  METCRO2D,
+		metDot3D:  METDOT3D,
+		gridCro2D: GRIDCRO2D,
+		conc:      CONC,
+
+		recordDelta: time.Hour,
+		fileDelta:   24 * time.Hour,
+
+		msgChan: msgChan,
+	}
+
+	var err error
+	c.start, err = ParseDate(startDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: CMAQ preprocessor start time: %v", err)
+	}
+	c.end, err = ParseDate(endDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: CMAQ preprocessor end time: %v", err)
+	}
+
+	if groups == nil {
+		groups = cmaqAERO6()
+	}
+	if err = groups.Check(); err != nil {
+		return nil, err
+	}
+	f, ff, err := ncfFromTemplate(c.conc, cmaqFormat, c.start)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: CMAQ preprocessor: %v", err)
+	}
+	defer f.Close()
+	if err = groups.checkVariables(f.Name(), ff, sameName); err != nil {
+		return nil, err
+	}
+	c.groups = groups
+	return &c, nil
+}
+
+func (c *CMAQ) read(fileTemplate, varName string) NextData {
+	return nextDataNCF(fileTemplate, cmaqFormat, varName, c.start, c.end, c.recordDelta, c.fileDelta, readNCF, c.msgChan)
+}
+
+// read2D reads a variable with a single layer and returns it
+// without its layer dimension.
+func (c *CMAQ) read2D(fileTemplate, varName string) NextData {
+	return removeLayerDim(c.read(fileTemplate, varName))
+}
+
+func (c *CMAQ) readGroupAlt(varGroup map[string]float64) NextData {
+	return nextDataGroupAltNCF(c.conc, cmaqFormat, varGroup, c.ALT(), c.start, c.end, c.recordDelta, c.fileDelta, readNCF, c.msgChan)
+}
+
+func (c *CMAQ) readGroup(varGroup map[string]float64) NextData {
+	return nextDataGroupNCF(c.conc, cmaqFormat, varGroup, c.start, c.end, c.recordDelta, c.fileDelta, readNCF, c.msgChan)
+}
+
+func (c *CMAQ) readSpeciesGroup(group string) NextData {
+	massFraction, conc := c.groups.factors(group, sameName)
+	return readSpeciesGroup(massFraction, conc, c.readGroupAlt, c.readGroup)
+}
+
+// removeLayerDim converts 2-D IOAPI data, which has a layer dimension
+// of length 1, to an array with dimensions (y, x).
+func removeLayerDim(inFunc NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		in, err := inFunc()
+		if err != nil {
+			return nil, err
+		}
+		if len(in.Shape) != 3 || in.Shape[0] != 1 {
+			return nil, fmt.Errorf("inmap: CMAQ preprocessor: 2-D data should have dimensions [1 y x] but has %v", in.Shape)
+		}
+		out := sparse.ZerosDense(in.Shape[1:]...)
+		copy(out.Elements, in.Elements)
+		return out, nil
+	}
+}
+
+// addGroundLevel adds a layer of zeros below data that is located at the
+// tops of the model layers, so that it is staggered in the vertical direction.
+func addGroundLevel(inFunc NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		in, err := inFunc()
+		if err != nil {
+			return nil, err
+		}
+		out := sparse.ZerosDense(in.Shape[0]+1, in.Shape[1], in.Shape[2])
+		copy(out.Elements[in.Shape[1]*in.Shape[2]:], in.Elements)
+		return out, nil
+	}
+}
+
+// crop returns the part of 3-D data with the given number of elements
+// along each dimension, starting at index zero.
+func crop(inFunc NextData, nz, ny, nx int) NextData {
+	return func() (*sparse.DenseArray, error) {
+		in, err := inFunc()
+		if err != nil {
+			return nil, err
+		}
+		if in.Shape[0] < nz || in.Shape[1] < ny || in.Shape[2] < nx {
+			return nil, fmt.Errorf("inmap: CMAQ preprocessor: cannot crop data with dimensions %v to [%d %d %d]", in.Shape, nz, ny, nx)
+		}
+		out := sparse.ZerosDense(nz, ny, nx)
+		for k := 0; k < nz; k++ {
+			for j := 0; j < ny; j++ {
+				for i := 0; i < nx; i++ {
+					out.Set(in.Get(k, j, i), k, j, i)
+				}
+			}
+		}
+		return out, nil
+	}
+}
+
+// dims returns the lengths of the dimensions of cross-point 3-D data,
+// excluding the time dimension.
+func (c *CMAQ) dims() (nz, ny, nx int, err error) {
+	f, ff, err := ncfFromTemplate(c.metCro3D, cmaqFormat, c.start)
+	if err != nil {
+		return -1, -1, -1, err
+	}
+	defer f.Close()
+	d := ff.Header.Lengths("TA")
+	if len(d) != 4 {
+		return -1, -1, -1, fmt.Errorf("inmap: CMAQ preprocessor: variable TA in METCRO3D file has dimensions %v", d)
+	}
+	return d[1], d[2], d[3], nil
+}
+
+// Nx helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the West-East direction.
+func (c *CMAQ) Nx() (int, error) {
+	_, _, nx, err := c.dims()
+	if err != nil {
+		return -1, fmt.Errorf("nx: %v", err)
+	}
+	return nx, nil
+}
+
+// Ny helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the South-North direction.
+func (c *CMAQ) Ny() (int, error) {
+	_, ny, _, err := c.dims()
+	if err != nil {
+		return -1, fmt.Errorf("ny: %v", err)
+	}
+	return ny, nil
+}
+
+// Nz helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the below-above direction.
+func (c *CMAQ) Nz() (int, error) {
+	nz, _, _, err := c.dims()
+	if err != nil {
+		return -1, fmt.Errorf("nz: %v", err)
+	}
+	return nz, nil
+}
+
+// PBLH helps fulfill the Preprocessor interface by returning
+// planetary boundary layer height [m].
+func (c *CMAQ) PBLH() NextData { return c.read2D(c.metCro2D, "PBL") }
+
+// Height helps fulfill the Preprocessor interface by returning
+// layer heights above ground level [m], calculated from the
+// heights of the layer tops.
+func (c *CMAQ) Height() NextData { return addGroundLevel(c.read(c.metCro3D, "ZF")) }
+
+// ALT helps fulfill the Preprocessor interface by returning
+// inverse air density [m3/kg].
+func (c *CMAQ) ALT() NextData {
+	densFunc := c.read(c.metCro3D, "DENS") // air density [kg/m3]
+	return func() (*sparse.DenseArray, error) {
+		dens, err := densFunc()
+		if err != nil {
+			return nil, err
+		}
+		alt := sparse.ZerosDense(dens.Shape...)
+		for i, d := range dens.Elements {
+			alt.Elements[i] = 1 / d
+		}
+		return alt, nil
+	}
+}
+
+// U helps fulfill the Preprocessor interface by returning
+// West-East wind speed [m/s] on the West and East edges of the grid cells.
+func (c *CMAQ) U() NextData {
+	nz, ny, nx, err := c.dims()
+	if err != nil {
+		return func() (*sparse.DenseArray, error) { return nil, err }
+	}
+	return crop(c.read(c.metDot3D, "UWINDC"), nz, ny, nx+1)
+}
+
+// V helps fulfill the Preprocessor interface by returning
+// South-North wind speed [m/s] on the South and North edges of the grid cells.
+func (c *CMAQ) V() NextData {
+	nz, ny, nx, err := c.dims()
+	if err != nil {
+		return func() (*sparse.DenseArray, error) { return nil, err }
+	}
+	return crop(c.read(c.metDot3D, "VWINDC"), nz, ny+1, nx)
+}
+
+// W helps fulfill the Preprocessor interface by returning
+// below-above wind speed [m/s] on the bottom and top edges of the grid cells.
+func (c *CMAQ) W() NextData { return addGroundLevel(c.read(c.metCro3D, "WWIND")) }
+
+// AVOC helps fulfill the Preprocessor interface.
+func (c *CMAQ) AVOC() NextData { return c.readSpeciesGroup("AVOC") }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (c *CMAQ) BVOC() NextData { return c.readSpeciesGroup("BVOC") }
+
+// NOx helps fulfill the Preprocessor interface.
+func (c *CMAQ) NOx() NextData { return c.readSpeciesGroup("NOx") }
+
+// SOx helps fulfill the Preprocessor interface.
+func (c *CMAQ) SOx() NextData { return c.readSpeciesGroup("SOx") }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (c *CMAQ) NH3() NextData { return c.readSpeciesGroup("NH3") }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (c *CMAQ) ASOA() NextData { return c.readSpeciesGroup("ASOA") }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (c *CMAQ) BSOA() NextData { return c.readSpeciesGroup("BSOA") }
+
+// PNO helps fulfill the Preprocessor interface.
+func (c *CMAQ) PNO() NextData { return c.readSpeciesGroup("PNO") }
+
+// PS helps fulfill the Preprocessor interface.
+func (c *CMAQ) PS() NextData { return c.readSpeciesGroup("PS") }
+
+// PNH helps fulfill the Preprocessor interface.
+func (c *CMAQ) PNH() NextData { return c.readSpeciesGroup("PNH") }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (c *CMAQ) TotalPM25() NextData { return c.readSpeciesGroup("TotalPM25") }
+
+// SurfaceHeatFlux helps fulfill the Preprocessor interface
+// by returning heat flux at the surface [W/m2].
+func (c *CMAQ) SurfaceHeatFlux() NextData { return c.read2D(c.metCro2D, "HFX") }
+
+// UStar helps fulfill the Preprocessor interface
+// by returning friction velocity [m/s].
+func (c *CMAQ) UStar() NextData { return c.read2D(c.metCro2D, "USTAR") }
+
+// T helps fulfill the Preprocessor interface by
+// returning temperature [K].
+func (c *CMAQ) T() NextData { return c.read(c.metCro3D, "TA") }
+
+// P helps fulfill the Preprocessor interface
+// by returning pressure [Pa].
+func (c *CMAQ) P() NextData { return c.read(c.metCro3D, "PRES") }
+
+// HO helps fulfill the Preprocessor interface
+// by returning hydroxyl radical concentration [ppmv].
+func (c *CMAQ) HO() NextData { return c.read(c.conc, "OH") }
+
+// H2O2 helps fulfill the Preprocessor interface
+// by returning hydrogen peroxide concentration [ppmv].
+func (c *CMAQ) H2O2() NextData { return c.read(c.conc, "H2O2") }
+
+// landUse returns the USGS land use index from the GRIDCRO2D file,
+// which does not change over time, once for each meteorology record.
+func (c *CMAQ) landUse() NextData {
+	pblFunc := c.read2D(c.metCro2D, "PBL")
+	var lu *sparse.DenseArray
+	return func() (*sparse.DenseArray, error) {
+		if _, err := pblFunc(); err != nil {
+			return nil, err
+		}
+		if lu != nil {
+			return lu, nil
+		}
+		f, ff, err := ncfFromTemplate(c.gridCro2D, cmaqFormat, c.start)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: CMAQ preprocessor: %v", err)
+		}
+		defer f.Close()
+		data, err := readNCF("DLUSE", ff, 0)
+		if err != nil {
+			return nil, err
+		}
+		lu, err = removeLayerDim(func() (*sparse.DenseArray, error) { return data, nil })()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range lu.Elements {
+			if i := f2i(v); i < 0 || i >= len(USGSz0) {
+				return nil, fmt.Errorf("inmap: CMAQ preprocessor: land use category %g is not in the USGS 24-category classification", v)
+			}
+		}
+		return lu, nil
+	}
+}
+
+// SeinfeldLandUse helps fulfill the Preprocessor interface
+// by returning land use categories as
+// specified in github.com/ctessum/atmos/seinfeld.
+func (c *CMAQ) SeinfeldLandUse() NextData { return wrfSeinfeldLandUse(c.landUse()) }
+
+// WeselyLandUse helps fulfill the Preprocessor interface
+// by returning land use categories as
+// specified in github.com/ctessum/atmos/wesely1989.
+func (c *CMAQ) WeselyLandUse() NextData { return wrfWeselyLandUse(c.landUse()) }
+
+// Z0 helps fulfill the Preprocessor interface by
+// returning roughness length [m].
+func (c *CMAQ) Z0() NextData { return c.read2D(c.metCro2D, "ZRUF") }
+
+// QRain helps fulfill the Preprocessor interface by
+// returning rain mass fraction.
+func (c *CMAQ) QRain() NextData { return c.read(c.metCro3D, "QR") }
+
+// CloudFrac helps fulfill the Preprocessor interface
+// by returning the fraction of each grid cell filled
+// with clouds [volume/volume].
+func (c *CMAQ) CloudFrac() NextData { return c.read(c.metCro3D, "CFRAC_3D") }
+
+// QCloud helps fulfill the Preprocessor interface by returning
+// the mass fraction of cloud water in each grid cell [mass/mass].
+func (c *CMAQ) QCloud() NextData { return c.read(c.metCro3D, "QC") }
+
+// RadiationDown helps fulfill the Preprocessor interface by returning
+// total downwelling radiation at ground level [W/m2].
+func (c *CMAQ) RadiationDown() NextData {
+	swDownFunc := c.read2D(c.metCro2D, "RGRND") // downwelling short wave radiation at ground level [W/m2]
+	glwFunc := c.read2D(c.metCro2D, "GLW")      // downwelling long wave radiation at ground level [W/m2]
+	return wrfRadiationDown(swDownFunc, glwFunc)
+}
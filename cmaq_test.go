@@ -0,0 +1,292 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/cdf"
+)
+
+// ioapiVar is a variable in a synthetic IOAPI file.
+type ioapiVar struct {
+	dims  []string
+	value func(k, j, i int) float64
+}
+
+// writeIOAPI writes a NetCDF file with nrec hourly records of the given
+// variables, which are laid out as in the IOAPI files written by
+// CMAQ and MCIP.
+func writeIOAPI(t *testing.T, fileName string, nrec int, dims map[string]int, vars map[string]ioapiVar) {
+	dimNames := []string{"TSTEP"}
+	dimLengths := []int{0}
+	for name, l := range dims {
+		dimNames = append(dimNames, name)
+		dimLengths = append(dimLengths, l)
+	}
+	h := cdf.NewHeader(dimNames, dimLengths)
+	for name, v := range vars {
+		h.AddVariable(name, append([]string{"TSTEP"}, v.dims...), []float32{0})
+	}
+	h.Define()
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ff, err := cdf.Create(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range vars {
+		nz, ny, nx := dims[v.dims[0]], dims[v.dims[1]], dims[v.dims[2]]
+		data := make([]float32, 0, nz*ny*nx)
+		for k := 0; k < nz; k++ {
+			for j := 0; j < ny; j++ {
+				for i := 0; i < nx; i++ {
+					data = append(data, float32(v.value(k, j, i)))
+				}
+			}
+		}
+		for r := 0; r < nrec; r++ {
+			w := ff.Writer(name, []int{r, 0, 0, 0}, []int{r + 1, nz, ny, nx})
+			if _, err = w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = cdf.UpdateNumRecs(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ioapiConstant returns a function that gives the same value everywhere.
+func ioapiConstant(v float64) func(k, j, i int) float64 {
+	return func(int, int, int) float64 { return v }
+}
+
+func TestCMAQ(t *testing.T) {
+	const (
+		tolerance  = 1.0e-6
+		nz, ny, nx = 2, 3, 4
+		nrec       = 3
+		dens       = 1.2 // kg/m3
+		conc       = 1.e-3
+	)
+	dir, err := ioutil.TempDir("", "inmap_cmaq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cro3D := []string{"LAY", "ROW", "COL"}
+	cro2D := []string{"LAY1", "ROW", "COL"}
+	dims := map[string]int{"LAY": nz, "LAY1": 1, "ROW": ny, "COL": nx}
+	writeIOAPI(t, filepath.Join(dir, "METCRO3D_20050101"), nrec, dims, map[string]ioapiVar{
+		"TA":       {cro3D, ioapiConstant(280)},
+		"PRES":     {cro3D, ioapiConstant(90000)},
+		"DENS":     {cro3D, ioapiConstant(dens)},
+		"ZF":       {cro3D, func(k, j, i int) float64 { return float64(k+1) * 100 }},
+		"QR":       {cro3D, ioapiConstant(1.e-5)},
+		"QC":       {cro3D, ioapiConstant(1.e-5)},
+		"CFRAC_3D": {cro3D, ioapiConstant(0.1)},
+		"WWIND":    {cro3D, ioapiConstant(0.01)},
+	})
+	writeIOAPI(t, filepath.Join(dir, "METCRO2D_20050101"), nrec, dims, map[string]ioapiVar{
+		"PBL":   {cro2D, ioapiConstant(500)},
+		"USTAR": {cro2D, ioapiConstant(0.3)},
+		"HFX":   {cro2D, ioapiConstant(50)},
+		"RGRND": {cro2D, ioapiConstant(300)},
+		"GLW":   {cro2D, ioapiConstant(200)},
+		"ZRUF":  {cro2D, ioapiConstant(0.1)},
+	})
+	writeIOAPI(t, filepath.Join(dir, "GRIDCRO2D_20050101"), 1, dims, map[string]ioapiVar{
+		"DLUSE": {cro2D, ioapiConstant(2)},
+	})
+	dotDims := map[string]int{"LAY": nz, "ROW": ny + 1, "COL": nx + 1}
+	writeIOAPI(t, filepath.Join(dir, "METDOT3D_20050101"), nrec, dotDims, map[string]ioapiVar{
+		"UWINDC": {cro3D, func(k, j, i int) float64 { return float64(i) }},
+		"VWINDC": {cro3D, func(k, j, i int) float64 { return float64(j) }},
+	})
+	concVars := map[string]ioapiVar{
+		"OH":   {cro3D, ioapiConstant(1.e-7)},
+		"H2O2": {cro3D, ioapiConstant(conc)},
+	}
+	for _, group := range cmaqAERO6() {
+		for s := range group {
+			concVars[s] = ioapiVar{cro3D, ioapiConstant(conc)}
+		}
+	}
+	writeIOAPI(t, filepath.Join(dir, "CONC_20050101"), nrec, dims, concVars)
+
+	newCMAQ := func(groups SpeciesGroups) (*CMAQ, error) {
+		return NewCMAQ(
+			filepath.Join(dir, "METCRO3D_[DATE]"),
+			filepath.Join(dir, "METCRO2D_[DATE]"),
+			filepath.Join(dir, "METDOT3D_[DATE]"),
+			filepath.Join(dir, "GRIDCRO2D_[DATE]"),
+			filepath.Join(dir, "CONC_[DATE]"),
+			"20050101", "20050101T03", groups, nil)
+	}
+	c, err := newCMAQ(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("dims", func(t *testing.T) {
+		for _, test := range []struct {
+			f    func() (int, error)
+			want int
+		}{{c.Nx, nx}, {c.Ny, ny}, {c.Nz, nz}} {
+			n, err := test.f()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != test.want {
+				t.Errorf("have %d, want %d", n, test.want)
+			}
+		}
+	})
+
+	t.Run("staggered", func(t *testing.T) {
+		for _, test := range []struct {
+			name  string
+			f     NextData
+			shape []int
+			want  func(k, j, i int) float64
+		}{
+			{"U", c.U(), []int{nz, ny, nx + 1}, func(k, j, i int) float64 { return float64(i) }},
+			{"V", c.V(), []int{nz, ny + 1, nx}, func(k, j, i int) float64 { return float64(j) }},
+			{"W", c.W(), []int{nz + 1, ny, nx}, func(k, j, i int) float64 {
+				if k == 0 {
+					return 0
+				}
+				return 0.01
+			}},
+			{"Height", c.Height(), []int{nz + 1, ny, nx}, func(k, j, i int) float64 { return float64(k) * 100 }},
+		} {
+			data, err := test.f()
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !reflect.DeepEqual(data.Shape, test.shape) {
+				t.Fatalf("%s: shape %v != %v", test.name, data.Shape, test.shape)
+			}
+			for k := 0; k < test.shape[0]; k++ {
+				for j := 0; j < test.shape[1]; j++ {
+					for i := 0; i < test.shape[2]; i++ {
+						if different(data.Get(k, j, i), test.want(k, j, i), tolerance) {
+							t.Errorf("%s [%d %d %d]: %g != %g", test.name, k, j, i, data.Get(k, j, i), test.want(k, j, i))
+						}
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("2D", func(t *testing.T) {
+		for _, test := range []struct {
+			name string
+			f    NextData
+			want float64
+		}{
+			{"PBLH", c.PBLH(), 500},
+			{"RadiationDown", c.RadiationDown(), 500},
+			{"SeinfeldLandUse", c.SeinfeldLandUse(), float64(USGSseinfeld[2])},
+			{"WeselyLandUse", c.WeselyLandUse(), float64(USGSwesely[2])},
+		} {
+			data, err := test.f()
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !reflect.DeepEqual(data.Shape, []int{ny, nx}) {
+				t.Fatalf("%s: shape %v", test.name, data.Shape)
+			}
+			for _, v := range data.Elements {
+				if different(v, test.want, tolerance) {
+					t.Errorf("%s: %g != %g", test.name, v, test.want)
+				}
+			}
+		}
+	})
+
+	t.Run("species", func(t *testing.T) {
+		for _, test := range []struct {
+			group string
+			f     NextData
+		}{
+			{"AVOC", c.AVOC()}, {"BVOC", c.BVOC()}, {"ASOA", c.ASOA()}, {"BSOA", c.BSOA()},
+			{"NOx", c.NOx()}, {"PNO", c.PNO()}, {"SOx", c.SOx()}, {"PS", c.PS()},
+			{"NH3", c.NH3()}, {"PNH", c.PNH()}, {"TotalPM25", c.TotalPM25()},
+		} {
+			// Gas-phase concentrations are converted from ppmv to μg/m3.
+			var want float64
+			for _, s := range cmaqAERO6()[test.group] {
+				if s.Units == "ppmv" {
+					want += conc * ppmvToUgKg(s.MW) * dens
+				} else {
+					want += conc * s.Factor
+				}
+			}
+			data, err := test.f()
+			if err != nil {
+				t.Fatalf("%s: %v", test.group, err)
+			}
+			for _, v := range data.Elements {
+				if different(v, want, tolerance) {
+					t.Errorf("%s: %g != %g", test.group, v, want)
+				}
+			}
+		}
+	})
+
+	t.Run("custom groups", func(t *testing.T) {
+		groups := cmaqAERO6()
+		groups["PS"] = map[string]Species{"ASO4J": {Units: "ug/m3", Factor: 2}}
+		c2, err := newCMAQ(groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c2.PS()()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if different(data.Elements[0], conc*2, tolerance) {
+			t.Errorf("%g != %g", data.Elements[0], conc*2)
+		}
+		groups["PS"] = map[string]Species{"XXX": {Units: "ug/m3"}}
+		if _, err := newCMAQ(groups); err == nil {
+			t.Error("expected an error for a species that is not in the CONC file")
+		}
+	})
+
+	t.Run("preprocess", func(t *testing.T) {
+		data, err := Preprocess(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data.Data["UAvg"].Data.Shape, []int{nz, ny, nx + 1}) {
+			t.Errorf("UAvg shape %v", data.Data["UAvg"].Data.Shape)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom/proj"
+)
+
+const wgs84WKT = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`
+
+// wktParam is a projection parameter in a WKT projection definition.
+type wktParam struct {
+	name  string
+	value func(sr *proj.SR) float64
+}
+
+// Functions to retrieve projection parameters from a spatial reference,
+// in degrees or projected units.
+var (
+	wktLat0  = func(sr *proj.SR) float64 { return sr.Lat0 * 180 / math.Pi }
+	wktLat1  = func(sr *proj.SR) float64 { return sr.Lat1 * 180 / math.Pi }
+	wktLat2  = func(sr *proj.SR) float64 { return sr.Lat2 * 180 / math.Pi }
+	wktLatTS = func(sr *proj.SR) float64 { return sr.LatTS * 180 / math.Pi }
+	wktLong0 = func(sr *proj.SR) float64 { return sr.Long0 * 180 / math.Pi }
+	wktK0    = func(sr *proj.SR) float64 {
+		if sr.K0 == 0 {
+			return 1
+		}
+		return sr.K0
+	}
+	wktX0 = func(sr *proj.SR) float64 { return sr.X0 }
+	wktY0 = func(sr *proj.SR) float64 { return sr.Y0 }
+)
+
+// wktProjections maps the names of projections supported by the
+// github.com/ctessum/geom/proj package to their WKT names and parameters.
+var wktProjections = map[string]struct {
+	name   string
+	params []wktParam
+}{
+	"lcc": {name: "Lambert_Conformal_Conic", params: []wktParam{
+		{"standard_parallel_1", wktLat1}, {"standard_parallel_2", wktLat2},
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"merc": {name: "Mercator", params: []wktParam{
+		{"standard_parallel_1", wktLatTS}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"tmerc": {name: "Transverse_Mercator", params: []wktParam{
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"scale_factor", wktK0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"utm": {name: "Transverse_Mercator", params: []wktParam{
+		{"latitude_of_origin", func(*proj.SR) float64 { return 0 }},
+		{"central_meridian", func(sr *proj.SR) float64 {
+			zone := sr.Zone
+			if zone < 0 {
+				zone = -zone
+			}
+			return float64(6*zone - 183)
+		}},
+		{"scale_factor", func(*proj.SR) float64 { return 0.9996 }},
+		{"false_easting", func(*proj.SR) float64 { return 500000 }},
+		{"false_northing", func(sr *proj.SR) float64 {
+			if sr.UTMSouth {
+				return 10000000
+			}
+			return 0
+		}}}},
+	"aea": {name: "Albers_Conic_Equal_Area", params: []wktParam{
+		{"standard_parallel_1", wktLat1}, {"standard_parallel_2", wktLat2},
+		{"latitude_of_center", wktLat0}, {"longitude_of_center", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"eqdc": {name: "Equidistant_Conic", params: []wktParam{
+		{"standard_parallel_1", wktLat1}, {"standard_parallel_2", wktLat2},
+		{"latitude_of_center", wktLat0}, {"longitude_of_center", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"laea": {name: "Lambert_Azimuthal_Equal_Area", params: []wktParam{
+		{"latitude_of_center", wktLat0}, {"longitude_of_center", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"aeqd": {name: "Azimuthal_Equidistant", params: []wktParam{
+		{"latitude_of_center", wktLat0}, {"longitude_of_center", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"gnom": {name: "Gnomonic", params: []wktParam{
+		{"latitude_of_center", wktLat0}, {"longitude_of_center", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"stere": {name: "Stereographic", params: []wktParam{
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"scale_factor", wktK0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"sterea": {name: "Oblique_Stereographic", params: []wktParam{
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"scale_factor", wktK0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"eqc": {name: "Equirectangular", params: []wktParam{
+		{"standard_parallel_1", wktLatTS}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"cea": {name: "Cylindrical_Equal_Area", params: []wktParam{
+		{"standard_parallel_1", wktLatTS}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"cass": {name: "Cassini_Soldner", params: []wktParam{
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"poly": {name: "Polyconic", params: []wktParam{
+		{"latitude_of_origin", wktLat0}, {"central_meridian", wktLong0},
+		{"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"mill": {name: "Miller_Cylindrical", params: []wktParam{
+		{"central_meridian", wktLong0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"sinu": {name: "Sinusoidal", params: []wktParam{
+		{"central_meridian", wktLong0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+	"moll": {name: "Mollweide", params: []wktParam{
+		{"central_meridian", wktLong0}, {"false_easting", wktX0}, {"false_northing", wktY0}}},
+}
+
+// isWGS84 returns whether sr is a geographic (longitude-latitude)
+// spatial reference on the WGS84 ellipsoid (or one that
+// does not specify an ellipsoid).
+func isWGS84(sr *proj.SR) bool {
+	return sr.Name == "longlat" && (sr.A == 0 || (sr.A == 6378137 && (sr.B == 0 || math.Abs(sr.B-6356752.314245) < 1.e-3)))
+}
+
+// wkt returns the well-known text (WKT) projection definition for sr.
+func wkt(sr *proj.SR) (string, error) {
+	if isWGS84(sr) {
+		return wgs84WKT, nil
+	}
+
+	// Geographic coordinate system.
+	invFlattening := "0"
+	if sr.B != 0 && sr.B != sr.A {
+		invFlattening = fmt.Sprintf("%.9f", sr.A/(sr.A-sr.B))
+	}
+	geogcs := fmt.Sprintf("GEOGCS[\"GCS_unnamed ellipse\","+
+		"DATUM[\"D_unknown\",SPHEROID[\"Unknown\",%f,%s]],PRIMEM[\"Greenwich\",0],"+
+		"UNIT[\"Degree\",0.017453292519943295]]", sr.A, invFlattening)
+	if sr.Name == "longlat" {
+		return geogcs, nil
+	}
+
+	p, ok := wktProjections[sr.Name]
+	if !ok {
+		return "", fmt.Errorf("inmap: unable to create WKT projection definition for projection type `%s`", sr.Name)
+	}
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "PROJCS[\"%s\",%s,PROJECTION[\"%s\"],", p.name, geogcs, p.name)
+	for _, param := range p.params {
+		fmt.Fprintf(b, "PARAMETER[\"%s\",%g],", param.name, param.value(sr))
+	}
+	toMeter := sr.ToMeter
+	if toMeter == 0 {
+		toMeter = 1
+	}
+	fmt.Fprintf(b, "UNIT[\"Meter\",%g]]", toMeter)
+	return b.String(), nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/ctessum/sparse"
+)
+
+// ctmDataRanges holds the ranges of physically plausible values of the
+// variables created by Preprocess. The ranges are wide enough to
+// include the values in the upper layers of global models, so they
+// are intended to catch problems like unit conversion errors rather
+// than to show that the values are realistic.
+var ctmDataRanges = map[string]struct{ min, max float64 }{
+	"UAvg":                       {-200, 200}, // m/s
+	"VAvg":                       {-200, 200}, // m/s
+	"WAvg":                       {-10, 10},   // m/s
+	"UDeviation":                 {0, 200},    // m/s
+	"VDeviation":                 {0, 200},    // m/s
+	"aOrgPartitioning":           {0, 1},      // fraction
+	"bOrgPartitioning":           {0, 1},      // fraction
+	"NOPartitioning":             {0, 1},      // fraction
+	"SPartitioning":              {0, 1},      // fraction
+	"NHPartitioning":             {0, 1},      // fraction
+	"aVOC":                       {0, 1e5},    // μg/m3
+	"aSOA":                       {0, 1e5},    // μg/m3
+	"bVOC":                       {0, 1e5},    // μg/m3
+	"bSOA":                       {0, 1e5},    // μg/m3
+	"gNO":                        {0, 1e5},    // μg/m3
+	"pNO":                        {0, 1e5},    // μg/m3
+	"gS":                         {0, 1e5},    // μg/m3
+	"pS":                         {0, 1e5},    // μg/m3
+	"gNH":                        {0, 1e5},    // μg/m3
+	"pNH":                        {0, 1e5},    // μg/m3
+	"TotalPM25":                  {0, 1e5},    // μg/m3
+	"SO2oxidation":               {0, 1},      // 1/s
+	"ParticleDryDep":             {0, 1},      // m/s
+	"SO2DryDep":                  {0, 1},      // m/s
+	"NOxDryDep":                  {0, 1},      // m/s
+	"NH3DryDep":                  {0, 1},      // m/s
+	"VOCDryDep":                  {0, 1},      // m/s
+	"ParticleWetDep":             {0, 1},      // 1/s
+	"SO2WetDep":                  {0, 1},      // 1/s
+	"OtherGasWetDep":             {0, 1},      // 1/s
+	"Kxxyy":                      {0, 1e4},    // m2/s
+	"Kzz":                        {0, 1e4},    // m2/s
+	"M2u":                        {0, 1},      // 1/s
+	"M2d":                        {0, 1},      // 1/s
+	"LayerHeights":               {0, 2e5},    // m
+	"Dz":                         {0, 1e5},    // m
+	"Pblh":                       {0, 1e4},    // m
+	"WindSpeed":                  {0, 200},    // m/s
+	"WindSpeedInverse":           {0, 1e3},    // (m/s)^(-1)
+	"WindSpeedMinusThird":        {0, 1e3},    // (m/s)^(-1/3)
+	"WindSpeedMinusOnePointFour": {0, 1e3},    // (m/s)^(-1.4)
+	"Temperature":                {150, 350},  // K
+	"S1":                         {-1, 1},     // 1/m
+	"Sclass":                     {0, 1},      // 0=Unstable; 1=Stable
+	"alt":                        {0, 1e5},    // m3/kg
+}
+
+// Check checks whether d has all of the variables created by Preprocess
+// with the expected dimensions, whether the values of the variables
+// are finite and within physically plausible ranges, and whether the
+// layer heights increase with height. It returns an error describing
+// each problem that is found.
+func (d *CTMData) Check() []error {
+	ws, ok := d.Data["WindSpeed"]
+	if !ok || len(ws.Data.Shape) != 3 {
+		return []error{fmt.Errorf("inmap: checking CTM data: missing or invalid variable WindSpeed")}
+	}
+	s := ws.Data.Shape
+	dimLengths := map[string]int{
+		"z": s[0], "y": s[1], "x": s[2],
+		"zStagger": s[0] + 1, "yStagger": s[1] + 1, "xStagger": s[2] + 1,
+	}
+	var errs []error
+	for _, stage := range preprocStages {
+		for _, g := range stage {
+		vars:
+			for _, v := range g.vars {
+				dd, ok := d.Data[v.name]
+				if !ok {
+					errs = append(errs, fmt.Errorf("inmap: checking CTM data: missing variable %s", v.name))
+					continue
+				}
+				if !reflect.DeepEqual(dd.Dims, v.dims) {
+					errs = append(errs, fmt.Errorf("inmap: checking CTM data: %s has dimensions %v; it should have %v",
+						v.name, dd.Dims, v.dims))
+					continue
+				}
+				for i, dim := range v.dims {
+					if dd.Data.Shape[i] != dimLengths[dim] {
+						errs = append(errs, fmt.Errorf("inmap: checking CTM data: %s has shape %v, which does not match the "+
+							"shape of WindSpeed, %v", v.name, dd.Data.Shape, s))
+						continue vars
+					}
+				}
+				r := ctmDataRanges[v.name]
+				if err := checkRange(v.name, dd.Data, r.min, r.max); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if lh, ok := d.Data["LayerHeights"]; ok && len(lh.Data.Shape) == 3 {
+		if err := checkLayerHeights(lh.Data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkRange returns an error if any of the values in a are not finite
+// or are outside of the range [min, max].
+func checkRange(name string, a *sparse.DenseArray, min, max float64) error {
+	var nonFinite, below, above int
+	iNonFinite, iMin, iMax := -1, -1, -1
+	for i, v := range a.Elements {
+		switch {
+		case math.IsNaN(v) || math.IsInf(v, 0):
+			if nonFinite == 0 {
+				iNonFinite = i
+			}
+			nonFinite++
+		case v < min:
+			if iMin < 0 || v < a.Elements[iMin] {
+				iMin = i
+			}
+			below++
+		case v > max:
+			if iMax < 0 || v > a.Elements[iMax] {
+				iMax = i
+			}
+			above++
+		}
+	}
+	if nonFinite == 0 && below == 0 && above == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("inmap: checking CTM data: %s:", name)
+	n := len(a.Elements)
+	if nonFinite > 0 {
+		msg += fmt.Sprintf(" %d of %d values are not finite (first %g at %v);", nonFinite, n,
+			a.Elements[iNonFinite], indexNd(a.Shape, iNonFinite))
+	}
+	if below > 0 {
+		msg += fmt.Sprintf(" %d of %d values are less than %g (minimum %g at %v);", below, n, min,
+			a.Elements[iMin], indexNd(a.Shape, iMin))
+	}
+	if above > 0 {
+		msg += fmt.Sprintf(" %d of %d values are greater than %g (maximum %g at %v);", above, n, max,
+			a.Elements[iMax], indexNd(a.Shape, iMax))
+	}
+	return fmt.Errorf("%s", msg[:len(msg)-1])
+}
+
+// checkLayerHeights returns an error if the layer heights in
+// the (zStagger, y, x) array lh do not increase with height.
+func checkLayerHeights(lh *sparse.DenseArray) error {
+	var n, total int
+	var first []int
+	for k := 0; k < lh.Shape[0]-1; k++ {
+		for j := 0; j < lh.Shape[1]; j++ {
+			for i := 0; i < lh.Shape[2]; i++ {
+				total++
+				if !(lh.Get(k+1, j, i) > lh.Get(k, j, i)) {
+					if n == 0 {
+						first = []int{k, j, i}
+					}
+					n++
+				}
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("inmap: checking CTM data: LayerHeights: layer heights do not increase with height "+
+		"at %d of %d locations (first at %v)", n, total, first)
+}
+
+// LayerStats holds summary statistics for a horizontal layer
+// of a CTMData variable.
+type LayerStats struct {
+	Min, Max, Mean float64
+
+	// NonFinite is the number of values that are NaN or infinite,
+	// which are not included in the other statistics.
+	NonFinite int
+}
+
+// LayerStats returns summary statistics for each horizontal layer of
+// variable name in d, starting with the lowest layer. Variables
+// without a vertical dimension have a single layer.
+func (d *CTMData) LayerStats(name string) ([]LayerStats, error) {
+	dd, ok := d.Data[name]
+	if !ok {
+		return nil, fmt.Errorf("inmap: CTM data does not contain variable %s", name)
+	}
+	a := dd.Data
+	n := len(a.Shape)
+	if n < 2 {
+		return nil, fmt.Errorf("inmap: CTM data variable %s has %d dimensions; it should have at least 2", name, n)
+	}
+	layerSize := a.Shape[n-2] * a.Shape[n-1]
+	stats := make([]LayerStats, len(a.Elements)/layerSize)
+	for l := range stats {
+		s := LayerStats{Min: math.Inf(1), Max: math.Inf(-1)}
+		var finite int
+		for _, v := range a.Elements[l*layerSize : (l+1)*layerSize] {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				s.NonFinite++
+				continue
+			}
+			s.Min = math.Min(s.Min, v)
+			s.Max = math.Max(s.Max, v)
+			s.Mean += v
+			finite++
+		}
+		if finite > 0 {
+			s.Mean /= float64(finite)
+		} else {
+			s.Min, s.Max, s.Mean = math.NaN(), math.NaN(), math.NaN()
+		}
+		stats[l] = s
+	}
+	return stats, nil
+}
+
+// indexNd converts index i in the Elements of an array
+// with the given shape to an N-dimensional index.
+func indexNd(shape []int, i int) []int {
+	index := make([]int, len(shape))
+	for d := len(shape) - 1; d >= 0; d-- {
+		index[d] = i % shape[d]
+		i /= shape[d]
+	}
+	return index
+}
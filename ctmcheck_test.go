@@ -0,0 +1,107 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+func loadGoldenWRFChem(t *testing.T) *CTMData {
+	f, err := os.Open("cmd/inmap/testdata/preproc/inmapData_WRFChem_golden.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg := VarGridConfig{}
+	d, err := cfg.LoadCTMData(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCTMDataCheck(t *testing.T) {
+	d := loadGoldenWRFChem(t)
+	if errs := d.Check(); len(errs) != 0 {
+		t.Fatalf("golden data should not have any problems: %v", errs)
+	}
+
+	d.Data["Kzz"].Data.Set(-1, 0, 1, 1)
+	d.Data["NOPartitioning"].Data.Set(math.NaN(), 2, 0, 1)
+	lh := d.Data["LayerHeights"].Data
+	h1, h2 := lh.Get(1, 0, 0), lh.Get(2, 0, 0)
+	lh.Set(h2, 1, 0, 0)
+	lh.Set(h1, 2, 0, 0)
+	delete(d.Data, "pS")
+	gS := d.Data["gS"]
+	gS.Dims = []string{"zStagger", "y", "x"}
+	d.Data["gS"] = gS
+
+	errs := d.Check()
+	want := []string{
+		"Kzz: 1 of 40 values are less than 0 (minimum -1 at [0 1 1])",
+		"NOPartitioning: 1 of 40 values are not finite (first NaN at [2 0 1])",
+		"LayerHeights: layer heights do not increase with height at 1 of 40 locations (first at [1 0 0])",
+		"missing variable pS",
+		"gS has dimensions [zStagger y x]",
+	}
+	if len(errs) != len(want) {
+		t.Errorf("have %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for _, w := range want {
+		var found bool
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), w)
+		}
+		if !found {
+			t.Errorf("missing error containing %q: %v", w, errs)
+		}
+	}
+}
+
+func TestCTMDataLayerStats(t *testing.T) {
+	d := new(CTMData)
+	a := sparse.ZerosDense(2, 2, 2)
+	copy(a.Elements, []float64{1, 2, 3, 4, 5, math.NaN(), 7, 9})
+	d.AddVariable("v", []string{"z", "y", "x"}, "", "", a)
+	stats, err := d.LayerStats("v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LayerStats{
+		{Min: 1, Max: 4, Mean: 2.5},
+		{Min: 5, Max: 9, Mean: 7, NonFinite: 1},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("have %d layers, want %d", len(stats), len(want))
+	}
+	for i, s := range stats {
+		if s != want[i] {
+			t.Errorf("layer %d: have %+v, want %+v", i, s, want[i])
+		}
+	}
+	if _, err := d.LayerStats("missing"); err == nil {
+		t.Error("expected an error for a missing variable")
+	}
+}
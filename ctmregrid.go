@@ -0,0 +1,299 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/sparse"
+)
+
+// CTMGrid describes a regular rectangular grid that chemical transport
+// model data can be defined on.
+type CTMGrid struct {
+	// SR is the spatial reference of the grid.
+	SR *proj.SR
+
+	// X0 and Y0 are the coordinates of the lower-left corner of the grid.
+	X0, Y0 float64
+
+	// Dx and Dy are the x and y edge lengths of the grid cells.
+	Dx, Dy float64
+
+	// Nx and Ny are the numbers of grid cells in the x and y directions.
+	Nx, Ny int
+}
+
+// polygons returns the geometry of the cells in g in (y, x) order.
+func (g *CTMGrid) polygons() []geom.Polygonal {
+	o := make([]geom.Polygonal, 0, g.Nx*g.Ny)
+	for j := 0; j < g.Ny; j++ {
+		y0 := g.Y0 + g.Dy*float64(j)
+		y1 := g.Y0 + g.Dy*float64(j+1)
+		for i := 0; i < g.Nx; i++ {
+			x0 := g.X0 + g.Dx*float64(i)
+			x1 := g.X0 + g.Dx*float64(i+1)
+			o = append(o, geom.Polygon{[]geom.Point{
+				{X: x0, Y: y0},
+				{X: x1, Y: y0},
+				{X: x1, Y: y1},
+				{X: x0, Y: y1},
+				{X: x0, Y: y0},
+			}})
+		}
+	}
+	return o
+}
+
+// Regrid conservatively regrids all of the variables in d from grid from,
+// which d is defined on, to grid to, which can have a different spatial
+// reference. As in the Regrid function, the value in each new grid cell
+// is the area-weighted average of the values in the overlapping old grid
+// cells. New grid cells that are only partly covered by the old grid are
+// averaged over the covered area, and an error is returned if any new
+// grid cell does not overlap the old grid at all.
+//
+// Staggered variables are interpolated to grid cell centers before
+// regridding and back to the grid cell edges afterwards, and the
+// horizontal wind variables (UAvg, VAvg, UDeviation, and VDeviation)
+// are rotated to align with the axes of the new grid.
+func (d *CTMData) Regrid(from, to *CTMGrid) (*CTMData, error) {
+	ws, ok := d.Data["WindSpeed"]
+	if !ok {
+		return nil, fmt.Errorf("inmap: regridding CTM data: missing variable WindSpeed")
+	}
+	if s := ws.Data.Shape; s[1] != from.Ny || s[2] != from.Nx {
+		return nil, fmt.Errorf("inmap: regridding CTM data: data is %dx%d but CTM grid is %dx%d",
+			s[2], s[1], from.Nx, from.Ny)
+	}
+	trans, err := to.SR.NewTransform(from.SR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: regridding CTM data: %v", err)
+	}
+
+	// Calculate the regridding weights in the spatial reference
+	// of the old grid.
+	newGeom := to.polygons()
+	for i, g := range newGeom {
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: regridding CTM data: %v", err)
+		}
+		newGeom[i] = gg.(geom.Polygonal)
+	}
+	weights := regridWeights(from.polygons(), newGeom)
+	for i, w := range weights {
+		var covered float64
+		for _, ww := range w {
+			covered += ww.frac
+		}
+		if covered == 0 {
+			return nil, fmt.Errorf("inmap: regridding CTM data: target grid cell (x=%d, y=%d) "+
+				"does not overlap the CTM grid", i%to.Nx, i/to.Nx)
+		}
+		for j := range w {
+			w[j].frac /= covered
+		}
+	}
+	cos, sin, err := gridRotation(from, to, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	centered := make(map[string]*sparse.DenseArray)
+	axes := make(map[string]int)
+	for name, v := range d.Data {
+		axis, err := staggerAxis(v.Dims)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: regridding CTM data: variable %s: %v", name, err)
+		}
+		axes[name] = axis
+		centered[name] = regridLayers(destagger(v.Data, axis), weights, to.Nx, to.Ny)
+	}
+	rotateWind(centered["UAvg"], centered["VAvg"], cos, sin, false)
+	rotateWind(centered["UDeviation"], centered["VDeviation"], cos, sin, true)
+
+	o := new(CTMData)
+	for name, v := range d.Data {
+		o.AddVariable(name, v.Dims, v.Description, v.Units, restagger(centered[name], axes[name]))
+	}
+	return o, nil
+}
+
+// staggerAxis returns the index of the staggered horizontal dimension
+// in dims, or -1 if neither horizontal dimension is staggered.
+func staggerAxis(dims []string) (int, error) {
+	n := len(dims)
+	if n < 2 {
+		return 0, fmt.Errorf("unsupported dimensions %v", dims)
+	}
+	switch {
+	case dims[n-2] == "y" && dims[n-1] == "x":
+		return -1, nil
+	case dims[n-2] == "y" && dims[n-1] == "xStagger":
+		return n - 1, nil
+	case dims[n-2] == "yStagger" && dims[n-1] == "x":
+		return n - 2, nil
+	default:
+		return 0, fmt.Errorf("unsupported dimensions %v", dims)
+	}
+}
+
+// destagger returns a with the values along the given axis interpolated
+// from the grid cell edges to the grid cell centers. a is returned
+// unchanged if axis is less than zero.
+func destagger(a *sparse.DenseArray, axis int) *sparse.DenseArray {
+	if axis < 0 {
+		return a
+	}
+	shape := append([]int{}, a.Shape...)
+	shape[axis]--
+	o := sparse.ZerosDense(shape...)
+	n := a.Shape[axis]
+	stride := 1
+	for _, s := range a.Shape[axis+1:] {
+		stride *= s
+	}
+	for outer := 0; outer < len(a.Elements)/(n*stride); outer++ {
+		for k := 0; k < n-1; k++ {
+			for r := 0; r < stride; r++ {
+				i := outer*n*stride + k*stride + r
+				o.Elements[outer*(n-1)*stride+k*stride+r] = (a.Elements[i] + a.Elements[i+stride]) / 2
+			}
+		}
+	}
+	return o
+}
+
+// restagger reverses destagger, interpolating the values along the given
+// axis from the grid cell centers to the grid cell edges. The values on the
+// outer edges are set equal to the values in the adjacent cells.
+func restagger(a *sparse.DenseArray, axis int) *sparse.DenseArray {
+	if axis < 0 {
+		return a
+	}
+	shape := append([]int{}, a.Shape...)
+	shape[axis]++
+	o := sparse.ZerosDense(shape...)
+	n := a.Shape[axis]
+	stride := 1
+	for _, s := range a.Shape[axis+1:] {
+		stride *= s
+	}
+	for outer := 0; outer < len(a.Elements)/(n*stride); outer++ {
+		for k := 0; k <= n; k++ {
+			for r := 0; r < stride; r++ {
+				below := outer*n*stride + (k-1)*stride + r
+				above := below + stride
+				var v float64
+				switch k {
+				case 0:
+					v = a.Elements[above]
+				case n:
+					v = a.Elements[below]
+				default:
+					v = (a.Elements[below] + a.Elements[above]) / 2
+				}
+				o.Elements[outer*(n+1)*stride+k*stride+r] = v
+			}
+		}
+	}
+	return o
+}
+
+// regridLayers applies weights to each horizontal layer of a,
+// returning an array with nx columns and ny rows.
+func regridLayers(a *sparse.DenseArray, weights [][]regridWeight, nx, ny int) *sparse.DenseArray {
+	shape := append([]int{}, a.Shape...)
+	n := len(shape)
+	nOld := shape[n-2] * shape[n-1]
+	shape[n-2], shape[n-1] = ny, nx
+	o := sparse.ZerosDense(shape...)
+	nNew := nx * ny
+	for l := 0; l < len(a.Elements)/nOld; l++ {
+		for i, w := range weights {
+			var v float64
+			for _, ww := range w {
+				v += a.Elements[l*nOld+ww.i] * ww.frac
+			}
+			o.Elements[l*nNew+i] = v
+		}
+	}
+	return o
+}
+
+// gridRotation returns the cosine and sine of the angle between the x axis
+// of grid from and the x axis of each cell in grid to, where trans
+// transforms coordinates from the spatial reference of to to that of from.
+func gridRotation(from, to *CTMGrid, trans proj.Transformer) (cos, sin []float64, err error) {
+	cos = make([]float64, to.Nx*to.Ny)
+	sin = make([]float64, to.Nx*to.Ny)
+	for j := 0; j < to.Ny; j++ {
+		y := to.Y0 + to.Dy*(float64(j)+0.5)
+		for i := 0; i < to.Nx; i++ {
+			x := to.X0 + to.Dx*(float64(i)+0.5)
+			x0, y0, err := trans(x, y)
+			if err != nil {
+				return nil, nil, fmt.Errorf("inmap: regridding CTM data: %v", err)
+			}
+			x1, y1, err := trans(x+to.Dx/100, y)
+			if err != nil {
+				return nil, nil, fmt.Errorf("inmap: regridding CTM data: %v", err)
+			}
+			dx, dy := x1-x0, y1-y0
+			if from.SR.Name == "longlat" {
+				// Degrees of longitude get shorter towards the poles.
+				dx *= math.Cos(y0 * math.Pi / 180)
+			}
+			h := math.Hypot(dx, dy)
+			cos[j*to.Nx+i] = dx / h
+			sin[j*to.Nx+i] = dy / h
+		}
+	}
+	return cos, sin, nil
+}
+
+// rotateWind rotates the x and y wind components u and v, which are on
+// grid cell centers, by the angles given by cos and sin.
+// If deviation is true, u and v are treated as magnitudes of
+// deviations rather than velocities. Nothing is done if either
+// u or v is nil.
+func rotateWind(u, v *sparse.DenseArray, cos, sin []float64, deviation bool) {
+	if u == nil || v == nil {
+		return
+	}
+	n := len(cos)
+	for l := 0; l < len(u.Elements)/n; l++ {
+		for i := 0; i < n; i++ {
+			uu, vv := u.Elements[l*n+i], v.Elements[l*n+i]
+			c, s := cos[i], sin[i]
+			if deviation {
+				c, s = math.Abs(c), math.Abs(s)
+				u.Elements[l*n+i] = c*uu + s*vv
+				v.Elements[l*n+i] = s*uu + c*vv
+			} else {
+				u.Elements[l*n+i] = c*uu + s*vv
+				v.Elements[l*n+i] = -s*uu + c*vv
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/sparse"
+)
+
+// regridTestData returns CTM data on an nx by ny grid with two layers,
+// where the x and y wind velocities are u and v everywhere.
+func regridTestData(nx, ny int, u, v float64) *CTMData {
+	d := new(CTMData)
+	ws := sparse.ZerosDense(2, ny, nx)
+	for i := range ws.Elements {
+		ws.Elements[i] = float64(i)
+	}
+	d.AddVariable("WindSpeed", []string{"z", "y", "x"}, "wind speed", "m/s", ws)
+	uAvg := sparse.ZerosDense(2, ny, nx+1)
+	for i := range uAvg.Elements {
+		uAvg.Elements[i] = u
+	}
+	d.AddVariable("UAvg", []string{"z", "y", "xStagger"}, "u", "m/s", uAvg)
+	vAvg := sparse.ZerosDense(2, ny+1, nx)
+	for i := range vAvg.Elements {
+		vAvg.Elements[i] = v
+	}
+	d.AddVariable("VAvg", []string{"z", "yStagger", "x"}, "v", "m/s", vAvg)
+	pblh := sparse.ZerosDense(ny, nx)
+	for i := range pblh.Elements {
+		pblh.Elements[i] = 100
+	}
+	d.AddVariable("Pblh", []string{"y", "x"}, "pblh", "m", pblh)
+	return d
+}
+
+func TestCTMDataRegrid(t *testing.T) {
+	sr, err := proj.Parse(TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("refine", func(t *testing.T) {
+		d := regridTestData(2, 2, 0, 0)
+		uAvg := d.Data["UAvg"].Data
+		for k := 0; k < 2; k++ {
+			for j := 0; j < 2; j++ {
+				for i, v := range []float64{0, 2, 4} {
+					uAvg.Set(v, k, j, i)
+				}
+			}
+		}
+		from := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 2000, Dy: 2000, Nx: 2, Ny: 2}
+		to := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 1000, Dy: 1000, Nx: 4, Ny: 4}
+		o, err := d.Regrid(from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws := o.Data["WindSpeed"].Data
+		if !reflect.DeepEqual(ws.Shape, []int{2, 4, 4}) {
+			t.Fatalf("WindSpeed shape: have %v, want [2 4 4]", ws.Shape)
+		}
+		for k := 0; k < 2; k++ {
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					want := d.Data["WindSpeed"].Data.Get(k, j/2, i/2)
+					if have := ws.Get(k, j, i); different(have, want, 1e-10) {
+						t.Errorf("WindSpeed (%d, %d, %d): have %g, want %g", k, j, i, have, want)
+					}
+				}
+			}
+		}
+		u := o.Data["UAvg"].Data
+		if !reflect.DeepEqual(u.Shape, []int{2, 4, 5}) {
+			t.Fatalf("UAvg shape: have %v, want [2 4 5]", u.Shape)
+		}
+		for i, want := range []float64{1, 1, 2, 3, 3} {
+			if have := u.Get(1, 3, i); math.Abs(have-want) > 1e-10 {
+				t.Errorf("UAvg %d: have %g, want %g", i, have, want)
+			}
+		}
+		if s := o.Data["VAvg"].Data.Shape; !reflect.DeepEqual(s, []int{2, 5, 4}) {
+			t.Errorf("VAvg shape: have %v, want [2 5 4]", s)
+		}
+		pblh := o.Data["Pblh"].Data
+		if !reflect.DeepEqual(pblh.Shape, []int{4, 4}) || pblh.Get(3, 3) != 100 {
+			t.Errorf("Pblh: have %v", pblh)
+		}
+		if dims := o.Data["UAvg"].Dims; !reflect.DeepEqual(dims, []string{"z", "y", "xStagger"}) {
+			t.Errorf("UAvg dims: have %v", dims)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		// A longitude-latitude grid east of the central meridian of
+		// the target grid, where north is rotated to the left.
+		ll, err := proj.Parse("+proj=longlat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trans, err := ll.NewTransform(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y, err := trans(-80, 40)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := regridTestData(4, 4, 1, 0)
+		from := &CTMGrid{SR: ll, X0: -82, Y0: 38, Dx: 1, Dy: 1, Nx: 4, Ny: 4}
+		to := &CTMGrid{SR: sr, X0: x - 10000, Y0: y - 10000, Dx: 10000, Dy: 10000, Nx: 2, Ny: 2}
+		o, err := d.Regrid(from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, v := o.Data["UAvg"].Data, o.Data["VAvg"].Data
+		for j := 0; j < 2; j++ {
+			for i := 0; i < 2; i++ {
+				uu, vv := u.Get(0, j, i), v.Get(0, j, i)
+				if vv <= 0 || uu <= vv {
+					t.Errorf("(%d, %d): have u=%g, v=%g; want an eastward wind rotated counterclockwise", i, j, uu, vv)
+				}
+				if speed := math.Hypot(uu, vv); math.Abs(speed-1) > 1e-3 {
+					t.Errorf("(%d, %d): speed %g != 1", i, j, speed)
+				}
+			}
+		}
+	})
+
+	t.Run("outside", func(t *testing.T) {
+		d := regridTestData(2, 2, 0, 0)
+		from := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 2000, Dy: 2000, Nx: 2, Ny: 2}
+		to := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 1000, Dy: 1000, Nx: 8, Ny: 8}
+		if _, err := d.Regrid(from, to); err == nil {
+			t.Error("expected an error for a target grid outside of the CTM grid")
+		}
+	})
+
+	t.Run("wrong size", func(t *testing.T) {
+		d := regridTestData(2, 2, 0, 0)
+		from := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 2000, Dy: 2000, Nx: 3, Ny: 2}
+		to := &CTMGrid{SR: sr, X0: 0, Y0: 0, Dx: 1000, Dy: 1000, Nx: 4, Ny: 4}
+		if _, err := d.Regrid(from, to); err == nil {
+			t.Error("expected an error for a CTM grid that does not match the data")
+		}
+	})
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Deposition holds the cumulative mass of each chemical species that has
+// been removed from a grid cell by deposition, per unit horizontal area
+// of the cell [μg/m²], and the simulation time over which it has been
+// accumulated [s]. The species are in the order of the concentration arrays
+// of the chemical mechanism.
+type Deposition struct {
+	Dry, Wet         []float64
+	DryTime, WetTime float64
+
+	// column holds the wet deposition from the whole column of cells
+	// above a ground-level cell, as calculated by sumDepositionColumns.
+	column []float64
+}
+
+// newDeposition returns a new Deposition for n species.
+func newDeposition(n int) *Deposition {
+	return &Deposition{
+		Dry: make([]float64, n),
+		Wet: make([]float64, n),
+	}
+}
+
+// clone returns a copy of dep, which may be nil.
+func (dep *Deposition) clone() *Deposition {
+	if dep == nil {
+		return nil
+	}
+	o := newDeposition(len(dep.Dry))
+	copy(o.Dry, dep.Dry)
+	copy(o.Wet, dep.Wet)
+	o.DryTime, o.WetTime = dep.DryTime, dep.WetTime
+	return o
+}
+
+// mergeDeposition returns the area-weighted average of the deposition
+// returned by dep for each of cells, or nil if none of the cells
+// have deposition.
+func mergeDeposition(cells []*Cell, dep func(*Cell) *Deposition) *Deposition {
+	var o *Deposition
+	var totalArea float64
+	for _, c := range cells {
+		totalArea += c.Dx * c.Dy
+	}
+	for _, c := range cells {
+		cd := dep(c)
+		if cd == nil {
+			continue
+		}
+		if o == nil {
+			o = newDeposition(len(cd.Dry))
+		}
+		w := c.Dx * c.Dy / totalArea
+		for i := range cd.Dry {
+			o.Dry[i] += cd.Dry[i] * w
+			o.Wet[i] += cd.Wet[i] * w
+		}
+		o.DryTime += cd.DryTime * w
+		o.WetTime += cd.WetTime * w
+	}
+	return o
+}
+
+// AddDeposition records that a concentration Δc [μg/m³] of species i has
+// been removed from c by deposition process p, which must be
+// DryDepositionBudget or WetDepositionBudget. The deposited mass is also
+// added to the mass budget of c (see AddToBudget).
+// It is intended to be called by deposition CellManipulators, which
+// should also call AddDepositionTime once for each time step.
+func (c *Cell) AddDeposition(p BudgetProcess, i int, Δc float64) {
+	if c.Deposition == nil {
+		c.Deposition = newDeposition(len(c.Cf))
+	}
+	switch p {
+	case DryDepositionBudget:
+		c.Deposition.Dry[i] += Δc * c.Dz
+	case WetDepositionBudget:
+		c.Deposition.Wet[i] += Δc * c.Dz
+	default:
+		panic(fmt.Errorf("inmap: invalid deposition process %d", p))
+	}
+	c.AddToBudget(p, i, -Δc)
+}
+
+// AddDepositionTime records that deposition process p, which must be
+// DryDepositionBudget or WetDepositionBudget, has been
+// calculated for c for a time step of length Δt [s].
+func (c *Cell) AddDepositionTime(p BudgetProcess, Δt float64) {
+	if c.Deposition == nil {
+		c.Deposition = newDeposition(len(c.Cf))
+	}
+	switch p {
+	case DryDepositionBudget:
+		c.Deposition.DryTime += Δt
+	case WetDepositionBudget:
+		c.Deposition.WetTime += Δt
+	default:
+		panic(fmt.Errorf("inmap: invalid deposition process %d", p))
+	}
+}
+
+// DepositionRate returns the average rate at which species i has been
+// deposited in c by process p, which must be DryDepositionBudget or
+// WetDepositionBudget, over the course of the simulation [μg/m²/s].
+// For ground-level cells, the wet deposition rate includes the deposition
+// from the whole column of cells above the cell when it is calculated
+// as part of the simulation results (see InMAP.Results).
+func (c *Cell) DepositionRate(p BudgetProcess, i int) float64 {
+	dep := c.Deposition
+	if dep == nil {
+		return 0
+	}
+	switch p {
+	case DryDepositionBudget:
+		if dep.DryTime == 0 {
+			return 0
+		}
+		return dep.Dry[i] / dep.DryTime
+	case WetDepositionBudget:
+		if dep.WetTime == 0 {
+			return 0
+		}
+		return dep.wet()[i] / dep.WetTime
+	default:
+		panic(fmt.Errorf("inmap: invalid deposition process %d", p))
+	}
+}
+
+// wet returns the wet deposition from the whole column of cells
+// above a ground-level cell if it has been calculated, and the wet
+// deposition from the cell itself otherwise.
+func (dep *Deposition) wet() []float64 {
+	if dep.column != nil {
+		return dep.column
+	}
+	return dep.Wet
+}
+
+// Gridded deposition output variables, which are followed by the name of
+// a chemical species.
+const (
+	dryDepVarPrefix = "DryDep"
+	wetDepVarPrefix = "WetDep"
+)
+
+// depositionVariables returns the names and descriptions of the gridded
+// cumulative deposition output variables.
+func depositionVariables(m Mechanism) (names, descriptions []string) {
+	for _, s := range m.Species() {
+		names = append(names, dryDepVarPrefix+s)
+		descriptions = append(descriptions, s+" dry deposition")
+	}
+	for _, s := range m.Species() {
+		names = append(names, wetDepVarPrefix+s)
+		descriptions = append(descriptions, s+" wet deposition")
+	}
+	return
+}
+
+// depositionValue returns the value of gridded deposition output variable
+// varName in c: the cumulative mass deposited per unit area [μg/m²],
+// in the form used in the concentration arrays of m.
+// For ground-level cells, wet deposition includes the deposition from
+// the whole column of cells above the cell, as calculated by
+// sumDepositionColumns. ok is false if varName is not a gridded deposition
+// output variable.
+func (c *Cell) depositionValue(varName string, m Mechanism) (v float64, ok bool) {
+	var wet bool
+	var species string
+	switch {
+	case strings.HasPrefix(varName, dryDepVarPrefix):
+		species = strings.TrimPrefix(varName, dryDepVarPrefix)
+	case strings.HasPrefix(varName, wetDepVarPrefix):
+		species = strings.TrimPrefix(varName, wetDepVarPrefix)
+		wet = true
+	default:
+		return 0, false
+	}
+	for i, s := range m.Species() {
+		if s != species {
+			continue
+		}
+		if c.Deposition == nil {
+			return 0, true
+		}
+		if wet {
+			return c.Deposition.wet()[i], true
+		}
+		return c.Deposition.Dry[i], true
+	}
+	return 0, false
+}
+
+// sumDepositionColumns calculates the total wet deposition from the column
+// of cells above each ground-level cell. The caller is responsible for
+// holding d.cellLock.
+func (d *InMAP) sumDepositionColumns() {
+	for _, c := range *d.cells {
+		if c.Layer == 0 && c.Deposition != nil {
+			c.Deposition.column = make([]float64, len(c.Deposition.Wet))
+			copy(c.Deposition.column, c.Deposition.Wet)
+		}
+	}
+	for _, c := range *d.cells {
+		if c.Layer == 0 || c.Deposition == nil {
+			continue
+		}
+		area := c.Dx * c.Dy
+		for _, g := range *c.groundLevel {
+			if g.Deposition == nil {
+				g.Deposition = newDeposition(len(c.Deposition.Wet))
+				g.Deposition.WetTime = c.Deposition.WetTime
+				g.Deposition.column = make([]float64, len(c.Deposition.Wet))
+			}
+			// Convert the deposition to the area of the ground-level cell.
+			f := g.info.coverFrac * area / (g.Dx * g.Dy)
+			for i, v := range c.Deposition.Wet {
+				g.Deposition.column[i] += v * f
+			}
+		}
+	}
+}
@@ -0,0 +1,624 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Distributed simulations divide the grid cells among a number of worker
+// processes, each of which simulates the cells in its subdomain.
+// The coordinating process, which holds a Cluster, creates the grid,
+// sends each worker the cells in its subdomain, and at each time step
+// exchanges the concentrations of halo cells—cells that are neighbors of
+// cells in a subdomain but belong to a different subdomain—between
+// the workers. Communication uses net/rpc over TCP.
+
+// WorkerInitArgs holds the information needed to initialize a Worker.
+type WorkerInitArgs struct {
+	// Mechanism is the name of the chemical mechanism,
+	// as registered using RegisterMechanism.
+	Mechanism string
+
+	// MechanismSettings is the JSON encoding of the chemical mechanism,
+	// which holds any settings (e.g., exported fields of the
+	// mechanism's type) that differ from those of the registered mechanism.
+	MechanismSettings []byte
+
+	// PopIndex is the index of the population type used for
+	// checking convergence.
+	PopIndex int
+
+	// Cells are the cells in the worker's subdomain, followed by its halo cells.
+	Cells []*Cell
+
+	// NumOwned is the number of cells in Cells that are in the subdomain.
+	NumOwned int
+
+	// Export holds the indices in Cells of the cells in the subdomain
+	// that are halo cells of other subdomains.
+	Export []int
+}
+
+// WorkerStepArgs holds the input for one phase of a time step.
+type WorkerStepArgs struct {
+	// Dt is the time step [s].
+	Dt float64
+
+	// Halo holds the initial concentrations (Ci) of the halo cells,
+	// in the order they were provided in WorkerInitArgs.
+	Halo []float64
+}
+
+// WorkerStepReply holds the output of one phase of a time step.
+type WorkerStepReply struct {
+	// Export holds the initial concentrations (Ci) of the cells that are halo
+	// cells of other subdomains, in the order specified in WorkerInitArgs.
+	Export []float64
+
+	// Sums holds the total mass and population-weighted concentration of each
+	// species in the subdomain, in the order used by SteadyStateConvergenceCheck.
+	Sums []float64
+}
+
+// Worker simulates a subdomain of a distributed simulation. Its exported
+// methods are called remotely by a Cluster and should not be used directly.
+type Worker struct {
+	scienceFuncs func(Mechanism) ([]CellManipulator, error)
+
+	d             *InMAP
+	m             Mechanism
+	popIndex      int
+	owned, halo   []*Cell
+	export        []*Cell
+	emis, science DomainManipulator
+	initialized   bool
+	mu            sync.Mutex // Only allow one request at a time.
+}
+
+// NewWorker returns a new Worker, where scienceFuncs returns the science
+// functions that should be run in each grid cell at each time step
+// for a given chemical mechanism.
+func NewWorker(scienceFuncs func(Mechanism) ([]CellManipulator, error)) *Worker {
+	return &Worker{scienceFuncs: scienceFuncs}
+}
+
+// ServeWorker serves requests from a Cluster to w for connections on l.
+// It blocks until l is closed.
+func ServeWorker(l net.Listener, w *Worker) error {
+	s := rpc.NewServer()
+	if err := s.RegisterName("Worker", w); err != nil {
+		return fmt.Errorf("inmap: registering worker: %v", err)
+	}
+	s.Accept(l)
+	return nil
+}
+
+// Init initializes the worker's subdomain.
+func (w *Worker) Init(args *WorkerInitArgs, reply *bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, err := GetMechanism(args.Mechanism)
+	if err != nil {
+		return err
+	}
+	if m, err = configureMechanism(m, args.MechanismSettings); err != nil {
+		return err
+	}
+	scienceFuncs, err := w.scienceFuncs(m)
+	if err != nil {
+		return err
+	}
+	if args.NumOwned > len(args.Cells) {
+		return fmt.Errorf("inmap: worker: %d cells in subdomain but only %d cells provided", args.NumOwned, len(args.Cells))
+	}
+	w.m = m
+	w.popIndex = args.PopIndex
+	w.d = new(InMAP)
+	w.d.init()
+	for _, c := range args.Cells {
+		w.d.InsertCell(c, m)
+	}
+	w.owned = args.Cells[:args.NumOwned]
+	w.halo = args.Cells[args.NumOwned:]
+	w.export = make([]*Cell, len(args.Export))
+	for i, j := range args.Export {
+		if j < 0 || j >= args.NumOwned {
+			return fmt.Errorf("inmap: worker: export cell index %d out of range", j)
+		}
+		w.export[i] = args.Cells[j]
+	}
+	// Only the cells in the subdomain are simulated; the halo cells
+	// only provide the concentrations of neighboring cells.
+	w.d.cellPartitions = partitionCells(w.owned)
+	w.emis = Calculations(AddEmissionsFlux())
+	w.science = Calculations(scienceFuncs...)
+	w.initialized = true
+	*reply = true
+	return nil
+}
+
+// Emissions adds emissions to the cells in the subdomain, which also
+// updates their initial concentrations, and returns the initial concentrations
+// of the cells that are needed by other subdomains.
+func (w *Worker) Emissions(args *WorkerStepArgs, reply *WorkerStepReply) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.initialized {
+		return fmt.Errorf("inmap: worker has not been initialized")
+	}
+	w.d.Dt = args.Dt
+	if err := w.emis(w.d); err != nil {
+		return err
+	}
+	n := w.m.Len()
+	reply.Export = make([]float64, 0, len(w.export)*n)
+	for _, c := range w.export {
+		reply.Export = append(reply.Export, c.Ci...)
+	}
+	return nil
+}
+
+// Science sets the initial concentrations of the halo cells, runs
+// the science functions on the cells in the subdomain, and returns the
+// total mass and population-weighted concentration in the subdomain.
+func (w *Worker) Science(args *WorkerStepArgs, reply *WorkerStepReply) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.initialized {
+		return fmt.Errorf("inmap: worker has not been initialized")
+	}
+	n := w.m.Len()
+	if len(args.Halo) != len(w.halo)*n {
+		return fmt.Errorf("inmap: worker: received %d halo values; expected %d", len(args.Halo), len(w.halo)*n)
+	}
+	for i, c := range w.halo {
+		copy(c.Ci, args.Halo[i*n:(i+1)*n])
+	}
+	w.d.Dt = args.Dt
+	if err := w.science(w.d); err != nil {
+		return err
+	}
+	reply.Sums = concentrationSums(w.owned, n, w.popIndex)
+	return nil
+}
+
+// Concentrations returns the initial and final concentrations of each
+// cell in the subdomain, with the initial concentrations of all cells
+// followed by the final concentrations of all cells.
+func (w *Worker) Concentrations(args *bool, reply *[]float64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.initialized {
+		return fmt.Errorf("inmap: worker has not been initialized")
+	}
+	o := make([]float64, 0, 2*len(w.owned)*w.m.Len())
+	for _, c := range w.owned {
+		o = append(o, c.Ci...)
+	}
+	for _, c := range w.owned {
+		o = append(o, c.Cf...)
+	}
+	*reply = o
+	return nil
+}
+
+// Deposition returns the deposition from each cell in the subdomain.
+// Cells without deposition are represented by an empty Deposition.
+func (w *Worker) Deposition(args *bool, reply *[]Deposition) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.initialized {
+		return fmt.Errorf("inmap: worker has not been initialized")
+	}
+	o := make([]Deposition, len(w.owned))
+	for i, c := range w.owned {
+		if c.Deposition != nil {
+			o[i] = *c.Deposition
+		}
+	}
+	*reply = o
+	return nil
+}
+
+// concentrationSums returns the total mass and population-weighted
+// concentration of each of the n species in cells, where popIndex is the
+// index of the population type for population weighting. The total mass of
+// species i is at index 2*i and the population-weighted concentration is at
+// index 2*i+1.
+func concentrationSums(cells []*Cell, n, popIndex int) []float64 {
+	sums := make([]float64, n*2)
+	for ii := 0; ii < n; ii++ {
+		for _, c := range cells {
+			sums[ii*2] += c.Cf[ii] * c.Volume
+		}
+		for _, c := range cells {
+			sums[ii*2+1] += c.Cf[ii] * c.PopData[popIndex]
+		}
+	}
+	return sums
+}
+
+// haloSource specifies where the concentrations of a halo cell come from:
+// the worker that the cell belongs to and its index in that worker's
+// export list.
+type haloSource struct {
+	worker, index int
+}
+
+// Cluster coordinates a simulation that is distributed among several
+// Worker processes.
+type Cluster struct {
+	clients []*rpc.Client
+
+	// cells holds the cells belonging to each worker, in the
+	// coordinator's grid.
+	cells [][]*Cell
+
+	// halo holds the source of each halo cell of each worker.
+	halo [][]haloSource
+
+	// sums holds the most recent total mass and population-weighted
+	// concentrations calculated by the workers.
+	sums []float64
+
+	m Mechanism
+}
+
+// NewCluster connects to the workers running at the specified
+// TCP addresses (e.g., "localhost:9000").
+func NewCluster(addrs ...string) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("inmap: no worker addresses specified")
+	}
+	c := new(Cluster)
+	for _, addr := range addrs {
+		client, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("inmap: connecting to worker at %s: %v", addr, err)
+		}
+		c.clients = append(c.clients, client)
+	}
+	return c, nil
+}
+
+// Close closes the connections to the workers.
+func (c *Cluster) Close() error {
+	var err error
+	for _, client := range c.clients {
+		if e := client.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// mechanismName returns the name that the type of m has been registered with.
+func mechanismName(m Mechanism) (string, error) {
+	for _, name := range Mechanisms() {
+		if reflect.TypeOf(mechanisms[name]) == reflect.TypeOf(m) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("inmap: chemical mechanism %T has not been registered", m)
+}
+
+// configureMechanism returns a copy of m with the settings
+// in the JSON encoding settings, which was created from a mechanism of
+// the same type as m.
+func configureMechanism(m Mechanism, settings []byte) (Mechanism, error) {
+	if len(settings) == 0 {
+		return m, nil
+	}
+	v := reflect.New(reflect.TypeOf(m))
+	v.Elem().Set(reflect.ValueOf(m))
+	if err := json.Unmarshal(settings, v.Interface()); err != nil {
+		return nil, fmt.Errorf("inmap: configuring chemical mechanism %T: %v", m, err)
+	}
+	return v.Elem().Interface().(Mechanism), nil
+}
+
+// subdomains divides the grid cells among n subdomains. Each subdomain
+// holds complete vertical columns of outermost (unnested) grid cells,
+// which are assigned to subdomains in order of their position in the grid
+// so that the subdomains are spatially contiguous and have
+// approximately equal numbers of cells.
+func (d *InMAP) subdomains(n int) ([][]*Cell, error) {
+	size := make(map[[2]int]int) // number of cells in each column
+	for _, c := range *d.cells {
+		if len(c.Index) == 0 {
+			return nil, fmt.Errorf("inmap: distributed simulations require grid cells with nest indices")
+		}
+		size[c.Index[0]]++
+	}
+	columns := make([][2]int, 0, len(size))
+	for k := range size {
+		columns = append(columns, k)
+	}
+	sort.Slice(columns, func(a, b int) bool {
+		if columns[a][0] != columns[b][0] {
+			return columns[a][0] < columns[b][0]
+		}
+		return columns[a][1] < columns[b][1]
+	})
+	if len(columns) < n {
+		return nil, fmt.Errorf("inmap: the grid can only be divided among %d workers, not %d", len(columns), n)
+	}
+
+	owner := make(map[[2]int]int)
+	total := d.cells.len()
+	var count, w, wCount int
+	for i, k := range columns {
+		// Move on to the next subdomain when this one is large enough,
+		// making sure there are enough columns left for the remaining ones.
+		if w < n-1 && wCount > 0 && (count >= (w+1)*total/n || len(columns)-i <= n-w-1) {
+			w++
+			wCount = 0
+		}
+		owner[k] = w
+		count += size[k]
+		wCount += size[k]
+	}
+	// Keep the cells in each subdomain in the same order as in the full grid.
+	o := make([][]*Cell, n)
+	for _, c := range *d.cells {
+		w := owner[c.Index[0]]
+		o[w] = append(o[w], c.Cell)
+	}
+	return o, nil
+}
+
+// Distribute returns a function that divides the grid cells in d among
+// the workers in the cluster and sends each worker the cells in its
+// subdomain. It should be run after the grid has been created
+// and the emissions have been added. popGridColumn is the population type
+// used for checking convergence, and m is the chemical mechanism, which must
+// have been registered using RegisterMechanism. After Distribute is run,
+// Step should be used instead of Calculations, and the grid must not change.
+// SteadyStateConvergenceCheck, Results, and Checkpoint automatically
+// use the concentrations calculated by the workers. Source tags
+// (see TrackTags) and the mass budget (see TrackBudget) can not be
+// tracked in distributed simulations, and boundary conditions
+// (see SetBoundaryConditions) can not be used.
+func (c *Cluster) Distribute(popGridColumn string, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		if len(d.tags) > 0 {
+			return fmt.Errorf("inmap: source tags can not be tracked in distributed simulations")
+		}
+		if d.budget != nil {
+			return fmt.Errorf("inmap: the mass budget can not be tracked in distributed simulations")
+		}
+		if d.boundaryConditions != nil {
+			return fmt.Errorf("inmap: boundary conditions can not be used in distributed simulations")
+		}
+		mechName, err := mechanismName(m)
+		if err != nil {
+			return err
+		}
+		mechSettings, err := json.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("inmap: encoding chemical mechanism settings: %v", err)
+		}
+		popIndex, ok := d.PopIndices[popGridColumn]
+		if !ok {
+			return fmt.Errorf("inmap: invalid population type %s", popGridColumn)
+		}
+		c.cells, err = d.subdomains(len(c.clients))
+		if err != nil {
+			return err
+		}
+		c.m = m
+		owner := make(map[*Cell]int)
+		for w, cells := range c.cells {
+			for _, cell := range cells {
+				owner[cell] = w
+			}
+		}
+
+		// Find the halo cells of each subdomain using the neighbor lists.
+		exportIndex := make([]map[*Cell]int, len(c.clients))
+		exports := make([][]int, len(c.clients))
+		ownedIndex := make([]map[*Cell]int, len(c.clients))
+		for w, cells := range c.cells {
+			exportIndex[w] = make(map[*Cell]int)
+			ownedIndex[w] = make(map[*Cell]int)
+			for i, cell := range cells {
+				ownedIndex[w][cell] = i
+			}
+		}
+		haloCells := make([][]*Cell, len(c.clients))
+		c.halo = make([][]haloSource, len(c.clients))
+		for w, cells := range c.cells {
+			inHalo := make(map[*Cell]bool)
+			for _, cell := range cells {
+				for _, l := range []*cellList{cell.west, cell.east, cell.south, cell.north,
+					cell.above, cell.below, cell.groundLevel} {
+					for _, n := range *l {
+						if n.boundary || inHalo[n.Cell] {
+							continue
+						}
+						o := owner[n.Cell]
+						if o == w {
+							continue
+						}
+						inHalo[n.Cell] = true
+						i, ok := exportIndex[o][n.Cell]
+						if !ok {
+							i = len(exports[o])
+							exportIndex[o][n.Cell] = i
+							exports[o] = append(exports[o], ownedIndex[o][n.Cell])
+						}
+						haloCells[w] = append(haloCells[w], n.Cell)
+						c.halo[w] = append(c.halo[w], haloSource{worker: o, index: i})
+					}
+				}
+			}
+		}
+
+		err = c.each(func(w int, client *rpc.Client) error {
+			args := &WorkerInitArgs{
+				Mechanism:         mechName,
+				MechanismSettings: mechSettings,
+				PopIndex:          popIndex,
+				Cells:             append(append([]*Cell{}, c.cells[w]...), haloCells[w]...),
+				NumOwned:          len(c.cells[w]),
+				Export:            exports[w],
+			}
+			var reply bool
+			if err := client.Call("Worker.Init", args, &reply); err != nil {
+				return fmt.Errorf("inmap: initializing worker %d: %v", w, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		d.cluster = c
+		return nil
+	}
+}
+
+// each concurrently runs f for each worker and returns the first error.
+func (c *Cluster) each(f func(w int, client *rpc.Client) error) error {
+	errs := make([]error, len(c.clients))
+	var wg sync.WaitGroup
+	wg.Add(len(c.clients))
+	for w, client := range c.clients {
+		go func(w int, client *rpc.Client) {
+			errs[w] = f(w, client)
+			wg.Done()
+		}(w, client)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Step returns a function that advances the distributed simulation by
+// one time step. It adds emissions in each worker, exchanges the
+// concentrations of halo cells among workers, and then runs the
+// science functions in each worker. It replaces
+// Calculations(AddEmissionsFlux()) and Calculations(scienceFuncs...)
+// in a non-distributed simulation.
+func (c *Cluster) Step() DomainManipulator {
+	return func(d *InMAP) error {
+		if d.cluster != c {
+			return fmt.Errorf("inmap: the simulation has not been distributed among the workers in this cluster")
+		}
+		if d.Dt == 0 {
+			return fmt.Errorf("inmap: timestep is zero")
+		}
+		exports := make([][]float64, len(c.clients))
+		err := c.each(func(w int, client *rpc.Client) error {
+			var reply WorkerStepReply
+			if err := client.Call("Worker.Emissions", &WorkerStepArgs{Dt: d.Dt}, &reply); err != nil {
+				return fmt.Errorf("inmap: worker %d: %v", w, err)
+			}
+			exports[w] = reply.Export
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		n := c.m.Len()
+		sums := make([][]float64, len(c.clients))
+		err = c.each(func(w int, client *rpc.Client) error {
+			halo := make([]float64, 0, len(c.halo[w])*n)
+			for _, src := range c.halo[w] {
+				halo = append(halo, exports[src.worker][src.index*n:(src.index+1)*n]...)
+			}
+			var reply WorkerStepReply
+			if err := client.Call("Worker.Science", &WorkerStepArgs{Dt: d.Dt, Halo: halo}, &reply); err != nil {
+				return fmt.Errorf("inmap: worker %d: %v", w, err)
+			}
+			sums[w] = reply.Sums
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Add the sums in a consistent order.
+		c.sums = make([]float64, 2*n)
+		for _, s := range sums {
+			for i, v := range s {
+				c.sums[i] += v
+			}
+		}
+		return nil
+	}
+}
+
+// Gather returns a function that copies the concentrations and deposition
+// calculated by the workers into the grid cells of the coordinating process.
+// It is run automatically by Results and Checkpoint.
+func (c *Cluster) Gather() DomainManipulator {
+	return func(d *InMAP) error {
+		n := c.m.Len()
+		return c.each(func(w int, client *rpc.Client) error {
+			var conc []float64
+			if err := client.Call("Worker.Concentrations", new(bool), &conc); err != nil {
+				return fmt.Errorf("inmap: worker %d: %v", w, err)
+			}
+			cells := c.cells[w]
+			if len(conc) != 2*len(cells)*n {
+				return fmt.Errorf("inmap: worker %d returned %d concentrations; expected %d", w, len(conc), 2*len(cells)*n)
+			}
+			for i, cell := range cells {
+				copy(cell.Ci, conc[i*n:(i+1)*n])
+				copy(cell.Cf, conc[(len(cells)+i)*n:(len(cells)+i+1)*n])
+			}
+			var dep []Deposition
+			if err := client.Call("Worker.Deposition", new(bool), &dep); err != nil {
+				return fmt.Errorf("inmap: worker %d: %v", w, err)
+			}
+			if len(dep) != len(cells) {
+				return fmt.Errorf("inmap: worker %d returned deposition for %d cells; expected %d", w, len(dep), len(cells))
+			}
+			for i, cell := range cells {
+				if dep[i].Dry != nil {
+					cell.Deposition = &dep[i]
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// concentrationSums returns the total mass and population-weighted
+// concentration of each species in d, as described in the
+// concentrationSums function. If the simulation is distributed,
+// the sums from the most recent time step are returned.
+func (d *InMAP) concentrationSums(m Mechanism, popIndex int) []float64 {
+	if d.cluster != nil && d.cluster.sums != nil {
+		return d.cluster.sums
+	}
+	return concentrationSums(d.cells.array(), m.Len(), popIndex)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// startTestWorkers starts n workers in the current process and returns
+// their addresses.
+func startTestWorkers(t *testing.T, n int) []string {
+	RegisterMechanism("distributedtest", Mech{})
+	scienceFuncs := func(m Mechanism) ([]CellManipulator, error) {
+		return []CellManipulator{UpwindAdvection(), Mixing(), MeanderMixing(), m.(Mech).Chemistry()}, nil
+	}
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ServeWorker(l, NewWorker(scienceFuncs))
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+func TestDistributed(t *testing.T) {
+	const nsteps = 10
+	var m Mech
+	o, err := NewOutputter("", false, map[string]string{
+		"PNH4": "pNH4",
+		"PSO4": "pSO4",
+		"SOA":  "SOA",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single, science := partitionTestModel(t)
+	emisCalc, scienceCalc := Calculations(AddEmissionsFlux()), Calculations(science...)
+	for i := 0; i < nsteps; i++ {
+		if err := emisCalc(single); err != nil {
+			t.Fatal(err)
+		}
+		if err := scienceCalc(single); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := single.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nworkers := range []int{1, 2, 3} {
+		t.Run(fmt.Sprintf("workers=%d", nworkers), func(t *testing.T) {
+			cluster, err := NewCluster(startTestWorkers(t, nworkers)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cluster.Close()
+
+			d, _ := partitionTestModel(t)
+			if err := cluster.Distribute("TotalPop", m)(d); err != nil {
+				t.Fatal(err)
+			}
+			var nCells int
+			for _, cells := range cluster.cells {
+				if len(cells) == 0 {
+					t.Error("subdomain has no cells")
+				}
+				nCells += len(cells)
+			}
+			if nCells != d.cells.len() {
+				t.Errorf("subdomains have %d cells; want %d", nCells, d.cells.len())
+			}
+			step := cluster.Step()
+			for i := 0; i < nsteps; i++ {
+				if err := step(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			have, err := d.Results(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for v, wantV := range want {
+				for i, w := range wantV {
+					if different(have[v][i], w, 1.e-10) {
+						t.Errorf("%s cell %d: %g != %g", v, i, have[v][i], w)
+					}
+				}
+			}
+
+			// The distributed sums used for checking convergence should
+			// match the sums from the gathered concentrations.
+			popIndex := d.PopIndices["TotalPop"]
+			wantSums := concentrationSums(d.cells.array(), m.Len(), popIndex)
+			for i, s := range d.concentrationSums(m, popIndex) {
+				if different(s, wantSums[i], 1.e-10) {
+					t.Errorf("sum %d: %g != %g", i, s, wantSums[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDistributedConverge(t *testing.T) {
+	var m Mech
+	cluster, err := NewCluster(startTestWorkers(t, 2)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+
+	d, _ := partitionTestModel(t)
+	d.RunFuncs = []DomainManipulator{
+		cluster.Step(),
+		SteadyStateConvergenceCheck(-1, "TotalPop", m, nil),
+	}
+	if err := cluster.Distribute("TotalPop", m)(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if d.convergence.Iteration < 2 {
+		t.Errorf("simulation converged after only %d iterations", d.convergence.Iteration)
+	}
+}
+
+// scaledMech is a mechanism with a setting.
+type scaledMech struct {
+	Mech
+	Scale float64
+}
+
+func TestConfigureMechanism(t *testing.T) {
+	RegisterMechanism("scaledtest", scaledMech{})
+	m := scaledMech{Scale: 2}
+	name, err := mechanismName(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "scaledtest" {
+		t.Errorf("name: have %s, want scaledtest", name)
+	}
+	settings, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := GetMechanism(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := configureMechanism(base, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.(scaledMech).Scale != 2 {
+		t.Errorf("scale: have %g, want 2", m2.(scaledMech).Scale)
+	}
+}
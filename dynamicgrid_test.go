@@ -126,6 +126,105 @@ func TestDynamicGrid(t *testing.T) {
 	}
 }
 
+func TestCoarsenGrid(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	var m simplechem.Mechanism
+	mutator, err := inmap.PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err = d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	regularCells := len(d.Cells())
+	if err = cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+	// Set arbitrary concentrations.
+	for i, c := range d.Cells() {
+		for j := range c.Cf {
+			c.Cf[j] = float64(i + j)
+			c.Ci[j] = float64(i * j)
+		}
+	}
+	mass := func() (ci, cf []float64) {
+		ci, cf = make([]float64, m.Len()), make([]float64, m.Len())
+		for _, c := range d.Cells() {
+			for j := range c.Cf {
+				ci[j] += c.Ci[j] * c.Volume
+				cf[j] += c.Cf[j] * c.Volume
+			}
+		}
+		return
+	}
+	wantCi, wantCf := mass()
+	nest := func() (maxNest int) {
+		for _, c := range d.Cells() {
+			if len(c.Index) > maxNest {
+				maxNest = len(c.Index)
+			}
+		}
+		return
+	}
+
+	beginNest := nest()
+	if beginNest < 2 {
+		t.Fatal("the grid should have nested cells")
+	}
+	always := func([]*inmap.Cell, float64, float64) bool { return true }
+	for i := 1; i < beginNest; i++ {
+		if err = cfg.CoarsenGrid(always, ctmdata, pop, mr, emis, m, nil)(d); err != nil {
+			t.Fatal(err)
+		}
+		if n := nest(); n != beginNest-i {
+			t.Errorf("after %d coarsenings, maximum nest level should be %d but is %d", i, beginNest-i, n)
+		}
+		haveCi, haveCf := mass()
+		for j := range wantCf {
+			if different(haveCi[j], wantCi[j], 1.e-10) {
+				t.Errorf("species %d initial mass: %g != %g", j, haveCi[j], wantCi[j])
+			}
+			if different(haveCf[j], wantCf[j], 1.e-10) {
+				t.Errorf("species %d final mass: %g != %g", j, haveCf[j], wantCf[j])
+			}
+		}
+	}
+	if n := len(d.Cells()); n != regularCells {
+		t.Errorf("the coarsened grid should have %d cells but has %d", regularCells, n)
+	}
+
+	// With no concentration gradients, the dynamic grid rule should
+	// allow nested cells to be combined.
+	if err = cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.Cells() {
+		for j := range c.Cf {
+			c.Cf[j] = 1
+		}
+	}
+	popConcMutator := inmap.NewPopConcMutator(cfg, popIndices)
+	before := len(d.Cells())
+	if err = cfg.CoarsenGrid(popConcMutator.Coarsen(), ctmdata, pop, mr, emis, m, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(d.Cells()); after >= before {
+		t.Errorf("the grid should have fewer than %d cells after coarsening but has %d", before, after)
+	}
+}
+
 func different(a, b, tolerance float64) bool {
 	if 2*math.Abs(a-b)/math.Abs(a+b) > tolerance || math.IsNaN(a) || math.IsNaN(b) {
 		return true
@@ -0,0 +1,781 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/unit"
+)
+
+// EmissionsColumns maps the names of the emissions and stack parameter
+// fields of EmisRecord (VOC, NOx, NH3, SOx, PM25, Height, Diam, Temp, and
+// Velocity), of the source tag field (Tag), and of the geometry columns in CSV files (WKT, Longitude, and
+// Latitude) to the names of the columns in emissions input files that
+// hold them. Fields that are not included use the column names in
+// DefaultEmissionsColumns. Column names are not case sensitive.
+type EmissionsColumns map[string]string
+
+// DefaultEmissionsColumns are the names of the columns that are used
+// for any fields that are not included in an EmissionsColumns.
+var DefaultEmissionsColumns = EmissionsColumns{
+	"VOC":       "VOC",
+	"NOx":       "NOx",
+	"NH3":       "NH3",
+	"SOx":       "SOx",
+	"PM25":      "PM2_5",
+	"Height":    "height",
+	"Diam":      "diam",
+	"Temp":      "temp",
+	"Velocity":  "velocity",
+	"Tag":       "tag",
+	"WKT":       "WKT",
+	"Longitude": "lon",
+	"Latitude":  "lat",
+}
+
+// emisFields are the EmisRecord fields that are read from emissions
+// input files, in the order returned by EmisRecord.fields.
+var emisFields = []string{"VOC", "NOx", "NH3", "SOx", "PM25", "Height", "Diam", "Temp", "Velocity"}
+
+// fields returns pointers to the fields of e listed in emisFields.
+func (e *EmisRecord) fields() []*float64 {
+	return []*float64{&e.VOC, &e.NOx, &e.NH3, &e.SOx, &e.PM25, &e.Height, &e.Diam, &e.Temp, &e.Velocity}
+}
+
+// check returns an error if c includes any fields that are not
+// in DefaultEmissionsColumns.
+func (c EmissionsColumns) check() error {
+	for field := range c {
+		if _, ok := DefaultEmissionsColumns[field]; !ok {
+			valid := make([]string, 0, len(DefaultEmissionsColumns))
+			for f := range DefaultEmissionsColumns {
+				valid = append(valid, f)
+			}
+			sort.Strings(valid)
+			return fmt.Errorf("inmap: invalid emissions column field '%s'; valid fields are %s",
+				field, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+// column returns the lower-case name of the column that holds field,
+// and whether the column was specified in c rather than by default.
+func (c EmissionsColumns) column(field string) (name string, specified bool) {
+	if name, ok := c[field]; ok {
+		return strings.ToLower(name), true
+	}
+	return strings.ToLower(DefaultEmissionsColumns[field]), false
+}
+
+// record creates an emissions record with geometry g and the
+// emissions and stack parameters in attributes, which are keyed by
+// lower-case column name. Fields whose columns are not in attributes are
+// set to zero, unless the column was specified in c, in which case an
+// error is returned.
+func (c EmissionsColumns) record(g geom.Geom, attributes map[string]interface{}) (*EmisRecord, error) {
+	e := &EmisRecord{Geom: g}
+	vals := e.fields()
+	for i, field := range emisFields {
+		name, specified := c.column(field)
+		v, ok := attributes[name]
+		if !ok {
+			if specified {
+				return nil, fmt.Errorf("inmap: emissions column '%s' for %s is missing", name, field)
+			}
+			continue
+		}
+		var err error
+		if *vals[i], err = emisValue(v); err != nil {
+			return nil, fmt.Errorf("inmap: emissions column '%s': %v", name, err)
+		}
+	}
+	name, specified := c.column("Tag")
+	v, ok := attributes[name]
+	if !ok && specified {
+		return nil, fmt.Errorf("inmap: emissions column '%s' for Tag is missing", name)
+	}
+	switch t := v.(type) {
+	case nil:
+	case string:
+		e.Tag = strings.Trim(t, " \x00")
+	case []byte:
+		e.Tag = strings.Trim(string(t), " \x00")
+	default:
+		e.Tag = fmt.Sprint(t)
+	}
+	return e, nil
+}
+
+// emisValue converts an attribute value read from an emissions
+// file to a number. Missing values are converted to zero.
+func emisValue(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return t, nil
+	case int64:
+		return float64(t), nil
+	case json.Number:
+		return t.Float64()
+	case []byte:
+		return emisValue(string(t))
+	case string:
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return 0, nil
+		}
+		return strconv.ParseFloat(t, 64)
+	default:
+		return 0, fmt.Errorf("invalid value %v of type %T", v, v)
+	}
+}
+
+// An EmissionsReader reads emissions from the file fileName, using
+// columns to find the emissions and stack parameters. It returns the
+// emissions records, with emissions in the units of the input file,
+// and the spatial reference of their geometry.
+type EmissionsReader func(fileName string, columns EmissionsColumns) ([]*EmisRecord, *proj.SR, error)
+
+// emissionsReaders hold the EmissionsReaders for different file extensions.
+var emissionsReaders = map[string]EmissionsReader{
+	".shp":     readEmissionsShapefile,
+	".csv":     readEmissionsCSV,
+	".geojson": readEmissionsGeoJSON,
+	".json":    readEmissionsGeoJSON,
+	".gpkg":    readEmissionsGeoPackage,
+}
+
+// RegisterEmissionsReader specifies that r should be used to read emissions
+// files whose names end with extension ext (e.g., ".nc"),
+// replacing any existing EmissionsReader for that extension.
+// By default, EmissionsReaders are registered for shapefiles (".shp"),
+// CSV (".csv"), GeoJSON (".geojson" and ".json"), and GeoPackage (".gpkg")
+// files.
+// RegisterEmissionsReader should not be called concurrently with
+// reading emissions.
+func RegisterEmissionsReader(ext string, r EmissionsReader) {
+	emissionsReaders[strings.ToLower(ext)] = r
+}
+
+// ReadEmissions returns the emissions data in the specified files,
+// and converts them to the spatial reference gridSR. The format of each
+// file is determined by its extension as described in RegisterEmissionsReader;
+// files without an extension are assumed to be shapefiles.
+// columns specifies the names of the columns that hold the emissions and
+// stack parameters; if it is nil, DefaultEmissionsColumns are used.
+// Input units are specified by units, which can be any expression of mass
+// per time accepted by ParseEmissionUnits. Output units = μg/s.
+// Multipoint geometries are split into separate records for each point,
+// with the emissions divided evenly among them.
+// c is a channel over which status updates will be sent. If c is nil,
+// no updates will be sent.
+func ReadEmissions(gridSR *proj.SR, units string, columns EmissionsColumns, c chan string, files ...string) (*Emissions, error) {
+	emisConv, err := ParseEmissionUnits(units)
+	if err != nil {
+		return nil, err
+	}
+	if err = columns.check(); err != nil {
+		return nil, err
+	}
+
+	// Load emissions into rtree for fast searching
+	emis := NewEmissions()
+	for _, fname := range files {
+		if c != nil {
+			c <- fmt.Sprintf("Loading emissions file: %s.", fname)
+		}
+		ext := strings.ToLower(filepath.Ext(fname))
+		if ext == "" {
+			fname += ".shp"
+			ext = ".shp"
+		}
+		read, ok := emissionsReaders[ext]
+		if !ok {
+			return nil, fmt.Errorf("inmap: emissions file '%s' has unsupported file type '%s'", fname, ext)
+		}
+		recs, sr, err := read(fname, columns)
+		if err != nil {
+			return nil, err
+		}
+		trans, err := sr.NewTransform(gridSR)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem creating a spatial reprojector for "+
+				"the emissions file '%s'. The error message was %v.", fname, err)
+		}
+		for _, e := range recs {
+			e.Geom, err = e.Transform(trans)
+			if err != nil {
+				return nil, fmt.Errorf("there was a problem spatially reprojecting in "+
+					"emissions file %s. The error message was %v", fname, err)
+			}
+
+			e.VOC *= emisConv
+			e.NOx *= emisConv
+			e.NH3 *= emisConv
+			e.SOx *= emisConv
+			e.PM25 *= emisConv
+
+			if math.IsNaN(e.Height) {
+				e.Height = 0.
+			}
+			if math.IsNaN(e.Diam) {
+				e.Diam = 0.
+			}
+			if math.IsNaN(e.Temp) {
+				e.Temp = 0.
+			}
+			if math.IsNaN(e.Velocity) {
+				e.Velocity = 0.
+			}
+
+			mp, ok := e.Geom.(geom.MultiPoint)
+			if !ok {
+				emis.Add(e)
+				continue
+			}
+			frac := 1 / float64(len(mp))
+			for _, p := range mp {
+				ep := *e
+				ep.Geom = p
+				ep.VOC *= frac
+				ep.NOx *= frac
+				ep.NH3 *= frac
+				ep.SOx *= frac
+				ep.PM25 *= frac
+				emis.Add(&ep)
+			}
+		}
+	}
+	return emis, nil
+}
+
+// emissionUnitTerms are the mass and time units that can be used in
+// emissions unit expressions, in SI units.
+var emissionUnitTerms = map[string]struct {
+	value float64
+	dims  unit.Dimensions
+}{
+	"ug":         {1.e-9, unit.Kilogram},
+	"μg":         {1.e-9, unit.Kilogram}, // Greek mu
+	"µg":         {1.e-9, unit.Kilogram}, // micro sign
+	"mg":         {1.e-6, unit.Kilogram},
+	"g":          {1.e-3, unit.Kilogram},
+	"kg":         {1, unit.Kilogram},
+	"Mg":         {1.e3, unit.Kilogram},
+	"t":          {1.e3, unit.Kilogram},
+	"tonne":      {1.e3, unit.Kilogram},
+	"tonnes":     {1.e3, unit.Kilogram},
+	"metric_ton": {1.e3, unit.Kilogram},
+	"ton":        {907.18474, unit.Kilogram}, // short ton
+	"tons":       {907.18474, unit.Kilogram},
+	"short_ton":  {907.18474, unit.Kilogram},
+	"lb":         {0.45359237, unit.Kilogram},
+	"lbs":        {0.45359237, unit.Kilogram},
+	"s":          {1, unit.Second},
+	"sec":        {1, unit.Second},
+	"second":     {1, unit.Second},
+	"min":        {60, unit.Second},
+	"minute":     {60, unit.Second},
+	"h":          {3600, unit.Second},
+	"hr":         {3600, unit.Second},
+	"hour":       {3600, unit.Second},
+	"d":          {3600 * 24, unit.Second},
+	"day":        {3600 * 24, unit.Second},
+	"yr":         {3600 * 8760, unit.Second},
+	"year":       {3600 * 8760, unit.Second},
+}
+
+// ParseEmissionUnits returns the factor for converting emissions
+// in the specified units to μg/s. units is an expression of mass per time,
+// such as "tons/year", "kg/yr", "lb/hr", "g s^-1", or "μg/s", where terms
+// are separated by "/", "*", or spaces and may be followed by an integer
+// exponent after "^". Recognized terms include numbers; the mass units
+// ug (or μg), mg, g, kg, Mg, t (or tonne), ton (short tons), and lb;
+// and the time units s, min, h (or hr), day, and year (365 days).
+// Unit names can also be plural (e.g., "years") or capitalized
+// (e.g., "Year"). Because "mg" is milligrams, any capitalized form
+// of it (e.g., "Mg" or "MG") is megagrams.
+func ParseEmissionUnits(units string) (float64, error) {
+	u := unit.New(1, unit.Dimless)
+	for i, part := range strings.Split(units, "/") {
+		terms := strings.FieldsFunc(part, func(r rune) bool {
+			return r == '*' || r == '·' || unicode.IsSpace(r)
+		})
+		if len(terms) == 0 {
+			return 0, fmt.Errorf("inmap: invalid emissions units '%s'", units)
+		}
+		for _, term := range terms {
+			v, err := parseEmissionUnitTerm(term)
+			if err != nil {
+				return 0, fmt.Errorf("inmap: invalid emissions units '%s': %v", units, err)
+			}
+			if i == 0 {
+				u = unit.Mul(u, v)
+			} else {
+				u = unit.Div(u, v)
+			}
+		}
+	}
+	massPerTime := unit.Dimensions{unit.MassDim: 1, unit.TimeDim: -1}
+	if !u.Dimensions().Matches(massPerTime) {
+		return 0, fmt.Errorf("inmap: emissions units '%s' are not units of mass per time", units)
+	}
+	const massConv = 1.e9 // μg per kg
+	return u.Value() * massConv, nil
+}
+
+// parseEmissionUnitTerm parses a single term of an emissions unit expression,
+// as described in ParseEmissionUnits.
+func parseEmissionUnitTerm(term string) (*unit.Unit, error) {
+	exp := 1
+	if i := strings.Index(term, "^"); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(term[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid exponent in '%s'", term)
+		}
+		term = term[:i]
+	}
+	var base *unit.Unit
+	if v, err := strconv.ParseFloat(term, 64); err == nil {
+		base = unit.New(v, unit.Dimless)
+	} else {
+		t, ok := emissionUnitTerms[term]
+		if !ok {
+			t, ok = emissionUnitTerms[strings.TrimSuffix(term, "s")]
+		}
+		if !ok {
+			lower := strings.ToLower(term)
+			if strings.TrimSuffix(lower, "s") == "mg" {
+				// Only lowercase "mg" is milligrams; other capitalizations
+				// such as "MG" are the inventory convention for megagrams.
+				t, ok = emissionUnitTerms["Mg"], true
+			} else if t, ok = emissionUnitTerms[lower]; !ok {
+				t, ok = emissionUnitTerms[strings.TrimSuffix(lower, "s")]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown unit '%s'", term)
+		}
+		base = unit.New(t.value, t.dims)
+	}
+	u := unit.New(1, unit.Dimless)
+	for i := 0; i < exp; i++ {
+		u = unit.Mul(u, base)
+	}
+	for i := 0; i > exp; i-- {
+		u = unit.Div(u, base)
+	}
+	return u, nil
+}
+
+// wgs84 returns the WGS84 longitude-latitude spatial reference.
+func wgs84() (*proj.SR, error) {
+	return proj.Parse("+proj=longlat +datum=WGS84")
+}
+
+// readEmissionsShapefile reads emissions from a shapefile, whose
+// spatial reference is specified in the accompanying ".prj" file.
+func readEmissionsShapefile(fname string, columns EmissionsColumns) ([]*EmisRecord, *proj.SR, error) {
+	f, err := shp.NewDecoder(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("there was a problem reading the emissions shapefile '%s'. "+
+			"The error message was %v.", fname, err)
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		return nil, nil, fmt.Errorf("there was a problem reading the projection information for "+
+			"the emissions shapefile '%s'. The error message was %v.", fname, err)
+	}
+	fields := f.Reader.Fields()
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.String()
+	}
+	var recs []*EmisRecord
+	for {
+		g, data, more := f.DecodeRowFields(names...)
+		if !more {
+			break
+		}
+		attributes := make(map[string]interface{}, len(data))
+		for name, v := range data {
+			attributes[strings.ToLower(name)] = v
+		}
+		e, err := columns.record(g, attributes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v in emissions shapefile %s", err, fname)
+		}
+		recs = append(recs, e)
+	}
+	if err := f.Error(); err != nil {
+		return nil, nil, fmt.Errorf("problem reading emissions shapefile."+
+			"\nfile: %s\nerror: %v", fname, err)
+	}
+	return recs, sr, nil
+}
+
+// readEmissionsCSV reads emissions from a CSV file with a header row.
+// The geometry of each record is either specified as well-known text
+// in the WKT column or as a point in the Longitude and Latitude columns.
+// The spatial reference is read from a ".prj" file with the same
+// name as the CSV file if one exists; otherwise it is assumed to be
+// WGS84 longitude-latitude.
+func readEmissionsCSV(fname string, columns EmissionsColumns) ([]*EmisRecord, *proj.SR, error) {
+	var sr *proj.SR
+	prj, err := ioutil.ReadFile(strings.TrimSuffix(fname, filepath.Ext(fname)) + ".prj")
+	if os.IsNotExist(err) {
+		sr, err = wgs84()
+	} else if err == nil {
+		sr, err = proj.Parse(string(prj))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading projection for emissions file %s: %v", fname, err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: opening emissions file: %v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading header of emissions file %s: %v", fname, err)
+	}
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+	index := func(field string) int {
+		name, _ := columns.column(field)
+		for i, h := range header {
+			if h == name {
+				return i
+			}
+		}
+		return -1
+	}
+	iWKT, iLon, iLat := index("WKT"), index("Longitude"), index("Latitude")
+	if iWKT < 0 && (iLon < 0 || iLat < 0) {
+		wktCol, _ := columns.column("WKT")
+		lonCol, _ := columns.column("Longitude")
+		latCol, _ := columns.column("Latitude")
+		return nil, nil, fmt.Errorf("inmap: emissions file %s must have either a '%s' column "+
+			"or '%s' and '%s' columns", fname, wktCol, lonCol, latCol)
+	}
+
+	var recs []*EmisRecord
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+		}
+		var g geom.Geom
+		if iWKT >= 0 {
+			g, err = parseWKT(row[iWKT])
+		} else {
+			var p geom.Point
+			if p.X, err = strconv.ParseFloat(strings.TrimSpace(row[iLon]), 64); err == nil {
+				p.Y, err = strconv.ParseFloat(strings.TrimSpace(row[iLat]), 64)
+			}
+			g = p
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("inmap: emissions file %s line %d: invalid geometry: %v", fname, line, err)
+		}
+		attributes := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			attributes[header[i]] = v
+		}
+		e, err := columns.record(g, attributes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v in emissions file %s line %d", err, fname, line)
+		}
+		recs = append(recs, e)
+	}
+	return recs, sr, nil
+}
+
+// readEmissionsGeoJSON reads emissions from a GeoJSON file. Following
+// RFC 7946, the spatial reference is assumed to be WGS84
+// longitude-latitude unless a different one is specified in the "crs"
+// member, as in the GeoJSON files written by InMAP.
+func readEmissionsGeoJSON(fname string, columns EmissionsColumns) ([]*EmisRecord, *proj.SR, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: opening emissions file: %v", err)
+	}
+	defer f.Close()
+	var fc struct {
+		CRS *struct {
+			Properties struct {
+				Name string `json:"name"`
+			} `json:"properties"`
+		} `json:"crs"`
+		Features []struct {
+			Geometry *struct {
+				Type        string      `json:"type"`
+				Coordinates interface{} `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+	}
+
+	var sr *proj.SR
+	if fc.CRS == nil || strings.Contains(fc.CRS.Properties.Name, "CRS84") ||
+		strings.HasSuffix(fc.CRS.Properties.Name, "4326") {
+		sr, err = wgs84()
+	} else {
+		sr, err = proj.Parse(fc.CRS.Properties.Name)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading projection for emissions file %s: %v", fname, err)
+	}
+
+	recs := make([]*EmisRecord, 0, len(fc.Features))
+	for i, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		c, err := geoJSONInputCoordinates(feature.Geometry.Coordinates)
+		if err != nil {
+			return nil, nil, fmt.Errorf("inmap: emissions file %s feature %d: %v", fname, i, err)
+		}
+		g, err := c.geometry(feature.Geometry.Type)
+		if err != nil {
+			return nil, nil, fmt.Errorf("inmap: emissions file %s feature %d: %v", fname, i, err)
+		}
+		attributes := make(map[string]interface{}, len(feature.Properties))
+		for name, v := range feature.Properties {
+			attributes[strings.ToLower(name)] = v
+		}
+		e, err := columns.record(g, attributes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v in emissions file %s feature %d", err, fname, i)
+		}
+		recs = append(recs, e)
+	}
+	return recs, sr, nil
+}
+
+// coordinates is a nested list of coordinates, as found in GeoJSON and
+// well-known text (WKT) geometries. Either point or children is set.
+type coordinates struct {
+	point    []float64
+	children []coordinates
+}
+
+// geoJSONInputCoordinates converts the decoded "coordinates" member
+// of a GeoJSON geometry to coordinates.
+func geoJSONInputCoordinates(v interface{}) (coordinates, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return coordinates{}, fmt.Errorf("invalid coordinates %v", v)
+	}
+	var c coordinates
+	for _, item := range list {
+		if n, ok := item.(json.Number); ok {
+			x, err := n.Float64()
+			if err != nil {
+				return coordinates{}, err
+			}
+			c.point = append(c.point, x)
+			continue
+		}
+		child, err := geoJSONInputCoordinates(item)
+		if err != nil {
+			return coordinates{}, err
+		}
+		c.children = append(c.children, child)
+	}
+	return c, nil
+}
+
+// toPoint converts c to a point, ignoring any Z or M values.
+func (c coordinates) toPoint() (geom.Point, error) {
+	if c.point == nil && len(c.children) == 1 {
+		return c.children[0].toPoint() // WKT points in parentheses.
+	}
+	if len(c.point) < 2 {
+		return geom.Point{}, fmt.Errorf("invalid point coordinates")
+	}
+	return geom.Point{X: c.point[0], Y: c.point[1]}, nil
+}
+
+// toPoints converts the children of c to points.
+func (c coordinates) toPoints() ([]geom.Point, error) {
+	pts := make([]geom.Point, len(c.children))
+	for i, child := range c.children {
+		var err error
+		if pts[i], err = child.toPoint(); err != nil {
+			return nil, err
+		}
+	}
+	return pts, nil
+}
+
+// toPolygon converts the children of c to a polygon.
+func (c coordinates) toPolygon() (geom.Polygon, error) {
+	poly := make(geom.Polygon, len(c.children))
+	for i, ring := range c.children {
+		var err error
+		if poly[i], err = ring.toPoints(); err != nil {
+			return nil, err
+		}
+	}
+	return poly, nil
+}
+
+// geometry converts c to a geometry of the given GeoJSON or WKT type.
+func (c coordinates) geometry(geomType string) (geom.Geom, error) {
+	switch strings.ToLower(geomType) {
+	case "point":
+		return c.toPoint()
+	case "multipoint":
+		pts, err := c.toPoints()
+		return geom.MultiPoint(pts), err
+	case "linestring":
+		pts, err := c.toPoints()
+		return geom.LineString(pts), err
+	case "multilinestring":
+		ml := make(geom.MultiLineString, len(c.children))
+		for i, child := range c.children {
+			pts, err := child.toPoints()
+			if err != nil {
+				return nil, err
+			}
+			ml[i] = pts
+		}
+		return ml, nil
+	case "polygon":
+		return c.toPolygon()
+	case "multipolygon":
+		mp := make(geom.MultiPolygon, len(c.children))
+		for i, child := range c.children {
+			var err error
+			if mp[i], err = child.toPolygon(); err != nil {
+				return nil, err
+			}
+		}
+		return mp, nil
+	default:
+		return nil, fmt.Errorf("unsupported geometry type '%s'", geomType)
+	}
+}
+
+// parseWKT parses a geometry in well-known text (WKT) format.
+// Z and M values are ignored.
+func parseWKT(s string) (geom.Geom, error) {
+	s = strings.TrimSpace(s)
+	i := strings.Index(s, "(")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid WKT geometry '%s'", s)
+	}
+	// The geometry type may be followed by Z, M, or ZM.
+	typeFields := strings.Fields(s[:i])
+	if len(typeFields) == 0 {
+		return nil, fmt.Errorf("invalid WKT geometry '%s'", s)
+	}
+	p := &wktParser{s: s, pos: i}
+	c, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WKT geometry '%s': %v", s, err)
+	}
+	if strings.TrimSpace(p.s[p.pos:]) != "" {
+		return nil, fmt.Errorf("invalid WKT geometry '%s': unexpected text after geometry", s)
+	}
+	return c.geometry(typeFields[0])
+}
+
+// wktParser parses the coordinates of a WKT geometry.
+type wktParser struct {
+	s   string
+	pos int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// parse parses either a parenthesized, comma-separated list of
+// coordinates or a single point consisting of space-separated numbers.
+func (p *wktParser) parse() (coordinates, error) {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == '(' {
+		p.pos++
+		var c coordinates
+		for {
+			child, err := p.parse()
+			if err != nil {
+				return c, err
+			}
+			c.children = append(c.children, child)
+			p.skipSpace()
+			if p.pos >= len(p.s) {
+				return c, fmt.Errorf("missing ')'")
+			}
+			p.pos++
+			if p.s[p.pos-1] == ')' {
+				return c, nil
+			} else if p.s[p.pos-1] != ',' {
+				return c, fmt.Errorf("unexpected character '%c'", p.s[p.pos-1])
+			}
+		}
+	}
+	end := strings.IndexAny(p.s[p.pos:], ",)")
+	if end < 0 {
+		return coordinates{}, fmt.Errorf("missing ')'")
+	}
+	var c coordinates
+	for _, f := range strings.Fields(p.s[p.pos : p.pos+end]) {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return c, err
+		}
+		c.point = append(c.point, v)
+	}
+	p.pos += end
+	return c, nil
+}
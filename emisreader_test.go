@@ -0,0 +1,299 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+func TestParseEmissionUnits(t *testing.T) {
+	const tonsPerYear = 907184740000. / (3600. * 8760.)
+	tests := []struct {
+		units string
+		conv  float64
+		err   bool
+	}{
+		{units: "tons/year", conv: tonsPerYear},
+		{units: "kg/year", conv: 1.e9 / (3600. * 8760.)},
+		{units: "ug/s", conv: 1},
+		{units: "μg/s", conv: 1},
+		{units: "Tons / Years", conv: tonsPerYear},
+		{units: "lb/hr", conv: 0.45359237e9 / 3600},
+		{units: "g s^-1", conv: 1.e6},
+		{units: "Mg/day", conv: 1.e12 / (3600 * 24)},
+		{units: "MG/yr", conv: 1.e12 / (3600. * 8760.)},
+		{units: "MGs/Year", conv: 1.e12 / (3600. * 8760.)},
+		{units: "mg/s", conv: 1.e3},
+		{units: "mgs/s", conv: 1.e3},
+		{units: "1000 kg/yr", conv: 1.e12 / (3600. * 8760.)},
+		{units: "kg*s^-1", conv: 1.e9},
+		{units: "kg", err: true},
+		{units: "m/s", err: true},
+		{units: "furlongs/fortnight", err: true},
+		{units: "kg/", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.units, func(t *testing.T) {
+			conv, err := ParseEmissionUnits(test.units)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got conversion factor %g", conv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if different(conv, test.conv, 1.e-10) {
+				t.Errorf("%g != %g", conv, test.conv)
+			}
+		})
+	}
+}
+
+// Test whether emissions read from CSV, GeoJSON, and GeoPackage files
+// with custom column names match emissions read from a shapefile.
+func TestReadEmissionsFormats(t *testing.T) {
+	const tol = 1.e-8
+	if err := WriteTestEmis(); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteShapefile(TestEmisFilename)
+	sr, err := proj.Parse(TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emis, err := ReadEmissionShapefiles(sr, "tons/year", nil, TestEmisFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := emis.EmisRecords()
+
+	conv, err := ParseEmissionUnits("kg/year")
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := EmissionsColumns{"VOC": "voc_kg", "PM25": "PM25_KG", "Height": "stack_height"}
+	data := &OutputData{
+		SR:        sr,
+		Variables: []string{"NH3", "NOx", "PM25_KG", "SOx", "stack_height", "voc_kg"},
+		Values:    make(map[string][]float64),
+	}
+	csv := "WKT,voc_kg,NOx,NH3,SOx,PM25_KG,stack_height\n"
+	for _, e := range want {
+		data.Polygons = append(data.Polygons, e.Geom.(geom.Polygonal))
+		for _, v := range []struct {
+			name string
+			val  float64
+		}{
+			{"NH3", e.NH3 / conv}, {"NOx", e.NOx / conv}, {"PM25_KG", e.PM25 / conv},
+			{"SOx", e.SOx / conv}, {"stack_height", e.Height}, {"voc_kg", e.VOC / conv},
+		} {
+			data.Values[v.name] = append(data.Values[v.name], v.val)
+		}
+		var polys []string
+		for _, poly := range e.Geom.(geom.Polygonal).Polygons() {
+			var rings []string
+			for _, r := range poly {
+				pts := make([]string, len(r))
+				for i, p := range r {
+					pts[i] = fmt.Sprintf("%g %g", p.X, p.Y)
+				}
+				rings = append(rings, "("+strings.Join(pts, ", ")+")")
+			}
+			polys = append(polys, "("+strings.Join(rings, ", ")+")")
+		}
+		csv += fmt.Sprintf("\"MULTIPOLYGON (%s)\",%g,%g,%g,%g,%g,%g\n", strings.Join(polys, ", "),
+			e.VOC/conv, e.NOx/conv, e.NH3/conv, e.SOx/conv, e.PM25/conv, e.Height)
+	}
+
+	files := []string{"testEmisCSV.csv", "testEmisCSV.prj", "testEmis.geojson", "testEmis.gpkg"}
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	if err := ioutil.WriteFile("testEmisCSV.csv", []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("testEmisCSV.prj", []byte(TestGridSR), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGeoJSON("testEmis.geojson", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGeoPackage("testEmis.gpkg", data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{"testEmisCSV.csv", "testEmis.geojson", "testEmis.gpkg"} {
+		t.Run(file, func(t *testing.T) {
+			emis, err := ReadEmissions(sr, "kg/year", columns, nil, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have := emis.EmisRecords()
+			if len(have) != len(want) {
+				t.Fatalf("%d records != %d", len(have), len(want))
+			}
+			for i, h := range have {
+				w := want[i]
+				for j, v := range h.fields() {
+					if different(*v, *w.fields()[j], tol) {
+						t.Errorf("record %d %s: %g != %g", i, emisFields[j], *v, *w.fields()[j])
+					}
+				}
+				hb, wb := h.Bounds(), w.Bounds()
+				if math.Abs(hb.Min.X-wb.Min.X) > 1.e-6 || math.Abs(hb.Max.Y-wb.Max.Y) > 1.e-6 {
+					t.Errorf("record %d bounds: %v != %v", i, hb, wb)
+				}
+			}
+		})
+	}
+
+	t.Run("missing column", func(t *testing.T) {
+		_, err := ReadEmissions(sr, "kg/year", EmissionsColumns{"NOx": "nox_kg"}, nil, "testEmisCSV.csv")
+		if err == nil {
+			t.Error("expected an error for a missing column")
+		}
+	})
+	t.Run("invalid field", func(t *testing.T) {
+		_, err := ReadEmissions(sr, "kg/year", EmissionsColumns{"CO": "co"}, nil, "testEmisCSV.csv")
+		if err == nil {
+			t.Error("expected an error for an invalid field")
+		}
+	})
+}
+
+func TestReadEmissionsCSVPoints(t *testing.T) {
+	sr, err := proj.Parse(TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const fileName = "testEmisPoints.csv"
+	defer os.Remove(fileName)
+
+	// The grid projection is centered on 97°W, 40°N, and points
+	// without a projection file are assumed to be longitude-latitude.
+	if err := ioutil.WriteFile(fileName, []byte("Longitude,Latitude,PM2_5\n-97,40,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emis, err := ReadEmissions(sr, "ug/s", EmissionsColumns{"Longitude": "longitude", "Latitude": "latitude"}, nil, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := emis.EmisRecords()
+	if len(recs) != 1 {
+		t.Fatalf("%d records != 1", len(recs))
+	}
+	p := recs[0].Geom.(geom.Point)
+	if math.Abs(p.X) > 1.e-6 || math.Abs(p.Y) > 1.e-6 {
+		t.Errorf("point should be at the grid origin but is at %v", p)
+	}
+	if recs[0].PM25 != 2 {
+		t.Errorf("PM2.5: %g != 2", recs[0].PM25)
+	}
+
+	// Multipoint emissions should be divided among the points.
+	if err := ioutil.WriteFile(fileName, []byte("wkt,PM2_5\n\"MULTIPOINT ((-97 40), (-96 41))\",2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emis, err = ReadEmissions(sr, "ug/s", nil, nil, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs = emis.EmisRecords()
+	if len(recs) != 2 {
+		t.Fatalf("%d records != 2", len(recs))
+	}
+	for i, r := range recs {
+		if _, ok := r.Geom.(geom.Point); !ok {
+			t.Errorf("record %d geometry type %T", i, r.Geom)
+		}
+		if r.PM25 != 1 {
+			t.Errorf("record %d PM2.5: %g != 1", i, r.PM25)
+		}
+	}
+
+	// Source tags should be read from the tag column.
+	if err := ioutil.WriteFile(fileName, []byte("lon,lat,PM2_5,Sector\n-97,40,2, cars \n-96,41,1,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emis, err = ReadEmissions(sr, "ug/s", EmissionsColumns{"Tag": "sector"}, nil, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs = emis.EmisRecords()
+	if len(recs) != 2 {
+		t.Fatalf("%d records != 2", len(recs))
+	}
+	if recs[0].Tag != "cars" || recs[1].Tag != "" {
+		t.Errorf("tags: %q, %q != \"cars\", \"\"", recs[0].Tag, recs[1].Tag)
+	}
+}
+
+func TestParseWKT(t *testing.T) {
+	tests := []struct {
+		wkt  string
+		want geom.Geom
+	}{
+		{wkt: "POINT (1 2)", want: geom.Point{X: 1, Y: 2}},
+		{wkt: "point z (1 2 3)", want: geom.Point{X: 1, Y: 2}},
+		{wkt: "MULTIPOINT (1 2, 3 4)", want: geom.MultiPoint{{X: 1, Y: 2}, {X: 3, Y: 4}}},
+		{wkt: "LINESTRING (0 0, 1 1)", want: geom.LineString{{X: 0, Y: 0}, {X: 1, Y: 1}}},
+		{
+			wkt:  "MULTILINESTRING ((0 0, 1 1), (2 2, 3 3))",
+			want: geom.MultiLineString{{{X: 0, Y: 0}, {X: 1, Y: 1}}, {{X: 2, Y: 2}, {X: 3, Y: 3}}},
+		},
+		{
+			wkt:  "POLYGON ((0 0, 1 0, 1 1, 0 0))",
+			want: geom.Polygon{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 0}}},
+		},
+		{
+			wkt: "MULTIPOLYGON (((0 0, 1 0, 1 1, 0 0)), ((2 2, 3 2, 3 3, 2 2)))",
+			want: geom.MultiPolygon{
+				{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 0}}},
+				{{{X: 2, Y: 2}, {X: 3, Y: 2}, {X: 3, Y: 3}, {X: 2, Y: 2}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		g, err := parseWKT(test.wkt)
+		if err != nil {
+			t.Errorf("%s: %v", test.wkt, err)
+			continue
+		}
+		if fmt.Sprint(g) != fmt.Sprint(test.want) {
+			t.Errorf("%s: %v != %v", test.wkt, g, test.want)
+		}
+	}
+	for _, bad := range []string{"POINT EMPTY", "POINT (1 2", "POINT (1 x)", "CIRCLE (1 2)", "POINT (1 2) 3"} {
+		if _, err := parseWKT(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
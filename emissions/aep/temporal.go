@@ -0,0 +1,315 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package aep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TemporalRef holds temporal allocation information extracted
+// from SMOKE model temporal cross-reference (ATREF) and
+// temporal profile (ATPRO) files.
+type TemporalRef struct {
+	ref map[string]map[string]interface{} // map[SCC][FIPS][3]string{monthly, weekly, diurnal code}
+
+	monthly        map[string][]float64 // map[code]weights
+	weekly         map[string][]float64
+	diurnalWeekday map[string][]float64
+	diurnalWeekend map[string][]float64
+}
+
+// NewTemporalRef returns a new TemporalRef variable created from the
+// information in the given temporal cross-reference (ref) and
+// temporal profile (pro) readers.
+//
+// Cross-reference records should be in the format
+// SCC;MonthlyCode;WeeklyCode;DiurnalCode;Pollutant;FIPS, where semicolons
+// can be replaced by commas. Records with a blank or zero FIPS code apply to
+// all locations. Records that are specific to a single pollutant are ignored,
+// because emissions records in InMAP share a single temporal profile
+// among all pollutants.
+//
+// The profile file should contain /MONTHLY/, /WEEKLY/, /DIURNAL WEEKDAY/, and
+// optionally /DIURNAL WEEKEND/ sections, where each line contains a profile code
+// followed by 12 monthly, 7 daily (beginning on Monday), or 24 hourly weights,
+// separated by whitespace, and optionally the sum of the weights.
+func NewTemporalRef(ref, pro io.Reader) (*TemporalRef, error) {
+	tr := new(TemporalRef)
+	var err error
+	tr.ref, err = temporalRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if err = tr.temporalPro(pro); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// TemporalProfile specifies how emissions are distributed in time.
+// Each field contains the fraction of emissions that occur in each
+// month of the year, day of the week (beginning on Monday), or hour of the day.
+type TemporalProfile struct {
+	Monthly        [12]float64
+	Weekly         [7]float64
+	DiurnalWeekday [24]float64
+	DiurnalWeekend [24]float64
+}
+
+// Factor returns the ratio between the emissions rate at time t and
+// the annual average emissions rate. Time t should be in the time zone of
+// the emissions source.
+func (p *TemporalProfile) Factor(t time.Time) float64 {
+	year := t.Year()
+	daysInYear := float64(time.Date(year, time.December, 31, 0, 0, 0, 0, t.Location()).YearDay())
+	daysInMonth := float64(time.Date(year, t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day())
+
+	monthly := p.Monthly[t.Month()-1] * daysInYear / daysInMonth
+
+	day := (int(t.Weekday()) + 6) % 7 // Monday is day zero.
+	weekly := p.Weekly[day] * 7
+
+	diurnal := p.DiurnalWeekday[t.Hour()] * 24
+	if day >= 5 {
+		diurnal = p.DiurnalWeekend[t.Hour()] * 24
+	}
+	return monthly * weekly * diurnal
+}
+
+// Profile returns the temporal profile that matches the given SCC
+// and FIPS location codes.
+// If partialMatch is false, only profiles exactly matching the given
+// SCC and FIPS will be returned, otherwise if no match is found an attempt
+// will be made to return a profile matching a more general SCC and FIPS.
+func (tr *TemporalRef) Profile(SCC, FIPS string, partialMatch bool) (*TemporalProfile, error) {
+	FIPS = temporalFIPS(FIPS)
+	var codes interface{}
+	if !partialMatch {
+		var ok bool
+		codes, ok = tr.ref[SCC][FIPS]
+		if !ok {
+			return nil, fmt.Errorf("aep: no temporal profile exactly matching SCC '%s' and FIPS '%s'", SCC, FIPS)
+		}
+	} else {
+		var err error
+		_, _, codes, err = MatchCodeDouble(SCC, FIPS, tr.ref)
+		if err != nil {
+			return nil, fmt.Errorf("aep: no temporal profile partially matching SCC '%s' and FIPS '%s'", SCC, FIPS)
+		}
+	}
+	c := codes.([3]string)
+
+	p := new(TemporalProfile)
+	monthly, ok := tr.monthly[c[0]]
+	if !ok {
+		return nil, fmt.Errorf("aep: missing monthly temporal profile '%s'", c[0])
+	}
+	copy(p.Monthly[:], monthly)
+	weekly, ok := tr.weekly[c[1]]
+	if !ok {
+		return nil, fmt.Errorf("aep: missing weekly temporal profile '%s'", c[1])
+	}
+	copy(p.Weekly[:], weekly)
+	weekday, ok := tr.diurnalWeekday[c[2]]
+	if !ok {
+		return nil, fmt.Errorf("aep: missing diurnal temporal profile '%s'", c[2])
+	}
+	copy(p.DiurnalWeekday[:], weekday)
+	if weekend, ok := tr.diurnalWeekend[c[2]]; ok {
+		copy(p.DiurnalWeekend[:], weekend)
+	} else {
+		p.DiurnalWeekend = p.DiurnalWeekday
+	}
+	return p, nil
+}
+
+// TemporalRecord is a Record with a temporal profile attached.
+type TemporalRecord struct {
+	Record
+	Profile *TemporalProfile
+}
+
+// TemporalProfile returns the temporal profile associated with the receiver.
+func (r *TemporalRecord) TemporalProfile() *TemporalProfile { return r.Profile }
+
+// AttachProfiles returns copies of the given records wrapped as TemporalRecords,
+// with the temporal profile matching each record's SCC and FIPS code
+// attached. Records with identical profile codes share the same profile.
+// partialMatch has the same meaning as in Profile.
+func (tr *TemporalRef) AttachProfiles(recs []Record, partialMatch bool) ([]Record, error) {
+	profiles := make(map[string]*TemporalProfile)
+	o := make([]Record, len(recs))
+	for i, r := range recs {
+		key := r.GetSCC() + "," + temporalFIPS(r.GetFIPS())
+		p, ok := profiles[key]
+		if !ok {
+			var err error
+			p, err = tr.Profile(r.GetSCC(), r.GetFIPS(), partialMatch)
+			if err != nil {
+				return nil, err
+			}
+			profiles[key] = p
+		}
+		o[i] = &TemporalRecord{Record: r, Profile: p}
+	}
+	return o, nil
+}
+
+// temporalFIPS converts a FIPS code to the five-digit format used in
+// temporal cross-reference files, where "00000" matches all locations.
+func temporalFIPS(FIPS string) string {
+	FIPS = strings.TrimSpace(FIPS)
+	if len(FIPS) > 5 { // Remove the country code.
+		FIPS = FIPS[len(FIPS)-5:]
+	}
+	if len(FIPS) < 5 {
+		FIPS = strings.Repeat("0", 5-len(FIPS)) + FIPS
+	}
+	return FIPS
+}
+
+// temporalRef reads the SMOKE ATREF file, which maps SCC and FIPS codes
+// to temporal profiles.
+func temporalRef(fid io.Reader) (map[string]map[string]interface{}, error) {
+	ref := make(map[string]map[string]interface{})
+	// map[SCC][FIPS][3]string{monthly, weekly, diurnal}
+	buf := bufio.NewReader(fid)
+	for {
+		record, err := buf.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				if record == "" {
+					break
+				}
+			} else {
+				return nil, err
+			}
+		}
+		// Get rid of comments at end of line.
+		if i := strings.Index(record, "!"); i != -1 {
+			record = record[0:i]
+		}
+		record = strings.TrimSpace(record)
+		if record == "" || record[0] == '#' || record[0] == '/' {
+			continue
+		}
+		splitChar := ";"
+		if !strings.Contains(record, splitChar) {
+			if strings.Contains(record, ",") { // Use commas instead.
+				splitChar = ","
+			} else {
+				return nil, fmt.Errorf("aep: TemporalRef record %v doesn't have any semicolons or commas for splitting", record)
+			}
+		}
+		splitLine := strings.Split(record, splitChar)
+		for i, s := range splitLine {
+			splitLine[i] = strings.Trim(strings.TrimSpace(s), "\"")
+		}
+		if len(splitLine) < 4 {
+			return nil, fmt.Errorf("aep: TemporalRef record %v has fewer than 4 fields", record)
+		}
+		if len(splitLine) > 4 && splitLine[4] != "" {
+			continue // Pollutant-specific profiles are not supported.
+		}
+		SCC := splitLine[0]
+		if len(SCC) == 8 {
+			SCC = "00" + SCC
+		}
+		if SCC == "" || SCC == "0" {
+			SCC = "0000000000"
+		}
+		var FIPS string
+		if len(splitLine) > 5 {
+			FIPS = splitLine[5]
+		}
+		FIPS = temporalFIPS(FIPS)
+		if _, ok := ref[SCC]; !ok {
+			ref[SCC] = make(map[string]interface{})
+		}
+		ref[SCC][FIPS] = [3]string{splitLine[1], splitLine[2], splitLine[3]}
+	}
+	return ref, nil
+}
+
+// temporalPro reads the SMOKE ATPRO file, which contains the
+// monthly, weekly, and diurnal temporal profiles.
+func (tr *TemporalRef) temporalPro(fid io.Reader) error {
+	tr.monthly = make(map[string][]float64)
+	tr.weekly = make(map[string][]float64)
+	tr.diurnalWeekday = make(map[string][]float64)
+	tr.diurnalWeekend = make(map[string][]float64)
+
+	var section map[string][]float64
+	var n int
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		record := scanner.Text()
+		if i := strings.Index(record, "!"); i != -1 {
+			record = record[0:i]
+		}
+		record = strings.TrimSpace(record)
+		if record == "" || record[0] == '#' {
+			continue
+		}
+		if record[0] == '/' {
+			switch strings.ToUpper(record) {
+			case "/MONTHLY/":
+				section, n = tr.monthly, 12
+			case "/WEEKLY/":
+				section, n = tr.weekly, 7
+			case "/DIURNAL WEEKDAY/":
+				section, n = tr.diurnalWeekday, 24
+			case "/DIURNAL WEEKEND/":
+				section, n = tr.diurnalWeekend, 24
+			default:
+				section = nil
+			}
+			continue
+		}
+		if section == nil {
+			continue
+		}
+		fields := strings.Fields(record)
+		if len(fields) < n+1 {
+			return fmt.Errorf("aep: temporal profile record '%s' has %d weights; it should have %d", record, len(fields)-1, n)
+		}
+		weights := make([]float64, n)
+		var sum float64
+		for i := range weights {
+			v, err := strconv.ParseFloat(fields[i+1], 64)
+			if err != nil {
+				return fmt.Errorf("aep: parsing temporal profile '%s': %v", fields[0], err)
+			}
+			weights[i] = v
+			sum += v
+		}
+		if sum <= 0 {
+			return fmt.Errorf("aep: temporal profile '%s' weights sum to %g", fields[0], sum)
+		}
+		for i := range weights {
+			weights[i] /= sum
+		}
+		section[fields[0]] = weights
+	}
+	return scanner.Err()
+}
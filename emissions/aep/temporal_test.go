@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package aep
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	temporalRefExample = `#DESC Example temporal cross-reference
+0;262;7;24;;
+2102004000;262;7;24;;06037 ! Los Angeles
+2102004000;1;5;26;;
+2102004000;1;5;26;NOX;
+`
+
+	temporalProExample = `#DESC Example temporal profiles
+/MONTHLY/
+    1    1    1    1    1    1    1    1    1    1    1    1    1   12
+  262    2    1    1    1    1    1    1    1    1    1    1    1   13
+/END/
+/WEEKLY/
+    5    1    1    1    1    1    0    0    5
+    7    1    1    1    1    1    1    1    7
+/END/
+/DIURNAL WEEKDAY/
+   24    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1    1   24
+   26    0    0    0    0    0    0    0    0    1    1    1    1    1    1    1    1    0    0    0    0    0    0    0    0    8
+/END/
+/DIURNAL WEEKEND/
+   26    0    0    0    0    0    0    0    0    0    0    0    1    1    0    0    0    0    0    0    0    0    0    0    0    2
+/END/
+`
+)
+
+func TestTemporalRef(t *testing.T) {
+	tr, err := NewTemporalRef(bytes.NewBufferString(temporalRefExample),
+		bytes.NewBufferString(temporalProExample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wednesday, January 9, 2019 at 10:00.
+	wednesday := time.Date(2019, time.January, 9, 10, 0, 0, 0, time.UTC)
+	saturday := time.Date(2019, time.January, 12, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		SCC, FIPS     string
+		partialMatch  bool
+		t             time.Time
+		factor        float64
+		expectedError bool
+	}{
+		{
+			name: "exact weekday", SCC: "2102004000", FIPS: "", t: wednesday,
+			factor: (365. / 12. / 31.) * (7. / 5.) * (24. / 8.),
+		},
+		{
+			name: "exact weekend", SCC: "2102004000", FIPS: "", t: saturday,
+			factor: (365. / 12. / 31.) * 0 * (24. / 2.),
+		},
+		{
+			name: "exact FIPS", SCC: "2102004000", FIPS: "06037", t: wednesday,
+			factor: (2. / 13. * 365. / 31.) * 1 * 1,
+		},
+		{
+			name: "partial", SCC: "2102004001", FIPS: "06001", partialMatch: true, t: wednesday,
+			factor: (365. / 12. / 31.) * (7. / 5.) * (24. / 8.),
+		},
+		{
+			name: "default", SCC: "2302002100", FIPS: "06001", partialMatch: true, t: wednesday,
+			factor: (2. / 13. * 365. / 31.) * 1 * 1,
+		},
+		{
+			name: "no exact match", SCC: "2102004001", FIPS: "06001", t: wednesday,
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := tr.Profile(test.SCC, test.FIPS, test.partialMatch)
+			if err != nil {
+				if !test.expectedError {
+					t.Fatal(err)
+				}
+				return
+			} else if test.expectedError {
+				t.Fatal("expected an error")
+			}
+			if f := p.Factor(test.t); math.Abs(f-test.factor) > 1.e-10 {
+				t.Errorf("factor: have %g, want %g", f, test.factor)
+			}
+		})
+	}
+}
+
+func TestTemporalProfileAverage(t *testing.T) {
+	tr, err := NewTemporalRef(bytes.NewBufferString(temporalRefExample),
+		bytes.NewBufferString(temporalProExample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := tr.Profile("2102004000", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The factor should average to the monthly factor
+	// over any whole number of weeks.
+	start := time.Date(2019, time.January, 7, 0, 0, 0, 0, time.UTC)
+	var sum float64
+	const hours = 24 * 7 * 3
+	for h := 0; h < hours; h++ {
+		sum += p.Factor(start.Add(time.Duration(h) * time.Hour))
+	}
+	const want = 365. / 12. / 31.
+	if avg := sum / hours; math.Abs(avg-want) > 1.e-10 {
+		t.Errorf("average factor: have %g, want %g", avg, want)
+	}
+}
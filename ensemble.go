@@ -0,0 +1,243 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/geom/proj"
+)
+
+// ScalableCellVariables are the names of the science parameters of
+// grid cells that can be perturbed using ScaleCellVariables.
+var ScalableCellVariables = []string{
+	"UDeviation", "VDeviation",
+	"AOrgPartitioning", "BOrgPartitioning", "SPartitioning", "NOPartitioning", "NHPartitioning",
+	"SO2oxidation",
+	"ParticleWetDep", "SO2WetDep", "OtherGasWetDep",
+	"ParticleDryDep", "NH3DryDep", "SO2DryDep", "VOCDryDep", "NOxDryDep",
+	"Kzz", "Kxxyy", "M2u", "M2d",
+}
+
+// ScaleCellVariables returns a function that multiplies the science
+// parameters of every grid cell, including the boundary cells, by the
+// factors in factors, which maps the names of the parameters (see
+// ScalableCellVariables) to the factors that they should be multiplied by.
+// Particle partitioning fractions are limited to a maximum of one.
+// It should be run after the grid is created and before the time step is
+// calculated. Because cells that are added later by a dynamic grid are
+// not scaled, it should only be used with static grids.
+func ScaleCellVariables(factors map[string]float64) DomainManipulator {
+	return func(d *InMAP) error {
+		names := make([]string, 0, len(factors))
+		for name, f := range factors {
+			if !isScalableCellVariable(name) {
+				return fmt.Errorf("inmap: can not scale cell variable '%s'; valid variables are %v", name, ScalableCellVariables)
+			}
+			if f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("inmap: invalid scaling factor %g for cell variable %s", f, name)
+			}
+			names = append(names, name)
+		}
+		scale := func(c *Cell) {
+			v := reflect.ValueOf(c).Elem()
+			for _, name := range names {
+				field := v.FieldByName(name)
+				val := field.Float() * factors[name]
+				if strings.HasSuffix(name, "Partitioning") {
+					val = math.Min(val, 1)
+				}
+				field.SetFloat(val)
+			}
+		}
+		for _, c := range *d.cells {
+			scale(c.Cell)
+		}
+		for _, b := range d.boundaries() {
+			for _, c := range *b {
+				scale(c.Cell)
+			}
+		}
+		for _, c := range *d.cells {
+			c.updateNeighborDiffusivity()
+		}
+		return nil
+	}
+}
+
+func isScalableCellVariable(name string) bool {
+	for _, v := range ScalableCellVariables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsembleFileName returns the name of the file holding the ensemble
+// statistic stat (e.g., "mean"), which is created by adding stat
+// before the extension of fileName.
+func EnsembleFileName(fileName, stat string) string {
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "_" + stat + ext
+}
+
+// EnsembleStatistics calculates statistics of the results of the
+// members of an ensemble of simulations, such as simulations with
+// perturbed science parameters, in each grid cell. The members may be run
+// concurrently, but all members must have the same grid.
+type EnsembleStatistics struct {
+	o *Outputter
+
+	mu      sync.Mutex
+	cells   []*Cell
+	results []map[string][]float64
+}
+
+// NewEnsembleStatistics returns an EnsembleStatistics for the output
+// variables in o.
+func (o *Outputter) NewEnsembleStatistics() *EnsembleStatistics {
+	return &EnsembleStatistics{o: o}
+}
+
+// Add returns a function that adds the results of an ensemble member,
+// calculated using memberOutputter, to the ensemble. memberOutputter may
+// differ from the Outputter used to create the receiver, for example
+// if output expressions include member-specific parameters, but it must
+// have the same output variables.
+func (e *EnsembleStatistics) Add(memberOutputter *Outputter) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.Results(memberOutputter)
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if len(e.results) == 0 {
+			e.cells = d.Cells()
+		} else {
+			for v, r := range e.results[0] {
+				if len(results[v]) != len(r) {
+					return fmt.Errorf("inmap: ensemble statistics: member has %d grid cells for %s "+
+						"instead of %d", len(results[v]), v, len(r))
+				}
+			}
+		}
+		e.results = append(e.results, results)
+		return nil
+	}
+}
+
+// Members returns the number of ensemble members that have been added.
+func (e *EnsembleStatistics) Members() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.results)
+}
+
+// Statistics returns the mean ("mean"), sample standard deviation ("std"),
+// and the requested percentiles (e.g., "p5" for the 5th percentile) of the
+// results of the members, in the form map[statistic][variable][row].
+// Percentiles are calculated using linear interpolation between members.
+func (e *EnsembleStatistics) Statistics(percentiles ...float64) (map[string]map[string][]float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.results) < 2 {
+		return nil, fmt.Errorf("inmap: ensemble statistics need at least 2 members but have %d", len(e.results))
+	}
+	for _, p := range percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("inmap: ensemble percentile %g is not between 0 and 100", p)
+		}
+	}
+	stats := map[string]map[string][]float64{
+		"mean": make(map[string][]float64),
+		"std":  make(map[string][]float64),
+	}
+	for _, p := range percentiles {
+		stats[percentileName(p)] = make(map[string][]float64)
+	}
+	n := float64(len(e.results))
+	vals := make([]float64, len(e.results))
+	for v, r := range e.results[0] {
+		for _, s := range stats {
+			s[v] = make([]float64, len(r))
+		}
+		for i := range r {
+			var mean float64
+			for j, member := range e.results {
+				vals[j] = member[v][i]
+				mean += vals[j]
+			}
+			mean /= n
+			var ss float64
+			for _, val := range vals {
+				ss += (val - mean) * (val - mean)
+			}
+			stats["mean"][v][i] = mean
+			stats["std"][v][i] = math.Sqrt(ss / (n - 1))
+			sort.Float64s(vals)
+			for _, p := range percentiles {
+				stats[percentileName(p)][v][i] = percentile(vals, p)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// percentileName returns the name of the statistic for percentile p.
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// percentile returns percentile p (0–100) of the sorted values in x.
+func percentile(x []float64, p float64) float64 {
+	pos := p / 100 * float64(len(x)-1)
+	i := int(math.Floor(pos))
+	if i >= len(x)-1 {
+		return x[len(x)-1]
+	}
+	frac := pos - float64(i)
+	return x[i] + frac*(x[i+1]-x[i])
+}
+
+// Output writes each of the ensemble statistics (see Statistics) to a file
+// whose name is created from the Outputter file name using EnsembleFileName.
+// sr is the spatial reference of the model grid.
+func (e *EnsembleStatistics) Output(sr *proj.SR, percentiles ...float64) error {
+	stats, err := e.Statistics(percentiles...)
+	if err != nil {
+		return err
+	}
+	for stat, results := range stats {
+		o := *e.o
+		o.fileName = EnsembleFileName(e.o.fileName, stat)
+		if err := o.writeCells(e.cells, results, sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScaleCellVariables(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	var m Mech
+
+	newDomain := func(t *testing.T, factors map[string]float64) (*InMAP, error) {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), m),
+				ScaleCellVariables(factors),
+			},
+		}
+		return d, d.Init()
+	}
+	base, err := newDomain(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDomain(t, map[string]float64{"Kzz": 2, "SPartitioning": 1.e6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range d.Cells() {
+		b := base.Cells()[i]
+		if different(c.Kzz, b.Kzz*2, 1.e-10) {
+			t.Errorf("cell %d: Kzz %g != %g", i, c.Kzz, b.Kzz*2)
+		}
+		if b.SPartitioning > 0 && c.SPartitioning != 1 {
+			t.Errorf("cell %d: SPartitioning should be limited to 1 but is %g", i, c.SPartitioning)
+		}
+		if c.Kxxyy != b.Kxxyy {
+			t.Errorf("cell %d: Kxxyy should not change: %g != %g", i, c.Kxxyy, b.Kxxyy)
+		}
+		for _, n := range *c.above {
+			if n.boundary && n.info.diff != n.Kzz {
+				t.Errorf("cell %d: top boundary diffusivity %g != %g", i, n.info.diff, n.Kzz)
+			}
+		}
+	}
+
+	for _, factors := range []map[string]float64{{"Dz": 2}, {"Kzz": -1}, {"Kzz": math.NaN()}} {
+		if _, err := newDomain(t, factors); err == nil {
+			t.Errorf("%v: expected an error", factors)
+		}
+	}
+}
+
+func TestEnsembleStatistics(t *testing.T) {
+	e := (&Outputter{}).NewEnsembleStatistics()
+	if _, err := e.Statistics(); err == nil {
+		t.Error("expected an error for too few members")
+	}
+	for _, v := range []float64{4, 1, 3, 2} {
+		e.results = append(e.results, map[string][]float64{"x": {v, 2 * v}})
+	}
+	stats, err := e.Statistics(0, 50, 90, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]float64{
+		"mean": {2.5, 5},
+		"std":  {math.Sqrt(5. / 3.), 2 * math.Sqrt(5./3.)},
+		"p0":   {1, 2},
+		"p50":  {2.5, 5},
+		"p90":  {3.7, 7.4},
+		"p100": {4, 8},
+	}
+	if len(stats) != len(want) {
+		t.Errorf("have %d statistics, want %d", len(stats), len(want))
+	}
+	for stat, w := range want {
+		for i, v := range stats[stat]["x"] {
+			if different(v, w[i], 1.e-10) {
+				t.Errorf("%s row %d: %g != %g", stat, i, v, w[i])
+			}
+		}
+	}
+	if _, err := e.Statistics(101); err == nil {
+		t.Error("expected an error for an invalid percentile")
+	}
+}
@@ -189,7 +189,7 @@ func TestAnimation_logo(t *testing.T) {
 		map[string]string{"TotalPM25": "TotalPM25"}, cfg.GetString("EmissionUnits"),
 		[]string{"animation_logo/logo.shp"},
 		vgc, cfg.GetString("InMAPData"), cfg.GetString("VariableGridData"), cfg.GetInt("NumIterations"),
-		dynamic, createGrid, inmaputil.DefaultScienceFuncs, nil,
+		dynamic, createGrid, nil, inmaputil.DefaultScienceFuncs, nil,
 		[]inmap.DomainManipulator{inmap.RunPeriodically(framePeriod, saveConc(dataChan))}, nil, simplechem.Mechanism{}); err != nil {
 		t.Fatal(err)
 	}
@@ -244,7 +244,7 @@ func TestAnimation_nei(t *testing.T) {
 		inmaputil.GetStringMapString("OutputVariables", cfg.Viper), cfg.GetString("EmissionUnits"),
 		cfg.GetStringSlice("EmissionsShapefiles"),
 		vgc, cfg.GetString("InMAPData"), cfg.GetString("VariableGridData"), cfg.GetInt("NumIterations"),
-		dynamic, createGrid, inmaputil.DefaultScienceFuncs, nil,
+		dynamic, createGrid, nil, inmaputil.DefaultScienceFuncs, nil,
 		[]inmap.DomainManipulator{inmap.RunPeriodically(framePeriod, saveConc(dataChan))}, nil, simplechem.Mechanism{}); err != nil {
 		t.Fatal(err)
 	}
@@ -21,7 +21,9 @@ package inmap
 import (
 	"fmt"
 	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/index/rtree"
@@ -38,6 +40,10 @@ const (
 	// InMAPDataVersion is the version of the InMAP data required by this version
 	// of the software.
 	InMAPDataVersion = "1.2.0"
+
+	// CheckpointDataVersion gives the version of the checkpoint data
+	// written and required by this version of the software.
+	CheckpointDataVersion = "1.0.0"
 )
 
 // InMAP holds the current state of the model.
@@ -87,7 +93,39 @@ type InMAP struct {
 	// index is a spatial index of Cells.
 	index *rtree.Rtree
 
-	cellLock sync.Mutex
+	// convergence holds the state of the steady-state convergence check.
+	convergence *convergenceState
+
+	// cellPartitions holds the grid cells divided into spatial partitions
+	// for concurrent calculations. It is nil if the partitions have not been
+	// calculated since the grid last changed.
+	cellPartitions [][]*Cell
+
+	// cellLock prevents the grid cells from being read while they
+	// are being modified by Calculations.
+	cellLock sync.RWMutex
+
+	// cluster holds the workers that the simulation is distributed among,
+	// if any.
+	cluster *Cluster
+
+	// dtLimits holds the processes that limit the time step,
+	// as calculated by SetTimestepCFL.
+	dtLimits []TimestepLimit
+
+	// tags holds the source tags whose concentrations are tracked
+	// separately, as set by TrackTags.
+	tags []string
+
+	// budget holds the state of the mass budget, if it is being
+	// tracked using TrackBudget.
+	budget *budgetState
+
+	// boundaryConditions holds the concentrations outside of the domain,
+	// as set by SetBoundaryConditions, and boundaryTime is the time
+	// they are for.
+	boundaryConditions BoundaryConditions
+	boundaryTime       time.Time
 }
 
 // Init initializes the simulation by running d.InitFuncs.
@@ -109,6 +147,14 @@ func (d *InMAP) init() {
 	d.southBoundary = new(cellList)
 	d.topBoundary = new(cellList)
 	d.index = rtree.NewTree(25, 50)
+	d.convergence = nil
+	d.cellPartitions = nil
+	d.cluster = nil
+	d.dtLimits = nil
+	d.tags = nil
+	d.budget = nil
+	d.boundaryConditions = nil
+	d.boundaryTime = time.Time{}
 }
 
 // Run carries out the simulation by running d.RunFuncs until d.Done is true.
@@ -180,6 +226,29 @@ type Cell struct {
 	EmisFlux  []float64 // emissions [μg/m³/s]
 	CBaseline []float64 // Total baseline PM2.5 concentration.
 
+	emisFluxProfiles []emisFluxProfile // time-varying components of EmisFlux
+
+	TagCi       [][]float64 // concentrations at beginning of time step for each source tag [μg/m³]
+	TagCf       [][]float64 // concentrations at end of time step for each source tag [μg/m³]
+	TagEmisFlux [][]float64 // emissions for each source tag [μg/m³/s]
+
+	tagEmisFluxProfiles [][]emisFluxProfile // time-varying components of TagEmisFlux
+	tags                []string            // source tags tracked by TrackTags
+
+	// Budget holds the mass budget of the cell. It is nil unless the
+	// budget is being tracked (see TrackBudget).
+	Budget *CellBudget
+
+	// tagBudget holds Budget while the calculations for
+	// a source tag are being carried out.
+	tagBudget *CellBudget
+
+	// Deposition holds the cumulative deposition from the cell. It is nil
+	// until deposition has been calculated for the cell.
+	// TagDeposition holds the deposition for each source tag (see TrackTags).
+	Deposition    *Deposition
+	TagDeposition []*Deposition
+
 	west        *cellList // Neighbors to the East
 	east        *cellList // Neighbors to the West
 	south       *cellList // Neighbors to the South
@@ -200,8 +269,6 @@ type Cell struct {
 	S1                         float64 `desc:"Stability parameter" units:"?"`
 	SClass                     float64 `desc:"Stability class" units:"0=Unstable; 1=Stable"`
 
-	mutex sync.RWMutex // Avoid cell being written by one subroutine and read by another at the same time.
-
 	Index                 [][2]int // Index gives this cell's place in the nest structure.
 	AboveDensityThreshold bool
 }
@@ -267,6 +334,9 @@ func (c *Cell) boundaryCopy(m Mechanism) *Cell {
 	c2.Volume = c2.Dx * c2.Dy * c2.Dz
 	c2.PopData = c.PopData
 	c2.MortData = c.MortData
+	if len(c.tags) > 0 {
+		c2.setTags(c.tags, m)
+	}
 	return c2
 }
 
@@ -275,6 +345,7 @@ func (d *InMAP) addWestBoundary(cell *Cell, m Mechanism) {
 	c := cell.boundaryCopy(m)
 	ref := cell.west.add(c)
 	d.westBoundary.add(c)
+	d.setBoundaryConcentrations(c)
 	neighborInfoBoundaryEastWest(ref)
 }
 
@@ -283,6 +354,7 @@ func (d *InMAP) addEastBoundary(cell *Cell, m Mechanism) {
 	c := cell.boundaryCopy(m)
 	ref := cell.east.add(c)
 	d.eastBoundary.add(c)
+	d.setBoundaryConcentrations(c)
 	neighborInfoBoundaryEastWest(ref)
 }
 
@@ -291,6 +363,7 @@ func (d *InMAP) addSouthBoundary(cell *Cell, m Mechanism) {
 	c := cell.boundaryCopy(m)
 	ref := cell.south.add(c)
 	d.southBoundary.add(c)
+	d.setBoundaryConcentrations(c)
 	neighborInfoBoundarySouthNorth(ref)
 }
 
@@ -299,6 +372,7 @@ func (d *InMAP) addNorthBoundary(cell *Cell, m Mechanism) {
 	c := cell.boundaryCopy(m)
 	ref := cell.north.add(c)
 	d.northBoundary.add(c)
+	d.setBoundaryConcentrations(c)
 	neighborInfoBoundarySouthNorth(ref)
 }
 
@@ -307,6 +381,7 @@ func (d *InMAP) addTopBoundary(cell *Cell, m Mechanism) {
 	c := cell.boundaryCopy(m)
 	ref := cell.above.add(c)
 	d.topBoundary.add(c)
+	d.setBoundaryConcentrations(c)
 	neighborInfoBoundaryTopBottom(ref)
 }
 
@@ -315,6 +390,8 @@ func (d *InMAP) addTopBoundary(cell *Cell, m Mechanism) {
 // for advection or Von Neumann stability analysis
 // (http://en.wikipedia.org/wiki/Von_Neumann_stability_analysis) for
 // diffusion, whichever one yields a smaller time step.
+// The grid cells and processes that limit the time step
+// are available from TimestepLimits.
 func SetTimestepCFL() DomainManipulator {
 	sqrt3 := math.Pow(3., 0.5)
 	return func(d *InMAP) error {
@@ -327,6 +404,12 @@ func SetTimestepCFL() DomainManipulator {
 			CFirstOrder = 1.0 / 3.0
 		)
 		d.Dt = math.Inf(1)
+		limits := make(map[string]TimestepLimit)
+		limit := func(process string, c *Cell, dt float64) {
+			if l, ok := limits[process]; !ok || dt < l.Dt {
+				limits[process] = TimestepLimit{Process: process, Cell: c, Dt: dt}
+			}
+		}
 		for _, c := range *d.cells {
 			// Advection time step
 			cUadv := (math.Abs(c.UAvg) + c.UDeviation*2) / c.Dx
@@ -367,11 +450,97 @@ func SetTimestepCFL() DomainManipulator {
 			dt15 := CFirstOrder * c.Dy / c.NOxDryDep
 
 			d.Dt = amin(d.Dt, dt1, dt7, dt8, dt9, dt10, dt11, dt12, dt13, dt14, dt15) // seconds
+
+			limit(transportProcess(cUadv, cVadv, cWadv, cXdiff, cYdiff, cZdiff, c.M2d+c.M2u), c.Cell, dt1)
+			limit("chemistry", c.Cell, dt7)
+			limit("wet deposition", c.Cell, amin(dt8, dt9, dt10))
+			limit("dry deposition", c.Cell, amin(dt11, dt12, dt13, dt14, dt15))
+		}
+		d.dtLimits = make([]TimestepLimit, 0, len(limits))
+		for _, l := range limits {
+			d.dtLimits = append(d.dtLimits, l)
 		}
+		sort.Slice(d.dtLimits, func(i, j int) bool {
+			if d.dtLimits[i].Dt != d.dtLimits[j].Dt {
+				return d.dtLimits[i].Dt < d.dtLimits[j].Dt
+			}
+			return d.dtLimits[i].Process < d.dtLimits[j].Process
+		})
 		return nil
 	}
 }
 
+// transportProcess returns the name of the transport process that
+// limits the time step in a grid cell, given the rates [1/s] of
+// advection and diffusion in each direction and of ACM2 convective mixing.
+// Advection and diffusion in the direction with the largest combined rate
+// limit the time step, and the process with the largest rate in that direction
+// is returned.
+func transportProcess(uAdv, vAdv, wAdv, xDiff, yDiff, zDiff, acm2 float64) string {
+	type rate struct {
+		process string
+		value   float64
+	}
+	directions := [][]rate{
+		{{"advection", uAdv}, {"horizontal diffusion", xDiff}},
+		{{"advection", vAdv}, {"horizontal diffusion", yDiff}},
+		{{"advection", wAdv}, {"Kzz mixing", zDiff}, {"ACM2 mixing", acm2}},
+	}
+	var limiting []rate
+	maxSum := math.Inf(-1)
+	for _, dir := range directions {
+		var sum float64
+		for _, r := range dir {
+			sum += r.value
+		}
+		if sum > maxSum {
+			maxSum = sum
+			limiting = dir
+		}
+	}
+	p := limiting[0]
+	for _, r := range limiting[1:] {
+		if r.value > p.value {
+			p = r
+		}
+	}
+	return p.process
+}
+
+// TimestepLimit describes the grid cell where a physical process
+// most strongly limits the model time step.
+type TimestepLimit struct {
+	// Process is the name of the process: "advection",
+	// "horizontal diffusion", "Kzz mixing", "ACM2 mixing",
+	// "chemistry", "wet deposition", or "dry deposition".
+	Process string
+
+	// Cell is the grid cell where the process requires the shortest
+	// time step.
+	Cell *Cell
+
+	// Dt is the maximum time step allowed by the process in Cell [s].
+	Dt float64
+}
+
+func (l TimestepLimit) String() string {
+	if l.Cell == nil {
+		return fmt.Sprintf("%s: %.3gs", l.Process, l.Dt)
+	}
+	c := l.Cell.Centroid()
+	return fmt.Sprintf("%s: %.3gs in layer %d cell at (%g, %g)", l.Process, l.Dt, l.Cell.Layer, c.X, c.Y)
+}
+
+// TimestepLimits returns the grid cell where each process most strongly
+// limits the time step, as calculated the last time SetTimestepCFL was run,
+// sorted so that the process that limits the time step comes first.
+// Advection and diffusion are combined to determine the time step, so
+// in each cell only the one with the largest rate in the limiting
+// direction is reported.
+func (d *InMAP) TimestepLimits() []TimestepLimit {
+	return d.dtLimits
+}
+
 func harmonicMean(a, b float64) float64 {
 	return 2. * a * b / (a + b)
 }
@@ -380,14 +549,14 @@ func harmonicMean(a, b float64) float64 {
 // if WebMap is true, it returns the geometry in web mercator projection,
 // otherwise it returns the native grid projection.
 func (d *InMAP) GetGeometry(layer int, webMap bool) []geom.Polygonal {
+	d.cellLock.RLock()
+	defer d.cellLock.RUnlock()
 	o := make([]geom.Polygonal, 0, d.cells.len())
 	cells := d.cells.array()
 	for _, c := range cells {
-		c.mutex.RLock()
 		if c.Layer > layer {
 			// The cells should be sorted with the lower layers first, so we
 			// should be done here.
-			c.mutex.RUnlock()
 			return o
 		}
 		if c.Layer == layer {
@@ -397,28 +566,47 @@ func (d *InMAP) GetGeometry(layer int, webMap bool) []geom.Polygonal {
 				o = append(o, c.Polygonal)
 			}
 		}
-		c.mutex.RUnlock()
 	}
 	return o
 }
 
 // Regrid regrids concentration data from one spatial grid to a different one.
 func Regrid(oldGeom, newGeom []geom.Polygonal, oldData []float64) (newData []float64, err error) {
-	type data struct {
-		geom.Polygonal
-		data float64
-	}
 	if len(oldGeom) != len(oldData) {
 		return nil, fmt.Errorf("oldGeom and oldData have different lengths: %d!=%d", len(oldGeom), len(oldData))
 	}
+	weights := regridWeights(oldGeom, newGeom)
+	newData = make([]float64, len(newGeom))
+	for i, w := range weights {
+		for _, ww := range w {
+			newData[i] += oldData[ww.i] * ww.frac
+		}
+	}
+	return newData, nil
+}
+
+// regridWeight is the fraction of the area of a new grid cell
+// that overlaps old grid cell i.
+type regridWeight struct {
+	i    int
+	frac float64
+}
+
+// regridWeights returns the area-weighted contributions of the
+// cells in oldGeom to each of the cells in newGeom.
+func regridWeights(oldGeom, newGeom []geom.Polygonal) [][]regridWeight {
+	type data struct {
+		geom.Polygonal
+		i int
+	}
 	index := rtree.NewTree(25, 50)
 	for i, g := range oldGeom {
 		index.Insert(&data{
 			Polygonal: g,
-			data:      oldData[i],
+			i:         i,
 		})
 	}
-	newData = make([]float64, len(newGeom))
+	weights := make([][]regridWeight, len(newGeom))
 	for i, g := range newGeom {
 		for _, dI := range index.SearchIntersect(g.Bounds()) {
 			d := dI.(*data)
@@ -427,11 +615,10 @@ func Regrid(oldGeom, newGeom []geom.Polygonal, oldData []float64) (newData []flo
 				continue
 			}
 			a := isect.Area()
-			frac := a / g.Area()
-			newData[i] += d.data * frac
+			weights[i] = append(weights[i], regridWeight{i: d.i, frac: a / g.Area()})
 		}
 	}
-	return newData, nil
+	return weights
 }
 
 // CellIntersections returns an array of all of the grid cells (on all vertical levels)
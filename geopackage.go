@@ -0,0 +1,475 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	_ "github.com/mattn/go-sqlite3" // Register the SQLite database driver.
+)
+
+const (
+	// gpkgCustomSRSID is the GeoPackage spatial reference ID used for
+	// spatial references other than WGS84.
+	gpkgCustomSRSID = 100000
+
+	gpkgWGS84SRSID = 4326
+)
+
+// writeGeoPackage writes data to a GeoPackage file containing a single
+// feature table named after the file, with a column for each output variable.
+// Any existing file at fileName will be overwritten.
+func writeGeoPackage(fileName string, data *OutputData) error {
+	prj, err := wkt(data.SR)
+	if err != nil {
+		return err
+	}
+	srsID := gpkgCustomSRSID
+	if isWGS84(data.SR) {
+		srsID = gpkgWGS84SRSID
+	}
+
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("inmap: removing old GeoPackage output file: %v", err)
+	}
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating GeoPackage output file: %v", err)
+	}
+	defer db.Close()
+
+	table := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+
+	b := geom.NewBounds()
+	for _, p := range data.Polygons {
+		b.Extend(p.Bounds())
+	}
+
+	columns := make([]string, len(data.Variables))
+	for i, v := range data.Variables {
+		columns[i] = fmt.Sprintf("%s DOUBLE", gpkgQuote(v))
+	}
+
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+	stmts := []statement{
+		{query: "PRAGMA application_id = 1196444487"}, // "GPKG"
+		{query: "PRAGMA user_version = 10200"},        // Version 1.2
+		{query: `CREATE TABLE gpkg_spatial_ref_sys (srs_name TEXT NOT NULL,
+			srs_id INTEGER NOT NULL PRIMARY KEY, organization TEXT NOT NULL,
+			organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL,
+			description TEXT)`},
+		{query: `CREATE TABLE gpkg_contents (table_name TEXT NOT NULL PRIMARY KEY,
+			data_type TEXT NOT NULL, identifier TEXT UNIQUE, description TEXT DEFAULT '',
+			last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+			min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER,
+			CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`},
+		{query: `CREATE TABLE gpkg_geometry_columns (table_name TEXT NOT NULL,
+			column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL,
+			srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL,
+			CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+			CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+			CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`},
+		{query: "INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)",
+			args: []interface{}{"Undefined cartesian SRS", -1, "NONE", -1, "undefined", "undefined cartesian coordinate reference system"}},
+		{query: "INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)",
+			args: []interface{}{"Undefined geographic SRS", 0, "NONE", 0, "undefined", "undefined geographic coordinate reference system"}},
+		{query: "INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)",
+			args: []interface{}{"WGS 84 geodetic", gpkgWGS84SRSID, "EPSG", gpkgWGS84SRSID, wgs84WKT, "longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid"}},
+	}
+	if srsID == gpkgCustomSRSID {
+		stmts = append(stmts, statement{query: "INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)",
+			args: []interface{}{"InMAP output", srsID, "NONE", srsID, prj, "InMAP output spatial reference"}})
+	}
+	stmts = append(stmts, []statement{
+		{query: fmt.Sprintf("CREATE TABLE %s (fid INTEGER PRIMARY KEY AUTOINCREMENT, geom MULTIPOLYGON%s)",
+			gpkgQuote(table), strings.Join(append([]string{""}, columns...), ", "))},
+		{query: "INSERT INTO gpkg_contents (table_name, data_type, identifier, min_x, min_y, max_x, max_y, srs_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			args: []interface{}{table, "features", table, b.Min.X, b.Min.Y, b.Max.X, b.Max.Y, srsID}},
+		{query: "INSERT INTO gpkg_geometry_columns VALUES (?, ?, ?, ?, ?, ?)",
+			args: []interface{}{table, "geom", "MULTIPOLYGON", srsID, 0, 0}},
+	}...)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage output: %v", err)
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inmap: writing GeoPackage output: %v", err)
+		}
+	}
+
+	placeholders := strings.Repeat(", ?", len(data.Variables)+1)[2:]
+	names := make([]string, len(data.Variables))
+	for i, v := range data.Variables {
+		names[i] = gpkgQuote(v)
+	}
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", gpkgQuote(table),
+		strings.Join(append([]string{"geom"}, names...), ", "), placeholders))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("inmap: writing GeoPackage output: %v", err)
+	}
+	defer insert.Close()
+	args := make([]interface{}, len(data.Variables)+1)
+	for i, p := range data.Polygons {
+		args[0] = gpkgGeometry(p, srsID)
+		for j, v := range data.Variables {
+			args[j+1] = data.Values[v][i]
+		}
+		if _, err := insert.Exec(args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inmap: writing GeoPackage output: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage output: %v", err)
+	}
+	return db.Close()
+}
+
+// gpkgQuote quotes a GeoPackage table or column name.
+func gpkgQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// gpkgGeometry encodes p as a GeoPackage geometry binary blob,
+// which consists of a header followed by the
+// well-known binary (WKB) representation of the geometry.
+func gpkgGeometry(p geom.Polygonal, srsID int) []byte {
+	b := new(bytes.Buffer)
+	bounds := p.Bounds()
+	le := binary.LittleEndian
+	// Header: magic number, version, flags (little endian with
+	// [minx, maxx, miny, maxy] envelope), and spatial reference ID.
+	b.Write([]byte{'G', 'P', 0, 0x03})
+	binary.Write(b, le, int32(srsID))
+	binary.Write(b, le, []float64{bounds.Min.X, bounds.Max.X, bounds.Min.Y, bounds.Max.Y})
+
+	// WKB MultiPolygon.
+	const (
+		wkbLittleEndian = 1
+		wkbPolygon      = 3
+		wkbMultiPolygon = 6
+	)
+	polys := p.Polygons()
+	b.WriteByte(wkbLittleEndian)
+	binary.Write(b, le, uint32(wkbMultiPolygon))
+	binary.Write(b, le, uint32(len(polys)))
+	for _, poly := range polys {
+		b.WriteByte(wkbLittleEndian)
+		binary.Write(b, le, uint32(wkbPolygon))
+		binary.Write(b, le, uint32(len(poly)))
+		for _, ring := range poly {
+			closed := len(ring) == 0 || ring[0] == ring[len(ring)-1]
+			n := len(ring)
+			if !closed {
+				n++ // WKB rings must be closed.
+			}
+			binary.Write(b, le, uint32(n))
+			for _, pt := range ring {
+				binary.Write(b, le, []float64{pt.X, pt.Y})
+			}
+			if !closed {
+				binary.Write(b, le, []float64{ring[0].X, ring[0].Y})
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// readEmissionsGeoPackage reads emissions from the feature tables in a
+// GeoPackage file. All of the feature tables must use the same
+// spatial reference.
+func readEmissionsGeoPackage(fname string, columns EmissionsColumns) ([]*EmisRecord, *proj.SR, error) {
+	if _, err := os.Stat(fname); err != nil {
+		return nil, nil, fmt.Errorf("inmap: opening emissions file: %v", err)
+	}
+	db, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: opening emissions file: %v", err)
+	}
+	defer db.Close()
+
+	type featureTable struct {
+		name, geomColumn string
+		srsID            int
+	}
+	var tables []featureTable
+	rows, err := db.Query("SELECT table_name, column_name, srs_id FROM gpkg_geometry_columns")
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+	}
+	for rows.Next() {
+		var t featureTable
+		if err := rows.Scan(&t.name, &t.geomColumn, &t.srsID); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if len(tables) == 0 {
+		return nil, nil, fmt.Errorf("inmap: emissions file %s has no feature tables", fname)
+	}
+	for _, t := range tables[1:] {
+		if t.srsID != tables[0].srsID {
+			return nil, nil, fmt.Errorf("inmap: feature tables %s and %s in emissions file %s have different spatial references",
+				tables[0].name, t.name, fname)
+		}
+	}
+
+	var sr *proj.SR
+	if tables[0].srsID == gpkgWGS84SRSID {
+		sr, err = wgs84()
+	} else {
+		var def string
+		err = db.QueryRow("SELECT definition FROM gpkg_spatial_ref_sys WHERE srs_id = ?", tables[0].srsID).Scan(&def)
+		if err == nil {
+			sr, err = proj.Parse(def)
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading projection for emissions file %s: %v", fname, err)
+	}
+
+	var recs []*EmisRecord
+	for _, t := range tables {
+		rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s", gpkgQuote(t.name)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+		}
+		names, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+		}
+		vals := make([]interface{}, len(names))
+		ptrs := make([]interface{}, len(names))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+			}
+			var g geom.Geom
+			attributes := make(map[string]interface{}, len(names))
+			for i, name := range names {
+				if name == t.geomColumn {
+					b, _ := vals[i].([]byte)
+					if g, err = gpkgDecodeGeometry(b); err != nil {
+						rows.Close()
+						return nil, nil, fmt.Errorf("inmap: reading emissions file %s table %s: %v", fname, t.name, err)
+					}
+					continue
+				}
+				attributes[strings.ToLower(name)] = vals[i]
+			}
+			if g == nil {
+				continue // Skip features without geometry.
+			}
+			e, err := columns.record(g, attributes)
+			if err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("%v in emissions file %s table %s", err, fname, t.name)
+			}
+			recs = append(recs, e)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("inmap: reading emissions file %s: %v", fname, err)
+		}
+	}
+	return recs, sr, nil
+}
+
+// gpkgDecodeGeometry decodes a GeoPackage geometry binary blob, as
+// described in gpkgGeometry. It returns nil for empty geometries.
+func gpkgDecodeGeometry(b []byte) (geom.Geom, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if len(b) < 8 || b[0] != 'G' || b[1] != 'P' {
+		return nil, fmt.Errorf("invalid GeoPackage geometry")
+	}
+	flags := b[3]
+	if flags&0x10 != 0 { // Empty geometry.
+		return nil, nil
+	}
+	envelopeSize := map[byte]int{0: 0, 1: 32, 2: 48, 3: 48, 4: 64}[(flags>>1)&0x07]
+	start := 8 + envelopeSize
+	if len(b) < start {
+		return nil, fmt.Errorf("invalid GeoPackage geometry")
+	}
+	r := &wkbReader{r: bytes.NewReader(b[start:])}
+	g := r.geometry()
+	return g, r.err
+}
+
+// wkbReader decodes well-known binary (WKB) geometries, ignoring
+// any Z or M values.
+type wkbReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+// header reads the byte order, geometry type, and number
+// of coordinates per point at the beginning of a WKB geometry.
+func (r *wkbReader) header() (order binary.ByteOrder, geomType uint32, dims int) {
+	var o byte
+	if r.err = binary.Read(r.r, binary.LittleEndian, &o); r.err != nil {
+		return
+	}
+	order = binary.ByteOrder(binary.BigEndian)
+	if o == 1 {
+		order = binary.LittleEndian
+	}
+	if r.err = binary.Read(r.r, order, &geomType); r.err != nil {
+		return
+	}
+	dims = 2
+	if geomType&0x80000000 != 0 { // Extended WKB Z flag.
+		dims++
+	}
+	if geomType&0x40000000 != 0 { // Extended WKB M flag.
+		dims++
+	}
+	geomType &= 0x0fffffff
+	switch geomType / 1000 { // ISO WKB Z, M, and ZM types.
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	return order, geomType % 1000, dims
+}
+
+func (r *wkbReader) uint32(order binary.ByteOrder) int {
+	var n uint32
+	if r.err == nil {
+		r.err = binary.Read(r.r, order, &n)
+	}
+	return int(n)
+}
+
+func (r *wkbReader) points(order binary.ByteOrder, dims int) []geom.Point {
+	n := r.uint32(order)
+	if r.err != nil || n > r.r.Len() {
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid WKB geometry")
+		}
+		return nil
+	}
+	pts := make([]geom.Point, n)
+	for i := range pts {
+		pts[i] = r.point(order, dims)
+	}
+	return pts
+}
+
+func (r *wkbReader) point(order binary.ByteOrder, dims int) geom.Point {
+	c := make([]float64, dims)
+	if r.err == nil {
+		r.err = binary.Read(r.r, order, c)
+	}
+	return geom.Point{X: c[0], Y: c[1]}
+}
+
+func (r *wkbReader) polygon(order binary.ByteOrder, dims int) geom.Polygon {
+	p := make(geom.Polygon, r.uint32(order))
+	for i := range p {
+		p[i] = r.points(order, dims)
+	}
+	return p
+}
+
+// geometry reads a WKB geometry.
+func (r *wkbReader) geometry() geom.Geom {
+	order, geomType, dims := r.header()
+	if r.err != nil {
+		return nil
+	}
+	const (
+		wkbPoint = iota + 1
+		wkbLineString
+		wkbPolygon
+		wkbMultiPoint
+		wkbMultiLineString
+		wkbMultiPolygon
+	)
+	switch geomType {
+	case wkbPoint:
+		return r.point(order, dims)
+	case wkbLineString:
+		return geom.LineString(r.points(order, dims))
+	case wkbPolygon:
+		return r.polygon(order, dims)
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon:
+		n := r.uint32(order)
+		if r.err == nil && n > r.r.Len() {
+			r.err = fmt.Errorf("invalid WKB geometry")
+		}
+		if r.err != nil {
+			return nil
+		}
+		var mp geom.MultiPoint
+		var ml geom.MultiLineString
+		var mpoly geom.MultiPolygon
+		for i := 0; i < n && r.err == nil; i++ {
+			switch g := r.geometry().(type) {
+			case geom.Point:
+				mp = append(mp, g)
+			case geom.LineString:
+				ml = append(ml, g)
+			case geom.Polygon:
+				mpoly = append(mpoly, g)
+			default:
+				if r.err == nil {
+					r.err = fmt.Errorf("invalid WKB multi-geometry member %T", g)
+				}
+			}
+		}
+		switch geomType {
+		case wkbMultiPoint:
+			return mp
+		case wkbMultiLineString:
+			return ml
+		default:
+			return mpoly
+		}
+	default:
+		r.err = fmt.Errorf("unsupported WKB geometry type %d", geomType)
+		return nil
+	}
+}
@@ -45,7 +45,7 @@ const (
 // and
 // http://wiki.seas.harvard.edu/geos-chem/index.php/Species_in_GEOS-Chem.
 type GEOSChem struct {
-	aVOC, bVOC, aSOA, bSOA, nox, no, no2, pNO, sox, pS, nh3, pNH, totalPM25 map[string]float64
+	groups SpeciesGroups
 
 	noChemHour bool
 
@@ -111,7 +111,7 @@ type GEOSChem struct {
 // http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map#Structure_of_the_vegtype.global_file
 //
 // startDate and endDate are the dates of the beginning and end of the
-// simulation, respectively, in the format "YYYYMMDD".
+// simulation, respectively, in the format "YYYYMMDD" or "YYYYMMDDTHH".
 //
 // If dash is true, GEOS-Chem chemical variable names are assumed to be in the
 // form 'IJ-AVG-S__xxx'. If dash is false, they are assumed to be in the form
@@ -128,7 +128,13 @@ type GEOSChem struct {
 //
 // If noChemHour is true, then the GEOS-Chem output files will be
 // assumed to not contain a time dimension.
-func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChemOut, VegTypeGlobal, startDate, endDate string, dash bool, chemRecordStr, chemFileStr string, noChemHour bool, msgChan chan string) (*GEOSChem, error) {
+//
+// groups specifies the GEOS-Chem species that make up the chemical
+// species groups, with names that do not include the 'IJ_AVG_S__'
+// prefix. If it is nil, the "GEOS-Chem:v11" preset will be used
+// (see SpeciesGroupPresets). It is an error if any of the
+// species are not in the first GEOS-Chem output file.
+func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChemOut, VegTypeGlobal, startDate, endDate string, dash bool, chemRecordStr, chemFileStr string, noChemHour bool, groups SpeciesGroups, msgChan chan string) (*GEOSChem, error) {
 	var d string
 	if dash {
 		d = "-"
@@ -136,113 +142,6 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 		d = "_"
 	}
 	gc := GEOSChem{
-		// These maps contain the GEOS-Chem variables that make
-		// up the chemical species groups, as well as the
-		// multiplication factors required to convert concentrations
-		// to mass fractions [μg/kg dry air].
-
-		// GEOS-Chem VOC species;
-		// Only includes anthropogenic precursors to SOA from
-		// anthropogenic (aSOA) and biogenic (bSOA) sources.
-		// Additional information available from:
-		// http://wiki.seas.harvard.edu/geos-chem/index.php/Species_in_GEOS-Chem.
-		// We assume condensable vapor from SOA has molar mass of 70.
-		aVOC: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__BENZ": ppbcToUgKg(78.11, 6),
-			"IJ" + d + "AVG" + d + "S__TOLU": ppbcToUgKg(92.14, 7),
-			"IJ" + d + "AVG" + d + "S__XYLE": ppbcToUgKg(106.16, 8),
-			"IJ" + d + "AVG" + d + "S__NAP":  ppbcToUgKg(128.1705, 10),
-			"IJ" + d + "AVG" + d + "S__POG1": ppbvToUgKg(12),
-			"IJ" + d + "AVG" + d + "S__POG2": ppbvToUgKg(12),
-		},
-		bVOC: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__ISOP": ppbcToUgKg(68.12, 5),
-			"IJ" + d + "AVG" + d + "S__LIMO": ppbvToUgKg(136.23),
-			"IJ" + d + "AVG" + d + "S__MTPA": ppbvToUgKg(136.23),
-			"IJ" + d + "AVG" + d + "S__MTPO": ppbvToUgKg(136.23),
-		},
-		// SOA species (anthropogenic only)
-		aSOA: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__ASOA1": ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__ASOA2": ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__ASOA3": ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__ASOAN": ppbvToUgKg(150),
-		},
-		// SOA species (biogenic only)
-		bSOA: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__TSOA0":  ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__TSOA1":  ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__TSOA2":  ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__TSOA3":  ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__SOAGX":  ppbvToUgKg(58),
-			"IJ" + d + "AVG" + d + "S__SOAMG":  ppbvToUgKg(72),
-			"IJ" + d + "AVG" + d + "S__SOAIE":  ppbvToUgKg(118),
-			"IJ" + d + "AVG" + d + "S__SOAME":  ppbvToUgKg(102),
-			"IJ" + d + "AVG" + d + "S__LVOCOA": ppbvToUgKg(154),
-			"IJ" + d + "AVG" + d + "S__ISN1OA": ppbvToUgKg(226),
-		},
-		// NOx species. We are only interested in the mass
-		// of Nitrogen, rather than the mass of the whole molecule, so
-		// we use the molecular weight of Nitrogen.
-		nox: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__NO":  ppbvToUgKg(mwN),
-			"IJ" + d + "AVG" + d + "S__NO2": ppbvToUgKg(mwN),
-		},
-		// pNO is the Nitrogen fraction of the particulate
-		// NO species.
-		pNO: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__NIT":  ppbvToUgKg(mwN),
-			"IJ" + d + "AVG" + d + "S__NITs": ppbvToUgKg(mwN),
-		},
-		// SOx species. We are only interested in the mass
-		// of Sulfur, rather than the mass of the whole molecule, so
-		// we use the molecular weight of Sulfur.
-		sox: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__SO2": ppbvToUgKg(mwS),
-		},
-		// pS is the MADE particulate Sulfur species; sulfur fraction
-		// sulfate (SO4) plus sulfate on the surface of sea ice (SO4s).
-		pS: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__SO4":  ppbvToUgKg(mwS),
-			"IJ" + d + "AVG" + d + "S__SO4s": ppbvToUgKg(mwS),
-			"IJ" + d + "AVG" + d + "S__DMS":  ppbvToUgKg(mwS),
-		},
-		// NH3 is ammonia. We are only interested in the mass
-		// of Nitrogen, rather than the mass of the whole molecule, so
-		// we use the molecular weight of Nitrogen.
-		nh3: map[string]float64{"IJ" + d + "AVG" + d + "S__NH3": ppbvToUgKg(mwN)},
-		// pNH is the Nitrogen fraction of the particulate
-		// ammonia species.
-		pNH: map[string]float64{"IJ" + d + "AVG" + d + "S__NH4": ppbvToUgKg(mwN)},
-		// totalPM25 is total mass of PM2.5.
-		// It is calculated based on the formula at:
-		// http://wiki.seas.harvard.edu/geos-chem/index.php/Particulate_matter_in_GEOS-Chem
-		totalPM25: map[string]float64{
-			"IJ" + d + "AVG" + d + "S__NH4":    ppbvToUgKg(150) * 1.33,
-			"IJ" + d + "AVG" + d + "S__NIT":    ppbvToUgKg(150) * 1.33,
-			"IJ" + d + "AVG" + d + "S__SO4":    ppbvToUgKg(150) * 1.33,
-			"IJ" + d + "AVG" + d + "S__BCPI":   ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__BCPO":   ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__TSOA0":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__TSOA1":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__TSOA2":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__TSOA3":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__ASOAN":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__ASOA1":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__ASOA2":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__ASOA3":  ppbvToUgKg(150) * 1.16,
-			"IJ" + d + "AVG" + d + "S__SOAGX":  ppbvToUgKg(58) * 1.16,
-			"IJ" + d + "AVG" + d + "S__INDIOL": ppbvToUgKg(102) * 1.16,
-			"IJ" + d + "AVG" + d + "S__SOAMG":  ppbvToUgKg(72) * 1.16,
-			"IJ" + d + "AVG" + d + "S__SOAIE":  ppbvToUgKg(118) * 1.16,
-			"IJ" + d + "AVG" + d + "S__SOAME":  ppbvToUgKg(102) * 1.16,
-			"IJ" + d + "AVG" + d + "S__LVOCOA": ppbvToUgKg(154) * 1.16,
-			"IJ" + d + "AVG" + d + "S__ISN1OA": ppbvToUgKg(226) * 1.16,
-			"IJ" + d + "AVG" + d + "S__DST1":   ppbvToUgKg(150),
-			"IJ" + d + "AVG" + d + "S__DST2":   ppbvToUgKg(150) * 0.38,
-			"IJ" + d + "AVG" + d + "S__SALA":   ppbvToUgKg(150) * 1.86,
-		},
-
 		geosA1:        GEOSA1,
 		geosA3Cld:     GEOSA3Cld,
 		geosA3Dyn:     GEOSA3Dyn,
@@ -258,11 +157,11 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 	}
 
 	var err error
-	gc.start, err = time.Parse(inDateFormat, startDate)
+	gc.start, err = ParseDate(startDate)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor start time: %v", err)
 	}
-	gc.end, err = time.Parse(inDateFormat, endDate)
+	gc.end, err = ParseDate(endDate)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor end time: %v", err)
 	}
@@ -315,9 +214,138 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 	}
 	gc.landUse = largestLandUse(landUse)
 
+	if groups == nil {
+		groups = geosChemSpeciesGroups(true)
+	}
+	if err = groups.Check(); err != nil {
+		return nil, err
+	}
+	date, _ := fileStart(gc.start, gc.chemFileDeltaInterval, gc.chemRecordDeltaInterval)
+	f, ff, err := ncfFromTemplate(gc.geosChem, geosChemFormat, date)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor: %v", err)
+	}
+	defer f.Close()
+	if err = groups.checkVariables(f.Name(), ff, gc.chemVarName); err != nil {
+		return nil, err
+	}
+	gc.groups = groups
+
 	return &gc, nil
 }
 
+// geosChemSpeciesGroups returns the species groups for GEOS-Chem
+// simulations. If v11 is true, the groups include the complex SOA
+// species from isoprene that were added in GEOS-Chem version 11.
+// The species names do not include the 'IJ_AVG_S__' prefix.
+func geosChemSpeciesGroups(v11 bool) SpeciesGroups {
+	ppbv := func(mw float64) Species { return Species{Units: "ppbv", MW: mw} }
+	ppbc := func(mw, nc float64) Species { return Species{Units: "ppbC", MW: mw, Carbons: nc} }
+	scaled := func(s Species, factor float64) Species {
+		s.Factor = factor
+		return s
+	}
+	g := SpeciesGroups{
+		// GEOS-Chem VOC species;
+		// Only includes anthropogenic precursors to SOA from
+		// anthropogenic (aSOA) and biogenic (bSOA) sources.
+		// Additional information available from:
+		// http://wiki.seas.harvard.edu/geos-chem/index.php/Species_in_GEOS-Chem.
+		"AVOC": {
+			"BENZ": ppbc(78.11, 6),
+			"TOLU": ppbc(92.14, 7),
+			"XYLE": ppbc(106.16, 8),
+			"NAP":  ppbc(128.1705, 10),
+			"POG1": ppbv(12),
+			"POG2": ppbv(12),
+		},
+		"BVOC": {
+			"ISOP": ppbc(68.12, 5),
+			"LIMO": ppbv(136.23),
+			"MTPA": ppbv(136.23),
+			"MTPO": ppbv(136.23),
+		},
+		// SOA species (anthropogenic only)
+		"ASOA": {
+			"ASOA1": ppbv(150),
+			"ASOA2": ppbv(150),
+			"ASOA3": ppbv(150),
+			"ASOAN": ppbv(150),
+		},
+		// SOA species (biogenic only)
+		"BSOA": {
+			"TSOA0": ppbv(150),
+			"TSOA1": ppbv(150),
+			"TSOA2": ppbv(150),
+			"TSOA3": ppbv(150),
+		},
+		// NOx species. We are only interested in the mass
+		// of Nitrogen, rather than the mass of the whole molecule, so
+		// we use the molecular weight of Nitrogen.
+		"NOx": {
+			"NO":  ppbv(mwN),
+			"NO2": ppbv(mwN),
+		},
+		// pNO is the Nitrogen fraction of the particulate
+		// NO species.
+		"PNO": {
+			"NIT":  ppbv(mwN),
+			"NITs": ppbv(mwN),
+		},
+		// SOx species. We are only interested in the mass
+		// of Sulfur, rather than the mass of the whole molecule, so
+		// we use the molecular weight of Sulfur.
+		"SOx": {
+			"SO2": ppbv(mwS),
+		},
+		// pS is the MADE particulate Sulfur species; sulfur fraction
+		// sulfate (SO4) plus sulfate on the surface of sea ice (SO4s).
+		"PS": {
+			"SO4":  ppbv(mwS),
+			"SO4s": ppbv(mwS),
+			"DMS":  ppbv(mwS),
+		},
+		// NH3 is ammonia. We are only interested in the mass
+		// of Nitrogen, rather than the mass of the whole molecule, so
+		// we use the molecular weight of Nitrogen.
+		"NH3": {"NH3": ppbv(mwN)},
+		// pNH is the Nitrogen fraction of the particulate
+		// ammonia species.
+		"PNH": {"NH4": ppbv(mwN)},
+		// totalPM25 is total mass of PM2.5.
+		// It is calculated based on the formula at:
+		// http://wiki.seas.harvard.edu/geos-chem/index.php/Particulate_matter_in_GEOS-Chem
+		"TotalPM25": {
+			"NH4":   scaled(ppbv(150), 1.33),
+			"NIT":   scaled(ppbv(150), 1.33),
+			"SO4":   scaled(ppbv(150), 1.33),
+			"BCPI":  ppbv(150),
+			"BCPO":  ppbv(150),
+			"TSOA0": scaled(ppbv(150), 1.16),
+			"TSOA1": scaled(ppbv(150), 1.16),
+			"TSOA2": scaled(ppbv(150), 1.16),
+			"TSOA3": scaled(ppbv(150), 1.16),
+			"ASOAN": scaled(ppbv(150), 1.16),
+			"ASOA1": scaled(ppbv(150), 1.16),
+			"ASOA2": scaled(ppbv(150), 1.16),
+			"ASOA3": scaled(ppbv(150), 1.16),
+			"DST1":  ppbv(150),
+			"DST2":  scaled(ppbv(150), 0.38),
+			"SALA":  scaled(ppbv(150), 1.86),
+		},
+	}
+	if v11 {
+		// Complex SOA from isoprene.
+		for name, mw := range map[string]float64{"SOAGX": 58, "SOAMG": 72, "SOAIE": 118,
+			"SOAME": 102, "LVOCOA": 154, "ISN1OA": 226} {
+			g["BSOA"][name] = ppbv(mw)
+			g["TotalPM25"][name] = scaled(ppbv(mw), 1.16)
+		}
+		g["TotalPM25"]["INDIOL"] = scaled(ppbv(102), 1.16)
+	}
+	return g
+}
+
 // ppbcToUgKg returns a multiplier to convert a concentration in
 // ppbc (parts per billion carbon) dry air to a mass fraction
 // [micrograms per kilogram dry air]
@@ -366,6 +394,24 @@ func (gc *GEOSChem) readChem(varName string) NextData {
 	return nextDataNCF(gc.geosChem, geosChemFormat, varName, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCF, gc.msgChan)
 }
 
+func (gc *GEOSChem) readChemGroup(varGroup map[string]float64) NextData {
+	if gc.noChemHour {
+		return nextDataGroupNCF(gc.geosChem, geosChemFormat, varGroup, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCFNoHour, gc.msgChan)
+	}
+	return nextDataGroupNCF(gc.geosChem, geosChemFormat, varGroup, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCF, gc.msgChan)
+}
+
+// chemVarName returns the name of the GEOS-Chem output variable
+// for the given species.
+func (gc *GEOSChem) chemVarName(species string) string {
+	return "IJ" + gc.dash + "AVG" + gc.dash + "S__" + species
+}
+
+func (gc *GEOSChem) readSpeciesGroup(group string) NextData {
+	massFraction, conc := gc.groups.factors(group, gc.chemVarName)
+	return readSpeciesGroup(massFraction, conc, gc.readChemGroupAlt, gc.readChemGroup)
+}
+
 func (gc *GEOSChem) readApBp(varName string) NextData {
 	if gc.geosApBp != "" {
 		return nextDataConstantNCF(strings.ToLower(varName), gc.geosApBp)
@@ -637,37 +683,37 @@ func (gc *GEOSChem) W() NextData {
 }
 
 // AVOC helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) AVOC() NextData { return gc.readChemGroupAlt(gc.aVOC) }
+func (gc *GEOSChem) AVOC() NextData { return gc.readSpeciesGroup("AVOC") }
 
 // BVOC helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) BVOC() NextData { return gc.readChemGroupAlt(gc.bVOC) }
+func (gc *GEOSChem) BVOC() NextData { return gc.readSpeciesGroup("BVOC") }
 
 // NOx helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) NOx() NextData { return gc.readChemGroupAlt(gc.nox) }
+func (gc *GEOSChem) NOx() NextData { return gc.readSpeciesGroup("NOx") }
 
 // SOx helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) SOx() NextData { return gc.readChemGroupAlt(gc.sox) }
+func (gc *GEOSChem) SOx() NextData { return gc.readSpeciesGroup("SOx") }
 
 // NH3 helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) NH3() NextData { return gc.readChemGroupAlt(gc.nh3) }
+func (gc *GEOSChem) NH3() NextData { return gc.readSpeciesGroup("NH3") }
 
 // ASOA helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) ASOA() NextData { return gc.readChemGroupAlt(gc.aSOA) }
+func (gc *GEOSChem) ASOA() NextData { return gc.readSpeciesGroup("ASOA") }
 
 // BSOA helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) BSOA() NextData { return gc.readChemGroupAlt(gc.bSOA) }
+func (gc *GEOSChem) BSOA() NextData { return gc.readSpeciesGroup("BSOA") }
 
 // PNO helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) PNO() NextData { return gc.readChemGroupAlt(gc.pNO) }
+func (gc *GEOSChem) PNO() NextData { return gc.readSpeciesGroup("PNO") }
 
 // PS helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) PS() NextData { return gc.readChemGroupAlt(gc.pS) }
+func (gc *GEOSChem) PS() NextData { return gc.readSpeciesGroup("PS") }
 
 // PNH helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) PNH() NextData { return gc.readChemGroupAlt(gc.pNH) }
+func (gc *GEOSChem) PNH() NextData { return gc.readSpeciesGroup("PNH") }
 
 // TotalPM25 helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) TotalPM25() NextData { return gc.readChemGroupAlt(gc.totalPM25) }
+func (gc *GEOSChem) TotalPM25() NextData { return gc.readSpeciesGroup("TotalPM25") }
 
 // SurfaceHeatFlux helps fulfill the Preprocessor interface by returning
 // sensible heat flux from turbulence [W/m2].
@@ -278,3 +278,44 @@ func TestCellAlignment(t *testing.T) {
 	}
 	d.TestCellAlignment2(t)
 }
+
+func TestTimestepLimits(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			inmap.SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	limits := d.TimestepLimits()
+	if len(limits) == 0 {
+		t.Fatal("no time step limits")
+	}
+	if limits[0].Dt != d.Dt {
+		t.Errorf("limiting time step %g != model time step %g", limits[0].Dt, d.Dt)
+	}
+	processes := make(map[string]bool)
+	for i, l := range limits {
+		if processes[l.Process] {
+			t.Errorf("process %s is listed more than once", l.Process)
+		}
+		processes[l.Process] = true
+		if l.Cell == nil {
+			t.Errorf("%s: missing grid cell", l.Process)
+		}
+		if i > 0 && l.Dt < limits[i-1].Dt {
+			t.Errorf("limits are not sorted: %v", limits)
+		}
+	}
+	for _, p := range []string{"chemistry", "wet deposition", "dry deposition"} {
+		if !processes[p] {
+			t.Errorf("missing time step limit for %s", p)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/emissions/aep"
+	"github.com/spatialmodel/inmap/emissions/aep/aeputil"
+)
+
+// AEPConfig holds configuration information for reading emissions
+// inventories such as the US National Emissions Inventory in FF10 or ORL
+// format using the aep package (github.com/spatialmodel/inmap/emissions/aep).
+// It is read from the [AEP] table of a TOML configuration file.
+type AEPConfig struct {
+	// InventoryConfig specifies the inventory files to read and the
+	// pollutants to keep from them.
+	InventoryConfig aeputil.InventoryConfig
+
+	// SpeciateConfig specifies how the inventory pollutants should be
+	// chemically speciated. Speciation is only carried out if
+	// SpeciateConfig.SpecRef is specified, in which case MassSpeciation
+	// must be true. If SpeciateConfig.Speciation is empty,
+	// InventoryConfig.PolsToKeep is used instead.
+	SpeciateConfig aeputil.SpeciateConfig
+
+	// SpatialConfig specifies how the inventory records should be
+	// allocated to the InMAP grid. Its GridCells are set to the ground-level
+	// InMAP grid cells, and OutputSR defaults to the InMAP grid projection.
+	SpatialConfig aeputil.SpatialConfig
+
+	// InMAPPollutants maps each of the InMAP emissions pollutants
+	// ("VOC", "NOx", "NH3", "SOx", and "PM25") to the names of the
+	// inventory pollutants, or of the speciated pollutants if speciation
+	// is carried out, that should be added to it. If it is empty and no
+	// speciation is carried out, the mapping is determined from the SpecType
+	// and SpecNames of the pollutants in InventoryConfig.PolsToKeep.
+	InMAPPollutants map[string][]string
+
+	// TemporalConfig specifies how the inventory emissions vary in time
+	// in time-resolved simulations. It has no effect on steady-state
+	// simulations, where the annual average emissions rate is used.
+	TemporalConfig TemporalConfig
+}
+
+// TemporalConfig holds emissions temporal allocation configuration
+// information.
+type TemporalConfig struct {
+	// TemporalRef and TemporalPro give the locations of the SMOKE-format
+	// temporal cross-reference and temporal profile files, in the format
+	// described in aep.NewTemporalRef. If they are not specified, the
+	// emissions are constant in time. They can include environment variables.
+	TemporalRef, TemporalPro string
+
+	// SCCExactMatch specifies whether SCC and FIPS codes must match
+	// the temporal cross-reference records exactly.
+	SCCExactMatch bool
+
+	// TimeZoneShapefile gives the location of a shapefile of time zone
+	// boundaries, and TimeZoneColumn is the attribute column within it that
+	// contains either IANA time zone database names (e.g., "America/Chicago")
+	// or offsets from UTC in hours (e.g., "-6"). The temporal profiles
+	// are applied in the local time of each emissions source.
+	TimeZoneShapefile, TimeZoneColumn string
+
+	// DefaultTimeZone is the time zone, in the same format as the values in
+	// TimeZoneColumn, of emissions sources that are not within any of the
+	// shapes in TimeZoneShapefile, or of all emissions sources if
+	// TimeZoneShapefile is not specified. If it is empty, UTC is used.
+	DefaultTimeZone string
+}
+
+// ReadAEPConfig reads the [AEP] table from the TOML configuration file
+// configFile. It returns nil if configFile is empty, is not a TOML file,
+// or does not contain an [AEP] table.
+func ReadAEPConfig(configFile string) (*AEPConfig, error) {
+	if configFile == "" || strings.ToLower(filepath.Ext(configFile)) != ".toml" {
+		return nil, nil
+	}
+	var c struct{ AEP *AEPConfig }
+	if _, err := toml.DecodeFile(configFile, &c); err != nil {
+		return nil, fmt.Errorf("inmap: reading AEP configuration: %v", err)
+	}
+	if c.AEP != nil {
+		if err := c.AEP.TemporalConfig.check(); err != nil {
+			return nil, err
+		}
+	}
+	return c.AEP, nil
+}
+
+// check returns an error if the receiver is incomplete.
+func (c *TemporalConfig) check() error {
+	if (c.TemporalRef == "") != (c.TemporalPro == "") {
+		return fmt.Errorf("inmap: AEP.TemporalConfig.TemporalRef and TemporalPro must be specified together")
+	}
+	if c.TimeZoneShapefile != "" && c.TimeZoneColumn == "" {
+		return fmt.Errorf("inmap: AEP.TemporalConfig.TimeZoneColumn must be specified with TimeZoneShapefile")
+	}
+	if _, err := inmap.TimeZone(c.DefaultTimeZone); err != nil {
+		return fmt.Errorf("inmap: AEP.TemporalConfig.DefaultTimeZone: %v", err)
+	}
+	return nil
+}
+
+// attachProfiles returns recs with the temporal profiles specified
+// by the receiver attached, as described in aep.TemporalRef.AttachProfiles.
+// If no temporal profiles are specified, recs is returned unchanged.
+func (c *TemporalConfig) attachProfiles(recs []aep.Record) ([]aep.Record, error) {
+	if c.TemporalRef == "" {
+		return recs, nil
+	}
+	ref, err := os.Open(os.ExpandEnv(c.TemporalRef))
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening temporal cross-reference file: %v", err)
+	}
+	defer ref.Close()
+	pro, err := os.Open(os.ExpandEnv(c.TemporalPro))
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening temporal profile file: %v", err)
+	}
+	defer pro.Close()
+	tr, err := aep.NewTemporalRef(ref, pro)
+	if err != nil {
+		return nil, err
+	}
+	return tr.AttachProfiles(recs, !c.SCCExactMatch)
+}
+
+// setTimeZones sets the TimeZone of each cell in grid to the time zone
+// specified by the receiver at the cell's centroid.
+func (c *TemporalConfig) setTimeZones(grid *aep.GridDef) error {
+	for _, cell := range grid.Cells {
+		cell.TimeZone = c.DefaultTimeZone
+	}
+	if c.TimeZoneShapefile == "" {
+		return nil
+	}
+	fname := os.ExpandEnv(c.TimeZoneShapefile)
+	f, err := shp.NewDecoder(fname)
+	if err != nil {
+		return fmt.Errorf("inmap: opening time zone shapefile: %v", err)
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		return fmt.Errorf("inmap: reading projection of time zone shapefile %s: %v", fname, err)
+	}
+	trans, err := sr.NewTransform(grid.SR)
+	if err != nil {
+		return fmt.Errorf("inmap: time zone shapefile %s: %v", fname, err)
+	}
+	type zone struct {
+		geom.Polygonal
+		name string
+	}
+	index := rtree.NewTree(25, 50)
+	for {
+		g, data, more := f.DecodeRowFields(c.TimeZoneColumn)
+		if !more {
+			break
+		}
+		name, ok := data[c.TimeZoneColumn]
+		if !ok {
+			return fmt.Errorf("inmap: time zone shapefile %s does not contain column %s", fname, c.TimeZoneColumn)
+		}
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return fmt.Errorf("inmap: time zone shapefile %s: %v", fname, err)
+		}
+		p, ok := gg.(geom.Polygonal)
+		if !ok {
+			return fmt.Errorf("inmap: time zone shapefile %s: shapes need to be polygons", fname)
+		}
+		index.Insert(zone{Polygonal: p, name: strings.TrimSpace(name)})
+	}
+	if err := f.Error(); err != nil {
+		return fmt.Errorf("inmap: time zone shapefile %s: %v", fname, err)
+	}
+	for _, cell := range grid.Cells {
+		centroid := cell.Centroid()
+		for _, z := range index.SearchIntersect(centroid.Bounds()) {
+			if centroid.Within(z.(zone).Polygonal) != geom.Outside {
+				cell.TimeZone = z.(zone).name
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// pollutants returns the inventory or speciated pollutants that should be
+// mapped to each of the InMAP emissions pollutants.
+func (c *AEPConfig) pollutants() (VOC, NOx, NH3, SOx, PM25 []aep.Pollutant, err error) {
+	if len(c.InMAPPollutants) == 0 {
+		if c.SpeciateConfig.SpecRef != "" {
+			return nil, nil, nil, nil, nil, fmt.Errorf("inmap: AEP.InMAPPollutants must be specified when emissions are speciated")
+		}
+		for name, s := range c.InventoryConfig.PolsToKeep {
+			p := aep.Pollutant{Name: name}
+			switch s.SpecType {
+			case aep.VOC, aep.VOCUngrouped:
+				VOC = append(VOC, p)
+			case aep.NOx:
+				NOx = append(NOx, p)
+			case aep.PM25:
+				PM25 = append(PM25, p)
+			default:
+				switch {
+				case matchPol(name, s.SpecNames.Names, "NH3"):
+					NH3 = append(NH3, p)
+				case matchPol(name, s.SpecNames.Names, "SOx", "SO2"):
+					SOx = append(SOx, p)
+				default:
+					return nil, nil, nil, nil, nil, fmt.Errorf("inmap: can't determine the InMAP pollutant for AEP pollutant %s; "+
+						"please specify it in AEP.InMAPPollutants", name)
+				}
+			}
+		}
+		return
+	}
+	for inmapPol, names := range c.InMAPPollutants {
+		var pols *[]aep.Pollutant
+		switch inmapPol {
+		case "VOC":
+			pols = &VOC
+		case "NOx":
+			pols = &NOx
+		case "NH3":
+			pols = &NH3
+		case "SOx":
+			pols = &SOx
+		case "PM25":
+			pols = &PM25
+		default:
+			return nil, nil, nil, nil, nil, fmt.Errorf("inmap: invalid InMAP pollutant '%s' in AEP.InMAPPollutants; "+
+				"valid options are VOC, NOx, NH3, SOx, and PM25", inmapPol)
+		}
+		for _, name := range names {
+			*pols = append(*pols, aep.Pollutant{Name: name})
+		}
+	}
+	return
+}
+
+// matchPol returns whether the pollutant name or any of its
+// SPECIATE names matches any of the options, ignoring case.
+func matchPol(name string, specNames []string, options ...string) bool {
+	for _, n := range append([]string{name}, specNames...) {
+		for _, o := range options {
+			if strings.EqualFold(n, o) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddEmissions returns a function that reads, speciates, and spatially
+// allocates the inventory emissions specified by the receiver to the
+// ground-level cells of the InMAP grid, adds the resulting records to emis,
+// and recalculates the emissions flux of each grid cell. gridProj is
+// the projection of the InMAP grid.
+func (c *AEPConfig) AddEmissions(emis *inmap.Emissions, gridProj string, m inmap.Mechanism) inmap.DomainManipulator {
+	return func(d *inmap.InMAP) error {
+		if err := c.ReadEmissions(emis, d.GetGeometry(0, false), gridProj); err != nil {
+			return err
+		}
+		return inmap.SetEmissionsFlux(emis, m)(d)
+	}
+}
+
+// ReadEmissions reads, speciates, and spatially allocates the inventory
+// emissions specified by the receiver to gridCells, which should be
+// the ground-level cells of the InMAP grid in projection gridProj,
+// and adds the resulting records to emis. The inventory report tables
+// are written to the log.
+func (c *AEPConfig) ReadEmissions(emis *inmap.Emissions, gridCells []geom.Polygonal, gridProj string) error {
+	VOC, NOx, NH3, SOx, PM25, err := c.pollutants()
+	if err != nil {
+		return err
+	}
+	if c.SpeciateConfig.SpecRef != "" && !c.SpeciateConfig.MassSpeciation {
+		return fmt.Errorf("inmap: AEP.SpeciateConfig.MassSpeciation must be true")
+	}
+
+	log.Println("Reading AEP emissions inventory...")
+	records, report, err := c.InventoryConfig.ReadEmissions()
+	if err != nil {
+		return err
+	}
+
+	c.SpatialConfig.GridCells = gridCells
+	if c.SpatialConfig.OutputSR == "" {
+		c.SpatialConfig.OutputSR = gridProj
+	}
+	if c.SpatialConfig.GridName == "" {
+		c.SpatialConfig.GridName = "InMAP"
+	}
+
+	iter := aeputil.IteratorFromMap(records)
+	if c.SpeciateConfig.SpecRef != "" {
+		if len(c.SpeciateConfig.Speciation) == 0 {
+			c.SpeciateConfig.Speciation = c.InventoryConfig.PolsToKeep
+		}
+		iter = c.SpeciateConfig.Iterator(iter)
+		report.AddData(iter.Report().Data...)
+	}
+	spatialIter := c.SpatialConfig.Iterator(iter, 0)
+	report.AddData(spatialIter.Report().Data...)
+
+	log.Println("Spatially allocating AEP emissions...")
+	var recs []aep.Record
+	for {
+		rec, err := spatialIter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		recs = append(recs, rec)
+	}
+	if recs, err = c.TemporalConfig.attachProfiles(recs); err != nil {
+		return err
+	}
+	sp, err := c.SpatialConfig.SpatialProcessor()
+	if err != nil {
+		return err
+	}
+	if err = c.TemporalConfig.setTimeZones(sp.Grids[0]); err != nil {
+		return err
+	}
+	aepEmis, err := inmap.EmissionsFromAEP(recs, sp, 0, VOC, NOx, NH3, SOx, PM25)
+	if err != nil {
+		return err
+	}
+	for _, er := range aepEmis.EmisRecords() {
+		emis.AddWithProfile(er, aepEmis.Profile(er))
+	}
+	logInventoryReport(report)
+	return nil
+}
+
+// logInventoryReport writes the emissions totals and dropped emissions
+// totals tables in report to the log.
+func logInventoryReport(report *aep.InventoryReport) {
+	for _, t := range []struct {
+		name  string
+		table aep.Table
+	}{
+		{name: "AEP emissions totals:", table: report.TotalsTable()},
+		{name: "AEP dropped emissions totals:", table: report.DroppedTotalsTable()},
+	} {
+		b := new(bytes.Buffer)
+		if _, err := t.table.Tabbed(b); err != nil {
+			panic(err) // Writing to a buffer shouldn't fail.
+		}
+		log.Printf("%s\n%s", t.name, b.String())
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/emissions/aep"
+)
+
+const testAEPConfig = `
+[AEP.InventoryConfig]
+InputUnits = "tons"
+[AEP.InventoryConfig.NEIFiles]
+othar = ["${INMAP_ROOT_DIR}/emissions/aep/aeputil/testdata/testemis.csv"]
+[AEP.InventoryConfig.PolsToKeep.VOC]
+SpecType = "VOC"
+[AEP.InventoryConfig.PolsToKeep.NOX]
+SpecType = "NOx"
+[AEP.InventoryConfig.PolsToKeep.PM2_5]
+SpecType = "PM2.5"
+[AEP.InventoryConfig.PolsToKeep.PM25-PRI]
+SpecType = "PM2.5"
+[AEP.InventoryConfig.PolsToKeep.NH3.SpecNames]
+Names = ["Ammonia"]
+[AEP.InventoryConfig.PolsToKeep.SO2.SpecNames]
+Names = ["Sulfur dioxide"]
+[AEP.SpatialConfig]
+SrgSpec = "${INMAP_ROOT_DIR}/emissions/aep/aeputil/testdata/surrogate_specification.csv"
+SrgShapefileDirectory = "${INMAP_ROOT_DIR}/emissions/aep/testdata"
+GridRef = ["${INMAP_ROOT_DIR}/emissions/aep/aeputil/testdata/gridref.txt"]
+InputSR = "+proj=longlat"
+`
+
+func TestReadAEPConfig(t *testing.T) {
+	c, err := ReadAEPConfig("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		t.Errorf("configuration without an [AEP] table should return nil, not %+v", c)
+	}
+
+	const fileName = "testAEPConfig.toml"
+	if err := ioutil.WriteFile(fileName, []byte(testAEPConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileName)
+	c, err = ReadAEPConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.InventoryConfig.InputUnits != "tons" {
+		t.Errorf("InputUnits: %s != tons", c.InventoryConfig.InputUnits)
+	}
+	// Pollutant names should keep their case.
+	if _, ok := c.InventoryConfig.PolsToKeep["PM25-PRI"]; !ok {
+		t.Errorf("missing pollutant PM25-PRI in %v", c.InventoryConfig.PolsToKeep)
+	}
+
+	names := func(pols []aep.Pollutant) []string {
+		var o []string
+		for _, p := range pols {
+			o = append(o, p.Name)
+		}
+		sort.Strings(o)
+		return o
+	}
+	t.Run("PolsToKeep", func(t *testing.T) {
+		VOC, NOx, NH3, SOx, PM25, err := c.pollutants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := [][]string{names(VOC), names(NOx), names(NH3), names(SOx), names(PM25)}
+		want := [][]string{{"VOC"}, {"NOX"}, {"NH3"}, {"SO2"}, {"PM25-PRI", "PM2_5"}}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	})
+	t.Run("InMAPPollutants", func(t *testing.T) {
+		c2 := &AEPConfig{InMAPPollutants: map[string][]string{"VOC": {"PAR", "TOL"}, "PM25": {"PEC"}}}
+		VOC, NOx, _, _, PM25, err := c2.pollutants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := [][]string{names(VOC), names(NOx), names(PM25)}
+		want := [][]string{{"PAR", "TOL"}, nil, {"PEC"}}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+		c2.InMAPPollutants["CO"] = []string{"CO"}
+		if _, _, _, _, _, err := c2.pollutants(); err == nil {
+			t.Error("expected an error for an invalid InMAP pollutant")
+		}
+	})
+	t.Run("TemporalConfig", func(t *testing.T) {
+		for _, test := range []struct {
+			c   TemporalConfig
+			err bool
+		}{
+			{c: TemporalConfig{}},
+			{c: TemporalConfig{TemporalRef: "ref", TemporalPro: "pro", DefaultTimeZone: "America/Chicago"}},
+			{c: TemporalConfig{TemporalRef: "ref"}, err: true},
+			{c: TemporalConfig{TimeZoneShapefile: "tz.shp"}, err: true},
+			{c: TemporalConfig{DefaultTimeZone: "Mars/Olympus_Mons"}, err: true},
+		} {
+			if err := test.c.check(); (err != nil) != test.err {
+				t.Errorf("%+v: have error %v, want error %v", test.c, err, test.err)
+			}
+		}
+		grid := aep.NewGridRegular("test", 2, 1, 1, 1, 0, 0, nil)
+		tc := TemporalConfig{DefaultTimeZone: "-5"}
+		if err := tc.setTimeZones(grid); err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range grid.Cells {
+			if cell.TimeZone != "-5" {
+				t.Errorf("cell time zone: have %q, want -5", cell.TimeZone)
+			}
+		}
+	})
+}
+
+func TestInMAPAEP(t *testing.T) {
+	base, err := ioutil.ReadFile("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const configFile = "testAEPRun.toml"
+	if err := ioutil.WriteFile(configFile, append(base, []byte(testAEPConfig)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile)
+
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	os.Setenv("InMAPRunType", "staticAEP")
+	cfg.Set("config", configFile)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	defer inmap.DeleteShapefile(cfg.GetString("OutputFile"))
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cfg.GetString("LogFile"))
+	b, err := ioutil.ReadFile(cfg.GetString("LogFile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"AEP emissions totals:", "AEP dropped emissions totals:", "NOX (kg)", "Spatial"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("log file does not contain %q", s)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+)
+
+// BoundaryConditionsConfig specifies the concentrations of pollutants
+// just outside of the model domain.
+type BoundaryConditionsConfig struct {
+	// Type is the type of boundary conditions: "zero" (the default)
+	// for zero concentrations, "inmap" for concentrations from the
+	// shapefile output of a previous InMAP simulation (see
+	// inmap.NewInMAPBoundaryConditions), or "netcdf" for the baseline
+	// concentrations in preprocessed CTM data (see
+	// inmap.NewCTMBoundaryConditions).
+	Type string
+
+	// Files are the paths to the files holding the boundary concentrations.
+	Files []string
+
+	// Times are the times of each of the Files, in the format
+	// "YYYYMMDD" or "YYYYMMDDTHH", for time-varying boundary conditions.
+	// It can be empty if there is only one file.
+	Times []string
+}
+
+// BoundaryConditions returns the boundary conditions specified by c for a
+// simulation using the grid configuration VarGrid and chemical mechanism m.
+// It returns nil if c is nil or the boundary conditions are zero.
+func (c *BoundaryConditionsConfig) BoundaryConditions(VarGrid *inmap.VarGridConfig, m inmap.Mechanism) (inmap.BoundaryConditions, error) {
+	if c == nil || c.Type == "" || c.Type == "zero" {
+		return nil, nil
+	}
+	times := make([]time.Time, len(c.Times))
+	for i, t := range c.Times {
+		var err error
+		times[i], err = inmap.ParseDate(t)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: boundary condition time: %v", err)
+		}
+	}
+	log.Println("Loading boundary conditions...")
+	switch c.Type {
+	case "inmap":
+		sr, err := spatialRef(VarGrid)
+		if err != nil {
+			return nil, err
+		}
+		return inmap.NewInMAPBoundaryConditions(removeShpSupportFiles(c.Files), times, sr, m)
+	case "netcdf":
+		data := make([]*inmap.CTMData, len(c.Files))
+		for i, f := range c.Files {
+			// Use a copy of the grid configuration so that the CTM grid
+			// of the boundary conditions does not replace that of the simulation.
+			vgc := *VarGrid
+			var err error
+			data[i], err = getCTMData(f, &vgc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return inmap.NewCTMBoundaryConditions(data, times, m)
+	default:
+		return nil, fmt.Errorf("inmap: invalid boundary condition type '%s'; valid types are 'zero', 'inmap', and 'netcdf'", c.Type)
+	}
+}
@@ -34,7 +34,7 @@ import (
 	"github.com/lnashier/viper"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/spatialmodel/inmap"
-	"github.com/spatialmodel/inmap/science/chem/simplechem"
+	_ "github.com/spatialmodel/inmap/science/chem/extendedchem" // Register the extendedchem mechanism.
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
@@ -51,9 +51,9 @@ type Cfg struct {
 	// files.
 	outputFiles []string
 
-	Root, versionCmd, runCmd, preprocCmd, steadyCmd, gridCmd                *cobra.Command
-	srCmd, srPredictCmd, srStartCmd, srSaveCmd, srCleanCmd                  *cobra.Command
-	cloudCmd, cloudStartCmd, cloudStatusCmd, cloudOutputCmd, cloudDeleteCmd *cobra.Command
+	Root, versionCmd, runCmd, preprocCmd, preprocCheckCmd, steadyCmd, transientCmd, periodicCmd, nestedCmd, ensembleCmd, gridCmd, workerCmd *cobra.Command
+	srCmd, srPredictCmd, srStartCmd, srSaveCmd, srCleanCmd                                                                                  *cobra.Command
+	cloudCmd, cloudStartCmd, cloudStatusCmd, cloudOutputCmd, cloudDeleteCmd                                                                 *cobra.Command
 }
 
 // InputFiles returns the names of the configuration options that are input
@@ -115,7 +115,7 @@ func InitializeConfig() *Cfg {
 		Use:   "run",
 		Short: "Run the model.",
 		Long: `run runs an InMAP simulation. Use the subcommands specified below to
-	choose a run mode. (Currently 'steady' is the only available run mode.)`,
+	choose a run mode.`,
 		DisableAutoGenTag: true,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			outputFile, err := checkOutputFile(cfg.GetString("OutputFile"))
@@ -133,6 +133,21 @@ func InitializeConfig() *Cfg {
 		Short: "Run InMAP in steady-state mode.",
 		Long: `steady runs InMAP in steady-state mode to calculate annual average
 	concentrations with no temporal variability.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSteady(cmd, cfg.Viper)
+		},
+		DisableAutoGenTag: true,
+	}
+
+	// transientCmd is a command that runs a time-resolved simulation.
+	cfg.transientCmd = &cobra.Command{
+		Use:   "transient",
+		Short: "Run InMAP in time-resolved mode.",
+		Long: `transient runs InMAP in time-resolved (transient) mode, where the
+	meteorology changes over time according to a series of preprocessed
+	snapshots and concentrations are output at regular intervals.
+	The variable resolution grid is created from the first snapshot
+	using the static grid settings.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			outChan := outChan()
 
@@ -152,27 +167,162 @@ func InitializeConfig() *Cfg {
 			if err != nil {
 				return err
 			}
+			mech, err := getMechanism(cfg.Viper)
+			if err != nil {
+				return err
+			}
+			scienceFuncs, err := ScienceFuncs(mech)
+			if err != nil {
+				return err
+			}
 
 			shapeFiles := removeShpSupportFiles(expandStringSlice(cfg.GetStringSlice("EmissionsShapefiles")))
 			// This goes over each shapeFile and downloads it if necessary.
 			for i := range shapeFiles {
 				shapeFiles[i] = maybeDownload(context.TODO(), shapeFiles[i], outChan)
 			}
+			aepConfig, err := ReadAEPConfig(cfg.GetString("config"))
+			if err != nil {
+				return err
+			}
 
-			return Run(
+			return RunTransient(
 				cmd,
 				cfg.GetString("LogFile"),
 				outputFile,
+				cfg.GetString("OutputProj"),
 				cfg.GetBool("OutputAllLayers"),
 				outputVars,
 				emisUnits,
 				shapeFiles,
+				GetStringMapString("EmissionsColumns", cfg.Viper),
+				aepConfig,
 				vgc,
-				maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("InMAPData")), outChan),
-				maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("VariableGridData")), outChan),
+				os.ExpandEnv(cfg.GetString("InMAPData")),
+				os.ExpandEnv(cfg.GetString("Transient.StartDate")),
+				os.ExpandEnv(cfg.GetString("Transient.EndDate")),
+				cfg.GetString("Transient.SnapshotInterval"),
+				cfg.GetString("Transient.OutputInterval"),
+				&BoundaryConditionsConfig{
+					Type:  cfg.GetString("BoundaryConditions.Type"),
+					Files: expandStringSlice(cfg.GetStringSlice("BoundaryConditions.Files")),
+					Times: cfg.GetStringSlice("BoundaryConditions.Times"),
+				},
+				scienceFuncs, nil, nil, nil,
+				mech)
+		},
+		DisableAutoGenTag: true,
+	}
+
+	// periodicCmd is a command that runs a steady-state simulation for each
+	// season or month.
+	cfg.periodicCmd = &cobra.Command{
+		Use:   "periodic",
+		Short: "Run InMAP in steady-state mode for each season or month.",
+		Long: `periodic runs a separate steady-state InMAP simulation for each
+	season or month, using meteorology and emissions specific to each period,
+	and combines the results into an average over the whole simulation, where
+	each period is weighted by its length. Results are output for each
+	period and for the average. The variable resolution grid is created
+	from the first period using the static grid settings.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			outChan := outChan()
+
+			vgc, err := VarGridConfig(cfg.Viper)
+			if err != nil {
+				return err
+			}
+			outputFile, err := checkOutputFile(cfg.GetString("OutputFile"))
+			if err != nil {
+				return err
+			}
+			outputVars, err := checkOutputVars(GetStringMapString("OutputVariables", cfg.Viper))
+			if err != nil {
+				return err
+			}
+			emisUnits, err := checkEmissionUnits(cfg.GetString("EmissionUnits"))
+			if err != nil {
+				return err
+			}
+			mech, err := getMechanism(cfg.Viper)
+			if err != nil {
+				return err
+			}
+			scienceFuncs, err := ScienceFuncs(mech)
+			if err != nil {
+				return err
+			}
+
+			shapeFiles := removeShpSupportFiles(expandStringSlice(cfg.GetStringSlice("EmissionsShapefiles")))
+			// This goes over each shapeFile and downloads it if necessary.
+			// Files that vary by period are downloaded when they are read.
+			for i := range shapeFiles {
+				if !strings.Contains(shapeFiles[i], "[DATE]") {
+					shapeFiles[i] = maybeDownload(context.TODO(), shapeFiles[i], outChan)
+				}
+			}
+
+			return RunPeriodic(
+				cmd,
+				cfg.GetString("LogFile"),
+				outputFile,
+				cfg.GetString("OutputProj"),
+				cfg.GetBool("OutputAllLayers"),
+				outputVars,
+				emisUnits,
+				shapeFiles,
+				GetStringMapString("EmissionsColumns", cfg.Viper),
+				vgc,
+				os.ExpandEnv(cfg.GetString("InMAPData")),
+				os.ExpandEnv(cfg.GetString("Periodic.StartDate")),
+				os.ExpandEnv(cfg.GetString("Periodic.EndDate")),
+				cfg.GetString("Periodic.Periods"),
 				cfg.GetInt("NumIterations"),
-				!cfg.GetBool("static"), cfg.GetBool("createGrid"), DefaultScienceFuncs, nil, nil, nil,
-				simplechem.Mechanism{})
+				scienceFuncs, nil, nil, nil,
+				mech)
+		},
+		DisableAutoGenTag: true,
+	}
+
+	// nestedCmd is a command that runs a steady-state simulation of an inner
+	// domain nested within a steady-state simulation of an outer domain.
+	cfg.nestedCmd = &cobra.Command{
+		Use:   "nested",
+		Short: "Run InMAP in steady-state mode for a domain nested within a larger domain.",
+		Long: `nested runs a steady-state simulation of an outer domain and then uses
+	its results as the boundary conditions of a steady-state simulation of a
+	smaller inner domain, which can have its own grid and meteorology. The outer
+	domain uses the same configuration as "inmap run steady", and the inner domain
+	uses the configuration in the file specified by Nested.Config, which only needs
+	to contain the options that are different from those of the outer domain, such
+	as OutputFile, InMAPData, and the [VarGrid] table.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inner, err := nestedConfig(cfg.Viper, cfg.GetString("Nested.Config"))
+			if err != nil {
+				return err
+			}
+			return RunNested(cmd, cfg.Viper, inner)
+		},
+		DisableAutoGenTag: true,
+	}
+
+	// ensembleCmd is a command that runs an ensemble of steady-state simulations
+	// with perturbed science parameters.
+	cfg.ensembleCmd = &cobra.Command{
+		Use:   "ensemble",
+		Short: "Run an ensemble of steady-state InMAP simulations with perturbed parameters.",
+		Long: `ensemble runs an ensemble of steady-state simulations where the science
+	parameters of the grid cells (for example, Kzz or SO2oxidation) and the
+	parameters of the output variable expressions (for example, hazard ratio
+	coefficients) are sampled from the distributions specified in the
+	[Ensemble] table, and outputs the mean, standard deviation, and percentiles
+	of the output variables across the ensemble members. The members use the
+	same options as "inmap run steady", but all members share the same static
+	grid, and source tags, mass budgets, checkpoints, and distributed workers
+	are not supported. Because the output is written to a local directory,
+	ensembles cannot be run on a cluster using "inmap cloud".`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runEnsemble(cmd, cfg.Viper)
 		},
 		DisableAutoGenTag: true,
 	}
@@ -199,6 +349,19 @@ func InitializeConfig() *Cfg {
 		DisableAutoGenTag: true,
 	}
 
+	cfg.workerCmd = &cobra.Command{
+		Use:   "worker",
+		Short: "Start a worker for distributed simulations",
+		Long: `worker starts a process that simulates a subdomain of a distributed
+	steady-state simulation. It listens for connections at Worker.Address
+	until it is stopped. Distributed simulations are started using the
+	Workers option of "inmap run steady".`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Worker(cfg.GetString("Worker.Address"))
+		},
+		DisableAutoGenTag: true,
+	}
+
 	cfg.preprocCmd = &cobra.Command{
 		Use:   "preproc",
 		Short: "Preprocess CTM output",
@@ -222,15 +385,58 @@ func InitializeConfig() *Cfg {
 				os.ExpandEnv(cfg.GetString("Preproc.GEOSChem.GEOSApBp")),
 				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.GEOSChem.GEOSChem")), outChan),
 				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.GEOSChem.VegTypeGlobal")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.CMAQ.METCRO3D")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.CMAQ.METCRO2D")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.CMAQ.METDOT3D")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.CMAQ.GRIDCRO2D")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.CMAQ.CONC")), outChan),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("Preproc.SpeciesGroups")), outChan),
 				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("InMAPData")), outChan),
 				cfg.GetFloat64("Preproc.CtmGridXo"),
 				cfg.GetFloat64("Preproc.CtmGridYo"),
 				cfg.GetFloat64("Preproc.CtmGridDx"),
 				cfg.GetFloat64("Preproc.CtmGridDy"),
+				cfg.GetString("Preproc.CtmGridProj"),
+				cfg.GetString("Preproc.TargetGrid.GridProj"),
+				cfg.GetFloat64("Preproc.TargetGrid.Xo"),
+				cfg.GetFloat64("Preproc.TargetGrid.Yo"),
+				cfg.GetFloat64("Preproc.TargetGrid.Dx"),
+				cfg.GetFloat64("Preproc.TargetGrid.Dy"),
+				cfg.GetInt("Preproc.TargetGrid.Nx"),
+				cfg.GetInt("Preproc.TargetGrid.Ny"),
 				cfg.GetBool("Preproc.GEOSChem.Dash"),
 				cfg.GetString("Preproc.GEOSChem.ChemRecordInterval"),
 				cfg.GetString("Preproc.GEOSChem.ChemFileInterval"),
 				cfg.GetBool("Preproc.GEOSChem.NoChemHourIndex"),
+				cfg.GetString("Preproc.SnapshotInterval"),
+				cfg.GetString("Preproc.Periods"),
+				cfg.GetInt("Preproc.TileRows"),
+				cfg.GetInt("Preproc.Concurrency"),
+				os.ExpandEnv(cfg.GetString("Preproc.TempDir")),
+			)
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cfg.preprocCheckCmd = &cobra.Command{
+		Use:   "check",
+		Short: "Check preprocessed CTM data",
+		Long: `check loads the preprocessed InMAP data file specified by
+	InMAPData, checks that each variable has the expected dimensions and
+	physically reasonable values, and reports statistics of each variable
+	in each vertical layer. If Preproc.Check.PlotDir is specified, maps and
+	histograms of the variables in Preproc.Check.Variables are saved there
+	as PNG files. An error is returned if any problems are found.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			outChan := outChan()
+			ctx := context.TODO()
+
+			return PreprocCheck(
+				cmd.OutOrStdout(),
+				maybeDownload(ctx, os.ExpandEnv(cfg.GetString("InMAPData")), outChan),
+				cfg.GetStringSlice("Preproc.Check.Variables"),
+				cfg.GetInt("Preproc.Check.Layer"),
+				os.ExpandEnv(cfg.GetString("Preproc.Check.PlotDir")),
 			)
 		},
 		DisableAutoGenTag: true,
@@ -468,8 +674,10 @@ func InitializeConfig() *Cfg {
 				emisUnits,
 				os.ExpandEnv(cfg.GetString("SR.OutputFile")),
 				outputFile,
+				cfg.GetString("OutputProj"),
 				outputVars,
 				shapeFiles,
+				GetStringMapString("EmissionsColumns", cfg.Viper),
 				vgc,
 			)
 		},
@@ -479,9 +687,11 @@ func InitializeConfig() *Cfg {
 	// Link the commands together.
 	cfg.Root.AddCommand(cfg.versionCmd)
 	cfg.Root.AddCommand(cfg.runCmd)
-	cfg.runCmd.AddCommand(cfg.steadyCmd)
+	cfg.runCmd.AddCommand(cfg.steadyCmd, cfg.transientCmd, cfg.periodicCmd, cfg.nestedCmd, cfg.ensembleCmd)
 	cfg.Root.AddCommand(cfg.gridCmd)
+	cfg.Root.AddCommand(cfg.workerCmd)
 	cfg.Root.AddCommand(cfg.preprocCmd)
+	cfg.preprocCmd.AddCommand(cfg.preprocCheckCmd)
 	cfg.Root.AddCommand(cfg.srCmd)
 	cfg.srCmd.AddCommand(cfg.srStartCmd, cfg.srSaveCmd, cfg.srCleanCmd)
 	cfg.Root.AddCommand(cfg.srPredictCmd)
@@ -516,6 +726,228 @@ func InitializeConfig() *Cfg {
 			defaultVal: false,
 			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
 		},
+		{
+			name: "Mechanism",
+			usage: `
+              Mechanism is the name of the chemical mechanism to use. Options are
+              "simplechem", which tracks nine lumped species, and "extendedchem",
+              which additionally tracks NO, NO2, and HNO3 separately and splits
+              organic matter into anthropogenic and biogenic precursor classes.
+              Mechanism settings are specified in a table with the same name as the
+              mechanism, for example ExtendedChem.OxidantScale.`,
+			defaultVal: "simplechem",
+			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags()},
+		},
+		{
+			name: "ExtendedChem.OxidantScale",
+			usage: `
+              ExtendedChem.OxidantScale is a factor by which the rates of the NO titration,
+              NO2 oxidation, and SO2 oxidation reactions in the "extendedchem" mechanism
+              are multiplied, for example to represent a change in ozone concentrations
+              relative to the baseline. It has no effect on other mechanisms.`,
+			defaultVal: 1.0,
+			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags()},
+		},
+		{
+			name: "restart",
+			usage: `
+              restart specifies whether to resume a simulation from the state
+              saved in Checkpoint.File rather than starting from the beginning.
+              The grid configuration, emissions, and chemical mechanism must
+              match those of the simulation that created the checkpoint.`,
+			defaultVal: false,
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "Checkpoint.File",
+			usage: `
+              Checkpoint.File is the path where the state of a steady-state simulation
+              should be periodically saved so that it can be resumed using the
+              restart option. It can include environment variables. If it is left
+              blank, checkpoints will not be saved.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "Checkpoint.Interval",
+			usage: `
+              Checkpoint.Interval is the amount of simulation time between
+              saving checkpoints (e.g., "24h").`,
+			defaultVal: "24h",
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "Workers",
+			usage: `
+              Workers is a list of the network addresses (e.g., "host1:9000,host2:9000")
+              of worker processes started with "inmap worker". If it is not empty,
+              the simulation grid will be divided among the workers, each of which
+              simulates a subdomain and exchanges the concentrations at the edges of
+              its subdomain with the other workers at each time step. Distributed
+              simulations require a static grid and can't be used with SourceTags,
+              BudgetInterval, or BoundaryConditions.`,
+			defaultVal: []string{},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "SourceTags",
+			usage: `
+              SourceTags is a list of source tags whose contributions to pollutant
+              concentrations should be tracked separately. The source tag of each
+              emissions record is read from the emissions file column specified by
+              EmissionsColumns.Tag. Memory use increases in proportion to the number
+              of tags, and tags can not be tracked in distributed simulations.`,
+			defaultVal: []string{},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "SourceTagOutputVariables",
+			usage: `
+              SourceTagOutputVariables is a list of the names of the OutputVariables that
+              should be output for each of the SourceTags, with names in the form
+              "Variable_tag". If it is empty, all OutputVariables are output for each tag.
+              The combined names are subject to the same restrictions as the names of
+              OutputVariables, so short variable names and tags should be used when the
+              output is written to a shapefile.`,
+			defaultVal: []string{},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "BudgetInterval",
+			usage: `
+              BudgetInterval specifies the amount of simulation time (e.g., "24h")
+              between reports of the mass budget of each pollutant in the log: the
+              mass that has been emitted, deposited, transformed by chemistry, and
+              transported out of each side of the domain. If it is empty, the mass
+              budget is not tracked. The budget can not be tracked in distributed
+              simulations.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
+		{
+			name: "BoundaryConditions.Type",
+			usage: `
+              BoundaryConditions.Type specifies the concentrations of pollutants just
+              outside of the model domain, which are carried into the domain by advection
+              and mixing: "zero" for zero concentrations, "inmap" for concentrations
+              interpolated from the shapefile output of a previous InMAP simulation of a
+              larger domain, or "netcdf" for the baseline concentrations in preprocessed
+              CTM data in the same format as InMAPData. Boundary conditions can not be
+              used in distributed simulations.`,
+			defaultVal: "zero",
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags(), cfg.transientCmd.Flags()},
+		},
+		{
+			name: "BoundaryConditions.Files",
+			usage: `
+              BoundaryConditions.Files are the paths to the files holding the boundary
+              concentrations. For the "inmap" type, the shapefiles need to have a column
+              named after each chemical species (e.g., "pSO4"), truncated to 10 characters,
+              and, to match the model layers, "LayerHt" and "Dz" columns holding the
+              LayerHeight and Dz of each grid cell. They can include environment variables.`,
+			defaultVal: []string{},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags(), cfg.transientCmd.Flags()},
+		},
+		{
+			name: "BoundaryConditions.Times",
+			usage: `
+              BoundaryConditions.Times are the times of each of the BoundaryConditions.Files
+              in the format "YYYYMMDD" or "YYYYMMDDTHH", which are used to interpolate
+              between the files in time-resolved simulations. Steady-state simulations use
+              the average of the files. It can be empty if there is only one file.`,
+			defaultVal: []string{},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags(), cfg.transientCmd.Flags()},
+		},
+		{
+			name: "Nested.Config",
+			usage: `
+              Nested.Config is the path to the configuration file for the inner domain
+              of a nested simulation. It only needs to contain the options that are
+              different from those of the outer domain, such as OutputFile, InMAPData,
+              and the [VarGrid] table. LogFile and Checkpoint.File are not copied
+              from the outer domain.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.nestedCmd.Flags()},
+		},
+		{
+			name: "Ensemble.Members",
+			usage: `
+              Ensemble.Members is the number of members in an ensemble simulation.`,
+			defaultVal: 10,
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Ensemble.Seed",
+			usage: `
+              Ensemble.Seed is the seed for the random number generator used to sample
+              the parameters of the ensemble members. Ensembles with the same seed
+              and distributions have the same parameters.`,
+			defaultVal: 1,
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Ensemble.Parallel",
+			usage: `
+              Ensemble.Parallel is the number of ensemble members to run at the same time.`,
+			defaultVal: 1,
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Ensemble.Percentiles",
+			usage: `
+              Ensemble.Percentiles are the percentiles of the output variables across the
+              ensemble members to output, in addition to the mean ("mean") and standard
+              deviation ("std"). Each statistic is written to a separate file, with the
+              name of the statistic (e.g., "p95") added to the OutputFile name.`,
+			defaultVal: []int{5, 50, 95},
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Ensemble.CellFactors",
+			usage: `
+              Ensemble.CellFactors maps the names of grid cell science parameters to the
+              distributions of the factors that they are multiplied by in each ensemble
+              member. Valid parameters are UDeviation, VDeviation, AOrgPartitioning,
+              BOrgPartitioning, SPartitioning, NOPartitioning, NHPartitioning, SO2oxidation,
+              ParticleWetDep, SO2WetDep, OtherGasWetDep, ParticleDryDep, NH3DryDep,
+              SO2DryDep, VOCDryDep, NOxDryDep, Kzz, Kxxyy, M2u, and M2d. Valid
+              distributions are "normal(mean, std)", "lognormal(mu, sigma)", where mu and
+              sigma are the mean and standard deviation of the logarithm of the factor,
+              "uniform(min, max)", and "triangular(min, mode, max)". Because factors cannot
+              be negative, distributions that can produce negative values, such as normal
+              distributions, are not allowed.`,
+			defaultVal: map[string]string{},
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Ensemble.Parameters",
+			usage: `
+              Ensemble.Parameters maps the names of parameters used in the OutputVariables
+              expressions, such as hazard ratio coefficients, to the distributions of their
+              values, using the same distributions as Ensemble.CellFactors. The sampled
+              values are substituted for the parameter names in the expressions of each
+              ensemble member.`,
+			defaultVal: map[string]string{},
+			flagsets:   []*pflag.FlagSet{cfg.ensembleCmd.Flags()},
+		},
+		{
+			name: "Worker.Address",
+			usage: `
+              Worker.Address is the network address (e.g., ":9000") where a worker
+              process should listen for connections from a distributed simulation.`,
+			defaultVal: ":9000",
+			flagsets:   []*pflag.FlagSet{cfg.workerCmd.Flags()},
+		},
+		{
+			name: "coarsen",
+			usage: `
+              coarsen specifies whether grid cells that have been divided during a
+              simulation with a dynamic grid should be combined again when the
+              concentration gradients around them become small, as determined by
+              VarGrid.PopConcThreshold. It has no effect if --static is true.`,
+			defaultVal: false,
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags()},
+		},
 		{
 			name: "creategrid",
 			usage: `
@@ -701,6 +1133,27 @@ func InitializeConfig() *Cfg {
 			},
 			flagsets: []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.gridCmd.Flags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
 		},
+		{
+			name: "VarGrid.RefinementFiles",
+			usage: `
+              VarGrid.RefinementFiles is a list of paths to shapefiles containing polygons,
+              lines, or points (for example, community boundaries, road corridors, or
+              facility locations) where the grid should have high resolution regardless
+              of population. Grid cells in layers below VarGrid.HiResLayers that intersect
+              any of the shapes will be divided to VarGrid.RefinementNestLevel.`,
+			defaultVal:  []string{},
+			isInputFile: true,
+			flagsets:    []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.gridCmd.Flags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
+		},
+		{
+			name: "VarGrid.RefinementNestLevel",
+			usage: `
+              VarGrid.RefinementNestLevel is the number of nest levels, including the outermost
+              level, that grid cells intersecting the shapes in VarGrid.RefinementFiles should
+              be divided to. If it is 0, they will be divided to the highest nest level.`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.gridCmd.Flags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
+		},
 		{
 			name: "InMAPData",
 			usage: `
@@ -708,7 +1161,7 @@ func InitializeConfig() *Cfg {
               The path can include environment variables.`,
 			defaultVal:  "${INMAP_ROOT_DIR}/cmd/inmap/testdata/testInMAPInputData.ncf",
 			isInputFile: true,
-			flagsets:    []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.gridCmd.Flags(), cfg.srStartCmd.Flags(), cfg.preprocCmd.Flags(), cfg.cloudStartCmd.Flags()},
+			flagsets:    []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.gridCmd.Flags(), cfg.srStartCmd.Flags(), cfg.preprocCmd.Flags(), cfg.preprocCheckCmd.Flags(), cfg.cloudStartCmd.Flags()},
 		},
 		{
 			name: "VariableGridData",
@@ -723,13 +1176,17 @@ func InitializeConfig() *Cfg {
 		{
 			name: "EmissionsShapefiles",
 			usage: `
-              EmissionsShapefiles are the paths to any emissions shapefiles.
+              EmissionsShapefiles are the paths to any emissions files. The file format
+              is determined by the file extension: ".shp" for shapefile, ".csv" for CSV,
+              ".geojson" for GeoJSON, or ".gpkg" for GeoPackage. CSV files need to have
+              either a column containing well-known text (WKT) geometries or longitude
+              and latitude columns, and their projection is read from a ".prj" file with
+              the same name if one exists; otherwise it is assumed to be longitude-latitude.
               Can be elevated or ground level; elevated files need to have columns
               labeled "height", "diam", "temp", and "velocity" containing stack
               information in units of m, m, K, and m/s, respectively.
-              Emissions will be allocated from the geometries in the shape file
-              to the InMAP computational grid, but the mapping projection of the
-              shapefile must be the same as the projection InMAP uses.
+              Emissions will be allocated from the geometries in the emissions files
+              to the InMAP computational grid.
               Can include environment variables.`,
 			defaultVal:  []string{"${INMAP_ROOT_DIR}/cmd/inmap/testdata/testEmis.shp"},
 			isInputFile: true,
@@ -739,19 +1196,44 @@ func InitializeConfig() *Cfg {
 			name: "EmissionUnits",
 			usage: `
               EmissionUnits gives the units that the input emissions are in.
-              Acceptable values are 'tons/year', 'kg/year', 'ug/s', and 'μg/s'.`,
+              It can be any unit of mass per time, for example 'tons/year', 'kg/year',
+              'lb/hr', 'ug/s', or 'μg/s'.`,
 			defaultVal: "tons/year",
 			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.srPredictCmd.Flags(), cfg.cloudStartCmd.Flags()},
 		},
+		{
+			name: "EmissionsColumns",
+			usage: `
+              EmissionsColumns maps emissions variables to the names of the columns in the
+              emissions files that contain them, in the form Variable = "column". The
+              variables are VOC, NOx, NH3, SOx, PM25, Height, Diam, Temp, and Velocity,
+              Tag for the source tag, as well as WKT, Longitude, and Latitude for the geometry
+              of CSV files. Variables that are not specified use the default column names:
+              "VOC", "NOx", "NH3", "SOx", "PM2_5", "height", "diam", "temp", "velocity", "tag",
+              "WKT", "lon", and "lat". Column names are not case sensitive.`,
+			defaultVal: map[string]string{},
+			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.srPredictCmd.Flags(), cfg.cloudStartCmd.Flags()},
+		},
 		{
 			name: "OutputFile",
 			usage: `
-              OutputFile is the path to the desired output shapefile location. It can
-              include environment variables.`,
+              OutputFile is the path to the desired output file location. It can
+              include environment variables. The output format is determined by the
+              file extension: ".shp" for shapefile, ".nc" for NetCDF, ".geojson" for GeoJSON,
+              or ".gpkg" for GeoPackage. Unrecognized extensions will be replaced by ".shp".`,
 			defaultVal:   "inmap_output.shp",
 			isOutputFile: true,
 			flagsets:     []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.srPredictCmd.Flags()},
 		},
+		{
+			name: "OutputProj",
+			usage: `
+              OutputProj is the projection that output files should be written in,
+              e.g. "+proj=longlat" for longitude and latitude coordinates. If it is left
+              blank, output will be in the projection of the model grid (GridProj).`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.runCmd.PersistentFlags(), cfg.srPredictCmd.Flags()},
+		},
 		{
 			name: "LogFile",
 			usage: `
@@ -787,7 +1269,7 @@ func InitializeConfig() *Cfg {
               NumIterations is the number of iterations to calculate. If < 1, convergence
               is automatically calculated.`,
 			defaultVal: 0,
-			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
+			flagsets:   []*pflag.FlagSet{cfg.steadyCmd.Flags(), cfg.periodicCmd.Flags(), cfg.cloudStartCmd.Flags(), cfg.srStartCmd.Flags()},
 		},
 		{
 			name: "SR.OutputFile",
@@ -804,10 +1286,24 @@ func InitializeConfig() *Cfg {
 			usage: `
               Preproc.CTMType specifies what type of chemical transport
               model we are going to be reading data from. Valid
-              options are "GEOS-Chem" and "WRF-Chem".`,
+              options are "GEOS-Chem", "WRF-Chem", and "CMAQ".`,
 			defaultVal: "WRF-Chem",
 			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
 		},
+		{
+			name: "Preproc.SpeciesGroups",
+			usage: `
+              Preproc.SpeciesGroups specifies the chemical transport model species that
+              make up the InMAP chemical species groups. It can be the name of a built-in
+              preset ("WRF-Chem:RACM_SOA_VBS", "WRF-Chem:RADM2SORG", "WRF-Chem:RACMSORG",
+              "WRF-Chem:MOZART_MOSAIC_4BIN_VBS0", "GEOS-Chem:v10", "GEOS-Chem:v11", or
+              "CMAQ:AERO6") or the path to a TOML or CSV file listing the species, units,
+              and molecular weights in each group. If it is empty, the default preset for
+              the CTMType will be used. All of the species must be in the chemical
+              transport model output files.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
 		{
 			name: "Preproc.WRFChem.WRFOut",
 			usage: `
@@ -919,6 +1415,50 @@ func InitializeConfig() *Cfg {
 			defaultVal: false,
 			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
 		},
+		{
+			name: "Preproc.CMAQ.METCRO3D",
+			usage: `
+              Preproc.CMAQ.METCRO3D is the location of the MCIP 3-D cross-point meteorology
+              files, which must include the vertical wind speed (WWIND).
+              [DATE] should be used as a wild card for the simulation date.`,
+			defaultVal: "METCRO3D_[DATE]",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.CMAQ.METCRO2D",
+			usage: `
+              Preproc.CMAQ.METCRO2D is the location of the MCIP 2-D cross-point meteorology
+              files. [DATE] should be used as a wild card for the simulation date.`,
+			defaultVal: "METCRO2D_[DATE]",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.CMAQ.METDOT3D",
+			usage: `
+              Preproc.CMAQ.METDOT3D is the location of the MCIP 3-D dot-point meteorology
+              files, which must include the C-staggered wind speeds (UWINDC and VWINDC).
+              [DATE] should be used as a wild card for the simulation date.`,
+			defaultVal: "METDOT3D_[DATE]",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.CMAQ.GRIDCRO2D",
+			usage: `
+              Preproc.CMAQ.GRIDCRO2D is the location of the MCIP 2-D cross-point grid file,
+              whose land use must use the USGS 24-category classification. If it
+              contains a [DATE] wild card, the file for the start date will be used.`,
+			defaultVal: "GRIDCRO2D_[DATE]",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.CMAQ.CONC",
+			usage: `
+              Preproc.CMAQ.CONC is the location of the CMAQ concentration files, which
+              must include all model layers. [DATE] should be used as a wild card for
+              the simulation date.`,
+			defaultVal: "CONC_[DATE]",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
 		{
 			name: "Preproc.StartDate",
 			usage: `
@@ -935,6 +1475,152 @@ func InitializeConfig() *Cfg {
 			defaultVal: "No Default",
 			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
 		},
+		{
+			name: "Preproc.SnapshotInterval",
+			usage: `
+              Preproc.SnapshotInterval specifies the length of time represented by each
+              meteorology snapshot (e.g., "1h" or "24h") when preprocessing data for
+              time-resolved simulations. If it is empty, a single average over
+              the whole period is created. Otherwise, each snapshot is saved in a separate
+              file, where [DATE] in InMAPData is replaced by the beginning time of the snapshot
+              in the format "YYYYMMDDTHH".`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.Periods",
+			usage: `
+              Preproc.Periods specifies whether to create a separate average of the
+              meteorology for each season ("seasonal") or month ("monthly") when
+              preprocessing data for periodic simulations. If it is empty, a single average
+              over the whole period is created. Otherwise, each average is saved in a
+              separate file, where [DATE] in InMAPData is replaced by the beginning time of
+              the season or month in the format "YYYYMMDDTHH". Seasons are
+              December–February, March–May, June–August, and September–November, and
+              only whole seasons that end between Preproc.StartDate and Preproc.EndDate
+              are included, so the winter of a calendar year begins in December of the
+              previous year.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TileRows",
+			usage: `
+              Preproc.TileRows is the number of grid rows in the South-North direction to
+              preprocess at a time. Smaller values use less memory, but the CTM output is
+              read once for each group of rows. If it is zero, the whole domain is
+              preprocessed at once.`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.Concurrency",
+			usage: `
+              Preproc.Concurrency is the maximum number of groups of variables to preprocess
+              at the same time. If it is zero, there is no limit.`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TempDir",
+			usage: `
+              Preproc.TempDir is a directory where intermediate preprocessing results are saved.
+              If it is specified and preprocessing is interrupted, running it again with the
+              same configuration will resume where it left off. It can include
+              environment variables.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.Check.Variables",
+			usage: `
+              Preproc.Check.Variables specifies the variables in the preprocessed
+              InMAP data file to plot when Preproc.Check.PlotDir is specified.`,
+			defaultVal: []string{"TotalPM25", "WindSpeed", "Kzz"},
+			flagsets:   []*pflag.FlagSet{cfg.preprocCheckCmd.Flags()},
+		},
+		{
+			name: "Preproc.Check.Layer",
+			usage: `
+              Preproc.Check.Layer specifies the vertical layer to plot, where 0 is the
+              ground-level layer. Variables without a vertical dimension are
+              plotted regardless of this setting.`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCheckCmd.Flags()},
+		},
+		{
+			name: "Preproc.Check.PlotDir",
+			usage: `
+              Preproc.Check.PlotDir is the directory where maps and histograms of
+              the variables in Preproc.Check.Variables are saved. If it is empty,
+              no plots are created. It can include environment variables.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCheckCmd.Flags()},
+		},
+		{
+			name: "Periodic.StartDate",
+			usage: `
+              Periodic.StartDate is the date of the beginning of a periodic simulation.
+              Format = "YYYYMMDD" or "YYYYMMDDTHH".`,
+			defaultVal: "No Default",
+			flagsets:   []*pflag.FlagSet{cfg.periodicCmd.Flags()},
+		},
+		{
+			name: "Periodic.EndDate",
+			usage: `
+              Periodic.EndDate is the date of the end of a periodic simulation.
+              Format = "YYYYMMDD" or "YYYYMMDDTHH".`,
+			defaultVal: "No Default",
+			flagsets:   []*pflag.FlagSet{cfg.periodicCmd.Flags()},
+		},
+		{
+			name: "Periodic.Periods",
+			usage: `
+              Periodic.Periods specifies whether a periodic simulation should be run for
+              each season ("seasonal") or month ("monthly"). It should match
+              the Preproc.Periods used to create InMAPData. Seasons are always whole
+              seasons, as described for Preproc.Periods. [DATE] in
+              EmissionsShapefiles is replaced by the beginning time of each period,
+              and the beginning time is added to the OutputFile name for the results
+              of each period.`,
+			defaultVal: "seasonal",
+			flagsets:   []*pflag.FlagSet{cfg.periodicCmd.Flags()},
+		},
+		{
+			name: "Transient.StartDate",
+			usage: `
+              Transient.StartDate is the date of the beginning of a time-resolved simulation.
+              Format = "YYYYMMDD" or "YYYYMMDDTHH".`,
+			defaultVal: "No Default",
+			flagsets:   []*pflag.FlagSet{cfg.transientCmd.Flags()},
+		},
+		{
+			name: "Transient.EndDate",
+			usage: `
+              Transient.EndDate is the date of the end of a time-resolved simulation.
+              Format = "YYYYMMDD" or "YYYYMMDDTHH".`,
+			defaultVal: "No Default",
+			flagsets:   []*pflag.FlagSet{cfg.transientCmd.Flags()},
+		},
+		{
+			name: "Transient.SnapshotInterval",
+			usage: `
+              Transient.SnapshotInterval is the length of time represented by each
+              meteorology snapshot in InMAPData (e.g., "1h" or "24h"). It should match
+              the Preproc.SnapshotInterval used to create the snapshots.`,
+			defaultVal: "24h",
+			flagsets:   []*pflag.FlagSet{cfg.transientCmd.Flags()},
+		},
+		{
+			name: "Transient.OutputInterval",
+			usage: `
+              Transient.OutputInterval is the length of time between outputs in a
+              time-resolved simulation (e.g., "6h"). The results are also output at
+              the end of the simulation. The time of each output is added to the
+              OutputFile name, replacing [DATE] if it is present.`,
+			defaultVal: "24h",
+			flagsets:   []*pflag.FlagSet{cfg.transientCmd.Flags()},
+		},
 		{
 			name: "Preproc.CtmGridXo",
 			usage: `
@@ -963,6 +1649,66 @@ func InitializeConfig() *Cfg {
 			defaultVal: 1000.0,
 			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
 		},
+		{
+			name: "Preproc.CtmGridProj",
+			usage: `
+              Preproc.CtmGridProj gives projection info for the CTM grid in Proj4 or WKT format.
+              It is only required when Preproc.TargetGrid.GridProj is specified.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.GridProj",
+			usage: `
+              Preproc.TargetGrid.GridProj gives projection info in Proj4 or WKT format for a grid
+              that the preprocessed data should be conservatively regridded to, for example
+              to use GEOS-Chem output with a Lambert conformal conic InMAP grid. If it is empty,
+              the data will be left on the CTM grid.`,
+			defaultVal: "",
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Xo",
+			usage: `
+              Preproc.TargetGrid.Xo is the lower left of the target grid, x`,
+			defaultVal: 0.0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Yo",
+			usage: `
+              Preproc.TargetGrid.Yo is the lower left of the target grid, y`,
+			defaultVal: 0.0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Dx",
+			usage: `
+              Preproc.TargetGrid.Dx is the target grid cell length in x direction`,
+			defaultVal: 12000.0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Dy",
+			usage: `
+              Preproc.TargetGrid.Dy is the target grid cell length in y direction`,
+			defaultVal: 12000.0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Nx",
+			usage: `
+              Preproc.TargetGrid.Nx is the number of target grid cells in the x direction`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
+		{
+			name: "Preproc.TargetGrid.Ny",
+			usage: `
+              Preproc.TargetGrid.Ny is the number of target grid cells in the y direction`,
+			defaultVal: 0,
+			flagsets:   []*pflag.FlagSet{cfg.preprocCmd.Flags()},
+		},
 		{
 			name: "job_name",
 			usage: `
@@ -993,6 +1739,16 @@ func InitializeConfig() *Cfg {
 		},
 	}
 
+	// The nested and ensemble commands accept all of the options of the steady command.
+	for i, option := range options {
+		for _, set := range option.flagsets {
+			if set == cfg.steadyCmd.Flags() {
+				options[i].flagsets = append(options[i].flagsets, cfg.nestedCmd.Flags(), cfg.ensembleCmd.Flags())
+				break
+			}
+		}
+	}
+
 	// Set the prefix for configuration environment variables.
 	cfg.SetEnvPrefix("INMAP")
 
@@ -1090,6 +1846,188 @@ func outChan() chan string {
 	return outChan
 }
 
+// getMechanism returns the chemical mechanism specified by the Mechanism
+// option in cfg. If the mechanism is an inmap.ConfigurableMechanism,
+// it is configured using the options in the table of cfg with the same
+// name as the mechanism (for example, ExtendedChem.OxidantScale).
+func getMechanism(cfg *viper.Viper) (inmap.Mechanism, error) {
+	name := cfg.GetString("Mechanism")
+	m, err := inmap.GetMechanism(name)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := m.(inmap.ConfigurableMechanism)
+	if !ok {
+		return m, nil
+	}
+	prefix := strings.ToLower(name) + "."
+	settings := make(map[string]string)
+	for _, key := range cfg.AllKeys() {
+		if strings.HasPrefix(key, prefix) {
+			settings[strings.TrimPrefix(key, prefix)] = cfg.GetString(key)
+		}
+	}
+	return c.Configure(settings)
+}
+
+// runSteady runs a steady-state simulation using the configuration in cfg.
+func runSteady(cmd *cobra.Command, cfg *viper.Viper) error {
+	outChan := outChan()
+
+	vgc, err := VarGridConfig(cfg)
+	if err != nil {
+		return err
+	}
+	outputFile, err := checkOutputFile(cfg.GetString("OutputFile"))
+	if err != nil {
+		return err
+	}
+	outputVars, err := checkOutputVars(GetStringMapString("OutputVariables", cfg))
+	if err != nil {
+		return err
+	}
+	emisUnits, err := checkEmissionUnits(cfg.GetString("EmissionUnits"))
+	if err != nil {
+		return err
+	}
+	mech, err := getMechanism(cfg)
+	if err != nil {
+		return err
+	}
+	scienceFuncs, err := ScienceFuncs(mech)
+	if err != nil {
+		return err
+	}
+
+	shapeFiles := removeShpSupportFiles(expandStringSlice(cfg.GetStringSlice("EmissionsShapefiles")))
+	// This goes over each shapeFile and downloads it if necessary.
+	for i := range shapeFiles {
+		shapeFiles[i] = maybeDownload(context.TODO(), shapeFiles[i], outChan)
+	}
+	aepConfig, err := ReadAEPConfig(cfg.GetString("config"))
+	if err != nil {
+		return err
+	}
+
+	return Run(
+		cmd,
+		cfg.GetString("LogFile"),
+		outputFile,
+		cfg.GetBool("OutputAllLayers"),
+		outputVars,
+		emisUnits,
+		shapeFiles,
+		vgc,
+		maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("InMAPData")), outChan),
+		maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("VariableGridData")), outChan),
+		cfg.GetInt("NumIterations"),
+		!cfg.GetBool("static"), cfg.GetBool("createGrid"),
+		&RunOptions{
+			OutputProj:               cfg.GetString("OutputProj"),
+			EmissionsColumns:         GetStringMapString("EmissionsColumns", cfg),
+			AEP:                      aepConfig,
+			SourceTags:               cfg.GetStringSlice("SourceTags"),
+			SourceTagOutputVariables: cfg.GetStringSlice("SourceTagOutputVariables"),
+			BudgetInterval:           cfg.GetString("BudgetInterval"),
+			BoundaryConditions: &BoundaryConditionsConfig{
+				Type:  cfg.GetString("BoundaryConditions.Type"),
+				Files: expandStringSlice(cfg.GetStringSlice("BoundaryConditions.Files")),
+				Times: cfg.GetStringSlice("BoundaryConditions.Times"),
+			},
+			CheckpointFile:     os.ExpandEnv(cfg.GetString("Checkpoint.File")),
+			CheckpointInterval: cfg.GetString("Checkpoint.Interval"),
+			Restart:            cfg.GetBool("restart"),
+			Workers:            cfg.GetStringSlice("Workers"),
+			Coarsen:            cfg.GetBool("coarsen"),
+		},
+		scienceFuncs, nil, nil, nil,
+		mech)
+}
+
+// runEnsemble runs an ensemble simulation using the configuration in cfg.
+func runEnsemble(cmd *cobra.Command, cfg *viper.Viper) error {
+	outChan := outChan()
+
+	if !cfg.GetBool("static") {
+		return fmt.Errorf("inmap: ensemble simulations require a static grid (--static) so " +
+			"that all members have the same grid cells")
+	}
+	vgc, err := VarGridConfig(cfg)
+	if err != nil {
+		return err
+	}
+	outputFile, err := checkOutputFile(cfg.GetString("OutputFile"))
+	if err != nil {
+		return err
+	}
+	outputVars, err := checkOutputVars(GetStringMapString("OutputVariables", cfg))
+	if err != nil {
+		return err
+	}
+	emisUnits, err := checkEmissionUnits(cfg.GetString("EmissionUnits"))
+	if err != nil {
+		return err
+	}
+	mech, err := getMechanism(cfg)
+	if err != nil {
+		return err
+	}
+	scienceFuncs, err := ScienceFuncs(mech)
+	if err != nil {
+		return err
+	}
+	percentiles, err := toIntSliceE(cfg.Get("Ensemble.Percentiles"))
+	if err != nil {
+		return fmt.Errorf("Ensemble.Percentiles: %v", err)
+	}
+	ensemble := &EnsembleConfig{
+		Members:     cfg.GetInt("Ensemble.Members"),
+		Seed:        cfg.GetInt64("Ensemble.Seed"),
+		Parallel:    cfg.GetInt("Ensemble.Parallel"),
+		Percentiles: make([]float64, len(percentiles)),
+		CellFactors: GetStringMapString("Ensemble.CellFactors", cfg),
+		Parameters:  GetStringMapString("Ensemble.Parameters", cfg),
+	}
+	for i, p := range percentiles {
+		ensemble.Percentiles[i] = float64(p)
+	}
+
+	shapeFiles := removeShpSupportFiles(expandStringSlice(cfg.GetStringSlice("EmissionsShapefiles")))
+	// This goes over each shapeFile and downloads it if necessary.
+	for i := range shapeFiles {
+		shapeFiles[i] = maybeDownload(context.TODO(), shapeFiles[i], outChan)
+	}
+	aepConfig, err := ReadAEPConfig(cfg.GetString("config"))
+	if err != nil {
+		return err
+	}
+
+	return RunEnsemble(
+		cmd,
+		cfg.GetString("LogFile"),
+		outputFile,
+		cfg.GetString("OutputProj"),
+		cfg.GetBool("OutputAllLayers"),
+		outputVars,
+		emisUnits,
+		shapeFiles,
+		GetStringMapString("EmissionsColumns", cfg),
+		aepConfig,
+		&BoundaryConditionsConfig{
+			Type:  cfg.GetString("BoundaryConditions.Type"),
+			Files: expandStringSlice(cfg.GetStringSlice("BoundaryConditions.Files")),
+			Times: cfg.GetStringSlice("BoundaryConditions.Times"),
+		},
+		vgc,
+		maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("InMAPData")), outChan),
+		maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("VariableGridData")), outChan),
+		cfg.GetInt("NumIterations"),
+		cfg.GetBool("createGrid"),
+		ensemble,
+		scienceFuncs, nil, nil, nil,
+		mech)
+}
+
 // setConfig finds and reads in the configuration file, if there is one.
 func setConfig(cfg *Cfg) error {
 	if cfgpath := cfg.GetString("config"); cfgpath != "" {
@@ -1127,7 +2065,7 @@ func (cfg *Cfg) StartWebServer() {
 
 	log.Println("Loading front-end...")
 
-	for _, cmd := range []*cobra.Command{cfg.Root, cfg.versionCmd, cfg.runCmd, cfg.steadyCmd,
+	for _, cmd := range []*cobra.Command{cfg.Root, cfg.versionCmd, cfg.runCmd, cfg.steadyCmd, cfg.transientCmd,
 		cfg.gridCmd, cfg.preprocCmd, cfg.srCmd, cfg.srPredictCmd} {
 		cmd.SilenceUsage = true // We don't want the usage messages in the GUI.
 	}
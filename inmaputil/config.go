@@ -58,12 +58,19 @@ func expandStringSlice(s []string) []string {
 	return s
 }
 
-// removeShpSupportFiles deletes from the list of files any that do not
-// end in `.shp`.
+// removeShpSupportFiles deletes from the list of files any shapefile
+// support files (for example, ".dbf" and ".prj" files) that have the same
+// name as a ".shp" file in the list.
 func removeShpSupportFiles(files []string) []string {
+	shapefiles := make(map[string]bool)
+	for _, s := range files {
+		if filepath.Ext(s) == ".shp" {
+			shapefiles[strings.TrimSuffix(s, ".shp")] = true
+		}
+	}
 	var o []string
 	for _, s := range files {
-		if strings.HasSuffix(s, ".shp") {
+		if ext := filepath.Ext(s); ext == ".shp" || !shapefiles[strings.TrimSuffix(s, ext)] {
 			o = append(o, s)
 		}
 	}
@@ -108,10 +115,10 @@ func checkLogFile(logFile, outputFile string) string {
 // units and ensures that an acceptable value was specified.
 func checkEmissionUnits(u string) (string, error) {
 	u = os.ExpandEnv(u)
-	if u != "tons/year" && u != "kg/year" && u != "ug/s" && u != "μg/s" {
+	if _, err := inmap.ParseEmissionUnits(u); err != nil {
 		return u, fmt.Errorf("the EmissionUnits variable in the configuration file "+
-			"needs to be set to either tons/year, kg/year, ug/s, or μg/s, but is currently set to `%s`",
-			u)
+			"needs to be set to a unit of mass per time such as tons/year, kg/year, ug/s, or μg/s, "+
+			"but is currently set to `%s`: %v", u, err)
 	}
 	return u, nil
 }
@@ -131,6 +138,21 @@ func spatialRef(config *inmap.VarGridConfig) (*proj.SR, error) {
 	return sr, nil
 }
 
+// outputSpatialRef parses the projection that output files should be
+// written in. It returns nil if OutputProj is empty, which indicates that
+// output should be written in the projection of the model grid.
+func outputSpatialRef(OutputProj string) (*proj.SR, error) {
+	if OutputProj == "" {
+		return nil, nil
+	}
+	sr, err := proj.Parse(OutputProj)
+	if err != nil {
+		return nil, fmt.Errorf("the following error occured while parsing the output "+
+			"projection (the OutputProj variable): %v", err)
+	}
+	return sr, nil
+}
+
 // VarGridConfig unmarshals a viper configuration for a variable grid.
 func VarGridConfig(cfg *viper.Viper) (*inmap.VarGridConfig, error) {
 	xNests, err := toIntSliceE(cfg.Get("VarGrid.Xnests"))
@@ -158,8 +180,12 @@ func VarGridConfig(cfg *viper.Viper) (*inmap.VarGridConfig, error) {
 		PopGridColumn:        os.ExpandEnv(cfg.GetString("VarGrid.PopGridColumn")),
 		MortalityRateFile:    maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.MortalityRateFile")), outChan()),
 		MortalityRateColumns: GetStringMapString("VarGrid.MortalityRateColumns", cfg),
+		RefinementNestLevel:  cfg.GetInt("VarGrid.RefinementNestLevel"),
 		GridProj:             os.ExpandEnv(cfg.GetString("VarGrid.GridProj")),
 	}
+	for _, f := range expandStringSlice(cfg.GetStringSlice("VarGrid.RefinementFiles")) {
+		c.RefinementFiles = append(c.RefinementFiles, maybeDownload(ctx, f, outChan()))
+	}
 
 	vars := []float64{c.VariableGridDx, c.VariableGridDy}
 	varNames := []string{"VarGrid.VariableGridDx", "VarGrid.VariableGridDy"}
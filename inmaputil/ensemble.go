@@ -0,0 +1,413 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+	"github.com/spf13/cobra"
+)
+
+// EnsembleConfig specifies an ensemble of simulations with
+// perturbed science parameters.
+type EnsembleConfig struct {
+	// Members is the number of ensemble members.
+	Members int
+
+	// Seed is the seed for the random number generator used to sample
+	// the parameters of the members. Ensembles with the same Seed and
+	// distributions have the same parameters.
+	Seed int64
+
+	// Parallel is the number of members to run at the same time.
+	Parallel int
+
+	// Percentiles are the percentiles (0–100) of the results
+	// across the members to output.
+	Percentiles []float64
+
+	// CellFactors maps the names of grid cell science parameters
+	// (see inmap.ScalableCellVariables) to the distributions of the factors
+	// that they are multiplied by in each member. Distributions that can
+	// produce negative factors are not allowed.
+	CellFactors map[string]string
+
+	// Parameters maps the names of parameters used in the output variable
+	// expressions, such as hazard ratio coefficients, to the distributions
+	// of their values. The parameter values are substituted for the
+	// parameter names in the expressions of each member.
+	Parameters map[string]string
+}
+
+// distribution draws a random value from a probability distribution.
+type distribution func(r *rand.Rand) float64
+
+var distributionRegexp = regexp.MustCompile(`^\s*(\w+)\s*\((.*)\)\s*$`)
+
+// parseDistribution parses a probability distribution specified as
+// "normal(mean, std)", "lognormal(mu, sigma)", where mu and sigma are the
+// mean and standard deviation of the logarithm of the value,
+// "uniform(min, max)", or "triangular(min, mode, max)".
+// A number is a distribution that always returns that number.
+// min is the smallest value that the distribution can return.
+func parseDistribution(s string) (dist distribution, min float64, err error) {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		return func(*rand.Rand) float64 { return v }, v, nil
+	}
+	m := distributionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, 0, fmt.Errorf("inmap: invalid distribution '%s'", s)
+	}
+	var p []float64
+	for _, a := range strings.Split(m[2], ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("inmap: invalid distribution '%s': %v", s, err)
+		}
+		p = append(p, v)
+	}
+	nParams := map[string]int{"normal": 2, "lognormal": 2, "uniform": 2, "triangular": 3}
+	n, ok := nParams[strings.ToLower(m[1])]
+	if !ok {
+		return nil, 0, fmt.Errorf("inmap: invalid distribution type '%s' in '%s'; valid types are "+
+			"'normal', 'lognormal', 'uniform', and 'triangular'", m[1], s)
+	}
+	if len(p) != n {
+		return nil, 0, fmt.Errorf("inmap: distribution '%s' has %d parameters instead of %d", s, len(p), n)
+	}
+	switch strings.ToLower(m[1]) {
+	case "normal":
+		min = math.Inf(-1)
+		if p[1] == 0 {
+			min = p[0]
+		}
+		return func(r *rand.Rand) float64 { return p[0] + p[1]*r.NormFloat64() }, min, nil
+	case "lognormal":
+		return func(r *rand.Rand) float64 { return math.Exp(p[0] + p[1]*r.NormFloat64()) }, 0, nil
+	case "uniform":
+		if p[1] < p[0] {
+			return nil, 0, fmt.Errorf("inmap: distribution '%s' has a maximum less than its minimum", s)
+		}
+		return func(r *rand.Rand) float64 { return p[0] + (p[1]-p[0])*r.Float64() }, p[0], nil
+	default: // triangular
+		a, c, b := p[0], p[1], p[2]
+		if c < a || b < c || a == b {
+			return nil, 0, fmt.Errorf("inmap: distribution '%s' needs min <= mode <= max and min < max", s)
+		}
+		return func(r *rand.Rand) float64 {
+			u := r.Float64()
+			if u < (c-a)/(b-a) {
+				return a + math.Sqrt(u*(b-a)*(c-a))
+			}
+			return b - math.Sqrt((1-u)*(b-a)*(b-c))
+		}, a, nil
+	}
+}
+
+// ensembleMember holds the parameters of an ensemble member.
+type ensembleMember struct {
+	cellFactors, parameters map[string]float64
+}
+
+// members samples the parameters of each ensemble member.
+// The parameters are sampled in alphabetical order so that
+// the same seed always results in the same parameters.
+func (c *EnsembleConfig) members() ([]ensembleMember, error) {
+	if c.Members < 2 {
+		return nil, fmt.Errorf("inmap: an ensemble needs at least 2 members but has %d", c.Members)
+	}
+	if len(c.CellFactors) == 0 && len(c.Parameters) == 0 {
+		return nil, fmt.Errorf("inmap: there are no ensemble parameters to perturb; " +
+			"please specify Ensemble.CellFactors or Ensemble.Parameters")
+	}
+	type sampler struct {
+		name    string
+		isCell  bool
+		nextVal distribution
+	}
+	var samplers []sampler
+	for _, set := range []struct {
+		dists  map[string]string
+		isCell bool
+	}{{dists: c.CellFactors, isCell: true}, {dists: c.Parameters}} {
+		names := make([]string, 0, len(set.dists))
+		for name := range set.dists {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dist, min, err := parseDistribution(set.dists[name])
+			if err != nil {
+				return nil, fmt.Errorf("inmap: ensemble parameter %s: %v", name, err)
+			}
+			if set.isCell && min < 0 {
+				return nil, fmt.Errorf("inmap: ensemble cell factor %s: distribution '%s' can "+
+					"produce negative factors; please use a lognormal distribution or a "+
+					"distribution with a non-negative minimum", name, set.dists[name])
+			}
+			samplers = append(samplers, sampler{name: name, isCell: set.isCell, nextVal: dist})
+		}
+	}
+
+	r := rand.New(rand.NewSource(c.Seed))
+	members := make([]ensembleMember, c.Members)
+	for i := range members {
+		members[i] = ensembleMember{
+			cellFactors: make(map[string]float64),
+			parameters:  make(map[string]float64),
+		}
+		for _, s := range samplers {
+			v := s.nextVal(r)
+			if s.isCell {
+				members[i].cellFactors[s.name] = v
+			} else {
+				members[i].parameters[s.name] = v
+			}
+		}
+	}
+	return members, nil
+}
+
+// String returns a description of the member parameters.
+func (m ensembleMember) String() string {
+	var s []string
+	for name, v := range m.cellFactors {
+		s = append(s, fmt.Sprintf("%s×%.4g", name, v))
+	}
+	for name, v := range m.parameters {
+		s = append(s, fmt.Sprintf("%s=%.4g", name, v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+// outputVariables returns a copy of vars where the member parameter
+// values have been substituted for the parameter names.
+func (m ensembleMember) outputVariables(vars map[string]string) map[string]string {
+	o := make(map[string]string, len(vars))
+	for k, v := range vars {
+		for name, val := range m.parameters {
+			r := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`)
+			v = r.ReplaceAllLiteralString(v, "("+strconv.FormatFloat(val, 'f', -1, 64)+")")
+		}
+		o[k] = v
+	}
+	return o
+}
+
+// RunEnsemble runs an ensemble of steady-state simulations where the
+// science parameters of the grid cells and the parameters of the
+// output variable expressions, such as health impact function coefficients,
+// are sampled from the distributions specified in Ensemble.
+// All members use the same static variable resolution grid, which is
+// created as specified by VarGrid if createGrid is true, and is otherwise
+// loaded from VariableGridData.
+//
+// The mean, standard deviation, and requested percentiles of the
+// output variables across the members are written to files whose names
+// are created from OutputFile as described in inmap.EnsembleFileName,
+// for example "output_mean.shp" and "output_p95.shp".
+//
+// The remaining arguments are the same as for Run.
+func RunEnsemble(CobraCommand *cobra.Command, LogFile string, OutputFile, OutputProj string, OutputAllLayers bool, OutputVariables map[string]string,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsColumns map[string]string, AEP *AEPConfig,
+	BoundaryConditions *BoundaryConditionsConfig, VarGrid *inmap.VarGridConfig,
+	InMAPData, VariableGridData string, NumIterations int, createGrid bool, Ensemble *EnsembleConfig,
+	scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
+	m inmap.Mechanism) error {
+
+	startTime := time.Now()
+
+	if IsBlob(OutputFile) {
+		return fmt.Errorf("inmap: ensemble simulation output must be saved to a local file, not %s", OutputFile)
+	}
+	members, err := Ensemble.members()
+	if err != nil {
+		return err
+	}
+
+	cConverge, cLog, msgLog, stopLog, err := startLog(CobraCommand, LogFile)
+	if err != nil {
+		return err
+	}
+	defer stopLog()
+
+	// NewOutputter modifies the output variables, so keep a copy
+	// for creating the outputters of the members.
+	memberVars := make(map[string]string, len(OutputVariables))
+	for k, v := range OutputVariables {
+		memberVars[k] = v
+	}
+	o, err := inmap.NewOutputter(OutputFile, OutputAllLayers, OutputVariables, nil, m)
+	if err != nil {
+		return err
+	}
+	log.Println("Parsing output variable expressions...")
+	outSR, err := outputSpatialRef(OutputProj)
+	if err != nil {
+		return err
+	}
+	if outSR != nil {
+		o.ReprojectOutput(outSR)
+	}
+
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+	emis, err := inmap.ReadEmissions(sr, EmissionUnits, EmissionsColumns, msgLog, EmissionsShapefiles...)
+	if err != nil {
+		return err
+	}
+
+	// Create or load the grid once and save it so that it can be
+	// loaded by each of the members.
+	var gridFuncs []inmap.DomainManipulator
+	if createGrid {
+		log.Println("Loading CTM data...")
+		ctmData, err := getCTMData(InMAPData, VarGrid)
+		if err != nil {
+			return err
+		}
+		log.Println("Loading population and mortality rate data...")
+		pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+		if err != nil {
+			return err
+		}
+		mutator, err := staticMutator(VarGrid, popIndices)
+		if err != nil {
+			return err
+		}
+		gridFuncs = []inmap.DomainManipulator{
+			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, emis, m),
+			VarGrid.MutateGrid(mutator, ctmData, pop, mr, emis, m, msgLog),
+		}
+	} else {
+		b, err := ioutil.ReadFile(VariableGridData)
+		if err != nil {
+			return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+		}
+		gridFuncs = []inmap.DomainManipulator{inmap.Load(bytes.NewReader(b), VarGrid, emis, m)}
+	}
+	if AEP != nil {
+		// The inventory emissions are added to emis, so they
+		// are included when the grid is loaded by each member.
+		gridFuncs = append(gridFuncs, AEP.AddEmissions(emis, VarGrid.GridProj, m))
+	}
+	var grid bytes.Buffer
+	gridFuncs = append(gridFuncs, inmap.Save(&grid))
+	log.Println("Creating grid...")
+	if err = (&inmap.InMAP{InitFuncs: gridFuncs}).Init(); err != nil {
+		return fmt.Errorf("InMAP: problem creating grid: %v\n", err)
+	}
+
+	bc, err := BoundaryConditions.BoundaryConditions(VarGrid, m)
+	if err != nil {
+		return err
+	}
+
+	stats := o.NewEnsembleStatistics()
+
+	runMember := func(i int, member ensembleMember) error {
+		mo, err := inmap.NewOutputter("", OutputAllLayers, member.outputVariables(memberVars), nil, m)
+		if err != nil {
+			return err
+		}
+		initFuncs := []inmap.DomainManipulator{
+			inmap.Load(bytes.NewReader(grid.Bytes()), VarGrid, emis, m),
+			inmap.ScaleCellVariables(member.cellFactors),
+		}
+		if bc != nil {
+			initFuncs = append(initFuncs, inmap.SetBoundaryConditions(bc, nil))
+		}
+		initFuncs = append(initFuncs,
+			inmap.SetTimestepCFL(),
+			mo.CheckOutputVars(m),
+		)
+		d := &inmap.InMAP{
+			InitFuncs: append(initFuncs, addInit...),
+			RunFuncs: append([]inmap.DomainManipulator{
+				inmap.Log(cLog),
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.Calculations(scienceFuncs...),
+				inmap.SteadyStateConvergenceCheck(NumIterations,
+					VarGrid.PopGridColumn, m, cConverge),
+			}, addRun...),
+			CleanupFuncs: append([]inmap.DomainManipulator{
+				stats.Add(mo),
+			}, addCleanup...),
+		}
+		log.Printf("Running ensemble member %d of %d: %v", i+1, len(members), member)
+		if err = d.Init(); err != nil {
+			return fmt.Errorf("InMAP: problem initializing ensemble member %d: %v\n", i+1, err)
+		}
+		if err = d.Run(); err != nil {
+			return fmt.Errorf("InMAP: problem running ensemble member %d: %v\n", i+1, err)
+		}
+		if err = d.Cleanup(); err != nil {
+			return fmt.Errorf("InMAP: problem shutting down ensemble member %d: %v\n", i+1, err)
+		}
+		log.Printf("Finished ensemble member %d of %d", i+1, len(members))
+		return nil
+	}
+
+	parallel := Ensemble.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	errs := make([]error, len(members))
+	for i, member := range members {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, member ensembleMember) {
+			defer wg.Done()
+			errs[i] = runMember(i, member)
+			<-sem
+		}(i, member)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Calculating ensemble statistics...")
+	if err = stats.Output(sr, Ensemble.Percentiles...); err != nil {
+		return err
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spatialmodel/inmap"
+)
+
+func TestParseDistribution(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		s        string
+		min, max float64
+	}{
+		{s: "2.5", min: 2.5, max: 2.5},
+		{s: "uniform(0.5, 1.5)", min: 0.5, max: 1.5},
+		{s: "triangular(1, 2, 4)", min: 1, max: 4},
+		{s: "lognormal(0, 0.3)", min: 0, max: 100},
+		{s: " Normal( 1, 0 )", min: 1, max: 1},
+	} {
+		dist, min, err := parseDistribution(test.s)
+		if err != nil {
+			t.Errorf("%s: %v", test.s, err)
+			continue
+		}
+		if min < test.min {
+			t.Errorf("%s: minimum %g is less than %g", test.s, min, test.min)
+		}
+		for i := 0; i < 100; i++ {
+			if v := dist(r); v < test.min || v > test.max {
+				t.Errorf("%s: %g is not between %g and %g", test.s, v, test.min, test.max)
+			}
+		}
+	}
+	for _, s := range []string{"", "x", "beta(1, 2)", "uniform(1)", "uniform(2, 1)", "triangular(1, 5, 4)", "normal(a, 1)"} {
+		if _, _, err := parseDistribution(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestEnsembleMembers(t *testing.T) {
+	c := &EnsembleConfig{
+		Members:     3,
+		Seed:        2,
+		CellFactors: map[string]string{"Kzz": "uniform(0.5, 1.5)", "SO2oxidation": "lognormal(0, 0.3)"},
+		Parameters:  map[string]string{"Beta": "normal(0.0075, 0.0012)"},
+	}
+	m1, err := c.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := c.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m1, m2) {
+		t.Error("members with the same seed should have the same parameters")
+	}
+	if reflect.DeepEqual(m1[0], m1[1]) {
+		t.Error("members should have different parameters")
+	}
+	c.Seed = 3
+	m3, err := c.members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(m1, m3) {
+		t.Error("members with different seeds should have different parameters")
+	}
+
+	m := ensembleMember{parameters: map[string]float64{"Beta": 0.5}}
+	vars := m.outputVariables(map[string]string{
+		"TotalPopD": "(exp(Beta * TotalPM25) - 1) * TotalPop",
+		"Betas":     "Betas",
+	})
+	want := map[string]string{
+		"TotalPopD": "(exp((0.5) * TotalPM25) - 1) * TotalPop",
+		"Betas":     "Betas",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	c.CellFactors["Kzz"] = "normal(1, 0.5)"
+	if _, err := c.members(); err == nil {
+		t.Error("expected an error for a cell factor that can be negative")
+	}
+	c.CellFactors["Kzz"] = "uniform(-0.5, 1.5)"
+	if _, err := c.members(); err == nil {
+		t.Error("expected an error for a cell factor that can be negative")
+	}
+
+	c.CellFactors["Kzz"] = "uniform(0.5, 1.5)"
+	c.Members = 1
+	if _, err := c.members(); err == nil {
+		t.Error("expected an error for too few members")
+	}
+}
+
+func TestInMAPEnsemble(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	os.Setenv("InMAPRunType", "ensemble")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Root.SetArgs([]string{"run", "ensemble", "--Ensemble.Members=2", "--Ensemble.Parallel=2"})
+	const outputFile = "../cmd/inmap/testdata/output_ensemble.shp"
+	defer os.Remove("../cmd/inmap/testdata/output_ensemble.log")
+	stats := []string{"mean", "std", "p5", "p50", "p95"}
+	for _, stat := range stats {
+		defer inmap.DeleteShapefile(inmap.EnsembleFileName(outputFile, stat))
+	}
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, stat := range stats {
+		if _, err := os.Stat(inmap.EnsembleFileName(outputFile, stat)); err != nil {
+			t.Errorf("missing output file: %v", err)
+		}
+	}
+}
@@ -64,7 +64,7 @@ func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) erro
 
 	msgLog <- "Creating grid"
 
-	mutator, err := inmap.PopulationMutator(VarGrid, popIndices)
+	mutator, err := staticMutator(VarGrid, popIndices)
 	if err != nil {
 		return err
 	}
@@ -82,3 +82,21 @@ func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) erro
 	msgLog <- fmt.Sprintf("Grid successfully created at %s", VariableGridData)
 	return nil
 }
+
+// staticMutator returns a GridMutator for creating static grids, which
+// divides grid cells based on population and on any refinement regions
+// specified in VarGrid.
+func staticMutator(VarGrid *inmap.VarGridConfig, popIndices inmap.PopIndices) (inmap.GridMutator, error) {
+	mutator, err := inmap.PopulationMutator(VarGrid, popIndices)
+	if err != nil {
+		return nil, err
+	}
+	if len(VarGrid.RefinementFiles) == 0 {
+		return mutator, nil
+	}
+	regions, err := inmap.NewRegionMutator(VarGrid)
+	if err != nil {
+		return nil, err
+	}
+	return inmap.CombineMutators(mutator, regions.Mutate()), nil
+}
@@ -47,6 +47,54 @@ func getCTMData(inmapData string, VarGrid *inmap.VarGridConfig) (*inmap.CTMData,
 
 var m simplechem.Mechanism
 
+// startLog directs log messages to the output of CobraCommand and to
+// LogFile, and starts goroutines that log any messages sent over the
+// returned channels. stop should be called to close the channels and wait
+// for logging to finish.
+func startLog(CobraCommand *cobra.Command, LogFile string) (cConverge chan inmap.ConvergenceStatus, cLog chan *inmap.SimulationStatus, msgLog chan string, stop func(), err error) {
+	logfile, err := os.Create(LogFile)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("inmap: problem creating log file: %v", err)
+	}
+	mw := io.MultiWriter(CobraCommand.OutOrStdout(), logfile)
+	log.SetOutput(mw)
+	cConverge = make(chan inmap.ConvergenceStatus)
+	cLog = make(chan *inmap.SimulationStatus)
+	msgLog = make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		for msg := range cConverge {
+			log.Println(msg.String())
+		}
+		wg.Done()
+	}()
+	go func() {
+		for msg := range cLog {
+			log.Println(msg.String())
+			if msg.Budget != nil {
+				log.Println(msg.Budget)
+			}
+		}
+		wg.Done()
+	}()
+	go func() {
+		for msg := range msgLog {
+			log.Println(msg)
+		}
+		wg.Done()
+	}()
+
+	stop = func() { // Wait for the logging to finish.
+		close(cConverge)
+		close(cLog)
+		close(msgLog)
+		wg.Wait()
+		logfile.Close()
+	}
+	return cConverge, cLog, msgLog, stop, nil
+}
+
 func scienceMust(c inmap.CellManipulator, err error) inmap.CellManipulator {
 	if err != nil {
 		panic(err)
@@ -55,7 +103,7 @@ func scienceMust(c inmap.CellManipulator, err error) inmap.CellManipulator {
 }
 
 // DefaultScienceFuncs are the science functions that are run in
-// typical simulations.
+// typical simulations, using the simplechem chemical mechanism.
 var DefaultScienceFuncs = []inmap.CellManipulator{
 	inmap.UpwindAdvection(),
 	inmap.Mixing(),
@@ -65,6 +113,102 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 	m.Chemistry(),
 }
 
+// ScienceFuncs returns the science functions that are run in
+// typical simulations, using chemical mechanism m.
+func ScienceFuncs(m inmap.Mechanism) ([]inmap.CellManipulator, error) {
+	drydep, err := m.DryDep("simple")
+	if err != nil {
+		return nil, err
+	}
+	wetdep, err := m.WetDep("emep")
+	if err != nil {
+		return nil, err
+	}
+	return []inmap.CellManipulator{
+		inmap.UpwindAdvection(),
+		inmap.Mixing(),
+		inmap.MeanderMixing(),
+		drydep,
+		wetdep,
+		m.Chemistry(),
+	}, nil
+}
+
+// RunOptions holds optional settings for Run. The zero value
+// specifies a simulation without any of the options.
+type RunOptions struct {
+	// OutputProj is the projection that the output should be written in.
+	// If it is empty, output will be in the projection of the model grid.
+	OutputProj string
+
+	// EmissionsColumns maps emissions variables to the names of the columns
+	// in the emissions files that contain them, as described in
+	// inmap.EmissionsColumns. If it is nil, the default column names are used.
+	EmissionsColumns map[string]string
+
+	// If AEP is not nil, the emissions inventory it specifies will be
+	// speciated and spatially allocated to the ground-level grid cells once
+	// the grid has been created, and added to the emissions from
+	// EmissionsShapefiles. When restarting from a checkpoint, the inventory
+	// is instead allocated to the checkpointed ground-level grid cells
+	// before the checkpoint is loaded.
+	AEP *AEPConfig
+
+	// SourceTags are the source tags (the values of the inmap.EmisRecord Tag
+	// field) whose contributions to concentrations should be tracked separately,
+	// as described in inmap.TrackTags. SourceTagOutputVariables are the
+	// names of the OutputVariables that should be output for each source tag;
+	// if it is empty, all OutputVariables are output for each tag.
+	SourceTags, SourceTagOutputVariables []string
+
+	// If BudgetInterval is not empty, the mass budget of each pollutant will be
+	// tracked as described in inmap.TrackBudget and written to the log with
+	// BudgetInterval (e.g., "24h") specifying the amount of simulation time
+	// between reports, and once more at the end of the simulation.
+	BudgetInterval string
+
+	// BoundaryConditions specifies the concentrations of pollutants just
+	// outside of the model domain, as described in BoundaryConditionsConfig.
+	// If it is nil, the concentrations outside of the domain are zero.
+	BoundaryConditions *BoundaryConditionsConfig
+
+	// If CheckpointFile is not empty, the state of the simulation will be saved
+	// there periodically, with CheckpointInterval (e.g., "24h") specifying the
+	// amount of simulation time between checkpoints.
+	CheckpointFile, CheckpointInterval string
+
+	// If Restart is true, the simulation will be resumed from the state
+	// saved in CheckpointFile rather than starting from the beginning.
+	Restart bool
+
+	// If Workers is not empty, the simulation will be distributed among
+	// worker processes (started with "inmap worker") listening at the
+	// specified TCP addresses, each of which simulates a subdomain of
+	// the grid. Distributed simulations cannot use a dynamic grid,
+	// SourceTags, BudgetInterval, or BoundaryConditions.
+	Workers []string
+
+	// If Coarsen is true and the grid is dynamic, grid cells that were
+	// divided during the simulation will be combined again when the
+	// concentration gradients around them become small.
+	Coarsen bool
+}
+
+// addAEPToCheckpoint adds the emissions specified by AEP to emis,
+// allocated to the ground-level grid cells in checkpointFile.
+func addAEPToCheckpoint(AEP *AEPConfig, emis *inmap.Emissions, checkpointFile, gridProj string) error {
+	f, err := os.Open(checkpointFile)
+	if err != nil {
+		return fmt.Errorf("problem opening checkpoint file: %v", err)
+	}
+	defer f.Close()
+	gridCells, err := inmap.CheckpointGeometry(f, 0)
+	if err != nil {
+		return err
+	}
+	return AEP.ReadEmissions(emis, gridCells, gridProj)
+}
+
 // Run runs the model. dynamic and createGrid specify whether the variable
 // resolution grid should be created dynamically and whether the static
 // grid should be created or read from a file, respectively.
@@ -75,8 +219,9 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 // LogFile is the path to the desired logfile location. It can include
 // environment variables.
 //
-// OutputFile is the path to the desired output shapefile location. It can
-// include environment variables.
+// OutputFile is the path to the desired output file location. It can
+// include environment variables. The output format is chosen based on the
+// file extension, as described in inmap.Outputter.Output.
 //
 // If OutputAllLayers is true, output data for all model layers. If false, only output
 // the lowest layer.
@@ -84,16 +229,18 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 // OutputVariables specifies which model variables should be included in the
 // output file.
 //
-// EmissionUnits gives the units that the input emissions are in.
-// Acceptable values are 'tons/year', 'kg/year', 'ug/s', and 'μg/s'.
+// EmissionUnits gives the units that the input emissions are in,
+// as any expression of mass per time accepted by inmap.ParseEmissionUnits,
+// for example 'tons/year', 'kg/year', 'ug/s', or 'μg/s'.
 //
-// EmissionsShapefiles are the paths to any emissions shapefiles.
+// EmissionsShapefiles are the paths to any emissions files, which can be
+// shapefiles, CSV files, GeoJSON files, or GeoPackage files as described
+// in inmap.ReadEmissions.
 // Can be elevated or ground level; elevated files need to have columns
 // labeled "height", "diam", "temp", and "velocity" containing stack
 // information in units of m, m, K, and m/s, respectively.
-// Emissions will be allocated from the geometries in the shape file
-// to the InMAP computational grid, but the mapping projection of the
-// shapefile must be the same as the projection InMAP uses.
+// Emissions will be allocated from the geometries in the emissions files
+// to the InMAP computational grid.
 //
 // VarGrid provides information for specifying the variable resolution grid.
 //
@@ -107,7 +254,8 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 // is automatically calculated.
 //
 // If dynamic is
-// true, createGrid is ignored. scienceFuncs specifies the science functions
+// true, createGrid is ignored. opts specifies optional settings; if it is
+// nil, none of the options are used. scienceFuncs specifies the science functions
 // to perform in each cell at each time step. addInit, addRun, and addCleanup
 // specifies functions beyond the default functions to run at initialization,
 // runtime, and cleanup, respectively.
@@ -115,69 +263,52 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 // notMeters should be set to true if the units of the grid are not meters
 // (e.g., if the grid is in degrees latitude/longitude.)
 func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputAllLayers bool, OutputVariables map[string]string,
-	EmissionUnits string, EmissionsShapefiles []string, VarGrid *inmap.VarGridConfig, InMAPData, VariableGridData string,
-	NumIterations int,
-	dynamic, createGrid bool, scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
+	EmissionUnits string, EmissionsShapefiles []string, VarGrid *inmap.VarGridConfig,
+	InMAPData, VariableGridData string, NumIterations int,
+	dynamic, createGrid bool, opts *RunOptions, scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
 	m inmap.Mechanism) error {
 
 	startTime := time.Now()
 
+	if opts == nil {
+		opts = new(RunOptions)
+	}
+
 	var upload uploader
 
-	// Start a function to receive and print log messages.
-	logfile, err := os.Create(upload.maybeUpload(LogFile))
+	cConverge, cLog, msgLog, stopLog, err := startLog(CobraCommand, upload.maybeUpload(LogFile))
 	if err != nil {
-		return fmt.Errorf("inmap: problem creating log file: %v", err)
+		return err
 	}
-	mw := io.MultiWriter(CobraCommand.OutOrStdout(), logfile)
-	log.SetOutput(mw)
-	cConverge := make(chan inmap.ConvergenceStatus)
-	cLog := make(chan *inmap.SimulationStatus)
-	msgLog := make(chan string)
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		for msg := range cConverge {
-			log.Println(msg.String())
-		}
-		wg.Done()
-	}()
-	go func() {
-		for msg := range cLog {
-			log.Println(msg.String())
-		}
-		wg.Done()
-	}()
-	go func() {
-		for msg := range msgLog {
-			log.Println(msg)
-		}
-		wg.Done()
-	}()
-
-	defer func() { // Wait for the logging to finish.
-		close(cConverge)
-		close(cLog)
-		close(msgLog)
-		wg.Wait()
-		logfile.Close()
-	}()
+	defer stopLog()
 
 	o, err := inmap.NewOutputter(upload.maybeUpload(OutputFile), OutputAllLayers, OutputVariables, nil, m)
 	if err != nil {
 		return err
 	}
 	log.Println("Parsing output variable expressions...")
+	if len(opts.SourceTags) > 0 {
+		if err = o.TagOutput(opts.SourceTags, opts.SourceTagOutputVariables...); err != nil {
+			return err
+		}
+	}
 
 	if upload.err != nil {
 		return upload.err
 	}
+	outSR, err := outputSpatialRef(opts.OutputProj)
+	if err != nil {
+		return err
+	}
+	if outSR != nil {
+		o.ReprojectOutput(outSR)
+	}
 
 	sr, err := spatialRef(VarGrid)
 	if err != nil {
 		return err
 	}
-	emis, err := inmap.ReadEmissionShapefiles(sr, EmissionUnits, msgLog, EmissionsShapefiles...)
+	emis, err := inmap.ReadEmissions(sr, EmissionUnits, opts.EmissionsColumns, msgLog, EmissionsShapefiles...)
 	if err != nil {
 		return err
 	}
@@ -188,7 +319,7 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 	var popIndices inmap.PopIndices
 	var mortIndices inmap.MortIndices
 	var ctmData *inmap.CTMData
-	if dynamic || createGrid {
+	if dynamic || (createGrid && !opts.Restart) {
 		log.Println("Loading CTM data...")
 		ctmData, err = getCTMData(InMAPData, VarGrid)
 		if err != nil {
@@ -207,7 +338,7 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 	if !dynamic {
 		if createGrid {
 			var mutator inmap.GridMutator
-			mutator, err = inmap.PopulationMutator(VarGrid, popIndices)
+			mutator, err = staticMutator(VarGrid, popIndices)
 			if err != nil {
 				return err
 			}
@@ -216,7 +347,7 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 				VarGrid.MutateGrid(mutator, ctmData, pop, mr, emis, m, msgLog),
 				inmap.SetTimestepCFL(),
 			}
-		} else { // pre-created static grid
+		} else if !opts.Restart { // pre-created static grid
 			var r io.Reader
 			r, err = os.Open(VariableGridData)
 			if err != nil {
@@ -238,20 +369,126 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 	} else { // dynamic grid
 		initFuncs = []inmap.DomainManipulator{
 			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, emis, m),
-			inmap.SetTimestepCFL(),
-			o.CheckOutputVars(m),
 		}
 		popConcMutator := inmap.NewPopConcMutator(VarGrid, popIndices)
+		coarsener := popConcMutator.Coarsen()
+		if len(VarGrid.RefinementFiles) > 0 {
+			// Refine the grid in the user-specified regions and keep it refined.
+			var regions *inmap.RegionMutator
+			regions, err = inmap.NewRegionMutator(VarGrid)
+			if err != nil {
+				return err
+			}
+			initFuncs = append(initFuncs,
+				VarGrid.MutateGrid(regions.Mutate(), ctmData, pop, mr, emis, m, msgLog))
+			coarsener = inmap.CombineCoarseners(coarsener, regions.Coarsen())
+		}
+		initFuncs = append(initFuncs,
+			inmap.SetTimestepCFL(),
+			o.CheckOutputVars(m),
+		)
 		const gridMutateInterval = 3 * 60 * 60 // every 3 hours in seconds
 		runFuncs = []inmap.DomainManipulator{
 			inmap.Log(cLog),
 			inmap.Calculations(inmap.AddEmissionsFlux()),
 			scienceCalcs,
+		}
+		if opts.Coarsen {
+			runFuncs = append(runFuncs, inmap.RunPeriodically(gridMutateInterval,
+				VarGrid.CoarsenGrid(coarsener, ctmData, pop, mr, emis, m, msgLog)))
+		}
+		runFuncs = append(runFuncs,
 			inmap.RunPeriodically(gridMutateInterval,
 				VarGrid.MutateGrid(popConcMutator.Mutate(), ctmData, pop, mr, emis, m, msgLog)),
 			inmap.RunPeriodically(gridMutateInterval, inmap.SetTimestepCFL()),
 			inmap.SteadyStateConvergenceCheck(NumIterations, VarGrid.PopGridColumn, m, cConverge),
+		)
+	}
+
+	if opts.Restart {
+		// Resume from the checkpoint instead of creating or loading the grid.
+		if opts.CheckpointFile == "" {
+			return fmt.Errorf("inmap: a checkpoint file (Checkpoint.File) must be specified to restart a simulation")
+		}
+		log.Printf("Restarting from checkpoint %s...", opts.CheckpointFile)
+		if opts.AEP != nil {
+			// The checkpointed emissions include the AEP emissions, so
+			// they need to be added before the checkpoint is loaded.
+			// They are allocated to the checkpointed grid cells, which
+			// are the cells they were allocated to in the original simulation.
+			if err = addAEPToCheckpoint(opts.AEP, emis, opts.CheckpointFile, VarGrid.GridProj); err != nil {
+				return err
+			}
+		}
+		var f *os.File
+		f, err = os.Open(opts.CheckpointFile)
+		if err != nil {
+			return fmt.Errorf("problem opening checkpoint file: %v", err)
+		}
+		defer f.Close()
+		initFuncs = []inmap.DomainManipulator{
+			inmap.Restart(f, VarGrid, emis, m),
+			o.CheckOutputVars(m),
+		}
+	} else if opts.AEP != nil {
+		initFuncs = append(initFuncs, opts.AEP.AddEmissions(emis, VarGrid.GridProj, m))
+	}
+	if len(opts.SourceTags) > 0 {
+		initFuncs = append(initFuncs, inmap.TrackTags(emis, m, opts.SourceTags...))
+	}
+	if opts.BudgetInterval != "" {
+		var interval time.Duration
+		interval, err = time.ParseDuration(opts.BudgetInterval)
+		if err != nil {
+			return fmt.Errorf("inmap: budget interval: %v", err)
 		}
+		initFuncs = append(initFuncs, inmap.TrackBudget(m, interval.Seconds()))
+		addCleanup = append([]inmap.DomainManipulator{logBudget}, addCleanup...)
+	}
+	bc, err := opts.BoundaryConditions.BoundaryConditions(VarGrid, m)
+	if err != nil {
+		return err
+	}
+	if bc != nil {
+		initFuncs = append(initFuncs, inmap.SetBoundaryConditions(bc, nil))
+	}
+	if len(opts.Workers) > 0 {
+		// The workers only add emissions and run the science functions,
+		// so options that require other calculations in each time step
+		// can't be used.
+		switch {
+		case dynamic:
+			return fmt.Errorf("inmap: distributed simulations cannot use a dynamic grid")
+		case len(opts.SourceTags) > 0:
+			return fmt.Errorf("inmap: distributed simulations cannot track source tags")
+		case opts.BudgetInterval != "":
+			return fmt.Errorf("inmap: distributed simulations cannot track the mass budget")
+		case bc != nil:
+			return fmt.Errorf("inmap: distributed simulations cannot use boundary conditions")
+		}
+		log.Printf("Connecting to %d workers...", len(opts.Workers))
+		var cluster *inmap.Cluster
+		cluster, err = inmap.NewCluster(opts.Workers...)
+		if err != nil {
+			return err
+		}
+		defer cluster.Close()
+		initFuncs = append(initFuncs, cluster.Distribute(VarGrid.PopGridColumn, m))
+		runFuncs = []inmap.DomainManipulator{
+			inmap.Log(cLog),
+			cluster.Step(),
+			inmap.SteadyStateConvergenceCheck(NumIterations,
+				VarGrid.PopGridColumn, m, cConverge),
+		}
+	}
+	if opts.CheckpointFile != "" {
+		var interval time.Duration
+		interval, err = time.ParseDuration(opts.CheckpointInterval)
+		if err != nil {
+			return fmt.Errorf("inmap: checkpoint interval: %v", err)
+		}
+		runFuncs = append(runFuncs, inmap.RunPeriodically(interval.Seconds(),
+			inmap.Checkpoint(opts.CheckpointFile, VarGrid, m)))
 	}
 
 	d := &inmap.InMAP{
@@ -268,16 +505,8 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
 	}
 
-	emisTotals := make([]float64, len(d.Cells()[0].Cf))
-	for _, c := range d.Cells() {
-		for i, val := range c.EmisFlux {
-			emisTotals[i] += val * c.Volume
-		}
-	}
-	log.Println("Emission totals:")
-	for i, pol := range inmap.PolNames {
-		log.Printf("%v, %g μg/s\n", pol, emisTotals[i])
-	}
+	logEmissionTotals(d, m)
+	logTimestepLimits(d)
 
 	if err = d.Run(); err != nil {
 		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
@@ -292,3 +521,37 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 
 	return nil
 }
+
+// logBudget writes the mass budget of d to the log.
+func logBudget(d *inmap.InMAP) error {
+	log.Println(d.Budget())
+	return nil
+}
+
+// logTimestepLimits writes the processes and grid cells that limit
+// the time step in d to the log.
+func logTimestepLimits(d *inmap.InMAP) {
+	limits := d.TimestepLimits()
+	if len(limits) == 0 {
+		return
+	}
+	log.Println("Time step limits:")
+	for _, l := range limits {
+		log.Println(l)
+	}
+}
+
+// logEmissionTotals writes the total emissions of each species
+// of mechanism m in d to the log.
+func logEmissionTotals(d *inmap.InMAP, m inmap.Mechanism) {
+	emisTotals := make([]float64, m.Len())
+	for _, c := range d.Cells() {
+		for i, val := range c.EmisFlux {
+			emisTotals[i] += val * c.Volume
+		}
+	}
+	log.Println("Emission totals:")
+	for i, pol := range m.Species() {
+		log.Printf("%v, %g μg/s\n", pol, emisTotals[i])
+	}
+}
@@ -23,9 +23,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/science/chem/extendedchem"
 )
 
 // Set up directory location for configuration files.
@@ -145,3 +147,40 @@ func TestGetStringMapString(t *testing.T) {
 	}
 	cfg.Set("VarGrid.MortalityRateColumns", save)
 }
+
+func TestGetMechanism(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("Mechanism", "extendedchem")
+	cfg.Set("ExtendedChem.OxidantScale", 1.5)
+	m, err := getMechanism(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := m.(extendedchem.Mechanism).OxidantScale; have != 1.5 {
+		t.Errorf("OxidantScale: have %g, want 1.5", have)
+	}
+	cfg.Set("ExtendedChem.OxidantScale", -1)
+	if _, err := getMechanism(cfg.Viper); err == nil {
+		t.Error("expected an error for a negative OxidantScale")
+	}
+	cfg.Set("ExtendedChem.OxidantScale", 1)
+	cfg.Set("ExtendedChem.NOxScale", 1)
+	if _, err := getMechanism(cfg.Viper); err == nil {
+		t.Error("expected an error for an invalid setting")
+	}
+}
+
+func TestInMAPWorkersUnsupported(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Workers", []string{"127.0.0.1:1"})
+	cfg.Set("SourceTags", []string{"a"})
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	defer os.Remove("inmap_output.log")
+	err := cfg.Root.Execute()
+	if err == nil || !strings.Contains(err.Error(), "cannot track source tags") {
+		t.Errorf("have error %v, want an error about source tags", err)
+	}
+}
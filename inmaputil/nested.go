@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/lnashier/viper"
+	"github.com/spatialmodel/inmap"
+	"github.com/spf13/cobra"
+)
+
+// RunNested runs a one-way nested simulation, where the results of a
+// steady-state simulation of an outer domain are used as the boundary
+// conditions of a steady-state simulation of a smaller inner domain,
+// which can have its own grid and meteorology. outer and inner hold the
+// configuration of the outer and inner domains, with the same options as
+// "inmap run steady".
+//
+// The results of the outer domain, which must be written to a local
+// shapefile, are output for all layers and include the variables
+// needed for the boundary conditions (see inmap.BoundaryOutputVariables)
+// in addition to the OutputVariables. Any boundary conditions specified
+// for the inner domain are replaced by the results of the outer domain.
+// Both domains must use the same chemical mechanism.
+func RunNested(CobraCommand *cobra.Command, outer, inner *viper.Viper) error {
+	outputFile, err := checkOutputFile(outer.GetString("OutputFile"))
+	if err != nil {
+		return err
+	}
+	if IsBlob(outputFile) || filepath.Ext(outputFile) != ".shp" {
+		return fmt.Errorf("inmap: the OutputFile of the outer domain of a nested simulation must be a local shapefile, not %s", outputFile)
+	}
+	innerOutputFile, err := checkOutputFile(inner.GetString("OutputFile"))
+	if err != nil {
+		return err
+	}
+	if innerOutputFile == outputFile {
+		return fmt.Errorf("inmap: the inner domain of a nested simulation needs its own OutputFile")
+	}
+	if outer.GetString("Mechanism") != inner.GetString("Mechanism") {
+		return fmt.Errorf("inmap: the inner and outer domains of a nested simulation must use the same Mechanism")
+	}
+	m, err := getMechanism(outer)
+	if err != nil {
+		return err
+	}
+
+	bcVars, err := inmap.BoundaryOutputVariables(m)
+	if err != nil {
+		return err
+	}
+	outputVars := make(map[string]string)
+	for k, v := range GetStringMapString("OutputVariables", outer) {
+		outputVars[k] = v
+	}
+	for k, v := range bcVars {
+		if vv, ok := outputVars[k]; ok && vv != v {
+			return fmt.Errorf("inmap: the outer domain of a nested simulation needs output variable %s to be '%s', not '%s'", k, v, vv)
+		}
+		outputVars[k] = v
+	}
+	outer.Set("OutputVariables", outputVars)
+	outer.Set("OutputAllLayers", true)
+
+	log.Println("Running the outer domain...")
+	if err = runSteady(CobraCommand, outer); err != nil {
+		return fmt.Errorf("inmap: outer domain of nested simulation: %v", err)
+	}
+
+	inner.Set("BoundaryConditions.Type", "inmap")
+	inner.Set("BoundaryConditions.Files", []string{outputFile})
+	inner.Set("BoundaryConditions.Times", []string{})
+
+	log.Println("Running the inner domain...")
+	if err = runSteady(CobraCommand, inner); err != nil {
+		return fmt.Errorf("inmap: inner domain of nested simulation: %v", err)
+	}
+	return nil
+}
+
+// nestedConfig returns the configuration of the inner domain of a nested
+// simulation: the configuration of the outer domain in outer, replaced by
+// any options that are set in the configuration file innerFile.
+// LogFile and Checkpoint.File are not copied from the outer domain,
+// and the [AEP] table is only copied if innerFile does not have one.
+func nestedConfig(outer *viper.Viper, innerFile string) (*viper.Viper, error) {
+	if innerFile == "" {
+		return nil, fmt.Errorf("inmap: the configuration file for the inner domain of a nested simulation (Nested.Config) needs to be specified")
+	}
+	innerFile = os.ExpandEnv(innerFile)
+	f := viper.New()
+	f.SetConfigFile(innerFile)
+	if err := f.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("inmap: problem reading nested configuration file: %v", err)
+	}
+
+	inner := viper.New()
+	for _, option := range options {
+		inner.Set(option.name, outer.Get(option.name))
+	}
+	inner.Set("LogFile", "")
+	inner.Set("Checkpoint.File", "")
+	for _, option := range options {
+		if f.IsSet(option.name) {
+			inner.Set(option.name, f.Get(option.name))
+		}
+	}
+
+	aep, err := ReadAEPConfig(innerFile)
+	if err != nil {
+		return nil, err
+	}
+	if aep != nil {
+		inner.Set("config", innerFile)
+	}
+	outputFile, err := checkOutputFile(inner.GetString("OutputFile"))
+	if err != nil {
+		return nil, err
+	}
+	inner.Set("LogFile", checkLogFile(inner.GetString("LogFile"), outputFile))
+	return inner, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spatialmodel/inmap"
+)
+
+func TestInMAPNested(t *testing.T) {
+	// The inner domain covers the center of the outer domain at a finer
+	// resolution.
+	const innerConfig = `OutputFile = "${INMAP_ROOT_DIR}/cmd/inmap/testdata/output_nestedInner.shp"
+
+[VarGrid]
+VariableGridXo = -2000.0
+VariableGridYo = -2000.0
+VariableGridDx = 1000.0
+VariableGridDy = 1000.0
+Xnests = [4, 2]
+Ynests = [4, 2]
+`
+	const innerFile = "nested_inner.toml"
+	if err := ioutil.WriteFile(innerFile, []byte(innerConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(innerFile)
+
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	os.Setenv("InMAPRunType", "nestedOuter")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Nested.Config", innerFile)
+	cfg.Root.SetArgs([]string{"run", "nested"})
+	outerFile := "../cmd/inmap/testdata/output_nestedOuter.shp"
+	innerOutputFile := "../cmd/inmap/testdata/output_nestedInner.shp"
+	defer os.Remove("inmap_output.log")
+	defer os.Remove("../cmd/inmap/testdata/output_nestedInner.log")
+	defer inmap.DeleteShapefile(outerFile)
+	defer inmap.DeleteShapefile(innerOutputFile)
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{outerFile, innerOutputFile} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("missing output file: %v", err)
+		}
+	}
+}
+
+func TestNestedConfig(t *testing.T) {
+	if _, err := nestedConfig(InitializeConfig().Viper, ""); err == nil {
+		t.Error("expected an error for a missing configuration file")
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+	"github.com/spf13/cobra"
+)
+
+// RunPeriodic runs a separate steady-state simulation for each season or
+// month between StartDate and EndDate, using meteorology and emissions
+// specific to each period, and combines the results into an average over
+// the whole simulation where each period is weighted by its length.
+// The variable resolution grid is created using the static grid
+// configuration in VarGrid and the meteorology from the first period,
+// and the same grid is used for all periods.
+//
+// InMAPData is the path to the preprocessed meteorology for each period
+// created by Preproc, where [DATE] is a wild card for the beginning time of
+// each period. If InMAPData does not contain [DATE], the period beginning time
+// will be expected before the file extension.
+//
+// StartDate and EndDate are the beginning and end of the simulation,
+// in the format "YYYYMMDD" or "YYYYMMDDTHH".
+//
+// Periods is the type of period, either "seasonal" or "monthly",
+// which should match the type used in preprocessing.
+//
+// Emissions for each period are read from EmissionsShapefiles, where
+// [DATE] in any of the file names is replaced with the beginning time of
+// the period. Emissions that have temporal profiles are set to their
+// average rate during each period.
+//
+// The results for each period are written to OutputFile, with the beginning
+// time of the period added to the file name as described in
+// inmap.TimeSeriesFileName. The weighted average results are written to
+// OutputFile itself.
+//
+// NumIterations is the number of iterations to calculate for each period.
+// If < 1, convergence is automatically calculated.
+//
+// The remaining arguments are the same as for Run.
+func RunPeriodic(CobraCommand *cobra.Command, LogFile string, OutputFile, OutputProj string, OutputAllLayers bool, OutputVariables map[string]string,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsColumns map[string]string, VarGrid *inmap.VarGridConfig, InMAPData string,
+	StartDate, EndDate, Periods string, NumIterations int,
+	scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
+	m inmap.Mechanism) error {
+
+	startTime := time.Now()
+
+	var upload uploader
+
+	cConverge, cLog, msgLog, stopLog, err := startLog(CobraCommand, upload.maybeUpload(LogFile))
+	if err != nil {
+		return err
+	}
+	defer stopLog()
+
+	start, err := inmap.ParseDate(StartDate)
+	if err != nil {
+		return fmt.Errorf("inmap: periodic simulation start date: %v", err)
+	}
+	end, err := inmap.ParseDate(EndDate)
+	if err != nil {
+		return fmt.Errorf("inmap: periodic simulation end date: %v", err)
+	}
+	periods, err := inmap.Periods(start, end, Periods)
+	if err != nil {
+		return err
+	}
+
+	o, err := inmap.NewOutputter(OutputFile, OutputAllLayers, OutputVariables, nil, m)
+	if err != nil {
+		return err
+	}
+	log.Println("Parsing output variable expressions...")
+
+	if upload.err != nil {
+		return upload.err
+	}
+	outSR, err := outputSpatialRef(OutputProj)
+	if err != nil {
+		return err
+	}
+	if outSR != nil {
+		o.ReprojectOutput(outSR)
+	}
+
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+
+	// loadEmissions reads the emissions for period p. If none of the
+	// emissions files vary by period, they are only read once.
+	var emisCache *inmap.Emissions
+	loadEmissions := func(p inmap.Period) (*inmap.Emissions, error) {
+		if emisCache != nil {
+			return emisCache, nil
+		}
+		var periodSpecific bool
+		files := make([]string, len(EmissionsShapefiles))
+		for i, f := range EmissionsShapefiles {
+			if strings.Contains(f, "[DATE]") {
+				periodSpecific = true
+				f = inmap.TimeSeriesFileName(f, p.Start)
+			}
+			files[i] = f
+		}
+		emis, err := inmap.ReadEmissions(sr, EmissionUnits, EmissionsColumns, msgLog, files...)
+		if err != nil {
+			return nil, err
+		}
+		if !periodSpecific {
+			emisCache = emis
+		}
+		return emis, nil
+	}
+	loadCTMData := func(p inmap.Period) (*inmap.CTMData, error) {
+		return getCTMData(inmap.TimeSeriesFileName(InMAPData, p.Start), VarGrid)
+	}
+
+	emis, err := loadEmissions(periods[0])
+	if err != nil {
+		return err
+	}
+	log.Println("Loading CTM data...")
+	ctmData, err := loadCTMData(periods[0])
+	if err != nil {
+		return err
+	}
+	log.Println("Loading population and mortality rate data...")
+	pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+	if err != nil {
+		return err
+	}
+	mutator, err := staticMutator(VarGrid, popIndices)
+	if err != nil {
+		return err
+	}
+
+	average := o.NewPeriodAverager()
+
+	d := &inmap.InMAP{
+		InitFuncs: append([]inmap.DomainManipulator{
+			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, emis, m),
+			VarGrid.MutateGrid(mutator, ctmData, pop, mr, emis, m, msgLog),
+			inmap.SetTimestepCFL(),
+			o.CheckOutputVars(m),
+		}, addInit...),
+		RunFuncs: append([]inmap.DomainManipulator{
+			inmap.Log(cLog),
+			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.Calculations(scienceFuncs...),
+			inmap.SteadyStateConvergenceCheck(NumIterations,
+				VarGrid.PopGridColumn, m, cConverge),
+		}, addRun...),
+		CleanupFuncs: append([]inmap.DomainManipulator{
+			average.Output(sr, upload.rename),
+			upload.uploadOutput,
+		}, addCleanup...),
+	}
+
+	log.Println("Initializing model...")
+	if err = d.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+
+	for i, p := range periods {
+		log.Printf("Simulating period %d of %d: %s to %s", i+1, len(periods),
+			p.Start.Format(inmap.TimeSeriesDateFormat), p.End.Format(inmap.TimeSeriesDateFormat))
+		var data *inmap.CTMData
+		if i > 0 { // The grid was created with the data for the first period.
+			if data, err = loadCTMData(p); err != nil {
+				return err
+			}
+			if emis, err = loadEmissions(p); err != nil {
+				return err
+			}
+		}
+		if err = inmap.StartPeriod(p, data, emis, m)(d); err != nil {
+			return fmt.Errorf("InMAP: problem starting period %d: %v\n", i+1, err)
+		}
+
+		logEmissionTotals(d, m)
+		logTimestepLimits(d)
+
+		if err = d.Run(); err != nil {
+			return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+		}
+		if err = o.PeriodOutput(p, sr, upload.rename)(d); err != nil {
+			return err
+		}
+		if err = average.Add(p)(d); err != nil {
+			return err
+		}
+	}
+
+	if err = d.Cleanup(); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+
+	return nil
+}
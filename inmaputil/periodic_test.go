@@ -0,0 +1,113 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+)
+
+func TestInMAPPeriodic(t *testing.T) {
+	const dataTemplate = "../cmd/inmap/testdata/testInMAPInputData_[DATE].ncf"
+	periods := []time.Time{
+		time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2005, time.February, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	// Use the steady-state input data for each of the periods.
+	for _, tt := range periods {
+		fname := inmap.TimeSeriesFileName(dataTemplate, tt)
+		if err := copyFile(fname, "../cmd/inmap/testdata/testInMAPInputData.ncf"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fname)
+	}
+
+	cfg := InitializeConfig()
+	os.Setenv("InMAPRunType", "periodic")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", dataTemplate)
+	cfg.Set("Periodic.StartDate", "20050101")
+	cfg.Set("Periodic.EndDate", "20050301")
+	cfg.Set("Periodic.Periods", "monthly")
+	cfg.Set("NumIterations", 10)
+	cfg.Root.SetArgs([]string{"run", "periodic"})
+	defer os.Remove("inmap_output.log")
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	outputFile := os.ExpandEnv(cfg.GetString("OutputFile"))
+	for _, tt := range periods {
+		fname := inmap.TimeSeriesFileName(outputFile, tt)
+		if _, err := os.Stat(fname); err != nil {
+			t.Errorf("missing period output file: %v", err)
+		}
+		inmap.DeleteShapefile(fname)
+	}
+	if _, err := os.Stat(outputFile); err != nil {
+		t.Errorf("missing average output file: %v", err)
+	}
+	inmap.DeleteShapefile(outputFile)
+}
+
+func TestInMAPPeriodic_bucket(t *testing.T) {
+	const dataTemplate = "../cmd/inmap/testdata/testInMAPInputData_[DATE].ncf"
+	periods := []time.Time{
+		time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2005, time.February, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, tt := range periods {
+		fname := inmap.TimeSeriesFileName(dataTemplate, tt)
+		if err := copyFile(fname, "../cmd/inmap/testdata/testInMAPInputData.ncf"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fname)
+	}
+	if err := os.Mkdir("test_bucket", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_bucket")
+
+	cfg := InitializeConfig()
+	os.Setenv("InMAPRunType", "periodic")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", dataTemplate)
+	cfg.Set("OutputFile", "file://test_bucket/output_periodic.shp")
+	cfg.Set("LogFile", "file://test_bucket/output_periodic.log")
+	cfg.Set("Periodic.StartDate", "20050101")
+	cfg.Set("Periodic.EndDate", "20050301")
+	cfg.Set("Periodic.Periods", "monthly")
+	cfg.Set("NumIterations", 10)
+	cfg.Root.SetArgs([]string{"run", "periodic"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	const outputFile = "test_bucket/output_periodic.shp"
+	for _, tt := range periods {
+		if _, err := os.Stat(inmap.TimeSeriesFileName(outputFile, tt)); err != nil {
+			t.Errorf("missing uploaded period output file: %v", err)
+		}
+	}
+	if _, err := os.Stat(outputFile); err != nil {
+		t.Errorf("missing uploaded average output file: %v", err)
+	}
+}
@@ -22,7 +22,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/ctessum/geom/proj"
 	"github.com/spatialmodel/inmap"
 )
 
@@ -31,14 +35,14 @@ import (
 // and saves the result for use in future InMAP simulations.
 //
 // StartDate is the date of the beginning of the simulation.
-// Format = "YYYYMMDD".
+// Format = "YYYYMMDD" or "YYYYMMDDTHH".
 //
 // EndDate is the date of the end of the simulation.
-// Format = "YYYYMMDD".
+// Format = "YYYYMMDD" or "YYYYMMDDTHH".
 //
 // CTMType specifies what type of chemical transport
 // model we are going to be reading data from. Valid
-// options are "GEOS-Chem" and "WRF-Chem".
+// options are "GEOS-Chem", "WRF-Chem", and "CMAQ".
 //
 // WRFOut is the location of WRF-Chem output files.
 // [DATE] should be used as a wild card for the simulation date.
@@ -73,6 +77,17 @@ import (
 // which is described here:
 // http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map#Structure_of_the_vegtype.global_file
 //
+// METCRO3D, METCRO2D, METDOT3D, and GRIDCRO2D are the locations of the
+// MCIP 3-D cross-point, 2-D cross-point, 3-D dot-point, and grid
+// files, and CMAQConc is the location of the CMAQ concentration files.
+// [DATE] should be used as a wild card for the simulation date.
+//
+// SpeciesGroups specifies the CTM species that make up the chemical
+// species groups. It can be the name of one of the presets listed by
+// inmap.SpeciesGroupPresets or the path to a TOML or CSV file in the
+// format described in inmap.LoadSpeciesGroups. If it is empty, the
+// default species groups for the CTMType will be used.
+//
 // InMAPData is the path where the preprocessed baseline meteorology and pollutant
 // data should be written.
 //
@@ -84,28 +99,150 @@ import (
 //
 // CtmGridDy is the grid cell size in the y direction [m].
 //
+// If TargetGridProj is not empty, the preprocessed data will be
+// conservatively regridded from the CTM grid, which has the spatial
+// reference CtmGridProj, to a target grid with the spatial reference
+// TargetGridProj, lower left corner TargetGridXo and TargetGridYo,
+// grid cell sizes TargetGridDx and TargetGridDy, and TargetGridNx
+// columns and TargetGridNy rows, as described in inmap.CTMData.Regrid.
+// CtmGridProj and TargetGridProj can be in Proj4 or WKT format.
+//
 // dash indicates whether GEOS-Chem variable names are in the form 'IJ-AVG-S__xxx'
 // as opposed to 'IJ_AVG_S_xxx'.
+//
+// If SnapshotInterval is not empty, a time series of
+// snapshots will be created for use in time-resolved simulations
+// rather than a single average over the whole period, where
+// SnapshotInterval is the length of time represented by each snapshot
+// (e.g., "1h" or "24h"). Each snapshot will be saved in a separate
+// file, with the name of the file created from InMAPData
+// as described in inmap.TimeSeriesFileName.
+//
+// If Periods is not empty, a separate average is created for each
+// season or month between StartDate and EndDate for use in periodic
+// simulations, where Periods is "seasonal" or "monthly" as described
+// in inmap.Periods. Each average is saved in a separate file, with the
+// name of the file created from InMAPData and the beginning time of
+// the period as described in inmap.TimeSeriesFileName.
+// Periods and SnapshotInterval cannot both be specified.
+//
+// TileRows is the number of grid rows in the South-North direction
+// to process at a time, which can be used to limit memory use. If it is
+// zero, the whole domain is processed at once.
+//
+// Concurrency is the maximum number of variable groups to process at
+// the same time. If it is zero, there is no limit.
+//
+// If TempDir is not empty, intermediate results are saved in
+// a subdirectory of TempDir so that preprocessing can be resumed
+// if it is interrupted, as described in inmap.PreprocessOptions.
 func Preproc(StartDate, EndDate, CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp,
-	GEOSChem, VegTypeGlobal, InMAPData string, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy float64, dash bool, recordDeltaStr, fileDeltaStr string, noChemHour bool) error {
+	GEOSChem, VegTypeGlobal, METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc, SpeciesGroups,
+	InMAPData string, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy float64,
+	CtmGridProj, TargetGridProj string, TargetGridXo, TargetGridYo, TargetGridDx, TargetGridDy float64, TargetGridNx, TargetGridNy int,
+	dash bool, recordDeltaStr, fileDeltaStr string, noChemHour bool,
+	SnapshotInterval, Periods string, TileRows, Concurrency int, TempDir string) error {
 	msgChan := make(chan string)
 	go func() {
 		for {
 			log.Println(<-msgChan)
 		}
 	}()
-	var ctm inmap.Preprocessor
+
+	if SnapshotInterval != "" && Periods != "" {
+		return fmt.Errorf("inmap preprocessor: SnapshotInterval and Periods cannot both be specified")
+	}
+
+	opts := inmap.PreprocessOptions{
+		TileRows:    TileRows,
+		Concurrency: Concurrency,
+		TempDir:     TempDir,
+		MsgChan:     msgChan,
+	}
+	ctmGrid := &inmap.CTMGrid{X0: CtmGridXo, Y0: CtmGridYo, Dx: CtmGridDx, Dy: CtmGridDy}
+	target, err := targetGrid(CtmGridProj, TargetGridProj, TargetGridXo, TargetGridYo,
+		TargetGridDx, TargetGridDy, TargetGridNx, TargetGridNy, ctmGrid)
+	if err != nil {
+		return err
+	}
+
+	if SnapshotInterval == "" && Periods == "" {
+		ctm, err := newPreprocessor(StartDate, EndDate, CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp,
+			GEOSChem, VegTypeGlobal, METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc, SpeciesGroups,
+			dash, recordDeltaStr, fileDeltaStr, noChemHour, msgChan)
+		if err != nil {
+			return err
+		}
+		return preprocWrite(ctm, InMAPData, opts, ctmGrid, target)
+	}
+
+	// Create a time series of snapshots or periods.
+	start, err := inmap.ParseDate(StartDate)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: start date: %v", err)
+	}
+	end, err := inmap.ParseDate(EndDate)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: end date: %v", err)
+	}
+	var windows []inmap.Period
+	if Periods != "" {
+		windows, err = inmap.Periods(start, end, Periods)
+		if err != nil {
+			return err
+		}
+	} else {
+		interval, err := time.ParseDuration(SnapshotInterval)
+		if err != nil {
+			return fmt.Errorf("inmap preprocessor: snapshot interval: %v", err)
+		}
+		times, err := inmap.TimeWindows(start, end, interval)
+		if err != nil {
+			return err
+		}
+		for i, t := range times {
+			windowEnd := end
+			if i < len(times)-1 {
+				windowEnd = times[i+1]
+			}
+			windows = append(windows, inmap.Period{Start: t, End: windowEnd})
+		}
+	}
+	for i, w := range windows {
+		ctm, err := newPreprocessor(w.Start.Format(inmap.TimeSeriesDateFormat), w.End.Format(inmap.TimeSeriesDateFormat),
+			CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp,
+			GEOSChem, VegTypeGlobal, METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc, SpeciesGroups,
+			dash, recordDeltaStr, fileDeltaStr, noChemHour, msgChan)
+		if err != nil {
+			return err
+		}
+		fileName := inmap.TimeSeriesFileName(InMAPData, w.Start)
+		log.Printf("Preprocessing period %d of %d: %s", i+1, len(windows), fileName)
+		if err := preprocWrite(ctm, fileName, opts, ctmGrid, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newPreprocessor returns the preprocessor for the specified CTMType.
+func newPreprocessor(StartDate, EndDate, CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp,
+	GEOSChem, VegTypeGlobal, METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc, SpeciesGroups string,
+	dash bool, recordDeltaStr, fileDeltaStr string, noChemHour bool, msgChan chan string) (inmap.Preprocessor, error) {
+	groups, err := speciesGroups(SpeciesGroups, CTMType)
+	if err != nil {
+		return nil, err
+	}
 	switch CTMType {
 	case "GEOS-Chem":
 		vars := []string{StartDate, EndDate, CTMType, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSChem, VegTypeGlobal, recordDeltaStr, fileDeltaStr}
 		varNames := []string{"StartDate", "EndDate", "CTMType", "GEOSA1", "GEOSA3Cld", "GEOSA3Dyn", "GEOSI3", "GEOSA3MstE", "GEOSChem", "VegTypeGlobal", "recordDeltaStr", "fileDeltaStr"}
 		for i, v := range vars {
 			if v == "" {
-				return fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
 			}
 		}
-		var err error
-		ctm, err = inmap.NewGEOSChem(
+		return inmap.NewGEOSChem(
 			GEOSA1,
 			GEOSA3Cld,
 			GEOSA3Dyn,
@@ -120,38 +257,116 @@ func Preproc(StartDate, EndDate, CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn,
 			recordDeltaStr,
 			fileDeltaStr,
 			noChemHour,
+			groups,
 			msgChan,
 		)
-		if err != nil {
-			return err
-		}
 	case "WRF-Chem":
 		vars := []string{StartDate, EndDate, CTMType, WRFOut}
 		varNames := []string{"StartDate", "EndDate", "CTMType", "WRFOut"}
 		for i, v := range vars {
 			if v == "" {
-				return fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
 			}
 		}
-		var err error
-		ctm, err = inmap.NewWRFChem(WRFOut, StartDate, EndDate, msgChan)
-		if err != nil {
-			return err
+		return inmap.NewWRFChem(WRFOut, StartDate, EndDate, groups, msgChan)
+	case "CMAQ":
+		vars := []string{StartDate, EndDate, CTMType, METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc}
+		varNames := []string{"StartDate", "EndDate", "CTMType", "METCRO3D", "METCRO2D", "METDOT3D", "GRIDCRO2D", "CONC"}
+		for i, v := range vars {
+			if v == "" {
+				return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+			}
 		}
+		return inmap.NewCMAQ(METCRO3D, METCRO2D, METDOT3D, GRIDCRO2D, CMAQConc, StartDate, EndDate, groups, msgChan)
 	default:
-		return fmt.Errorf("inmap preprocessor: the CTMType you specified, '%s', is invalid. Valid options are WRF-Chem and GEOS-Chem", CTMType)
+		return nil, fmt.Errorf("inmap preprocessor: the CTMType you specified, '%s', is invalid. Valid options are WRF-Chem, GEOS-Chem, and CMAQ", CTMType)
+	}
+}
+
+// speciesGroups returns the species groups specified by spec, which
+// can be empty, the name of a preset, or the path to a species group file.
+// Presets for CTMs other than CTMType are not allowed.
+func speciesGroups(spec, CTMType string) (inmap.SpeciesGroups, error) {
+	if spec == "" {
+		return nil, nil
 	}
-	ctmData, err := inmap.Preprocess(ctm)
+	for _, preset := range inmap.SpeciesGroupPresets() {
+		if spec != preset {
+			continue
+		}
+		if !strings.HasPrefix(preset, CTMType+":") {
+			return nil, fmt.Errorf("inmap preprocessor: species group preset %s cannot be used with CTMType %s", preset, CTMType)
+		}
+		return inmap.SpeciesGroupPreset(preset)
+	}
+	return inmap.LoadSpeciesGroups(spec)
+}
+
+// targetGrid returns the grid that preprocessed data should be regridded
+// to, or nil if TargetGridProj is empty, and sets the spatial reference
+// of ctmGrid.
+func targetGrid(CtmGridProj, TargetGridProj string, TargetGridXo, TargetGridYo, TargetGridDx, TargetGridDy float64,
+	TargetGridNx, TargetGridNy int, ctmGrid *inmap.CTMGrid) (*inmap.CTMGrid, error) {
+	if TargetGridProj == "" {
+		return nil, nil
+	}
+	if CtmGridProj == "" {
+		return nil, fmt.Errorf("inmap preprocessor: CtmGridProj must be specified when regridding to a target grid")
+	}
+	if TargetGridNx <= 0 || TargetGridNy <= 0 || TargetGridDx <= 0 || TargetGridDy <= 0 {
+		return nil, fmt.Errorf("inmap preprocessor: invalid target grid size: Nx=%d, Ny=%d, Dx=%g, Dy=%g",
+			TargetGridNx, TargetGridNy, TargetGridDx, TargetGridDy)
+	}
+	var err error
+	ctmGrid.SR, err = proj.Parse(CtmGridProj)
+	if err != nil {
+		return nil, fmt.Errorf("inmap preprocessor: parsing CtmGridProj: %v", err)
+	}
+	targetSR, err := proj.Parse(TargetGridProj)
+	if err != nil {
+		return nil, fmt.Errorf("inmap preprocessor: parsing TargetGrid.GridProj: %v", err)
+	}
+	return &inmap.CTMGrid{
+		SR: targetSR,
+		X0: TargetGridXo,
+		Y0: TargetGridYo,
+		Dx: TargetGridDx,
+		Dy: TargetGridDy,
+		Nx: TargetGridNx,
+		Ny: TargetGridNy,
+	}, nil
+}
+
+// preprocWrite preprocesses the data from ctm as specified by opts
+// and writes the result to InMAPData. If target is not nil, the data
+// is regridded from ctmGrid to target before it is written.
+// If opts.TempDir is not empty, the intermediate results are saved
+// in a subdirectory named after InMAPData.
+func preprocWrite(ctm inmap.Preprocessor, InMAPData string, opts inmap.PreprocessOptions, ctmGrid, target *inmap.CTMGrid) error {
+	if opts.TempDir != "" {
+		opts.TempDir = filepath.Join(opts.TempDir, filepath.Base(InMAPData))
+	}
+	ctmData, err := inmap.PreprocessWithOptions(ctm, opts)
 	if err != nil {
 		return err
 	}
+	grid := ctmGrid
+	if target != nil {
+		shape := ctmData.Data["WindSpeed"].Data.Shape
+		ctmGrid.Nx, ctmGrid.Ny = shape[2], shape[1]
+		ctmData, err = ctmData.Regrid(ctmGrid, target)
+		if err != nil {
+			return err
+		}
+		grid = target
+	}
 
 	// Write out the result.
 	ff, err := os.Create(InMAPData)
 	if err != nil {
 		return fmt.Errorf("inmap: preprocessor writing output file: %v", err)
 	}
-	ctmData.Write(ff, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy)
+	ctmData.Write(ff, grid.X0, grid.Y0, grid.Dx, grid.Dy)
 	ff.Close()
 
 	return nil
@@ -19,8 +19,16 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package inmaputil
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/ctessum/cdf"
+	"github.com/spatialmodel/inmap"
 )
 
 func TestPreprocWRFChem(t *testing.T) {
@@ -46,3 +54,117 @@ func TestPreprocGEOSChem(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSpeciesGroups(t *testing.T) {
+	g, err := speciesGroups("", "WRF-Chem")
+	if err != nil || g != nil {
+		t.Errorf("empty: have %v, %v; want nil", g, err)
+	}
+	g, err = speciesGroups("GEOS-Chem:v10", "GEOS-Chem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := inmap.SpeciesGroupPreset("GEOS-Chem:v10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("have %v, want %v", g, want)
+	}
+	if _, err = speciesGroups("GEOS-Chem:v10", "WRF-Chem"); err == nil {
+		t.Error("expected an error for a preset for a different CTMType")
+	}
+	if _, err = speciesGroups("does_not_exist.toml", "WRF-Chem"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestTargetGrid(t *testing.T) {
+	ctmGrid := &inmap.CTMGrid{X0: -130, Y0: 20, Dx: 0.625, Dy: 0.5}
+	g, err := targetGrid("", "", 0, 0, 0, 0, 0, 0, ctmGrid)
+	if err != nil || g != nil {
+		t.Errorf("no target grid: have %v, %v; want nil", g, err)
+	}
+	const lcc = "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1"
+	g, err = targetGrid("+proj=longlat", lcc, -2736000, -2088000, 12000, 12000, 459, 299, ctmGrid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Nx != 459 || g.Ny != 299 || g.Dx != 12000 || g.X0 != -2736000 || g.SR == nil {
+		t.Errorf("target grid: have %+v", g)
+	}
+	if ctmGrid.SR == nil {
+		t.Error("CTM grid spatial reference was not set")
+	}
+	if _, err = targetGrid("", lcc, -2736000, -2088000, 12000, 12000, 459, 299, ctmGrid); err == nil {
+		t.Error("expected an error for a missing CTM grid projection")
+	}
+	if _, err = targetGrid("+proj=longlat", lcc, -2736000, -2088000, 12000, 12000, 0, 299, ctmGrid); err == nil {
+		t.Error("expected an error for an empty target grid")
+	}
+}
+
+func TestPreprocCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inmap_preproc_check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	err = PreprocCheck(&b, "../cmd/inmap/testdata/preproc/inmapData_WRFChem_golden.ncf",
+		[]string{"TotalPM25", "Kzz", "Pblh"}, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := b.String()
+	for _, want := range []string{"No problems found.", "TotalPM25", "LayerHeights"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+	for _, f := range []string{"TotalPM25_layer1_map.png", "TotalPM25_layer1_hist.png",
+		"Kzz_layer1_map.png", "Kzz_layer1_hist.png", "Pblh_layer0_map.png", "Pblh_layer0_hist.png"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = PreprocCheck(ioutil.Discard, "../cmd/inmap/testdata/preproc/inmapData_WRFChem_golden.ncf",
+		[]string{"TotalPM25"}, 100, dir)
+	if err == nil || !strings.Contains(err.Error(), "cannot plot layer 100 of TotalPM25") {
+		t.Errorf("invalid layer: have error %v", err)
+	}
+
+	// A file that is missing required attributes and variables
+	// should be reported rather than causing a panic.
+	h := cdf.NewHeader([]string{"y", "x"}, []int{2, 2})
+	h.AddVariable("TotalPM25", []string{"y", "x"}, []float32{0})
+	h.AddAttribute("TotalPM25", "units", "μg m-3")
+	h.AddAttribute("", "dx", []float64{1})
+	h.Define()
+	badFile := filepath.Join(dir, "bad.ncf")
+	bf, err := os.Create(badFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cdf.Create(bf, h); err != nil {
+		t.Fatal(err)
+	}
+	bf.Close()
+	b.Reset()
+	if err = PreprocCheck(&b, badFile, nil, 0, ""); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+	report = b.String()
+	for _, want := range []string{"missing required variable UAvg", "variable TotalPM25 is missing text attribute 'description'",
+		"missing floating point global attribute 'dy'", "missing integer global attribute 'nx'",
+		"missing text global attribute 'data_version'"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "attribute 'dx'") {
+		t.Errorf("report should not contain attribute 'dx':\n%s", report)
+	}
+}
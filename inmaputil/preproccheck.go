@@ -0,0 +1,294 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ctessum/cdf"
+	"github.com/spatialmodel/inmap"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+// PreprocCheck loads the preprocessed InMAP data file InMAPData, checks it
+// for problems as described in inmap.CTMData.Check, and writes a report of
+// the problems and of the statistics of each variable in each vertical
+// layer to w. If the file is missing variables, dimensions, or attributes
+// that are needed to load it, those problems are reported instead.
+//
+// If PlotDir is not empty, a map and a histogram of the values in vertical
+// layer PlotLayer of each of the variables in PlotVariables are saved as PNG
+// files in PlotDir. Variables without a vertical dimension are plotted
+// regardless of PlotLayer.
+//
+// An error is returned if any problems are found.
+func PreprocCheck(w io.Writer, InMAPData string, PlotVariables []string, PlotLayer int, PlotDir string) error {
+	f, err := os.Open(InMAPData)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: opening InMAP data file: %v", err)
+	}
+	defer f.Close()
+	ff, err := cdf.Open(f)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: opening InMAP data file: %v", err)
+	}
+	// Check the file structure first, because LoadCTMData assumes
+	// that it is valid.
+	if errs := checkCTMHeader(ff.Header); len(errs) > 0 {
+		fmt.Fprintf(w, "%d problems found in the structure of %s:\n", len(errs), InMAPData)
+		for _, err := range errs {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+		return fmt.Errorf("inmap preprocessor: found %d problems in %s", len(errs), InMAPData)
+	}
+	var cfg inmap.VarGridConfig
+	d, err := cfg.LoadCTMData(f)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(d.Data))
+	for name := range d.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Statistics for each vertical layer in %s:\n\n", InMAPData)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Variable\tLayer\tMin\tMax\tMean\tNonFinite\tUnits\t")
+	for _, name := range names {
+		stats, err := d.LayerStats(name)
+		if err != nil {
+			return err
+		}
+		for l, s := range stats {
+			fmt.Fprintf(tw, "%s\t%d\t%.4g\t%.4g\t%.4g\t%d\t%s\t\n", name, l, s.Min, s.Max, s.Mean, s.NonFinite, d.Data[name].Units)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	errs := d.Check()
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "\nNo problems found.")
+	} else {
+		fmt.Fprintf(w, "\n%d problems found:\n", len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+	}
+
+	if PlotDir != "" {
+		if err := os.MkdirAll(PlotDir, 0755); err != nil {
+			return fmt.Errorf("inmap preprocessor: creating plot directory: %v", err)
+		}
+		for _, name := range PlotVariables {
+			if err := plotCTMVariable(d, name, PlotLayer, PlotDir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("inmap preprocessor: found %d problems in %s", len(errs), InMAPData)
+	}
+	return nil
+}
+
+// checkCTMHeader returns any problems with the variables, dimensions, and
+// attributes in header h of a preprocessed InMAP data file that would
+// prevent the file from being loaded.
+func checkCTMHeader(h *cdf.Header) []error {
+	var errs []error
+	vars := h.Variables()
+	hasUAvg := false
+	for _, v := range vars {
+		if v == "UAvg" {
+			hasUAvg = true
+		}
+		for _, a := range []string{"description", "units"} {
+			if _, ok := h.GetAttribute(v, a).(string); !ok {
+				errs = append(errs, fmt.Errorf("variable %s is missing text attribute '%s'", v, a))
+			}
+		}
+	}
+	if !hasUAvg {
+		errs = append(errs, fmt.Errorf("missing required variable UAvg"))
+	} else if n := len(h.Lengths("UAvg")); n != 3 {
+		errs = append(errs, fmt.Errorf("variable UAvg has %d dimensions instead of 3", n))
+	}
+	for _, a := range []string{"dx", "dy", "x0", "y0"} {
+		if v, ok := h.GetAttribute("", a).([]float64); !ok || len(v) == 0 {
+			errs = append(errs, fmt.Errorf("missing floating point global attribute '%s'", a))
+		}
+	}
+	for _, a := range []string{"nx", "ny"} {
+		if v, ok := h.GetAttribute("", a).([]int32); !ok || len(v) == 0 {
+			errs = append(errs, fmt.Errorf("missing integer global attribute '%s'", a))
+		}
+	}
+	if _, ok := h.GetAttribute("", "data_version").(string); !ok {
+		errs = append(errs, fmt.Errorf("missing text global attribute 'data_version'"))
+	}
+	return errs
+}
+
+// ctmLayer is a horizontal layer of a CTMData variable.
+// It implements plotter.GridXYZ, where the x and y values
+// are the column and row indices.
+type ctmLayer struct {
+	data   []float64
+	nx, ny int
+}
+
+func (l ctmLayer) Dims() (c, r int)   { return l.nx, l.ny }
+func (l ctmLayer) Z(c, r int) float64 { return l.data[r*l.nx+c] }
+func (l ctmLayer) X(c int) float64    { return float64(c) }
+func (l ctmLayer) Y(r int) float64    { return float64(r) }
+
+// plotCTMVariable saves a map and a histogram of the values in
+// vertical layer layer of CTMData variable name to PNG files in dir.
+func plotCTMVariable(d *inmap.CTMData, name string, layer int, dir string) error {
+	dd, ok := d.Data[name]
+	if !ok {
+		return fmt.Errorf("inmap preprocessor: cannot plot %s: variable not found", name)
+	}
+	shape := dd.Data.Shape
+	n := len(shape)
+	if n < 2 {
+		return fmt.Errorf("inmap preprocessor: cannot plot %s, which has %d dimensions", name, n)
+	}
+	nx, ny := shape[n-1], shape[n-2]
+	nLayers := len(dd.Data.Elements) / (nx * ny)
+	if nLayers == 1 {
+		layer = 0
+	}
+	if layer < 0 || layer >= nLayers {
+		return fmt.Errorf("inmap preprocessor: cannot plot layer %d of %s, which has %d layers", layer, name, nLayers)
+	}
+	values := dd.Data.Elements[layer*nx*ny : (layer+1)*nx*ny]
+
+	// Non-finite values are drawn in the map with the minimum
+	// value and are left out of the histogram.
+	min, max := math.Inf(1), math.Inf(-1)
+	finite := make(plotter.Values, 0, len(values))
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		finite = append(finite, v)
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if len(finite) == 0 {
+		return fmt.Errorf("inmap preprocessor: cannot plot layer %d of %s: there are no finite values", layer, name)
+	}
+	if max == min {
+		max = min + 1
+	}
+	l := ctmLayer{data: make([]float64, len(values)), nx: nx, ny: ny}
+	for i, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			v = min
+		}
+		l.data[i] = v
+	}
+
+	title := fmt.Sprintf("%s, layer %d (%s)", name, layer, dd.Units)
+	prefix := filepath.Join(dir, fmt.Sprintf("%s_layer%d", name, layer))
+	if err := plotCTMMap(l, min, max, title, prefix+"_map.png"); err != nil {
+		return fmt.Errorf("inmap preprocessor: plotting %s: %v", name, err)
+	}
+
+	p, err := plot.New()
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: plotting %s: %v", name, err)
+	}
+	h, err := plotter.NewHist(finite, 50)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: plotting %s: %v", name, err)
+	}
+	p.Add(h)
+	p.Title.Text = title
+	p.X.Label.Text = dd.Units
+	p.Y.Label.Text = "Number of grid cells"
+	if err := p.Save(5*vg.Inch, 4*vg.Inch, prefix+"_hist.png"); err != nil {
+		return fmt.Errorf("inmap preprocessor: plotting %s: %v", name, err)
+	}
+	return nil
+}
+
+// plotCTMMap saves a map of l, with a color scale ranging from min to max,
+// to a PNG file at fileName.
+func plotCTMMap(l ctmLayer, min, max float64, title, fileName string) error {
+	const (
+		width        = 5 * vg.Inch
+		height       = 5.5 * vg.Inch
+		legendHeight = 0.7 * vg.Inch
+	)
+	cm := moreland.ExtendedBlackBody()
+	cm.SetMin(min)
+	cm.SetMax(max)
+
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	hm := plotter.NewHeatMap(l, cm.Palette(255))
+	hm.Min, hm.Max = min, max
+	p.Add(hm)
+	p.Title.Text = title
+	p.X.Label.Text = "Column"
+	p.Y.Label.Text = "Row"
+
+	legend, err := plot.New()
+	if err != nil {
+		return err
+	}
+	legend.Add(&plotter.ColorBar{ColorMap: cm})
+	legend.HideY()
+	legend.X.Padding = 0
+
+	img := vgimg.New(width, height)
+	dc := draw.New(img)
+	p.Draw(draw.Crop(dc, 0, 0, legendHeight, 0))
+	legend.Draw(draw.Crop(dc, 0, 0, 0, legendHeight-height))
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := (vgimg.PngCanvas{Canvas: img}).WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
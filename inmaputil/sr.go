@@ -110,9 +110,14 @@ func CleanSR(ctx context.Context, jobName, VariableGridData string, VarGrid *inm
 // to predict concentrations resulting
 // from the emissions in EmissionsShapefiles, outputting the
 // results specified by outputVaraibles in OutputFile.
+// EmissionsColumns maps emissions variables to the names of the
+// columns in the emissions files that contain them, as described in
+// inmap.EmissionsColumns.
+// OutputProj is the projection that the output should be written in;
+// if it is empty, the projection of the variable resolution grid is used.
 // EmissionUnits specifies the units
 // of the emissions. VarGrid specifies the variable resolution grid.
-func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables map[string]string, EmissionsShapefiles []string, VarGrid *inmap.VarGridConfig) error {
+func SRPredict(EmissionUnits, SROutputFile, OutputFile, OutputProj string, outputVariables map[string]string, EmissionsShapefiles []string, EmissionsColumns map[string]string, VarGrid *inmap.VarGridConfig) error {
 	msgLog := make(chan string)
 	go func() {
 		for {
@@ -124,8 +129,12 @@ func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables m
 	if err != nil {
 		return err
 	}
+	outSR, err := outputSpatialRef(OutputProj)
+	if err != nil {
+		return err
+	}
 
-	emis, err := inmap.ReadEmissionShapefiles(vgsr, EmissionUnits, msgLog, EmissionsShapefiles...)
+	emis, err := inmap.ReadEmissions(vgsr, EmissionUnits, EmissionsColumns, msgLog, EmissionsShapefiles...)
 	if err != nil {
 		return err
 	}
@@ -155,7 +164,7 @@ func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables m
 		return upload.err
 	}
 
-	if err = r.Output(o, outputVariables, nil, vgsr); err != nil {
+	if err = r.Output(o, outputVariables, nil, vgsr, outSR); err != nil {
 		return err
 	}
 
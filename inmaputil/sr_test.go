@@ -97,7 +97,7 @@ func TestSRPredictAboveTop(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := SRPredict(cfg.GetString("EmissionUnits"), cfg.GetString("SR.OutputFile"), cfg.GetString("OutputFile"), outputVars, cfg.GetStringSlice("EmissionsShapefiles"), vcfg); err != nil {
+	if err := SRPredict(cfg.GetString("EmissionUnits"), cfg.GetString("SR.OutputFile"), cfg.GetString("OutputFile"), "", outputVars, cfg.GetStringSlice("EmissionsShapefiles"), nil, vcfg); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -0,0 +1,206 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+	"github.com/spf13/cobra"
+)
+
+// RunTransient runs a time-resolved (transient) simulation, where the
+// meteorology and baseline concentrations change as the simulation
+// progresses and concentrations are output at regular intervals.
+// The variable resolution grid is created using the static grid
+// configuration in VarGrid and the meteorology from the first time period.
+//
+// InMAPData is the path to the preprocessed meteorology snapshots created
+// by Preproc, where [DATE] is a wild card for the beginning time of each
+// snapshot. If InMAPData does not contain [DATE], the snapshot time will be
+// expected before the file extension.
+//
+// StartDate and EndDate are the beginning and end of the simulation,
+// in the format "YYYYMMDD" or "YYYYMMDDTHH".
+//
+// SnapshotInterval is the length of time represented by each meteorology
+// snapshot (e.g., "1h" or "24h"), which should match the interval used
+// in preprocessing.
+//
+// OutputInterval is the length of time between writing output files
+// (e.g., "6h"); output is also written at the end of the simulation.
+// The time of each output will be added to the name
+// of OutputFile as described in inmap.TimeSeriesFileName.
+//
+// Emissions that have temporal profiles are scaled to the simulation
+// time using inmap.TemporalEmissionsFlux. If AEP is not nil, the emissions
+// inventory it specifies is added to the emissions as described in Run,
+// using the temporal profiles in AEP.TemporalConfig.
+//
+// Time-varying boundary conditions specified by BoundaryConditions are
+// updated once for each meteorology snapshot.
+//
+// The remaining arguments are the same as for Run.
+func RunTransient(CobraCommand *cobra.Command, LogFile string, OutputFile, OutputProj string, OutputAllLayers bool, OutputVariables map[string]string,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsColumns map[string]string, AEP *AEPConfig,
+	VarGrid *inmap.VarGridConfig, InMAPData string, StartDate, EndDate, SnapshotInterval, OutputInterval string, BoundaryConditions *BoundaryConditionsConfig,
+	scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
+	m inmap.Mechanism) error {
+
+	startTime := time.Now()
+
+	var upload uploader
+
+	_, cLog, msgLog, stopLog, err := startLog(CobraCommand, upload.maybeUpload(LogFile))
+	if err != nil {
+		return err
+	}
+	defer stopLog()
+
+	start, err := inmap.ParseDate(StartDate)
+	if err != nil {
+		return fmt.Errorf("inmap: transient simulation start date: %v", err)
+	}
+	end, err := inmap.ParseDate(EndDate)
+	if err != nil {
+		return fmt.Errorf("inmap: transient simulation end date: %v", err)
+	}
+	snapshotInterval, err := time.ParseDuration(SnapshotInterval)
+	if err != nil {
+		return fmt.Errorf("inmap: transient simulation snapshot interval: %v", err)
+	}
+	outputInterval, err := time.ParseDuration(OutputInterval)
+	if err != nil {
+		return fmt.Errorf("inmap: transient simulation output interval: %v", err)
+	}
+	times, err := inmap.TimeWindows(start, end, snapshotInterval)
+	if err != nil {
+		return err
+	}
+
+	o, err := inmap.NewOutputter(OutputFile, OutputAllLayers, OutputVariables, nil, m)
+	if err != nil {
+		return err
+	}
+	log.Println("Parsing output variable expressions...")
+
+	if upload.err != nil {
+		return upload.err
+	}
+	outSR, err := outputSpatialRef(OutputProj)
+	if err != nil {
+		return err
+	}
+	if outSR != nil {
+		o.ReprojectOutput(outSR)
+	}
+
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+	emis, err := inmap.ReadEmissions(sr, EmissionUnits, EmissionsColumns, msgLog, EmissionsShapefiles...)
+	if err != nil {
+		return err
+	}
+
+	loadCTMData := func(t time.Time) (*inmap.CTMData, error) {
+		return getCTMData(inmap.TimeSeriesFileName(InMAPData, t), VarGrid)
+	}
+
+	log.Println("Loading CTM data...")
+	ctmData, err := loadCTMData(times[0])
+	if err != nil {
+		return err
+	}
+	log.Println("Loading population and mortality rate data...")
+	pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+	if err != nil {
+		return err
+	}
+	mutator, err := staticMutator(VarGrid, popIndices)
+	if err != nil {
+		return err
+	}
+
+	clock := inmap.NewClock(start)
+	bc, err := BoundaryConditions.BoundaryConditions(VarGrid, m)
+	if err != nil {
+		return err
+	}
+
+	initFuncs := []inmap.DomainManipulator{
+		VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, emis, m),
+		VarGrid.MutateGrid(mutator, ctmData, pop, mr, emis, m, msgLog),
+		inmap.SetTimestepCFL(),
+		o.CheckOutputVars(m),
+	}
+	if AEP != nil {
+		initFuncs = append(initFuncs, AEP.AddEmissions(emis, VarGrid.GridProj, m))
+	}
+	runFuncs := []inmap.DomainManipulator{
+		inmap.Log(cLog),
+		VarGrid.MeteorologySeries(clock, times, loadCTMData),
+	}
+	if bc != nil {
+		initFuncs = append(initFuncs, inmap.SetBoundaryConditions(bc, clock))
+		runFuncs = append(runFuncs, inmap.RunPeriodically(snapshotInterval.Seconds(),
+			inmap.SetBoundaryConditions(bc, clock)))
+	}
+	runFuncs = append(runFuncs,
+		inmap.Calculations(inmap.TemporalEmissionsFlux(clock), inmap.AddEmissionsFlux()),
+		inmap.Calculations(scienceFuncs...),
+	)
+	runFuncs = append(runFuncs, addRun...)
+	runFuncs = append(runFuncs,
+		clock.Advance(end),
+		o.TimeSeriesOutput(clock, outputInterval, sr, upload.rename),
+	)
+
+	d := &inmap.InMAP{
+		InitFuncs: append(initFuncs, addInit...),
+		RunFuncs:  runFuncs,
+		CleanupFuncs: append([]inmap.DomainManipulator{
+			upload.uploadOutput,
+		}, addCleanup...),
+	}
+
+	log.Println("Initializing model...")
+	if err = d.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+
+	logEmissionTotals(d, m)
+	logTimestepLimits(d)
+
+	if err = d.Run(); err != nil {
+		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+	}
+
+	if err = d.Cleanup(); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+
+	return nil
+}
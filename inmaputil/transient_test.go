@@ -0,0 +1,131 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spatialmodel/inmap"
+)
+
+func TestInMAPTransient(t *testing.T) {
+	const dataTemplate = "../cmd/inmap/testdata/testInMAPInputData_[DATE].ncf"
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{start, start.Add(12 * time.Hour)}
+
+	// Use the steady-state input data for each of the snapshots.
+	for _, tt := range times {
+		fname := inmap.TimeSeriesFileName(dataTemplate, tt)
+		if err := copyFile(fname, "../cmd/inmap/testdata/testInMAPInputData.ncf"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fname)
+	}
+
+	for _, test := range []struct {
+		interval string
+		outputs  []time.Duration // times of outputs after the start
+	}{
+		{interval: "12h", outputs: []time.Duration{12 * time.Hour, 24 * time.Hour}},
+		// The final state should be output even if the output interval
+		// does not divide the simulation.
+		{interval: "18h", outputs: []time.Duration{18 * time.Hour, 24 * time.Hour}},
+	} {
+		t.Run(test.interval, func(t *testing.T) {
+			cfg := InitializeConfig()
+			os.Setenv("InMAPRunType", "transient")
+			cfg.Set("config", "../cmd/inmap/configExample.toml")
+			cfg.Set("InMAPData", dataTemplate)
+			cfg.Set("Transient.StartDate", "20050101")
+			cfg.Set("Transient.EndDate", "20050102")
+			cfg.Set("Transient.SnapshotInterval", "12h")
+			cfg.Set("Transient.OutputInterval", test.interval)
+			cfg.Root.SetArgs([]string{"run", "transient"})
+			defer os.Remove("inmap_output.log")
+			if err := cfg.Root.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			outputFile := os.ExpandEnv(cfg.GetString("OutputFile"))
+			for _, o := range test.outputs {
+				fname := inmap.TimeSeriesFileName(outputFile, start.Add(o))
+				if _, err := os.Stat(fname); err != nil {
+					t.Errorf("missing output file: %v", err)
+				}
+				inmap.DeleteShapefile(fname)
+			}
+		})
+	}
+}
+
+func TestInMAPTransient_bucket(t *testing.T) {
+	const dataTemplate = "../cmd/inmap/testdata/testInMAPInputData_[DATE].ncf"
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []time.Time{start, start.Add(12 * time.Hour)} {
+		fname := inmap.TimeSeriesFileName(dataTemplate, tt)
+		if err := copyFile(fname, "../cmd/inmap/testdata/testInMAPInputData.ncf"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fname)
+	}
+	if err := os.Mkdir("test_bucket", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_bucket")
+
+	cfg := InitializeConfig()
+	os.Setenv("InMAPRunType", "transient")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", dataTemplate)
+	cfg.Set("OutputFile", "file://test_bucket/output_transient.shp")
+	cfg.Set("LogFile", "file://test_bucket/output_transient.log")
+	cfg.Set("Transient.StartDate", "20050101")
+	cfg.Set("Transient.EndDate", "20050102")
+	cfg.Set("Transient.SnapshotInterval", "12h")
+	cfg.Set("Transient.OutputInterval", "12h")
+	cfg.Root.SetArgs([]string{"run", "transient"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []time.Duration{12 * time.Hour, 24 * time.Hour} {
+		fname := inmap.TimeSeriesFileName("test_bucket/output_transient.shp", start.Add(o))
+		if _, err := os.Stat(fname); err != nil {
+			t.Errorf("missing uploaded output file: %v", err)
+		}
+	}
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -99,3 +99,11 @@ func (u *uploader) maybeUpload(path string) string {
 	}
 	return filepath.Join(u.dir, filepath.Base(files[0]))
 }
+
+// rename registers fileName for upload using maybeUpload and returns
+// the local path where the file should be written. It is for use with
+// inmap.Outputter.TimeSeriesOutput.
+func (u *uploader) rename(fileName string) (string, error) {
+	localName := u.maybeUpload(fileName)
+	return localName, u.err
+}
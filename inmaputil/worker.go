@@ -0,0 +1,40 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/spatialmodel/inmap"
+)
+
+// Worker starts a worker process for distributed simulations that
+// listens for connections at the specified network address
+// (e.g., ":9000"). It runs until the process is stopped.
+func Worker(Address string) error {
+	l, err := net.Listen("tcp", Address)
+	if err != nil {
+		return fmt.Errorf("inmap: starting worker: %v", err)
+	}
+	defer l.Close()
+	log.Printf("Worker listening at %s", l.Addr())
+	return inmap.ServeWorker(l, inmap.NewWorker(ScienceFuncs))
+}
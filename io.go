@@ -29,6 +29,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Knetic/govaluate"
 	"github.com/ctessum/geom"
@@ -41,24 +42,79 @@ import (
 	"gonum.org/v1/gonum/floats"
 )
 
-// AddEmissionsFlux adds emissions to c.Cf and sets c.Ci equal to c.Cf.
+// AddEmissionsFlux adds emissions to c.Cf and sets c.Ci equal to c.Cf,
+// which makes the concentrations calculated during the previous time step
+// available to the calculations in the current time step.
 // It should be run once for each timestep,
 // and it should not be run in parallel with other CellManipulators.
 func AddEmissionsFlux() CellManipulator {
 	return func(c *Cell, Dt float64) {
-		if c.EmisFlux != nil {
-			for i := range c.EmisFlux {
-				c.Cf[i] += c.EmisFlux[i] * Dt
-				c.Ci[i] = c.Cf[i]
+		for i := range c.EmisFlux {
+			c.Cf[i] += c.EmisFlux[i] * Dt
+		}
+		copy(c.Ci, c.Cf)
+	}
+}
+
+// TemporalEmissionsFlux returns a function that sets the emissions flux
+// in each grid cell to the emissions rate at the current simulation time
+// of clock, based on the temporal profiles of the emissions records.
+// It has no effect on emissions without temporal profiles.
+// It should be run before AddEmissionsFlux.
+func TemporalEmissionsFlux(clock *Clock) CellManipulator {
+	return func(c *Cell, Dt float64) {
+		if len(c.emisFluxProfiles) == 0 {
+			return
+		}
+		t := clock.Time()
+		for i := range c.EmisFlux {
+			c.EmisFlux[i] = 0
+		}
+		for _, fp := range c.emisFluxProfiles {
+			factor := 1.
+			if fp.profile != nil {
+				factor = fp.profile.Factor(t)
 			}
+			floats.AddScaled(c.EmisFlux, factor, fp.flux)
+		}
+	}
+}
+
+// emisFluxProfile is a component of a cell's emissions flux [μg/m³/s]
+// that varies in time according to profile. If profile is nil,
+// the flux is constant.
+type emisFluxProfile struct {
+	profile TemporalProfile
+	flux    []float64
+}
+
+// emisFluxProfile returns the flux array in c for emissions with
+// temporal profile p, creating it if necessary.
+func (c *Cell) emisFluxProfile(p TemporalProfile, n int) []float64 {
+	for _, fp := range c.emisFluxProfiles {
+		if fp.profile == p {
+			return fp.flux
 		}
 	}
+	fp := emisFluxProfile{profile: p, flux: make([]float64, n)}
+	c.emisFluxProfiles = append(c.emisFluxProfiles, fp)
+	return fp.flux
 }
 
 // Emissions is a holder for input emissions data.
 type Emissions struct {
 	data      *rtree.Rtree
 	dataSlice []*EmisRecord
+	profiles  map[*EmisRecord]TemporalProfile
+}
+
+// TemporalProfile describes how an emissions rate varies in time.
+// *aep.TemporalProfile satisfies this interface. Implementations must be
+// comparable so that emissions with the same profile can be grouped together.
+type TemporalProfile interface {
+	// Factor returns the ratio between the emissions rate at time t
+	// and the average emissions rate.
+	Factor(t time.Time) float64
 }
 
 // EmisRecord is a holder for an emissions record.
@@ -70,6 +126,11 @@ type EmisRecord struct {
 	Diam               float64 // stack diameter [m]
 	Temp               float64 // stack temperature [K]
 	Velocity           float64 // stack velocity [m/s]
+
+	// Tag identifies the source group that the emissions belong to,
+	// for tracking the contributions of different sources to
+	// concentrations using TrackTags.
+	Tag string
 }
 
 // add adds the emissions in o to the receiver.
@@ -94,97 +155,37 @@ func (e *Emissions) Add(er *EmisRecord) {
 	e.dataSlice = append(e.dataSlice, er)
 }
 
+// AddWithProfile adds an emissions record to e, where the emissions rate
+// in er is the average rate and p specifies how the rate varies in time.
+// If p is nil, the emissions rate is constant.
+func (e *Emissions) AddWithProfile(er *EmisRecord, p TemporalProfile) {
+	e.Add(er)
+	if p == nil {
+		return
+	}
+	if e.profiles == nil {
+		e.profiles = make(map[*EmisRecord]TemporalProfile)
+	}
+	e.profiles[er] = p
+}
+
+// Profile returns the temporal profile associated with er, or nil
+// if er has a constant emissions rate.
+func (e *Emissions) Profile(er *EmisRecord) TemporalProfile { return e.profiles[er] }
+
 // EmisRecords returns all EmisRecords stored in the
 // receiver.
 func (e *Emissions) EmisRecords() []*EmisRecord { return e.dataSlice }
 
 // ReadEmissionShapefiles returns the emissions data in the specified shapefiles,
 // and converts them to the spatial reference gridSR. Input units are specified
-// by units; options are tons/year, kg/year, ug/s, and μg/s. Output units = μg/s.
+// by units, as described in ParseEmissionUnits; for example, tons/year,
+// kg/year, ug/s, or μg/s. Output units = μg/s.
 // c is a channel over which status updates will be sent. If c is nil,
-// no updates will be sent.
+// no updates will be sent. ReadEmissionShapefiles is equivalent to
+// ReadEmissions with the default column names.
 func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapefiles ...string) (*Emissions, error) {
-	var emisConv float64
-	switch units {
-	case "tons/year":
-		// Input units = tons/year; output units = μg/s
-		const massConv = 907184740000. // μg per short ton
-		const timeConv = 3600. * 8760. // seconds per year
-		emisConv = massConv / timeConv // convert tons/year to μg/s
-	case "kg/year":
-		// Input units = kg/year; output units = μg/s
-		const massConv = 1.e9          // μg per kg
-		const timeConv = 3600. * 8760. // seconds per year
-		emisConv = massConv / timeConv // convert kg/year to μg/s
-	case "ug/s", "μg/s":
-		// Input units = μg/s; output units = μg/s
-		emisConv = 1
-	default:
-		return nil, fmt.Errorf("inmap: invalid emissions units '%s'", units)
-	}
-
-	// Add in emissions shapefiles
-	// Load emissions into rtree for fast searching
-	emis := NewEmissions()
-	for _, fname := range shapefiles {
-		if c != nil {
-			c <- fmt.Sprintf("Loading emissions shapefile: %s.", fname)
-		}
-		fname = strings.Replace(fname, ".shp", "", -1)
-		f, err := shp.NewDecoder(fname + ".shp")
-		if err != nil {
-			return nil, fmt.Errorf("there was a problem reading the emissions shapefile '%s'. "+
-				"The error message was %v.", fname, err)
-		}
-		sr, err := f.SR()
-		if err != nil {
-			return nil, fmt.Errorf("there was a problem reading the projection information for "+
-				"the emissions shapefile '%s'. The error message was %v.", fname, err)
-		}
-		trans, err := sr.NewTransform(gridSR)
-		if err != nil {
-			return nil, fmt.Errorf("there was a problem creating a spatial reprojector for "+
-				"the emissions shapefile '%s'. The error message was %v.", fname, err)
-		}
-		for {
-			var e EmisRecord
-			if ok := f.DecodeRow(&e); !ok {
-				break
-			}
-
-			e.Geom, err = e.Transform(trans)
-			if err != nil {
-				return nil, fmt.Errorf("there was a problem spatially reprojecting in "+
-					"emissions file %s. The error message was %v", fname, err)
-			}
-
-			e.VOC *= emisConv
-			e.NOx *= emisConv
-			e.NH3 *= emisConv
-			e.SOx *= emisConv
-			e.PM25 *= emisConv
-
-			if math.IsNaN(e.Height) {
-				e.Height = 0.
-			}
-			if math.IsNaN(e.Diam) {
-				e.Diam = 0.
-			}
-			if math.IsNaN(e.Temp) {
-				e.Temp = 0.
-			}
-			if math.IsNaN(e.Velocity) {
-				e.Velocity = 0.
-			}
-			emis.Add(&e)
-		}
-		f.Close()
-		if err := f.Error(); err != nil {
-			return nil, fmt.Errorf("problem reading emissions shapefile."+
-				"\nfile: %s\nerror: %v", fname, err)
-		}
-	}
-	return emis, nil
+	return ReadEmissions(gridSR, units, nil, c, shapefiles...)
 }
 
 // FromAEP converts the given AEP (github.com/spatialmodel/inmap/emissions/aep) records to
@@ -194,8 +195,76 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapef
 // The returned EmisRecords will be grouped as much as possible to minimize
 // the number of records.
 func FromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SOx, PM25 []aep.Pollutant) ([]*EmisRecord, error) {
+	eRecs, _, err := fromAEP(r, sp, gi, VOC, NOx, NH3, SOx, PM25)
+	return eRecs, err
+}
+
+// EmissionsFromAEP is similar to FromAEP, but it returns an emissions
+// holder where any temporal profiles that have been attached to the
+// AEP records (for example using aep.TemporalRef.AttachProfiles)
+// are associated with the corresponding EmisRecords.
+// The profiles are evaluated in the local time of each emissions source,
+// which is specified by the TimeZone field of the grid cell the emissions
+// are allocated to as described in TimeZone.
+func EmissionsFromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SOx, PM25 []aep.Pollutant) (*Emissions, error) {
+	eRecs, profiles, err := fromAEP(r, sp, gi, VOC, NOx, NH3, SOx, PM25)
+	if err != nil {
+		return nil, err
+	}
+	emis := NewEmissions()
+	for i, er := range eRecs {
+		emis.AddWithProfile(er, profiles[i])
+	}
+	return emis, nil
+}
+
+// aepTemporalProfile returns the temporal profile attached to rec,
+// or nil if there isn't one.
+func aepTemporalProfile(rec aep.Record) *aep.TemporalProfile {
+	tr, ok := rec.(interface {
+		TemporalProfile() *aep.TemporalProfile
+	})
+	if !ok {
+		return nil
+	}
+	return tr.TemporalProfile()
+}
+
+// localTemporalProfile is an AEP temporal profile that is evaluated
+// in the local time zone of an emissions source.
+type localTemporalProfile struct {
+	profile *aep.TemporalProfile
+	loc     *time.Location
+}
+
+// Factor implements TemporalProfile.
+func (p localTemporalProfile) Factor(t time.Time) float64 {
+	return p.profile.Factor(t.In(p.loc))
+}
+
+// TimeZone returns the time zone specified by name, which can either be
+// an IANA time zone database name (e.g., "America/New_York") or an
+// offset from UTC in hours (e.g., "-5"). An empty name specifies UTC.
+func TimeZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.UTC, nil
+	}
+	if offset, err := strconv.ParseFloat(name, 64); err == nil {
+		return time.FixedZone(fmt.Sprintf("UTC%+g", offset), int(offset*60*60)), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: invalid time zone: %v", err)
+	}
+	return loc, nil
+}
+
+// fromAEP carries out the conversion for FromAEP and EmissionsFromAEP,
+// returning the temporal profile associated with each EmisRecord.
+func fromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SOx, PM25 []aep.Pollutant) ([]*EmisRecord, []TemporalProfile, error) {
 	if gi > 0 || len(sp.Grids) <= gi {
-		return nil, fmt.Errorf("inmap: converting AEP record to EmisRecord: invalid gi (%d)", gi)
+		return nil, nil, fmt.Errorf("inmap: converting AEP record to EmisRecord: invalid gi (%d)", gi)
 	}
 
 	checkDim := func(v *unit.Unit) float64 {
@@ -208,27 +277,49 @@ func FromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SO
 		return v.Value()
 	}
 
-	// Find the centroids of the grid cells.
+	// Find the centroids and time zones of the grid cells.
 	grid := sp.Grids[gi]
 	centroids := make([]geom.Point, len(grid.Cells))
+	locations := make([]*time.Location, len(grid.Cells))
+	zones := make(map[string]*time.Location)
 	for i, c := range grid.Cells {
 		centroids[i] = c.Centroid()
+		loc, ok := zones[c.TimeZone]
+		if !ok {
+			var err error
+			loc, err = TimeZone(c.TimeZone)
+			if err != nil {
+				return nil, nil, err
+			}
+			zones[c.TimeZone] = loc
+		}
+		locations[i] = loc
 	}
 
 	var eRecs []*EmisRecord
-	groundERecs := make(map[geom.Point]*EmisRecord)
+	var profiles []TemporalProfile
+	type groundKey struct {
+		p       geom.Point
+		profile TemporalProfile
+	}
+	groundERecs := make(map[groundKey]*EmisRecord)
 
 	for _, rec := range r {
 		gridSrg, _, inGrid, err := rec.Spatialize(sp, gi)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if !inGrid {
 			continue
 		}
 		e := rec.GetEmissions().Totals()
+		aepProfile := aepTemporalProfile(rec)
 		for i, frac := range gridSrg.Elements {
 			p := centroids[i]
+			var profile TemporalProfile
+			if aepProfile != nil {
+				profile = localTemporalProfile{profile: aepProfile, loc: locations[i]}
+			}
 			er := EmisRecord{
 				Geom: p,
 			}
@@ -291,18 +382,19 @@ func FromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SO
 					}
 				}
 				if !found {
-					return nil, fmt.Errorf("inmap: no match for pollutant '%s'", pRec.Name)
+					return nil, nil, fmt.Errorf("inmap: no match for pollutant '%s'", pRec.Name)
 				}
 			}
 
 			pointData := rec.PointData()
 			if pointData == nil || pointData.GroundLevel() {
 				// For ground level sources, combine with other records
-				// at the same point.
-				if _, ok := groundERecs[p]; !ok {
-					groundERecs[p] = &er
+				// at the same point with the same temporal profile.
+				key := groundKey{p: p, profile: profile}
+				if _, ok := groundERecs[key]; !ok {
+					groundERecs[key] = &er
 				} else {
-					groundERecs[p].add(&er)
+					groundERecs[key].add(&er)
 				}
 			} else {
 				er.Height = pointData.StackHeight.Value()
@@ -310,13 +402,15 @@ func FromAEP(r []aep.Record, sp *aep.SpatialProcessor, gi int, VOC, NOx, NH3, SO
 				er.Temp = pointData.StackTemp.Value()
 				er.Velocity = pointData.StackVelocity.Value()
 				eRecs = append(eRecs, &er)
+				profiles = append(profiles, profile)
 			}
 		}
 	}
-	for _, groundERec := range groundERecs {
+	for key, groundERec := range groundERecs {
 		eRecs = append(eRecs, groundERec)
+		profiles = append(profiles, key.profile)
 	}
-	return eRecs, nil
+	return eRecs, profiles, nil
 }
 
 // calcWeightFactor calculates the fraction of emissions in e that should be
@@ -370,13 +464,48 @@ func calcWeightFactor(e geom.Geom, c *Cell) float64 {
 }
 
 // setEmissionsFlux sets the emissions flux for c based on the emissions in e.
+// EmisFlux is set to the average emissions rate; the components of the flux
+// from records with temporal profiles are additionally stored
+// for use by TemporalEmissionsFlux. If source tags are being tracked
+// (see TrackTags), TagEmisFlux is set to the flux from the records with
+// each tag.
 func (c *Cell) setEmissionsFlux(e *Emissions, m Mechanism) error {
+	if err := c.calcEmissionsFlux(e, m, nil); err != nil {
+		return err
+	}
+	if len(c.tags) == 0 {
+		return nil
+	}
+	flux, profiles := c.EmisFlux, c.emisFluxProfiles
+	defer func() { c.EmisFlux, c.emisFluxProfiles = flux, profiles }()
+	c.TagEmisFlux = make([][]float64, len(c.tags))
+	c.tagEmisFluxProfiles = make([][]emisFluxProfile, len(c.tags))
+	for i, tag := range c.tags {
+		tag := tag
+		if err := c.calcEmissionsFlux(e, m, func(er *EmisRecord) bool { return er.Tag == tag }); err != nil {
+			return err
+		}
+		c.TagEmisFlux[i], c.tagEmisFluxProfiles[i] = c.EmisFlux, c.emisFluxProfiles
+	}
+	return nil
+}
+
+// calcEmissionsFlux carries out the calculations for setEmissionsFlux.
+// If include is not nil, only the records for which it returns true
+// are included.
+func (c *Cell) calcEmissionsFlux(e *Emissions, m Mechanism, include func(*EmisRecord) bool) error {
 	c.EmisFlux = make([]float64, m.Len())
+	c.emisFluxProfiles = nil
+	constFlux := c.EmisFlux
+	defer func() { c.EmisFlux = constFlux }()
 	for _, eTemp := range e.data.SearchIntersect(c.Bounds()) {
-		e := eTemp.(*EmisRecord)
-		if e.Height > 0. {
+		er := eTemp.(*EmisRecord)
+		if include != nil && !include(er) {
+			continue
+		}
+		if er.Height > 0. {
 			// Figure out if this cell is at the right hight for the plume.
-			in, _, err := c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity)
+			in, _, err := c.IsPlumeIn(er.Height, er.Diam, er.Temp, er.Velocity)
 			if err != nil {
 				panic(err)
 			}
@@ -386,30 +515,61 @@ func (c *Cell) setEmissionsFlux(e *Emissions, m Mechanism) error {
 		} else if c.Layer != 0 {
 			continue
 		}
-		weightFactor := calcWeightFactor(e.Geom, c)
+		weightFactor := calcWeightFactor(er.Geom, c)
 		if weightFactor == 0 {
 			continue
 		}
 
-		if err := m.AddEmisFlux(c, "VOC", e.VOC*weightFactor); err != nil {
+		// Mechanisms add emissions to c.EmisFlux, so we temporarily
+		// replace it with the flux array for this record's temporal profile.
+		c.EmisFlux = constFlux
+		if p := e.Profile(er); p != nil {
+			c.EmisFlux = c.emisFluxProfile(p, m.Len())
+		}
+
+		if err := m.AddEmisFlux(c, "VOC", er.VOC*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "NOx", e.NOx*weightFactor); err != nil {
+		if err := m.AddEmisFlux(c, "NOx", er.NOx*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "NH3", e.NH3*weightFactor); err != nil {
+		if err := m.AddEmisFlux(c, "NH3", er.NH3*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "SOx", e.SOx*weightFactor); err != nil {
+		if err := m.AddEmisFlux(c, "SOx", er.SOx*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "PM2_5", e.PM25*weightFactor); err != nil {
+		if err := m.AddEmisFlux(c, "PM2_5", er.PM25*weightFactor); err != nil {
 			return err
 		}
 	}
+	if c.emisFluxProfiles != nil {
+		// Keep a copy of the constant flux and set EmisFlux to the total
+		// average flux.
+		c.emisFluxProfiles = append(c.emisFluxProfiles, emisFluxProfile{
+			flux: append([]float64{}, constFlux...),
+		})
+		for _, fp := range c.emisFluxProfiles[:len(c.emisFluxProfiles)-1] {
+			floats.Add(constFlux, fp.flux)
+		}
+	}
 	return nil
 }
 
+// SetEmissionsFlux returns a function that recalculates the emissions flux
+// of every grid cell from the records in emis. It can be used when records
+// have been added to emis after the grid cells were created.
+func SetEmissionsFlux(emis *Emissions, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		for _, c := range *d.cells {
+			if err := c.setEmissionsFlux(emis, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 // Outputter is a holder for output parameters.
 //
 // fileName contains the path where the output will be saved.
@@ -433,6 +593,11 @@ type Outputter struct {
 	modelVariables  []string
 	outputFunctions map[string]govaluate.ExpressionFunction
 	m               Mechanism
+	outputSR        *proj.SR
+
+	// tagVariables holds the output variables that are calculated
+	// for each source tag, as set by TagOutput.
+	tagVariables map[string]string
 }
 
 // NewOutputter initializes a new Outputter holder and adds a set of default
@@ -666,84 +831,149 @@ func (o *Outputter) CheckOutputVars(m Mechanism) DomainManipulator {
 	}
 }
 
-// Output writes the simulation results to a shapefile.
-// SR is the spatial reference of the model grid.
-func (o *Outputter) Output(sr *proj.SR) DomainManipulator {
-	return func(d *InMAP) error {
-		// Projection definition. This may need to be changed for a different
-		// spatial domain.
-		// TODO: Make this settable by the user, or at least check to make sure it
-		// matches the InMAPProj configuration variable.
-		var wkt string
-		switch sr.Name {
-		case "lcc":
-			wkt = fmt.Sprintf("PROJCS[\"Lambert_Conformal_Conic\",GEOGCS[\"GCS_unnamed ellipse\","+
-				"DATUM[\"D_unknown\",SPHEROID[\"Unknown\",%f,0]],PRIMEM[\"Greenwich\",0],"+
-				"UNIT[\"Degree\",0.017453292519943295]],PROJECTION[\"Lambert_Conformal_Conic\"],"+
-				"PARAMETER[\"standard_parallel_1\",%g],PARAMETER[\"standard_parallel_2\",%g],"+
-				"PARAMETER[\"latitude_of_origin\",%g],PARAMETER[\"central_meridian\",%g],"+
-				"PARAMETER[\"false_easting\",0],PARAMETER[\"false_northing\",0],UNIT[\"Meter\",1]]",
-				sr.A, sr.Lat1/math.Pi*180, sr.Lat2/math.Pi*180, sr.Lat0/math.Pi*180,
-				sr.Long0/math.Pi*180)
-		case "longlat":
-			wkt = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`
-		default:
-			return fmt.Errorf("only `lcc` and `longlat` projections are supported, not %s", sr.Name)
-		}
-
-		// Create slice of output variable names
-		outputVariableNames := make([]string, len(o.outputVariables))
-		i := 0
-		for k := range o.outputVariables {
-			outputVariableNames[i] = k
-			i++
+// TagOutput specifies that the output variables vars should also be
+// calculated for each of the source tags tracked using TrackTags.
+// If vars is empty, all output variables are calculated for each tag.
+// The output for each tag is named "<variable>_<tag>", and an error
+// is returned if any of the names are not valid output variable names.
+func (o *Outputter) TagOutput(tags []string, vars ...string) error {
+	if len(vars) == 0 {
+		for v := range o.outputVariables {
+			vars = append(vars, v)
+		}
+	}
+	o.tagVariables = make(map[string]string, len(vars))
+	names := make(map[string]string, len(vars)*len(tags))
+	for _, v := range vars {
+		expr, ok := o.outputVariables[v]
+		if !ok {
+			return fmt.Errorf("inmap: source tag output variable '%s' is not an output variable", v)
 		}
+		o.tagVariables[v] = expr
+		for _, tag := range tags {
+			names[tagVarName(v, tag)] = expr
+		}
+	}
+	return checkOutputNames(names)
+}
 
+// Output writes the simulation results to a file. The file format is
+// chosen based on the extension of the output file name using the
+// OutputWriter registered for that extension (see RegisterOutputWriter).
+// If there is no OutputWriter for the extension, the results will
+// be written to a shapefile.
+// SR is the spatial reference of the model grid. If an output
+// spatial reference has been set using ReprojectOutput, the
+// grid cell geometries will be transformed to it before they are written.
+func (o *Outputter) Output(sr *proj.SR) DomainManipulator {
+	return func(d *InMAP) error {
 		results, err := d.Results(o)
 		if err != nil {
 			return err
 		}
+		return o.writeResults(d, results, sr)
+	}
+}
 
-		vars := make([]string, 0, len(results))
-		for v := range results {
-			vars = append(vars, v)
-		}
-		sort.Strings(vars)
-		fields := make([]goshp.Field, len(vars))
-		for i, v := range vars {
-			fields[i] = shpFieldFromArray(v, results[v])
-		}
+// writeResults writes results, which hold the values of the output
+// variables in the grid cells of d, to the output file.
+func (o *Outputter) writeResults(d *InMAP, results map[string][]float64, sr *proj.SR) error {
+	return o.writeCells(d.cells.array(), results, sr)
+}
 
-		// remove extension and replace it with .shp
-		fileBase := strings.TrimSuffix(o.fileName, filepath.Ext(o.fileName))
-		o.fileName = fileBase + ".shp"
-		shape, err := shp.NewEncoderFromFields(o.fileName, goshp.POLYGON, fields...)
+// writeCells writes results, which hold the values of the output
+// variables in the first grid cells of cells, to the output file.
+func (o *Outputter) writeCells(cells []*Cell, results map[string][]float64, sr *proj.SR) error {
+	vars := make([]string, 0, len(results))
+	for v := range results {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	if len(vars) == 0 {
+		return fmt.Errorf("inmap: there are no output variables")
+	}
+
+	cells = cells[0:len(results[vars[0]])]
+	data := &OutputData{
+		Cells:       cells,
+		Polygons:    make([]geom.Polygonal, len(cells)),
+		SR:          sr,
+		Variables:   vars,
+		Values:      results,
+		Expressions: o.outputVariables,
+	}
+	if o.outputSR == nil {
+		for i, c := range cells {
+			data.Polygons[i] = c.Polygonal
+		}
+	} else {
+		trans, err := sr.NewTransform(o.outputSR)
 		if err != nil {
-			return fmt.Errorf("error creating output shapefile: %v", err)
+			return fmt.Errorf("inmap: creating output reprojection: %v", err)
 		}
-		cells := d.cells.array()
-		for i, c := range cells[0:len(results[outputVariableNames[0]])] {
-			outFields := make([]interface{}, len(vars))
-			for j, v := range vars {
-				outFields[j] = results[v][i]
-			}
-			err = shape.EncodeFields(c.Polygonal, outFields...)
+		for i, c := range cells {
+			g, err := c.Polygonal.Transform(trans)
 			if err != nil {
-				return fmt.Errorf("error writing output shapefile: %v", err)
+				return fmt.Errorf("inmap: reprojecting output: %v", err)
 			}
+			data.Polygons[i] = g.(geom.Polygonal)
 		}
-		shape.Close()
+		data.SR = o.outputSR
+	}
+
+	fileName := o.fileName
+	w, ok := outputWriters[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		// remove extension and replace it with .shp
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".shp"
+		w = writeShapefile
+	}
+	return w(fileName, data)
+}
+
+// ReprojectOutput specifies that the grid cell geometries should be
+// transformed to spatial reference sr when the output is written.
+// By default, output is in the spatial reference of the model grid.
+func (o *Outputter) ReprojectOutput(sr *proj.SR) { o.outputSR = sr }
+
+// writeShapefile writes data to a shapefile and an accompanying
+// .prj file.
+func writeShapefile(fileName string, data *OutputData) error {
+	prj, err := wkt(data.SR)
+	if err != nil {
+		return err
+	}
 
-		// Create .prj file
-		f, err := os.Create(fileBase + ".prj")
+	fields := make([]goshp.Field, len(data.Variables))
+	for i, v := range data.Variables {
+		fields[i] = shpFieldFromArray(v, data.Values[v])
+	}
+
+	shape, err := shp.NewEncoderFromFields(fileName, goshp.POLYGON, fields...)
+	if err != nil {
+		return fmt.Errorf("error creating output shapefile: %v", err)
+	}
+	for i, p := range data.Polygons {
+		outFields := make([]interface{}, len(data.Variables))
+		for j, v := range data.Variables {
+			outFields[j] = data.Values[v][i]
+		}
+		err = shape.EncodeFields(p, outFields...)
 		if err != nil {
-			return fmt.Errorf("error creating output prj file: %v", err)
+			return fmt.Errorf("error writing output shapefile: %v", err)
 		}
-		fmt.Fprint(f, wkt)
-		f.Close()
+	}
+	shape.Close()
 
-		return nil
+	// Create .prj file
+	f, err := os.Create(strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".prj")
+	if err != nil {
+		return fmt.Errorf("error creating output prj file: %v", err)
 	}
+	fmt.Fprint(f, prj)
+	f.Close()
+
+	return nil
 }
 
 // shpFieldFromArray creates a shapefile field from the given array,
@@ -792,29 +1022,86 @@ func shpFieldFromArray(name string, d []float64) goshp.Field {
 
 // Results returns the simulation results.
 // Output is in the form of map[variable][row]concentration.
+// If source tags are being tracked (see TrackTags), the results include
+// the output variables selected using Outputter.TagOutput for each tag,
+// with names in the form "<variable>_<tag>".
 func (d *InMAP) Results(o *Outputter) (map[string][]float64, error) {
+	if d.cluster != nil {
+		if err := d.cluster.Gather()(d); err != nil {
+			return nil, err
+		}
+	}
 
-	// Prepare output data.
-	modelVals := make(map[string]interface{})
-	valByRow := make(map[string]interface{})
 	output := make(map[string][]float64)
-	var nCells int
 
-	// Get the model variables that are to be used in the output.
-	for _, name := range o.modelVariables {
-		if o.allLayers {
-			data := d.toArray(name, -1, o.m)
-			modelVals[name] = data
-			nCells = len(data)
-		} else {
-			data := d.toArray(name, 0, o.m)
-			modelVals[name] = data
-			nCells = len(data)
+	// Calculate the results for each tag first, because calculating the
+	// results for the total concentrations replaces the segments of
+	// o.outputVariables that are surrounded by braces with their values.
+	for t, tag := range d.tags {
+		tagVars := make(map[string]string, len(o.tagVariables))
+		for k, v := range o.tagVariables {
+			tagVars[k] = v
 		}
+		d.cellLock.Lock()
+		d.swapTag(t)
+		d.sumDepositionColumns()
+		modelVals, nCells := d.modelValues(o, d.cellValues)
+		d.swapTag(t)
+		d.cellLock.Unlock()
+		tagOutput, err := o.evaluate(tagVars, modelVals, nCells)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range tagOutput {
+			output[tagVarName(k, tag)] = v
+		}
+	}
+
+	d.cellLock.Lock()
+	d.sumDepositionColumns()
+	d.cellLock.Unlock()
+	modelVals, nCells := d.modelValues(o, d.toArray)
+	totalOutput, err := o.evaluate(o.outputVariables, modelVals, nCells)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range totalOutput {
+		output[k] = v
 	}
+	return output, nil
+}
+
+// tagVarName returns the name of output variable v for source tag tag.
+func tagVarName(v, tag string) string { return v + "_" + tag }
+
+// modelValues returns the values of the model variables that are used
+// in the output, as calculated by toArray, and the number of
+// grid cells that they have values for.
+func (d *InMAP) modelValues(o *Outputter, toArray func(varName string, layer int, m Mechanism) []float64) (map[string]interface{}, int) {
+	modelVals := make(map[string]interface{})
+	var nCells int
+	layer := 0
+	if o.allLayers {
+		layer = -1
+	}
+	for _, name := range o.modelVariables {
+		data := toArray(name, layer, o.m)
+		modelVals[name] = data
+		nCells = len(data)
+	}
+	return modelVals, nCells
+}
+
+// evaluate calculates the values of the outputVariables expressions
+// in each grid cell from the model variable values in modelVals.
+// Segments of the expressions that are surrounded by braces are evaluated
+// across all grid cells and replaced in outputVariables by their values.
+func (o *Outputter) evaluate(outputVariables map[string]string, modelVals map[string]interface{}, nCells int) (map[string][]float64, error) {
+	valByRow := make(map[string]interface{})
+	output := make(map[string][]float64)
 
 	// Identify segments of output variable expressions that are surrounded by braces.
-	for k, v := range o.outputVariables {
+	for k, v := range outputVariables {
 		regx, _ := regexp.Compile("\\{(.*?)\\}")
 		matches := regx.FindAllString(v, -1)
 		if len(matches) > 0 {
@@ -831,11 +1118,11 @@ func (d *InMAP) Results(o *Outputter) (map[string][]float64, error) {
 				}
 				// Replace segments surrounded by braces with corresponding result
 				// calculated above.
-				o.outputVariables[k] = strings.Replace(o.outputVariables[k], m, strconv.FormatFloat(result.(float64), 'f', -1, 64), 1)
+				outputVariables[k] = strings.Replace(outputVariables[k], m, strconv.FormatFloat(result.(float64), 'f', -1, 64), 1)
 			}
 		}
 	}
-	for k, v := range o.outputVariables {
+	for k, v := range outputVariables {
 		expression, err := govaluate.NewEvaluableExpressionWithFunctions(v, o.outputFunctions)
 		if err != nil {
 			return nil, err
@@ -857,20 +1144,25 @@ func (d *InMAP) Results(o *Outputter) (map[string][]float64, error) {
 // toArray converts cell data for variable varName into a regular array.
 // If layer is less than zero, data for all layers is returned.
 func (d *InMAP) toArray(varName string, layer int, m Mechanism) []float64 {
+	d.cellLock.RLock()
+	defer d.cellLock.RUnlock()
+	return d.cellValues(varName, layer, m)
+}
+
+// cellValues carries out the calculations for toArray. The caller is
+// responsible for holding d.cellLock.
+func (d *InMAP) cellValues(varName string, layer int, m Mechanism) []float64 {
 	o := make([]float64, 0, d.cells.len())
 	cells := d.cells.array()
 	for _, c := range cells {
-		c.mutex.RLock()
 		if layer >= 0 && c.Layer > layer {
 			// The cells should be sorted with the lower layers first, so we
 			// should be done here.
-			c.mutex.RUnlock()
 			return o
 		}
 		if layer < 0 || c.Layer == layer {
 			o = append(o, c.getValue(varName, d.PopIndices, d.mortIndices, m))
 		}
-		c.mutex.RUnlock()
 	}
 	return o
 }
@@ -882,6 +1174,9 @@ func (c *Cell) getValue(varName string, popIndices, mortIndices map[string]int,
 	if err == nil {
 		return v
 	}
+	if v, ok := c.depositionValue(varName, m); ok { // Deposition
+		return v
+	}
 	if i, ok := popIndices[varName]; ok { // Population
 		return c.PopData[i]
 
@@ -919,6 +1214,8 @@ func (d *InMAP) getUnits(varName string, m Mechanism) string {
 	}
 	if _, ok := baselinePolLabels[varName]; ok { // Concentrations
 		return "μg/m³"
+	} else if _, ok := (&Cell{}).depositionValue(varName, m); ok { // Deposition
+		return "μg/m²"
 	} else if _, ok := d.PopIndices[varName]; ok { // Population
 		return "people/grid cell"
 	} else if _, ok := d.mortIndices[varName]; ok { // Mortality Rate
@@ -943,8 +1240,11 @@ func (d *InMAP) OutputOptions(m Mechanism) (names []string, descriptions []strin
 	for _, pol := range m.Species() {
 		names = append(names, pol)
 	}
+	if dm, ok := m.(DerivedVariableMechanism); ok {
+		names = append(names, dm.DerivedVariables()...)
+	}
 	for _, n := range names {
-		if strings.Contains(n, "Emissions") {
+		if strings.Contains(n, "Emissions") || strings.HasSuffix(n, "Dep") {
 			descriptions = append(descriptions, n)
 		} else {
 			descriptions = append(descriptions, n+" Concentration")
@@ -1000,6 +1300,11 @@ func (d *InMAP) OutputOptions(m Mechanism) (names []string, descriptions []strin
 	names = append(names, tempNames...)
 	descriptions = append(descriptions, tempDescriptions...)
 
+	// Deposition
+	depNames, depDescriptions := depositionVariables(m)
+	names = append(names, depNames...)
+	descriptions = append(descriptions, depDescriptions...)
+
 	units = make([]string, len(names))
 	for i, n := range names {
 		units[i] = d.getUnits(n, m)
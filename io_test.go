@@ -1211,3 +1211,42 @@ func TestShpFieldFromArray(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalTemporalProfile(t *testing.T) {
+	p := new(aep.TemporalProfile)
+	for i := range p.Monthly {
+		p.Monthly[i] = 1. / 12
+	}
+	for i := range p.Weekly {
+		p.Weekly[i] = 1. / 7
+	}
+	p.DiurnalWeekday[8] = 1 // All emissions are at 8 AM local time.
+	p.DiurnalWeekend[8] = 1
+
+	for _, test := range []struct {
+		zone   string
+		hour   int // UTC
+		factor float64
+	}{
+		{zone: "", hour: 8, factor: 24},
+		{zone: "", hour: 13, factor: 0},
+		{zone: "-5", hour: 8, factor: 0},
+		{zone: "-5", hour: 13, factor: 24},
+		{zone: "America/New_York", hour: 13, factor: 24},
+	} {
+		loc, err := TimeZone(test.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lp := localTemporalProfile{profile: p, loc: loc}
+		// January 2005 has 31 days and begins on a Saturday.
+		tt := time.Date(2005, time.January, 3, test.hour, 0, 0, 0, time.UTC)
+		want := test.factor * 365 / 31 / 12
+		if have := lp.Factor(tt); different(have, want, 1.e-10) {
+			t.Errorf("zone %q, hour %d: have %g, want %g", test.zone, test.hour, have, want)
+		}
+	}
+	if _, err := TimeZone("Not/A_Zone"); err == nil {
+		t.Error("expected an error for an invalid time zone")
+	}
+}
@@ -18,6 +18,11 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 
 package inmap
 
+import (
+	"fmt"
+	"sort"
+)
+
 // Mechanism is an interface for atmospheric chemical mechanisms.
 type Mechanism interface {
 	// AddEmisFlux adds emissions flux to Cell c based on the given
@@ -54,3 +59,64 @@ type Mechanism interface {
 	// Len returns the number of pollutants in the chemical mechanism.
 	Len() int
 }
+
+// DerivedVariableMechanism is a Mechanism that can calculate variables
+// that are derived from more than one of its species (for example,
+// total secondary organic aerosol from the secondary organic aerosol
+// formed from several classes of precursors). Derived variables
+// can be used as output variables in addition to the variables returned by
+// Species.
+type DerivedVariableMechanism interface {
+	Mechanism
+
+	// DerivedVariables returns the names of the derived variables,
+	// which must be accepted by the Value and Units methods.
+	DerivedVariables() []string
+}
+
+// ConfigurableMechanism is a Mechanism with settings that can be
+// specified by the user, for example in a table of a configuration file
+// with the same name as the mechanism.
+type ConfigurableMechanism interface {
+	Mechanism
+
+	// Configure returns a copy of the mechanism with the given settings
+	// applied, where the keys of settings are setting names, which are
+	// not case sensitive, and the values are the settings in text form.
+	// It returns an error for unknown or invalid settings.
+	Configure(settings map[string]string) (Mechanism, error)
+}
+
+// mechanisms holds the registered chemical mechanisms.
+var mechanisms = make(map[string]Mechanism)
+
+// RegisterMechanism makes chemical mechanism m available by name so that it
+// can be selected, for example, in a configuration file, replacing
+// any existing mechanism with the same name.
+// It is typically called in the init function of the package that implements
+// the mechanism.
+// RegisterMechanism should not be called concurrently with GetMechanism.
+func RegisterMechanism(name string, m Mechanism) {
+	mechanisms[name] = m
+}
+
+// GetMechanism returns the chemical mechanism that has been registered
+// as name using RegisterMechanism.
+func GetMechanism(name string) (Mechanism, error) {
+	m, ok := mechanisms[name]
+	if !ok {
+		return nil, fmt.Errorf("inmap: invalid chemical mechanism '%s'; valid options are %v", name, Mechanisms())
+	}
+	return m, nil
+}
+
+// Mechanisms returns the names of the registered chemical mechanisms
+// in alphabetical order.
+func Mechanisms() []string {
+	names := make([]string, 0, len(mechanisms))
+	for name := range mechanisms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
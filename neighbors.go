@@ -55,6 +55,7 @@ func (d *InMAP) neighbors(c *Cell) {
 	c.west = getCells(d.index, westbox, c.Layer)
 	for _, w := range *c.west {
 		if w.east.len() == 1 && (*w.east)[0].boundary {
+			d.removeBoundary(1, (*w.east)[0].Cell)
 			d.eastBoundary.delete((*w.east)[0])
 			w.east.delete((*w.east)[0])
 		}
@@ -66,6 +67,7 @@ func (d *InMAP) neighbors(c *Cell) {
 	c.east = getCells(d.index, eastbox, c.Layer)
 	for _, e := range *c.east {
 		if e.west.len() == 1 && (*e.west)[0].boundary {
+			d.removeBoundary(0, (*e.west)[0].Cell)
 			d.westBoundary.delete((*e.west)[0])
 			e.west.delete((*e.west)[0])
 		}
@@ -77,6 +79,7 @@ func (d *InMAP) neighbors(c *Cell) {
 	c.south = getCells(d.index, southbox, c.Layer)
 	for _, s := range *c.south {
 		if s.north.len() == 1 && (*s.north)[0].boundary {
+			d.removeBoundary(3, (*s.north)[0].Cell)
 			d.northBoundary.delete((*s.north)[0])
 			s.north.delete((*s.north)[0])
 		}
@@ -88,6 +91,7 @@ func (d *InMAP) neighbors(c *Cell) {
 	c.north = getCells(d.index, northbox, c.Layer)
 	for _, n := range *c.north {
 		if n.south.len() == 1 && (*n.south)[0].boundary {
+			d.removeBoundary(2, (*n.south)[0].Cell)
 			d.southBoundary.delete((*n.south)[0])
 			n.south.delete((*n.south)[0])
 		}
@@ -110,6 +114,7 @@ func (d *InMAP) neighbors(c *Cell) {
 	c.below = getCells(d.index, abovebelowbox, c.Layer-1)
 	for _, b := range *c.below {
 		if b.above.len() == 1 && (*b.above)[0].boundary {
+			d.removeBoundary(4, (*b.above)[0].Cell)
 			d.topBoundary.delete((*b.above)[0])
 			b.above.delete((*b.above)[0])
 		}
@@ -231,8 +236,12 @@ func neighborInfoGroundLevel(c *Cell, cr *cellRef) {
 // dereferenceNeighbors removes any references to this cell that exist in its
 // neighbors.
 func (c *Cell) dereferenceNeighbors(d *InMAP) {
+	if d.budget != nil {
+		d.budget.remove(c)
+	}
 	for _, w := range *c.west {
 		if w.boundary {
+			d.removeBoundary(0, w.Cell)
 			d.westBoundary.deleteCell(w.Cell)
 		} else {
 			w.east.deleteCell(c)
@@ -240,6 +249,7 @@ func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	}
 	for _, e := range *c.east {
 		if e.boundary {
+			d.removeBoundary(1, e.Cell)
 			d.eastBoundary.deleteCell(e.Cell)
 		} else {
 			e.west.deleteCell(c)
@@ -247,6 +257,7 @@ func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	}
 	for _, s := range *c.south {
 		if s.boundary {
+			d.removeBoundary(2, s.Cell)
 			d.southBoundary.deleteCell(s.Cell)
 		} else {
 			s.north.deleteCell(c)
@@ -254,6 +265,7 @@ func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	}
 	for _, n := range *c.north {
 		if n.boundary {
+			d.removeBoundary(3, n.Cell)
 			d.northBoundary.deleteCell(n.Cell)
 		} else {
 			n.south.deleteCell(c)
@@ -266,6 +278,7 @@ func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	}
 	for _, a := range *c.above {
 		if a.boundary {
+			d.removeBoundary(4, a.Cell)
 			d.topBoundary.deleteCell(a.Cell)
 		} else {
 			a.below.deleteCell(c)
@@ -0,0 +1,203 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom/proj"
+)
+
+// writeNetCDF writes data to a NetCDF file following
+// the Climate and Forecast (CF) metadata conventions.
+// Because the variable resolution grid is unstructured,
+// each output variable is a one-dimensional array over the grid cells,
+// with the cell center coordinates in the "x" and "y" variables and
+// the cell corners in the "x_bounds" and "y_bounds" variables.
+// The spatial reference is described by the "crs" variable.
+func writeNetCDF(fileName string, data *OutputData) error {
+	cells, sr, vars, results := data.Cells, data.SR, data.Variables, data.Values
+
+	const nv = 4 // number of vertices per cell
+	h := cdf.NewHeader([]string{"cell", "nv"}, []int{len(cells), nv})
+	h.AddAttribute("", "Conventions", "CF-1.7")
+	h.AddAttribute("", "title", "InMAP simulation results")
+	h.AddAttribute("", "source", "InMAP version "+Version)
+
+	h.AddVariable("crs", []string{}, []int32{0})
+	if err := cfGridMapping(h, sr); err != nil {
+		return err
+	}
+
+	stdName, units := []string{"projection_x_coordinate", "projection_y_coordinate"}, []string{"m", "m"}
+	if sr.Name == "longlat" {
+		stdName, units = []string{"longitude", "latitude"}, []string{"degrees_east", "degrees_north"}
+	}
+	for i, v := range []string{"x", "y"} {
+		h.AddVariable(v, []string{"cell"}, []float64{0})
+		h.AddAttribute(v, "standard_name", stdName[i])
+		h.AddAttribute(v, "long_name", v+" coordinate of grid cell center")
+		h.AddAttribute(v, "units", units[i])
+		h.AddAttribute(v, "bounds", v+"_bounds")
+		h.AddVariable(v+"_bounds", []string{"cell", "nv"}, []float64{0})
+	}
+
+	h.AddVariable("layer", []string{"cell"}, []int32{0})
+	h.AddAttribute("layer", "long_name", "vertical layer index")
+	h.AddVariable("layer_height", []string{"cell"}, []float64{0})
+	h.AddAttribute("layer_height", "long_name", "height at layer bottom")
+	h.AddAttribute("layer_height", "units", "m")
+	h.AddAttribute("layer_height", "positive", "up")
+	h.AddVariable("layer_thickness", []string{"cell"}, []float64{0})
+	h.AddAttribute("layer_thickness", "long_name", "layer thickness")
+	h.AddAttribute("layer_thickness", "units", "m")
+
+	for _, v := range vars {
+		h.AddVariable(v, []string{"cell"}, []float64{0})
+		if expr, ok := data.Expressions[v]; ok {
+			h.AddAttribute(v, "expression", expr)
+		}
+		h.AddAttribute(v, "coordinates", "x y")
+		h.AddAttribute(v, "grid_mapping", "crs")
+	}
+	h.Define()
+
+	w, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating NetCDF output file: %v", err)
+	}
+	defer w.Close()
+	f, err := cdf.Create(w, h)
+	if err != nil {
+		return fmt.Errorf("inmap: creating NetCDF output file: %v", err)
+	}
+
+	x := make([]float64, len(cells))
+	y := make([]float64, len(cells))
+	xb := make([]float64, len(cells)*nv)
+	yb := make([]float64, len(cells)*nv)
+	layer := make([]int32, len(cells))
+	layerHeight := make([]float64, len(cells))
+	dz := make([]float64, len(cells))
+	for i, c := range cells {
+		b := data.Polygons[i].Bounds()
+		x[i] = (b.Min.X + b.Max.X) / 2
+		y[i] = (b.Min.Y + b.Max.Y) / 2
+		// Vertices are listed counterclockwise starting at the lower left.
+		copy(xb[i*nv:(i+1)*nv], []float64{b.Min.X, b.Max.X, b.Max.X, b.Min.X})
+		copy(yb[i*nv:(i+1)*nv], []float64{b.Min.Y, b.Min.Y, b.Max.Y, b.Max.Y})
+		layer[i] = int32(c.Layer)
+		layerHeight[i] = c.LayerHeight
+		dz[i] = c.Dz
+	}
+	fields := map[string]interface{}{
+		"x":               x,
+		"y":               y,
+		"x_bounds":        xb,
+		"y_bounds":        yb,
+		"layer":           layer,
+		"layer_height":    layerHeight,
+		"layer_thickness": dz,
+	}
+	for _, v := range vars {
+		fields[v] = results[v]
+	}
+	for v, vals := range fields {
+		end := f.Header.Lengths(v)
+		start := make([]int, len(end))
+		if _, err := f.Writer(v, start, end).Write(vals); err != nil {
+			return fmt.Errorf("inmap: writing variable %s to NetCDF file: %v", v, err)
+		}
+	}
+	return w.Close()
+}
+
+// cfGridMapping adds the attributes describing the spatial reference
+// sr to the "crs" variable in h, following the CF conventions.
+// Projections without a CF grid mapping are described only by the
+// "crs_wkt" attribute.
+func cfGridMapping(h *cdf.Header, sr *proj.SR) error {
+	crsWKT, err := wkt(sr)
+	if err != nil {
+		return err
+	}
+	attr := func(name string, f func(*proj.SR) float64) {
+		h.AddAttribute("crs", name, []float64{f(sr)})
+	}
+	switch sr.Name {
+	case "longlat":
+		h.AddAttribute("crs", "grid_mapping_name", "latitude_longitude")
+	case "lcc":
+		h.AddAttribute("crs", "grid_mapping_name", "lambert_conformal_conic")
+		h.AddAttribute("crs", "standard_parallel", []float64{wktLat1(sr), wktLat2(sr)})
+		attr("longitude_of_central_meridian", wktLong0)
+		attr("latitude_of_projection_origin", wktLat0)
+	case "aea":
+		h.AddAttribute("crs", "grid_mapping_name", "albers_conical_equal_area")
+		h.AddAttribute("crs", "standard_parallel", []float64{wktLat1(sr), wktLat2(sr)})
+		attr("longitude_of_central_meridian", wktLong0)
+		attr("latitude_of_projection_origin", wktLat0)
+	case "merc":
+		h.AddAttribute("crs", "grid_mapping_name", "mercator")
+		attr("longitude_of_projection_origin", wktLong0)
+		attr("standard_parallel", wktLatTS)
+	case "tmerc", "utm":
+		h.AddAttribute("crs", "grid_mapping_name", "transverse_mercator")
+		for _, p := range wktProjections[sr.Name].params {
+			switch p.name {
+			case "latitude_of_origin":
+				attr("latitude_of_projection_origin", p.value)
+			case "central_meridian":
+				attr("longitude_of_central_meridian", p.value)
+			case "scale_factor":
+				attr("scale_factor_at_central_meridian", p.value)
+			}
+		}
+	case "laea":
+		h.AddAttribute("crs", "grid_mapping_name", "lambert_azimuthal_equal_area")
+		attr("longitude_of_projection_origin", wktLong0)
+		attr("latitude_of_projection_origin", wktLat0)
+	case "stere":
+		h.AddAttribute("crs", "grid_mapping_name", "stereographic")
+		attr("longitude_of_projection_origin", wktLong0)
+		attr("latitude_of_projection_origin", wktLat0)
+		attr("scale_factor_at_projection_origin", wktK0)
+	}
+	if sr.Name != "longlat" {
+		for _, p := range wktProjections[sr.Name].params {
+			switch p.name {
+			case "false_easting", "false_northing":
+				attr(p.name, p.value)
+			}
+		}
+	}
+	if isWGS84(sr) {
+		h.AddAttribute("crs", "semi_major_axis", []float64{6378137})
+		h.AddAttribute("crs", "inverse_flattening", []float64{298.257223563})
+	} else if sr.B == 0 || sr.B == sr.A {
+		h.AddAttribute("crs", "earth_radius", []float64{sr.A})
+	} else {
+		h.AddAttribute("crs", "semi_major_axis", []float64{sr.A})
+		h.AddAttribute("crs", "inverse_flattening", []float64{sr.A / (sr.A - sr.B)})
+	}
+	h.AddAttribute("crs", "crs_wkt", crsWKT)
+	return nil
+}
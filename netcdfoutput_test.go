@@ -0,0 +1,137 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+func TestOutputNetCDF(t *testing.T) {
+	const fileName = "testOutput.nc"
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+	var m Mech
+
+	o, err := NewOutputter(fileName, true, map[string]string{
+		"TotalPop":          "TotalPop",
+		"PM25Emissions":     "PM25Emissions",
+		"BaselineTotalPM25": "BaselineTotalPM25",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := proj.Parse(cfg.GridProj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			o.CheckOutputVars(m),
+		},
+		CleanupFuncs: []DomainManipulator{
+			o.Output(sr),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileName)
+
+	results, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := cdf.Open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conv := f.Header.GetAttribute("", "Conventions"); conv != "CF-1.7" {
+		t.Errorf("Conventions: have %v, want CF-1.7", conv)
+	}
+	if gm := f.Header.GetAttribute("crs", "grid_mapping_name"); gm != "lambert_conformal_conic" {
+		t.Errorf("grid_mapping_name: have %v", gm)
+	}
+
+	read := func(v string) []float64 {
+		dims := f.Header.Lengths(v)
+		if len(dims) == 0 {
+			t.Fatalf("missing variable %s", v)
+		}
+		n := 1
+		for _, dim := range dims {
+			n *= dim
+		}
+		rr := f.Reader(v, nil, nil)
+		buf := rr.Zero(n)
+		if _, err := rr.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.([]float64)
+	}
+	for v, want := range results {
+		have := read(v)
+		if len(have) != len(want) {
+			t.Fatalf("%s: length %d != %d", v, len(have), len(want))
+		}
+		for i := range want {
+			if different(have[i], want[i], 1.e-10) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, have[i], want[i])
+			}
+		}
+	}
+	cells := d.cells.array()
+	x, xb := read("x"), read("x_bounds")
+	if len(x) != len(cells) {
+		t.Fatalf("number of cells: %d != %d", len(x), len(cells))
+	}
+	for i, c := range cells {
+		b := c.Bounds()
+		if x[i] != (b.Min.X+b.Max.X)/2 || xb[i*4] != b.Min.X || xb[i*4+1] != b.Max.X {
+			t.Errorf("cell %d x coordinates don't match", i)
+		}
+	}
+	heights := read("layer_height")
+	for i, c := range cells {
+		if heights[i] != c.LayerHeight {
+			t.Errorf("cell %d layer height: %g != %g", i, heights[i], c.LayerHeight)
+		}
+	}
+}
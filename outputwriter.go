@@ -0,0 +1,175 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// OutputData holds simulation results that are ready to be written
+// to a file by an OutputWriter.
+type OutputData struct {
+	// Cells are the grid cells that the results correspond to.
+	Cells []*Cell
+
+	// Polygons are the grid cell geometries, in spatial reference SR.
+	Polygons []geom.Polygonal
+
+	// SR is the spatial reference of Polygons.
+	SR *proj.SR
+
+	// Variables are the names of the output variables, in alphabetical order.
+	Variables []string
+
+	// Values holds the value of each output variable in each grid cell.
+	Values map[string][]float64
+
+	// Expressions holds the expressions that were used to calculate
+	// the output variables.
+	Expressions map[string]string
+}
+
+// OutputWriter writes output data to the file at fileName.
+type OutputWriter func(fileName string, data *OutputData) error
+
+// outputWriters holds the output writers for each file extension.
+var outputWriters = map[string]OutputWriter{
+	".shp":     writeShapefile,
+	".nc":      writeNetCDF,
+	".ncf":     writeNetCDF,
+	".geojson": writeGeoJSON,
+	".json":    writeGeoJSON,
+	".gpkg":    writeGeoPackage,
+}
+
+// RegisterOutputWriter specifies that w should be used to write output
+// files whose names end with extension ext (e.g., ".csv"),
+// replacing any existing OutputWriter for that extension.
+// By default, OutputWriters are registered for shapefiles (".shp"),
+// NetCDF (".nc" and ".ncf"), GeoJSON (".geojson" and ".json"),
+// and GeoPackage (".gpkg") files.
+// RegisterOutputWriter should not be called concurrently with
+// writing output.
+func RegisterOutputWriter(ext string, w OutputWriter) {
+	outputWriters[strings.ToLower(ext)] = w
+}
+
+// geoJSONFeature is a GeoJSON feature holding a grid cell and
+// its output values.
+type geoJSONFeature struct {
+	Type       string              `json:"type"`
+	Geometry   geoJSONGeometry     `json:"geometry"`
+	Properties map[string]*float64 `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string           `json:"type"`
+	Coordinates [][][][2]float64 `json:"coordinates"`
+}
+
+// writeGeoJSON writes data to a GeoJSON file. Following RFC 7946,
+// the coordinate reference system is not specified if data is in
+// WGS84 longitude-latitude coordinates; otherwise, it is specified
+// in the "crs" member using its WKT definition, which is understood by
+// GDAL and other software that supports the original GeoJSON
+// specification. Values that are not finite numbers are written as null.
+func writeGeoJSON(fileName string, data *OutputData) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating GeoJSON output file: %v", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+
+	fmt.Fprint(w, `{"type":"FeatureCollection",`)
+	if !isWGS84(data.SR) {
+		prj, err := wkt(data.SR)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, `"crs":`)
+		if err := e.Encode(map[string]interface{}{
+			"type":       "name",
+			"properties": map[string]string{"name": prj},
+		}); err != nil {
+			return err
+		}
+		fmt.Fprint(w, ",")
+	}
+	fmt.Fprint(w, `"features":[`)
+	for i, p := range data.Polygons {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		feature := geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONGeometry{
+				Type:        "MultiPolygon",
+				Coordinates: geoJSONCoordinates(p),
+			},
+			Properties: make(map[string]*float64, len(data.Variables)),
+		}
+		for _, v := range data.Variables {
+			val := data.Values[v][i]
+			if math.IsNaN(val) || math.IsInf(val, 0) {
+				feature.Properties[v] = nil
+			} else {
+				feature.Properties[v] = &val
+			}
+		}
+		if err := e.Encode(feature); err != nil {
+			return fmt.Errorf("inmap: writing GeoJSON output: %v", err)
+		}
+	}
+	fmt.Fprint(w, "]}\n")
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("inmap: writing GeoJSON output: %v", err)
+	}
+	return f.Close()
+}
+
+// geoJSONCoordinates returns the coordinates of p in GeoJSON
+// MultiPolygon format.
+func geoJSONCoordinates(p geom.Polygonal) [][][][2]float64 {
+	polys := p.Polygons()
+	o := make([][][][2]float64, len(polys))
+	for i, poly := range polys {
+		o[i] = make([][][2]float64, len(poly))
+		for j, ring := range poly {
+			o[i][j] = make([][2]float64, len(ring))
+			for k, pt := range ring {
+				o[i][j][k] = [2]float64{pt.X, pt.Y}
+			}
+			// GeoJSON rings must be closed.
+			if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+				o[i][j] = append(o[i][j], [2]float64{ring[0].X, ring[0].Y})
+			}
+		}
+	}
+	return o
+}
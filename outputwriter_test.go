@@ -0,0 +1,244 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// outputTestRun runs the cleanup functions of a simple model
+// with output written to fileName, optionally reprojected to outputProj.
+func outputTestRun(t *testing.T, fileName, outputProj string) (*InMAP, *Outputter) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+	var m Mech
+
+	o, err := NewOutputter(fileName, false, map[string]string{
+		"TotalPop":      "TotalPop",
+		"PM25Emissions": "PM25Emissions",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputProj != "" {
+		outSR, err := proj.Parse(outputProj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.ReprojectOutput(outSR)
+	}
+
+	sr, err := proj.Parse(cfg.GridProj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			o.CheckOutputVars(m),
+		},
+		CleanupFuncs: []DomainManipulator{
+			o.Output(sr),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	return d, o
+}
+
+func TestOutputGeoJSON(t *testing.T) {
+	const fileName = "testOutput.geojson"
+	d, o := outputTestRun(t, fileName, "+proj=longlat")
+	defer os.Remove(fileName)
+
+	results, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var fc struct {
+		Type     string
+		CRS      interface{}
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates [][][][2]float64
+			}
+			Properties map[string]float64
+		}
+	}
+	if err := json.NewDecoder(f).Decode(&fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" {
+		t.Errorf("type: %s", fc.Type)
+	}
+	if fc.CRS != nil {
+		t.Errorf("longitude-latitude output should not specify a crs: %v", fc.CRS)
+	}
+	if len(fc.Features) != len(results["TotalPop"]) {
+		t.Fatalf("number of features: %d != %d", len(fc.Features), len(results["TotalPop"]))
+	}
+	for i, feature := range fc.Features {
+		if feature.Geometry.Type != "MultiPolygon" {
+			t.Errorf("feature %d geometry type: %s", i, feature.Geometry.Type)
+		}
+		ring := feature.Geometry.Coordinates[0][0]
+		if ring[0] != ring[len(ring)-1] {
+			t.Errorf("feature %d: ring is not closed", i)
+		}
+		for _, pt := range ring {
+			// The test grid is near the origin of a projection
+			// centered at 97°W, 40°N.
+			if math.Abs(pt[0]+97) > 1 || math.Abs(pt[1]-40) > 1 {
+				t.Errorf("feature %d: point %v is not in longitude-latitude coordinates", i, pt)
+			}
+		}
+		for v, vals := range results {
+			if different(feature.Properties[v], vals[i], 1.e-10) {
+				t.Errorf("feature %d %s: %g != %g", i, v, feature.Properties[v], vals[i])
+			}
+		}
+	}
+}
+
+func TestOutputGeoPackage(t *testing.T) {
+	const fileName = "testOutput.gpkg"
+	d, o := outputTestRun(t, fileName, "")
+	defer os.Remove(fileName)
+
+	results, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var srsID int
+	var definition string
+	if err := db.QueryRow("SELECT g.srs_id, s.definition FROM gpkg_geometry_columns g "+
+		"JOIN gpkg_spatial_ref_sys s ON g.srs_id = s.srs_id WHERE g.table_name = 'testOutput'").
+		Scan(&srsID, &definition); err != nil {
+		t.Fatal(err)
+	}
+	if srsID != gpkgCustomSRSID {
+		t.Errorf("srs_id: %d != %d", srsID, gpkgCustomSRSID)
+	}
+	if !strings.HasPrefix(definition, `PROJCS["Lambert_Conformal_Conic"`) {
+		t.Errorf("incorrect spatial reference definition: %s", definition)
+	}
+
+	rows, err := db.Query(`SELECT geom, "PM25Emissions", "TotalPop" FROM testOutput ORDER BY fid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	i := 0
+	for rows.Next() {
+		var g []byte
+		var emis, pop float64
+		if err := rows.Scan(&g, &emis, &pop); err != nil {
+			t.Fatal(err)
+		}
+		if string(g[0:2]) != "GP" {
+			t.Errorf("row %d: invalid geometry header", i)
+		}
+		if different(emis, results["PM25Emissions"][i], 1.e-10) {
+			t.Errorf("row %d PM25Emissions: %g != %g", i, emis, results["PM25Emissions"][i])
+		}
+		if different(pop, results["TotalPop"][i], 1.e-10) {
+			t.Errorf("row %d TotalPop: %g != %g", i, pop, results["TotalPop"][i])
+		}
+		i++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(results["TotalPop"]) {
+		t.Errorf("number of rows: %d != %d", i, len(results["TotalPop"]))
+	}
+}
+
+func TestWKT(t *testing.T) {
+	for _, test := range []struct {
+		proj, prefix string
+	}{
+		{
+			proj:   "+proj=longlat",
+			prefix: `GEOGCS["GCS_WGS_1984"`,
+		},
+		{
+			proj:   "+proj=lcc +lat_1=33 +lat_2=45 +lat_0=40 +lon_0=-97 +x_0=0 +y_0=0 +a=6370997 +b=6370997 +to_meter=1",
+			prefix: `PROJCS["Lambert_Conformal_Conic",GEOGCS["GCS_unnamed ellipse",DATUM["D_unknown",SPHEROID["Unknown",6370997.000000,0]]`,
+		},
+		{
+			proj:   "+proj=utm +zone=15 +ellps=WGS84",
+			prefix: `PROJCS["Transverse_Mercator"`,
+		},
+		{
+			proj:   "+proj=aea +lat_1=29.5 +lat_2=45.5 +lat_0=37.5 +lon_0=-96 +x_0=0 +y_0=0 +datum=NAD83 +units=m",
+			prefix: `PROJCS["Albers_Conic_Equal_Area"`,
+		},
+		{
+			proj:   "+proj=merc +lon_0=0 +k=1 +x_0=0 +y_0=0 +ellps=WGS84 +units=m",
+			prefix: `PROJCS["Mercator"`,
+		},
+	} {
+		t.Run(test.proj, func(t *testing.T) {
+			sr, err := proj.Parse(test.proj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := wkt(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(w, test.prefix) {
+				t.Errorf("have %s, want prefix %s", w, test.prefix)
+			}
+		})
+	}
+}
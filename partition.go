@@ -0,0 +1,78 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+// partitionTileSize is the width and height, in number of outermost
+// (unnested) grid cells, of each spatial partition of the domain.
+const partitionTileSize = 4
+
+// partitionFallbackSize is the number of cells in each partition
+// for cells that do not have a nest index.
+const partitionFallbackSize = 256
+
+// partitionKey identifies a spatial partition of the domain.
+type partitionKey struct {
+	layer, i, j int
+}
+
+// partitions returns the grid cells divided into spatial partitions
+// using partitionCells. The partitions are recalculated whenever
+// cells are added to or removed from the grid.
+func (d *InMAP) partitions() [][]*Cell {
+	if d.cellPartitions == nil {
+		d.cellPartitions = partitionCells(d.cells.array())
+	}
+	return d.cellPartitions
+}
+
+// partitionKey returns the spatial partition that c belongs to. Each
+// partition holds all of the cells in a single layer that are
+// nested within a square tile of partitionTileSize × partitionTileSize
+// outermost grid cells. i is the position of c in the grid cell list,
+// which is used to partition cells that do not have a nest index.
+func (c *Cell) partitionKey(i int) partitionKey {
+	if len(c.Index) == 0 {
+		return partitionKey{layer: c.Layer, i: -1, j: i / partitionFallbackSize}
+	}
+	return partitionKey{
+		layer: c.Layer,
+		i:     c.Index[0][0] / partitionTileSize,
+		j:     c.Index[0][1] / partitionTileSize,
+	}
+}
+
+// partitionCells divides cells into spatially contiguous groups,
+// as described in Cell.partitionKey, so that neighboring cells tend to be
+// processed together. The partitions only depend on the grid, not on the
+// number of processors.
+func partitionCells(cells []*Cell) [][]*Cell {
+	var partitions [][]*Cell
+	index := make(map[partitionKey]int)
+	for i, c := range cells {
+		k := c.partitionKey(i)
+		p, ok := index[k]
+		if !ok {
+			p = len(partitions)
+			index[k] = p
+			partitions = append(partitions, nil)
+		}
+		partitions[p] = append(partitions[p], c)
+	}
+	return partitions
+}
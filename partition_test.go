@@ -0,0 +1,203 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// partitionTestModel returns an initialized model with a nested grid
+// and the science functions to run on it.
+func partitionTestModel(t testing.TB) (*InMAP, []CellManipulator) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+			SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return d, []CellManipulator{UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry()}
+}
+
+func TestPartitions(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	var m Mech
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPartitions := func() int {
+		seen := make(map[*Cell]bool)
+		partitions := d.partitions()
+		for i, p := range partitions {
+			if len(p) == 0 {
+				t.Errorf("partition %d is empty", i)
+			}
+			for _, c := range p {
+				if seen[c] {
+					t.Errorf("cell %v is in more than one partition", c)
+				}
+				seen[c] = true
+				if c.Layer != p[0].Layer {
+					t.Errorf("partition %d has cells from layers %d and %d", i, p[0].Layer, c.Layer)
+				}
+			}
+		}
+		if len(seen) != d.cells.len() {
+			t.Errorf("partitions have %d cells; want %d", len(seen), d.cells.len())
+		}
+		return len(partitions)
+	}
+
+	before := checkPartitions()
+
+	// The partitions should be recalculated when the grid changes.
+	if err := cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil)(d); err != nil {
+		t.Fatal(err)
+	}
+	if after := checkPartitions(); after < before {
+		t.Errorf("number of partitions decreased from %d to %d after refining the grid", before, after)
+	}
+}
+
+// Test whether the results are identical regardless of the number
+// of processors.
+func TestCalculationsDeterministic(t *testing.T) {
+	const nsteps = 10
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	var want []float64
+	for _, nprocs := range []int{1, 2, 3, 8} {
+		runtime.GOMAXPROCS(nprocs)
+		d, science := partitionTestModel(t)
+		emisCalc, scienceCalc := Calculations(AddEmissionsFlux()), Calculations(science...)
+		for i := 0; i < nsteps; i++ {
+			if err := emisCalc(d); err != nil {
+				t.Fatal(err)
+			}
+			if err := scienceCalc(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var have []float64
+		for _, c := range d.cells.array() {
+			have = append(have, c.Cf...)
+		}
+		if want == nil {
+			want = have
+			continue
+		}
+		if len(have) != len(want) {
+			t.Fatalf("%d processors: %d values != %d", nprocs, len(have), len(want))
+		}
+		for i, v := range have {
+			if v != want[i] {
+				t.Errorf("%d processors: value %d is %g; want %g", nprocs, i, v, want[i])
+			}
+		}
+	}
+}
+
+// stridedCalculations is the previous implementation of Calculations,
+// which strides cells across processors and locks each cell while it is
+// being modified. It is used as a baseline for benchmarking.
+func stridedCalculations(calculators ...CellManipulator) DomainManipulator {
+	nprocs := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	var locks []sync.RWMutex
+	return func(d *InMAP) error {
+		if len(locks) != d.cells.len() {
+			locks = make([]sync.RWMutex, d.cells.len())
+		}
+		wg.Add(nprocs)
+		for pp := 0; pp < nprocs; pp++ {
+			go func(pp int) {
+				for i := pp; i < d.cells.len(); i += nprocs {
+					c := (*d.cells)[i]
+					locks[i].Lock()
+					for _, f := range calculators {
+						f(c.Cell, d.Dt)
+					}
+					locks[i].Unlock()
+				}
+				wg.Done()
+			}(pp)
+		}
+		wg.Wait()
+		return nil
+	}
+}
+
+func BenchmarkCalculations(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, impl := range []struct {
+		name string
+		f    func(...CellManipulator) DomainManipulator
+	}{
+		{name: "partitioned", f: Calculations},
+		{name: "strided", f: stridedCalculations},
+	} {
+		for _, nprocs := range []int{1, 2, 4, 8, 16} {
+			b.Run(fmt.Sprintf("%s/procs=%d", impl.name, nprocs), func(b *testing.B) {
+				runtime.GOMAXPROCS(nprocs)
+				d, science := partitionTestModel(b)
+				calc := impl.f(science...)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := calc(d); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ctessum/geom/proj"
+	"gonum.org/v1/gonum/floats"
+)
+
+// Period is a period of time, such as a season or month, that is
+// represented by a separate steady-state simulation.
+type Period struct {
+	Start, End time.Time
+}
+
+// Duration returns the length of the period.
+func (p Period) Duration() time.Duration { return p.End.Sub(p.Start) }
+
+// Periods splits the time between start and end into periods of the
+// specified type. Valid types are "monthly", for calendar months, and
+// "seasonal", for meteorological seasons (December–February,
+// March–May, June–August, and September–November).
+//
+// Monthly periods are shortened at the beginning and end of the
+// simulation if start and end do not fall on month boundaries.
+//
+// Seasonal periods are always whole seasons, so that each winter is
+// a single contiguous period from December through February of the next
+// year. The periods are the seasons that end after start and no later
+// than end, which means that the first period can begin before start.
+// For example, the seasons for the 2005 calendar year are the winter
+// from December 2004 through February 2005, followed by spring, summer,
+// and fall of 2005. An error is returned if no season ends between
+// start and end.
+func Periods(start, end time.Time, periodType string) ([]Period, error) {
+	if periodType != "monthly" && periodType != "seasonal" {
+		return nil, fmt.Errorf("inmap: invalid period type '%s'; valid options are 'monthly' and 'seasonal'", periodType)
+	}
+	if !start.Before(end) {
+		return nil, fmt.Errorf("inmap: period start %v is not before end %v", start, end)
+	}
+	var o []Period
+	if periodType == "monthly" {
+		for t := start; t.Before(end); {
+			e := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			if e.After(end) {
+				e = end
+			}
+			o = append(o, Period{Start: t, End: e})
+			t = e
+		}
+		return o, nil
+	}
+	// Seasons begin on the first day of December, March, June,
+	// and September. Month zero is December of the previous year.
+	t := time.Date(start.Year(), start.Month()-start.Month()%3, 1, 0, 0, 0, 0, start.Location())
+	for {
+		e := t.AddDate(0, 3, 0)
+		if e.After(end) {
+			break
+		}
+		o = append(o, Period{Start: t, End: e})
+		t = e
+	}
+	if len(o) == 0 {
+		return nil, fmt.Errorf("inmap: there are no whole seasons between %v and %v", start, end)
+	}
+	return o, nil
+}
+
+// averageFactor returns the average of the emissions rate factors of
+// temporal profile tp during the period, calculated at hourly intervals.
+func (p Period) averageFactor(tp TemporalProfile) float64 {
+	var sum float64
+	var n int
+	for t := p.Start; t.Before(p.End); t = t.Add(time.Hour) {
+		sum += tp.Factor(t)
+		n++
+	}
+	return sum / float64(n)
+}
+
+// StartPeriod returns a function that prepares the simulation to
+// calculate steady-state concentrations for period p.
+// If data is not nil, the meteorology and baseline concentrations of each
+// grid cell are replaced with those in data, as in MeteorologySeries.
+// The emissions flux of each grid cell is replaced with the emissions in emis,
+// where the rate of emissions with temporal profiles is their average rate
+// during p. The progress of SteadyStateConvergenceCheck is then reset so that
+// the simulation runs until it converges again. Concentrations from the
+// previous period are kept as the initial conditions.
+// Grid cells created by MutateGrid after StartPeriod is run will use the
+// emissions that MutateGrid was originally given.
+func StartPeriod(p Period, data *CTMData, emis *Emissions, m Mechanism) DomainManipulator {
+	setTimestep := SetTimestepCFL()
+	return func(d *InMAP) error {
+		if data != nil {
+			for _, c := range *d.cells {
+				if err := c.updateMeteorology(data); err != nil {
+					return err
+				}
+			}
+			for _, c := range *d.cells {
+				c.updateNeighborDiffusivity()
+			}
+		}
+		factors := make(map[TemporalProfile]float64)
+		for _, c := range *d.cells {
+			if err := c.setEmissionsFlux(emis, m); err != nil {
+				return err
+			}
+			if len(c.emisFluxProfiles) == 0 {
+				continue
+			}
+			for i := range c.EmisFlux {
+				c.EmisFlux[i] = 0
+			}
+			for _, fp := range c.emisFluxProfiles {
+				factor := 1.
+				if fp.profile != nil {
+					var ok bool
+					if factor, ok = factors[fp.profile]; !ok {
+						factor = p.averageFactor(fp.profile)
+						factors[fp.profile] = factor
+					}
+				}
+				floats.AddScaled(c.EmisFlux, factor, fp.flux)
+			}
+		}
+		d.convergence = nil
+		d.Done = false
+		return setTimestep(d)
+	}
+}
+
+// PeriodOutput returns a function that writes the simulation results for
+// period p to a file whose name is created from the Outputter file name
+// using TimeSeriesFileName with the beginning time of the period.
+// If rename is not nil, it is used to change the file name before the
+// file is written, as in TimeSeriesOutput.
+// sr is the spatial reference of the model grid.
+func (o *Outputter) PeriodOutput(p Period, sr *proj.SR, rename func(fileName string) (string, error)) DomainManipulator {
+	return func(d *InMAP) error {
+		o2 := *o
+		o2.fileName = TimeSeriesFileName(o.fileName, p.Start)
+		if rename != nil {
+			var err error
+			if o2.fileName, err = rename(o2.fileName); err != nil {
+				return err
+			}
+		}
+		return o2.Output(sr)(d)
+	}
+}
+
+// PeriodAverager calculates the average of the simulation results
+// from a series of periods, weighted by the length of each period.
+// The output variables are averaged directly, so the averages of
+// variables that are nonlinear functions of concentration are approximate.
+type PeriodAverager struct {
+	o        *Outputter
+	sum      map[string][]float64
+	duration float64 // seconds
+}
+
+// NewPeriodAverager returns a PeriodAverager for the output variables in o.
+func (o *Outputter) NewPeriodAverager() *PeriodAverager {
+	return &PeriodAverager{o: o}
+}
+
+// Add returns a function that adds the current simulation results,
+// which should be the results for period p, to the average.
+// The grid must not change between periods.
+func (a *PeriodAverager) Add(p Period) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.Results(a.o)
+		if err != nil {
+			return err
+		}
+		w := p.Duration().Seconds()
+		if w <= 0 {
+			return fmt.Errorf("inmap: period %v–%v has zero length", p.Start, p.End)
+		}
+		if a.sum == nil {
+			a.sum = make(map[string][]float64)
+			for v, r := range results {
+				a.sum[v] = make([]float64, len(r))
+			}
+		}
+		for v, r := range results {
+			if len(r) != len(a.sum[v]) {
+				return fmt.Errorf("inmap: period average: the number of grid cells for %s "+
+					"changed from %d to %d", v, len(a.sum[v]), len(r))
+			}
+			floats.AddScaled(a.sum[v], w, r)
+		}
+		a.duration += w
+		return nil
+	}
+}
+
+// Average returns the weighted average of the results
+// that have been added to the receiver.
+func (a *PeriodAverager) Average() (map[string][]float64, error) {
+	if a.duration == 0 {
+		return nil, fmt.Errorf("inmap: period average: no results have been added")
+	}
+	o := make(map[string][]float64)
+	for v, s := range a.sum {
+		o[v] = make([]float64, len(s))
+		floats.AddScaled(o[v], 1/a.duration, s)
+	}
+	return o, nil
+}
+
+// Output returns a function that writes the weighted average of the
+// results to the Outputter file. If rename is not nil, it is used to
+// change the file name before the file is written, as in
+// Outputter.TimeSeriesOutput.
+// sr is the spatial reference of the model grid.
+func (a *PeriodAverager) Output(sr *proj.SR, rename func(fileName string) (string, error)) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := a.Average()
+		if err != nil {
+			return err
+		}
+		o := *a.o
+		if rename != nil {
+			if o.fileName, err = rename(o.fileName); err != nil {
+				return err
+			}
+		}
+		return o.writeResults(d, results, sr)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ctessum/geom"
+)
+
+func TestPeriods(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		periodType string
+		start, end time.Time
+		want       []Period
+	}{
+		{
+			periodType: "monthly",
+			start:      date(2005, time.January, 15),
+			end:        date(2005, time.April, 1),
+			want: []Period{
+				{Start: date(2005, time.January, 15), End: date(2005, time.February, 1)},
+				{Start: date(2005, time.February, 1), End: date(2005, time.March, 1)},
+				{Start: date(2005, time.March, 1), End: date(2005, time.April, 1)},
+			},
+		},
+		{
+			periodType: "seasonal",
+			start:      date(2005, time.January, 1),
+			end:        date(2006, time.January, 1),
+			want: []Period{
+				{Start: date(2004, time.December, 1), End: date(2005, time.March, 1)},
+				{Start: date(2005, time.March, 1), End: date(2005, time.June, 1)},
+				{Start: date(2005, time.June, 1), End: date(2005, time.September, 1)},
+				{Start: date(2005, time.September, 1), End: date(2005, time.December, 1)},
+			},
+		},
+		{
+			periodType: "seasonal",
+			start:      date(2005, time.December, 1),
+			end:        date(2006, time.March, 1),
+			want: []Period{
+				{Start: date(2005, time.December, 1), End: date(2006, time.March, 1)},
+			},
+		},
+		{
+			periodType: "seasonal",
+			start:      date(2005, time.February, 15),
+			end:        date(2005, time.July, 1),
+			want: []Period{
+				{Start: date(2004, time.December, 1), End: date(2005, time.March, 1)},
+				{Start: date(2005, time.March, 1), End: date(2005, time.June, 1)},
+			},
+		},
+	} {
+		t.Run(test.periodType, func(t *testing.T) {
+			have, err := Periods(test.start, test.end, test.periodType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, test.want) {
+				t.Errorf("have %v, want %v", have, test.want)
+			}
+		})
+	}
+	if _, err := Periods(date(2005, time.January, 1), date(2006, time.January, 1), "weekly"); err == nil {
+		t.Error("invalid period type should cause an error")
+	}
+	if _, err := Periods(date(2005, time.January, 1), date(2005, time.January, 1), "monthly"); err == nil {
+		t.Error("zero-length simulation should cause an error")
+	}
+	if _, err := Periods(date(2005, time.January, 1), date(2005, time.February, 1), "seasonal"); err == nil {
+		t.Error("simulation without a whole season should cause an error")
+	}
+}
+
+// januaryProfile doubles emissions in January and halves them
+// during the rest of the year.
+type januaryProfile struct{}
+
+func (januaryProfile) Factor(t time.Time) float64 {
+	if t.Month() == time.January {
+		return 2
+	}
+	return 0.5
+}
+
+func TestPeriodAverager(t *testing.T) {
+	const E = 1000000.0 // emissions
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	var m Mech
+
+	jan := Period{
+		Start: time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2005, time.February, 1, 0, 0, 0, 0, time.UTC),
+	}
+	feb := Period{Start: jan.End, End: time.Date(2005, time.March, 1, 0, 0, 0, 0, time.UTC)}
+
+	emis := NewEmissions()
+	emis.AddWithProfile(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}, januaryProfile{})
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+
+	o, err := NewOutputter("", false, map[string]string{
+		"PM25Emissions": "PM25Emissions",
+		"SOxEmissions":  "SOxEmissions",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := o.NewPeriodAverager()
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	base, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []Period{jan, feb} {
+		if err := StartPeriod(p, ctmdata, emis, m)(d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Done {
+			t.Error("simulation should not be done at the beginning of a period")
+		}
+		results, err := d.Results(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		factor := 0.5
+		if p == jan {
+			factor = 2
+		}
+		for i, v := range results["PM25Emissions"] {
+			if different(v, base["PM25Emissions"][i]*factor, 1.e-10) {
+				t.Errorf("period %v cell %d PM25Emissions: %g != %g", p.Start, i, v, base["PM25Emissions"][i]*factor)
+			}
+		}
+		for i, v := range results["SOxEmissions"] {
+			if different(v, base["SOxEmissions"][i], 1.e-10) {
+				t.Errorf("period %v cell %d SOxEmissions: %g != %g", p.Start, i, v, base["SOxEmissions"][i])
+			}
+		}
+		if err := a.Add(p)(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	avg, err := a.Average()
+	if err != nil {
+		t.Fatal(err)
+	}
+	factor := (2*31 + 0.5*28) / 59.
+	for i, v := range avg["PM25Emissions"] {
+		if want := base["PM25Emissions"][i] * factor; different(v, want, 1.e-10) {
+			t.Errorf("cell %d average PM25Emissions: %g != %g", i, v, want)
+		}
+	}
+	for i, v := range avg["SOxEmissions"] {
+		if different(v, base["SOxEmissions"][i], 1.e-10) {
+			t.Errorf("cell %d average SOxEmissions: %g != %g", i, v, base["SOxEmissions"][i])
+		}
+	}
+}
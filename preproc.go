@@ -68,8 +68,27 @@ const (
 	// inDateFormat specifies the format to use
 	// when inputting dates.
 	inDateFormat = "20060102"
+
+	// inDateHourFormat specifies the format to use
+	// when inputting dates that do not begin at midnight.
+	inDateHourFormat = "20060102T15"
 )
 
+// ParseDate parses a preprocessor start or end date, which can
+// either be in the format "YYYYMMDD" or, for dates that do not
+// begin at midnight, "YYYYMMDDTHH".
+func ParseDate(date string) (time.Time, error) {
+	t, err := time.Parse(inDateFormat, date)
+	if err == nil {
+		return t, nil
+	}
+	t, err2 := time.Parse(inDateHourFormat, date)
+	if err2 == nil {
+		return t, nil
+	}
+	return time.Time{}, err
+}
+
 // NextData is a type of function that returns data for the next time step.
 // If there are no more time steps, it should return the io.EOF error.
 type NextData func() (*sparse.DenseArray, error)
@@ -159,235 +178,10 @@ type Preprocessor interface {
 
 // Preprocess returns preprocessed InMAP input data
 // based on the information available from the given
-// preprocessor.
+// preprocessor. The whole domain is processed at once;
+// use PreprocessWithOptions to process it in smaller pieces.
 func Preprocess(p Preprocessor) (*CTMData, error) {
-	var pblh, layerHeights, windSpeed, windSpeedInverse, windSpeedMinusThird, windSpeedMinusOnePointFour, uAvg, vAvg, wAvg *sparse.DenseArray
-
-	errChan := make(chan error)
-
-	go func() {
-		var err error
-		pblh, err = average(p.PBLH())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		layerHeights, err = average(p.Height())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		windSpeed, windSpeedInverse, windSpeedMinusThird, windSpeedMinusOnePointFour, uAvg, vAvg, wAvg, err = calcWindSpeed(p.U(), p.V(), p.W())
-		errChan <- err
-	}()
-
-	for i := 0; i < 3; i++ {
-		err := <-errChan
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	Dz := layerThickness(layerHeights)
-
-	var uDeviation, vDeviation, aOrgPartitioning, aVOC, aSOA, bOrgPartitioning, bVOC, bSOA,
-		NOPartitioning, gNO, pNO, SPartitioning, gS, pS, NHPartitioning, gNH, pNH, totalpm25,
-		alt, particleWetDep, SO2WetDep, otherGasWetDep, temperature, Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep,
-		NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy *sparse.DenseArray
-
-	go func() {
-		var err error
-		// calculate deviation from average wind speed.
-		// Only calculate horizontal deviations.
-		uDeviation, err = windDeviation(uAvg, p.U())
-		errChan <- err
-	}()
-	go func() {
-		var err error
-		vDeviation, err = windDeviation(vAvg, p.V())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		// calculate gas/particle partitioning
-		aOrgPartitioning, aVOC, aSOA, err = marginalPartitioning(p.AVOC(), p.ASOA())
-		errChan <- err
-	}()
-	go func() {
-		var err error
-		bOrgPartitioning, bVOC, bSOA, err = marginalPartitioning(p.BVOC(), p.BSOA())
-		errChan <- err
-	}()
-	go func() {
-		var err error
-		NOPartitioning, gNO, pNO, err = marginalPartitioning(p.NOx(), p.PNO())
-		errChan <- err
-	}()
-	go func() {
-		var err error
-		SPartitioning, gS, pS, err = marginalPartitioning(p.SOx(), p.PS())
-		errChan <- err
-	}()
-	go func() {
-		var err error
-		NHPartitioning, gNH, pNH, err = marginalPartitioning(p.NH3(), p.PNH())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		// Get total PM2.5 averages for performance eval.
-		totalpm25, err = average(p.TotalPM25())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		// average inverse density
-		alt, err = average(p.ALT())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		// Calculate wet deposition.
-		particleWetDep, SO2WetDep, otherGasWetDep, err = wetDeposition(Dz, p.QRain(), p.CloudFrac(), p.ALT())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		temperature, err = average(p.T())
-		errChan <- err
-	}()
-
-	go func() {
-		var err error
-		// Calculate stability for plume rise, vertical mixing,
-		// and chemical reaction rates.
-		Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep,
-			NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy, err = stabilityMixingChemistry(layerHeights, p.PBLH(),
-			p.UStar(), p.ALT(), p.T(), p.P(), p.SurfaceHeatFlux(), p.HO(), p.H2O2(),
-			p.Z0(), p.SeinfeldLandUse(), p.WeselyLandUse(), p.QCloud(), p.RadiationDown(), p.QRain())
-		errChan <- err
-	}()
-
-	for i := 0; i < 12; i++ {
-		err := <-errChan
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	data := new(CTMData)
-	data.AddVariable("UAvg", []string{"z", "y", "xStagger"},
-		"Annual average x velocity", "m/s", uAvg)
-	data.AddVariable("VAvg", []string{"z", "yStagger", "x"},
-		"Annual average y velocity", "m/s", vAvg)
-	data.AddVariable("WAvg", []string{"zStagger", "y", "x"},
-		"Annual average z velocity", "m/s", wAvg)
-	data.AddVariable("UDeviation", []string{"z", "y", "xStagger"},
-		"Average deviation from average x velocity", "m/s", uDeviation)
-	data.AddVariable("VDeviation", []string{"z", "yStagger", "x"},
-		"Average deviation from average y velocity", "m/s", vDeviation)
-	data.AddVariable("aOrgPartitioning", []string{"z", "y", "x"},
-		"Mass fraction of anthropogenic organic matter in particle {vs. gas} phase",
-		"fraction", aOrgPartitioning)
-	data.AddVariable("aVOC", []string{"z", "y", "x"},
-		"Average anthropogenic VOC concentration", "ug m-3", aVOC)
-	data.AddVariable("aSOA", []string{"z", "y", "x"},
-		"Average anthropogenic secondary organic aerosol concentration", "ug m-3", aSOA)
-	data.AddVariable("bOrgPartitioning", []string{"z", "y", "x"},
-		"Mass fraction of biogenic organic matter in particle {vs. gas} phase",
-		"fraction", bOrgPartitioning)
-	data.AddVariable("bVOC", []string{"z", "y", "x"},
-		"Average biogenic VOC concentration", "ug m-3", bVOC)
-	data.AddVariable("bSOA", []string{"z", "y", "x"},
-		"Average biogenic secondary organic aerosol concentration", "ug m-3", bSOA)
-	data.AddVariable("NOPartitioning", []string{"z", "y", "x"},
-		"Mass fraction of N from NOx in particle {vs. gas} phase", "fraction",
-		NOPartitioning)
-	data.AddVariable("gNO", []string{"z", "y", "x"},
-		"Average concentration of nitrogen fraction of gaseous NOx", "ug m-3",
-		gNO)
-	data.AddVariable("pNO", []string{"z", "y", "x"},
-		"Average concentration of nitrogen fraction of particulate NO3",
-		"ug m-3", pNO)
-	data.AddVariable("SPartitioning", []string{"z", "y", "x"},
-		"Mass fraction of S from SOx in particle {vs. gas} phase", "fraction",
-		SPartitioning)
-	data.AddVariable("gS", []string{"z", "y", "x"},
-		"Average concentration of sulfur fraction of gaseous SOx", "ug m-3",
-		gS)
-	data.AddVariable("pS", []string{"z", "y", "x"},
-		"Average concentration of sulfur fraction of particulate sulfate",
-		"ug m-3", pS)
-	data.AddVariable("NHPartitioning", []string{"z", "y", "x"},
-		"Mass fraction of N from NH3 in particle {vs. gas} phase", "fraction",
-		NHPartitioning)
-	data.AddVariable("gNH", []string{"z", "y", "x"},
-		"Average concentration of nitrogen fraction of gaseous ammonia",
-		"ug m-3", gNH)
-	data.AddVariable("pNH", []string{"z", "y", "x"},
-		"Average concentration of nitrogen fraction of particulate ammonium",
-		"ug m-3", pNH)
-	data.AddVariable("SO2oxidation", []string{"z", "y", "x"},
-		"Rate of SO2 oxidation to SO4 by hydroxyl radical and H2O2",
-		"s-1", SO2oxidation)
-	data.AddVariable("ParticleDryDep", []string{"z", "y", "x"},
-		"Dry deposition velocity for particles", "m s-1", particleDryDep)
-	data.AddVariable("SO2DryDep", []string{"z", "y", "x"},
-		"Dry deposition velocity for SO2", "m s-1", SO2DryDep)
-	data.AddVariable("NOxDryDep", []string{"z", "y", "x"},
-		"Dry deposition velocity for NOx", "m s-1", NOxDryDep)
-	data.AddVariable("NH3DryDep", []string{"z", "y", "x"},
-		"Dry deposition velocity for NH3", "m s-1", NH3DryDep)
-	data.AddVariable("VOCDryDep", []string{"z", "y", "x"},
-		"Dry deposition velocity for VOCs", "m s-1", VOCDryDep)
-	data.AddVariable("Kxxyy", []string{"z", "y", "x"},
-		"Horizontal eddy diffusion coefficient", "m2 s-1", Kxxyy)
-	data.AddVariable("LayerHeights", []string{"zStagger", "y", "x"},
-		"Height at edge of layer", "m", layerHeights)
-	data.AddVariable("Dz", []string{"z", "y", "x"},
-		"Vertical grid size", "m", Dz)
-	data.AddVariable("ParticleWetDep", []string{"z", "y", "x"},
-		"Wet deposition rate constant for fine particles",
-		"s-1", particleWetDep)
-	data.AddVariable("SO2WetDep", []string{"z", "y", "x"},
-		"Wet deposition rate constant for SO2 gas", "s-1", SO2WetDep)
-	data.AddVariable("OtherGasWetDep", []string{"z", "y", "x"},
-		"Wet deposition rate constant for other gases", "s-1", otherGasWetDep)
-	data.AddVariable("Kzz", []string{"z", "y", "x"},
-		"Vertical turbulent diffusivity", "m2 s-1", Kzz)
-	data.AddVariable("M2u", []string{"z", "y", "x"},
-		"ACM2 nonlocal upward mixing {Pleim 2007}", "s-1", M2u)
-	data.AddVariable("M2d", []string{"z", "y", "x"},
-		"ACM2 nonlocal downward mixing {Pleim 2007}", "s-1", M2d)
-	data.AddVariable("Pblh", []string{"y", "x"},
-		"Planetary boundary layer height", "m", pblh)
-	data.AddVariable("WindSpeed", []string{"z", "y", "x"},
-		"RMS wind speed", "m s-1", windSpeed)
-	data.AddVariable("WindSpeedInverse", []string{"z", "y", "x"},
-		"RMS wind speed^(-1)", "(m s-1)^(-1)", windSpeedInverse)
-	data.AddVariable("WindSpeedMinusThird", []string{"z", "y", "x"},
-		"RMS wind speed^(-1/3)", "(m s-1)^(-1/3)", windSpeedMinusThird)
-	data.AddVariable("WindSpeedMinusOnePointFour", []string{"z", "y", "x"},
-		"RMS wind speed^(-1.4)", "(m s-1)^(-1.4)", windSpeedMinusOnePointFour)
-	data.AddVariable("Temperature", []string{"z", "y", "x"},
-		"Average Temperature", "K", temperature)
-	data.AddVariable("S1", []string{"z", "y", "x"},
-		"Stability parameter", "?", S1)
-	data.AddVariable("Sclass", []string{"z", "y", "x"},
-		"Stability parameter", "0=Unstable; 1=Stable", Sclass)
-	data.AddVariable("alt", []string{"z", "y", "x"},
-		"Inverse density", "m3 kg-1", alt)
-	data.AddVariable("TotalPM25", []string{"z", "y", "x"},
-		"Total PM2.5 concentration", "ug m-3", totalpm25)
-
-	return data, nil
+	return PreprocessWithOptions(p, PreprocessOptions{})
 }
 
 // marginalPartitioning calculates marginal partitioning over a period
@@ -983,10 +777,9 @@ func arrayAverage(s *sparse.DenseArray, numTsteps int) *sparse.DenseArray {
 // in which dates appear in the filename.
 func nextDataNCF(fileTemplate string, dateFormat string, varName string, start, end time.Time, recordDelta, fileDelta time.Duration, readFunc readNCFFunc, msgChan chan string) NextData {
 	recordsPerFile := int(fileDelta / recordDelta)
-	var i int
-	date := start
+	date, i := fileStart(start, fileDelta, recordDelta)
 	return func() (*sparse.DenseArray, error) {
-		if !date.Before(end) {
+		if !date.Add(time.Duration(i) * recordDelta).Before(end) {
 			return nil, io.EOF
 		}
 		f, ff, err := ncfFromTemplate(fileTemplate, dateFormat, date)
@@ -1011,6 +804,21 @@ func nextDataNCF(fileTemplate string, dateFormat string, varName string, start,
 	}
 }
 
+// fileStart returns the beginning time of the file that contains
+// the record at time t, as well as the index of that record
+// within the file. Files that span one day or less are assumed to begin
+// at whole multiples of their length after midnight; longer files
+// are assumed to begin at t.
+func fileStart(t time.Time, fileDelta, recordDelta time.Duration) (time.Time, int) {
+	const day = 24 * time.Hour
+	if fileDelta <= 0 || fileDelta > day || day%fileDelta != 0 {
+		return t, 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start := midnight.Add(t.Sub(midnight) / fileDelta * fileDelta)
+	return start, int(t.Sub(start) / recordDelta)
+}
+
 // readNCFFunc is a function that can read information from a
 // NetCDF file.
 type readNCFFunc func(varName string, file *cdf.File, index int) (*sparse.DenseArray, error)
@@ -53,7 +53,7 @@ func regenGoldenFile(data *CTMData, filePath string, x0, y0, dx, dy float64) err
 func TestWRFChemToInMAP(t *testing.T) {
 	const tolerance = 1.0e-6
 
-	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil)
+	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,7 +84,7 @@ func TestWRFChemToInMAP(t *testing.T) {
 }
 
 func BenchmarkWRFChemToInMAP(b *testing.B) {
-	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil)
+	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil, nil)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -112,6 +112,7 @@ func TestGEOSChemToInMAP(t *testing.T) {
 		"3h",
 		"3h",
 		true,
+		geosChemSpeciesGroups(false),
 		nil,
 	)
 	if err != nil {
@@ -159,6 +160,7 @@ func BenchmarkGEOSChemToInMAP(b *testing.B) {
 		"3h",
 		"3h",
 		true,
+		geosChemSpeciesGroups(false),
 		nil,
 	)
 	if err != nil {
@@ -189,6 +191,7 @@ func TestGEOSChemToInMAP_new(t *testing.T) {
 		"24h",
 		false,
 		nil,
+		nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,615 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// PreprocessOptions specifies how PreprocessWithOptions carries out
+// preprocessing. The zero value processes the whole domain at once with
+// all variable groups that are ready running concurrently, which is
+// what Preprocess does.
+type PreprocessOptions struct {
+	// TileRows is the number of grid rows in the South-North direction
+	// to process at a time. Memory use is roughly proportional to TileRows,
+	// but the input data is read once for each tile.
+	// If TileRows is zero, the whole domain is processed at once.
+	TileRows int
+
+	// Concurrency is the maximum number of variable groups to process
+	// at the same time. If it is zero, there is no limit.
+	Concurrency int
+
+	// TempDir, if not empty, is a directory where the results for each
+	// tile and variable group are saved as they are completed, so that
+	// preprocessing can be resumed after an interruption by running it
+	// again with the same TempDir and configuration. The files are removed
+	// when preprocessing finishes successfully. TempDir should not be shared
+	// between preprocessing runs with different configurations.
+	TempDir string
+
+	// MsgChan, if not nil, receives progress messages for each
+	// variable group and time step.
+	MsgChan chan string
+}
+
+// preprocVariable describes a preprocessed variable.
+type preprocVariable struct {
+	name        string
+	dims        []string
+	description string
+	units       string
+}
+
+// preprocGroup is a group of preprocessed variables that are calculated
+// together.
+type preprocGroup struct {
+	name string
+	vars []preprocVariable
+
+	// calc calculates the variables in the group for tile t, in the
+	// same order as vars. in holds the variables for tile t calculated
+	// in earlier stages.
+	calc func(p Preprocessor, t preprocTile, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error)
+}
+
+// preprocStages holds the groups of preprocessed variables. The groups in each
+// stage are independent of each other, but depend on groups in earlier stages.
+var preprocStages = [][]preprocGroup{
+	{
+		{
+			name: "PBLH",
+			vars: []preprocVariable{
+				{"Pblh", []string{"y", "x"}, "Planetary boundary layer height", "m"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				pblh, err := average(t.progress(t.data(p.PBLH(), false)))
+				return []*sparse.DenseArray{pblh}, err
+			},
+		},
+		{
+			name: "layer heights",
+			vars: []preprocVariable{
+				{"LayerHeights", []string{"zStagger", "y", "x"}, "Height at edge of layer", "m"},
+				{"Dz", []string{"z", "y", "x"}, "Vertical grid size", "m"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				layerHeights, err := average(t.progress(t.data(p.Height(), false)))
+				if err != nil {
+					return nil, err
+				}
+				return []*sparse.DenseArray{layerHeights, layerThickness(layerHeights)}, nil
+			},
+		},
+		{
+			name: "wind speed",
+			vars: []preprocVariable{
+				{"WindSpeed", []string{"z", "y", "x"}, "RMS wind speed", "m s-1"},
+				{"WindSpeedInverse", []string{"z", "y", "x"}, "RMS wind speed^(-1)", "(m s-1)^(-1)"},
+				{"WindSpeedMinusThird", []string{"z", "y", "x"}, "RMS wind speed^(-1/3)", "(m s-1)^(-1/3)"},
+				{"WindSpeedMinusOnePointFour", []string{"z", "y", "x"}, "RMS wind speed^(-1.4)", "(m s-1)^(-1.4)"},
+				{"UAvg", []string{"z", "y", "xStagger"}, "Annual average x velocity", "m/s"},
+				{"VAvg", []string{"z", "yStagger", "x"}, "Annual average y velocity", "m/s"},
+				{"WAvg", []string{"zStagger", "y", "x"}, "Annual average z velocity", "m/s"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				windSpeed, windSpeedInverse, windSpeedMinusThird, windSpeedMinusOnePointFour, uAvg, vAvg, wAvg, err :=
+					calcWindSpeed(t.progress(t.data(p.U(), false)), t.data(p.V(), true), t.data(p.W(), false))
+				return []*sparse.DenseArray{windSpeed, windSpeedInverse, windSpeedMinusThird,
+					windSpeedMinusOnePointFour, uAvg, vAvg, wAvg}, err
+			},
+		},
+	},
+	{
+		{
+			name: "x wind deviation",
+			vars: []preprocVariable{
+				{"UDeviation", []string{"z", "y", "xStagger"}, "Average deviation from average x velocity", "m/s"},
+			},
+			calc: func(p Preprocessor, t preprocTile, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				// Only calculate horizontal deviations.
+				uDeviation, err := windDeviation(in["UAvg"], t.progress(t.data(p.U(), false)))
+				return []*sparse.DenseArray{uDeviation}, err
+			},
+		},
+		{
+			name: "y wind deviation",
+			vars: []preprocVariable{
+				{"VDeviation", []string{"z", "yStagger", "x"}, "Average deviation from average y velocity", "m/s"},
+			},
+			calc: func(p Preprocessor, t preprocTile, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				vDeviation, err := windDeviation(in["VAvg"], t.progress(t.data(p.V(), true)))
+				return []*sparse.DenseArray{vDeviation}, err
+			},
+		},
+		partitioningGroup("anthropogenic organic partitioning",
+			func(p Preprocessor) (NextData, NextData) { return p.AVOC(), p.ASOA() },
+			preprocVariable{"aOrgPartitioning", []string{"z", "y", "x"},
+				"Mass fraction of anthropogenic organic matter in particle {vs. gas} phase", "fraction"},
+			preprocVariable{"aVOC", []string{"z", "y", "x"},
+				"Average anthropogenic VOC concentration", "ug m-3"},
+			preprocVariable{"aSOA", []string{"z", "y", "x"},
+				"Average anthropogenic secondary organic aerosol concentration", "ug m-3"}),
+		partitioningGroup("biogenic organic partitioning",
+			func(p Preprocessor) (NextData, NextData) { return p.BVOC(), p.BSOA() },
+			preprocVariable{"bOrgPartitioning", []string{"z", "y", "x"},
+				"Mass fraction of biogenic organic matter in particle {vs. gas} phase", "fraction"},
+			preprocVariable{"bVOC", []string{"z", "y", "x"},
+				"Average biogenic VOC concentration", "ug m-3"},
+			preprocVariable{"bSOA", []string{"z", "y", "x"},
+				"Average biogenic secondary organic aerosol concentration", "ug m-3"}),
+		partitioningGroup("nitrate partitioning",
+			func(p Preprocessor) (NextData, NextData) { return p.NOx(), p.PNO() },
+			preprocVariable{"NOPartitioning", []string{"z", "y", "x"},
+				"Mass fraction of N from NOx in particle {vs. gas} phase", "fraction"},
+			preprocVariable{"gNO", []string{"z", "y", "x"},
+				"Average concentration of nitrogen fraction of gaseous NOx", "ug m-3"},
+			preprocVariable{"pNO", []string{"z", "y", "x"},
+				"Average concentration of nitrogen fraction of particulate NO3", "ug m-3"}),
+		partitioningGroup("sulfate partitioning",
+			func(p Preprocessor) (NextData, NextData) { return p.SOx(), p.PS() },
+			preprocVariable{"SPartitioning", []string{"z", "y", "x"},
+				"Mass fraction of S from SOx in particle {vs. gas} phase", "fraction"},
+			preprocVariable{"gS", []string{"z", "y", "x"},
+				"Average concentration of sulfur fraction of gaseous SOx", "ug m-3"},
+			preprocVariable{"pS", []string{"z", "y", "x"},
+				"Average concentration of sulfur fraction of particulate sulfate", "ug m-3"}),
+		partitioningGroup("ammonium partitioning",
+			func(p Preprocessor) (NextData, NextData) { return p.NH3(), p.PNH() },
+			preprocVariable{"NHPartitioning", []string{"z", "y", "x"},
+				"Mass fraction of N from NH3 in particle {vs. gas} phase", "fraction"},
+			preprocVariable{"gNH", []string{"z", "y", "x"},
+				"Average concentration of nitrogen fraction of gaseous ammonia", "ug m-3"},
+			preprocVariable{"pNH", []string{"z", "y", "x"},
+				"Average concentration of nitrogen fraction of particulate ammonium", "ug m-3"}),
+		{
+			// Total PM2.5 averages are used for performance evaluation.
+			name: "total PM2.5",
+			vars: []preprocVariable{
+				{"TotalPM25", []string{"z", "y", "x"}, "Total PM2.5 concentration", "ug m-3"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				totalpm25, err := average(t.progress(t.data(p.TotalPM25(), false)))
+				return []*sparse.DenseArray{totalpm25}, err
+			},
+		},
+		{
+			name: "inverse density",
+			vars: []preprocVariable{
+				{"alt", []string{"z", "y", "x"}, "Inverse density", "m3 kg-1"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				alt, err := average(t.progress(t.data(p.ALT(), false)))
+				return []*sparse.DenseArray{alt}, err
+			},
+		},
+		{
+			name: "wet deposition",
+			vars: []preprocVariable{
+				{"ParticleWetDep", []string{"z", "y", "x"}, "Wet deposition rate constant for fine particles", "s-1"},
+				{"SO2WetDep", []string{"z", "y", "x"}, "Wet deposition rate constant for SO2 gas", "s-1"},
+				{"OtherGasWetDep", []string{"z", "y", "x"}, "Wet deposition rate constant for other gases", "s-1"},
+			},
+			calc: func(p Preprocessor, t preprocTile, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				particleWetDep, SO2WetDep, otherGasWetDep, err := wetDeposition(in["Dz"],
+					t.progress(t.data(p.QRain(), false)), t.data(p.CloudFrac(), false), t.data(p.ALT(), false))
+				return []*sparse.DenseArray{particleWetDep, SO2WetDep, otherGasWetDep}, err
+			},
+		},
+		{
+			name: "temperature",
+			vars: []preprocVariable{
+				{"Temperature", []string{"z", "y", "x"}, "Average Temperature", "K"},
+			},
+			calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				temperature, err := average(t.progress(t.data(p.T(), false)))
+				return []*sparse.DenseArray{temperature}, err
+			},
+		},
+		{
+			// Stability is used for plume rise, vertical mixing,
+			// and chemical reaction rates.
+			name: "stability, mixing, and chemistry",
+			vars: []preprocVariable{
+				{"Sclass", []string{"z", "y", "x"}, "Stability parameter", "0=Unstable; 1=Stable"},
+				{"S1", []string{"z", "y", "x"}, "Stability parameter", "?"},
+				{"Kzz", []string{"z", "y", "x"}, "Vertical turbulent diffusivity", "m2 s-1"},
+				{"M2u", []string{"z", "y", "x"}, "ACM2 nonlocal upward mixing {Pleim 2007}", "s-1"},
+				{"M2d", []string{"z", "y", "x"}, "ACM2 nonlocal downward mixing {Pleim 2007}", "s-1"},
+				{"SO2oxidation", []string{"z", "y", "x"}, "Rate of SO2 oxidation to SO4 by hydroxyl radical and H2O2", "s-1"},
+				{"ParticleDryDep", []string{"z", "y", "x"}, "Dry deposition velocity for particles", "m s-1"},
+				{"SO2DryDep", []string{"z", "y", "x"}, "Dry deposition velocity for SO2", "m s-1"},
+				{"NOxDryDep", []string{"z", "y", "x"}, "Dry deposition velocity for NOx", "m s-1"},
+				{"NH3DryDep", []string{"z", "y", "x"}, "Dry deposition velocity for NH3", "m s-1"},
+				{"VOCDryDep", []string{"z", "y", "x"}, "Dry deposition velocity for VOCs", "m s-1"},
+				{"Kxxyy", []string{"z", "y", "x"}, "Horizontal eddy diffusion coefficient", "m2 s-1"},
+			},
+			calc: func(p Preprocessor, t preprocTile, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+				Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep,
+					NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy, err := stabilityMixingChemistry(in["LayerHeights"],
+					t.data(p.PBLH(), false), t.data(p.UStar(), false), t.data(p.ALT(), false),
+					t.progress(t.data(p.T(), false)), t.data(p.P(), false), t.data(p.SurfaceHeatFlux(), false),
+					t.data(p.HO(), false), t.data(p.H2O2(), false), t.data(p.Z0(), false),
+					t.data(p.SeinfeldLandUse(), false), t.data(p.WeselyLandUse(), false),
+					t.data(p.QCloud(), false), t.data(p.RadiationDown(), false), t.data(p.QRain(), false))
+				return []*sparse.DenseArray{Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep,
+					SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy}, err
+			},
+		},
+	},
+}
+
+// partitioningGroup returns a group that calculates gas/particle partitioning
+// using the gas and particle phase concentrations returned by data.
+func partitioningGroup(name string, data func(p Preprocessor) (gas, particle NextData), partitioning, gas, particle preprocVariable) preprocGroup {
+	return preprocGroup{
+		name: name,
+		vars: []preprocVariable{partitioning, gas, particle},
+		calc: func(p Preprocessor, t preprocTile, _ map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+			gasFunc, particleFunc := data(p)
+			part, gasConc, particleConc, err := marginalPartitioning(t.progress(t.data(gasFunc, false)), t.data(particleFunc, false))
+			return []*sparse.DenseArray{part, gasConc, particleConc}, err
+		},
+	}
+}
+
+// preprocTile is a range of grid rows in the South-North direction.
+type preprocTile struct {
+	// j0 is the first row in the tile, and j1 is one more than the last row.
+	j0, j1 int
+
+	// ny is the total number of rows.
+	ny int
+
+	// whole specifies whether the tile covers the whole domain.
+	whole bool
+
+	// i is the index of the tile, and n is the number of tiles.
+	i, n int
+
+	// group is the name of the variable group being processed.
+	group string
+
+	msgChan chan string
+}
+
+// tiles returns the tiles that the domain of p should be divided into.
+func (o PreprocessOptions) tiles(p Preprocessor) ([]preprocTile, error) {
+	if o.TileRows <= 0 && o.TempDir == "" {
+		return []preprocTile{{whole: true, n: 1, msgChan: o.MsgChan}}, nil
+	}
+	ny, err := p.Ny()
+	if err != nil {
+		return nil, err
+	}
+	rows := o.TileRows
+	if rows <= 0 || rows > ny {
+		rows = ny
+	}
+	var tiles []preprocTile
+	for j0 := 0; j0 < ny; j0 += rows {
+		j1 := j0 + rows
+		if j1 > ny {
+			j1 = ny
+		}
+		tiles = append(tiles, preprocTile{j0: j0, j1: j1, ny: ny, whole: rows == ny, i: len(tiles), msgChan: o.MsgChan})
+	}
+	for i := range tiles {
+		tiles[i].n = len(tiles)
+	}
+	return tiles, nil
+}
+
+// String returns a description of t for use in progress messages.
+func (t preprocTile) String() string {
+	if t.n <= 1 {
+		return t.group
+	}
+	return fmt.Sprintf("%s (tile %d of %d, rows %d-%d)", t.group, t.i+1, t.n, t.j0, t.j1-1)
+}
+
+// message sends a progress message, if t has a message channel.
+func (t preprocTile) message(format string, a ...interface{}) {
+	if t.msgChan != nil {
+		t.msgChan <- fmt.Sprintf(format, a...)
+	}
+}
+
+// data returns a function that returns the rows of the data returned by f
+// that are in tile t. yStagger specifies whether the data is on a grid
+// that is staggered in the South-North direction, in which case the
+// row at the northern edge of the tile is also included.
+func (t preprocTile) data(f NextData, yStagger bool) NextData {
+	if t.whole {
+		return f
+	}
+	return func() (*sparse.DenseArray, error) {
+		d, err := f()
+		if err != nil {
+			return nil, err
+		}
+		j1 := t.j1
+		if yStagger {
+			j1++
+		}
+		return cropRows(d, t.j0, j1), nil
+	}
+}
+
+// progress returns a function that reports a progress message each time
+// f returns data for a time step.
+func (t preprocTile) progress(f NextData) NextData {
+	if t.msgChan == nil {
+		return f
+	}
+	var step int
+	return func() (*sparse.DenseArray, error) {
+		d, err := f()
+		if err == nil {
+			step++
+			t.message("Preprocessing %v: time step %d", t, step)
+		}
+		return d, err
+	}
+}
+
+// cropRows returns rows j0 through j1-1 of d, where the
+// second-to-last dimension of d is the South-North dimension.
+func cropRows(d *sparse.DenseArray, j0, j1 int) *sparse.DenseArray {
+	n := len(d.Shape)
+	ny, nx := d.Shape[n-2], d.Shape[n-1]
+	shape := append([]int{}, d.Shape...)
+	shape[n-2] = j1 - j0
+	o := sparse.ZerosDense(shape...)
+	rows := j1 - j0
+	for outer := 0; outer < len(d.Elements)/(ny*nx); outer++ {
+		copy(o.Elements[outer*rows*nx:(outer+1)*rows*nx], d.Elements[(outer*ny+j0)*nx:(outer*ny+j1)*nx])
+	}
+	return o
+}
+
+// insertRows copies tile data d into full-domain array o starting at row j0,
+// where the second-to-last dimension of both arrays is the South-North dimension.
+func insertRows(o, d *sparse.DenseArray, j0 int) {
+	n := len(d.Shape)
+	rows, nx := d.Shape[n-2], d.Shape[n-1]
+	ny := o.Shape[n-2]
+	for outer := 0; outer < len(d.Elements)/(rows*nx); outer++ {
+		copy(o.Elements[(outer*ny+j0)*nx:(outer*ny+j0+rows)*nx], d.Elements[outer*rows*nx:(outer+1)*rows*nx])
+	}
+}
+
+// PreprocessWithOptions returns preprocessed InMAP input data
+// based on the information available from the given
+// preprocessor, as specified by o. See Preprocess for the
+// default behavior.
+func PreprocessWithOptions(p Preprocessor, o PreprocessOptions) (*CTMData, error) {
+	tiles, err := o.tiles(p)
+	if err != nil {
+		return nil, err
+	}
+	if o.TempDir != "" {
+		if err := os.MkdirAll(o.TempDir, 0755); err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing: creating TempDir: %v", err)
+		}
+	}
+
+	// results holds the data for the whole domain.
+	results := make(map[string]*sparse.DenseArray)
+	for _, t := range tiles {
+		// in holds the data for tile t.
+		in := make(map[string]*sparse.DenseArray)
+		for _, stage := range preprocStages {
+			if err := o.runStage(p, t, stage, in); err != nil {
+				return nil, err
+			}
+		}
+		for _, stage := range preprocStages {
+			for _, g := range stage {
+				for _, v := range g.vars {
+					d := in[v.name]
+					if t.whole {
+						results[v.name] = d
+						continue
+					}
+					if _, ok := results[v.name]; !ok {
+						shape := append([]int{}, d.Shape...)
+						shape[len(shape)-2] = t.ny
+						if v.dims[len(v.dims)-2] == "yStagger" {
+							shape[len(shape)-2]++
+						}
+						results[v.name] = sparse.ZerosDense(shape...)
+					}
+					insertRows(results[v.name], d, t.j0)
+				}
+			}
+		}
+	}
+
+	data := new(CTMData)
+	for _, stage := range preprocStages {
+		for _, g := range stage {
+			for _, v := range g.vars {
+				data.AddVariable(v.name, v.dims, v.description, v.units, results[v.name])
+			}
+		}
+	}
+
+	if o.TempDir != "" {
+		for _, t := range tiles {
+			for _, stage := range preprocStages {
+				for _, g := range stage {
+					if err := os.Remove(t.tempFile(o.TempDir, g)); err != nil && !os.IsNotExist(err) {
+						return nil, fmt.Errorf("inmap: preprocessing: removing intermediate file: %v", err)
+					}
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// runStage calculates the variable groups in stage for tile t and
+// adds the results to in, running up to o.Concurrency groups at a time.
+func (o PreprocessOptions) runStage(p Preprocessor, t preprocTile, stage []preprocGroup, in map[string]*sparse.DenseArray) error {
+	n := o.Concurrency
+	if n <= 0 || n > len(stage) {
+		n = len(stage)
+	}
+	sem := make(chan struct{}, n) // semaphore pattern
+	type result struct {
+		g    preprocGroup
+		data []*sparse.DenseArray
+		err  error
+	}
+	resultChan := make(chan result)
+	for _, g := range stage {
+		go func(g preprocGroup) {
+			sem <- struct{}{}
+			data, err := o.runGroup(p, t, g, in)
+			<-sem
+			resultChan <- result{g: g, data: data, err: err}
+		}(g)
+	}
+	// Wait for all of the groups to finish before returning any error
+	// so that the results of the others can be saved.
+	results := make([]result, len(stage))
+	var err error
+	for i := range stage {
+		results[i] = <-resultChan
+		if results[i].err != nil && err == nil {
+			err = results[i].err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		for i, v := range r.g.vars {
+			in[v.name] = r.data[i]
+		}
+	}
+	return nil
+}
+
+// runGroup calculates variable group g for tile t, or loads it from
+// o.TempDir if it has already been calculated.
+func (o PreprocessOptions) runGroup(p Preprocessor, t preprocTile, g preprocGroup, in map[string]*sparse.DenseArray) ([]*sparse.DenseArray, error) {
+	t.group = g.name
+	var fileName string
+	if o.TempDir != "" {
+		fileName = t.tempFile(o.TempDir, g)
+		data, err := t.loadTemp(fileName, g)
+		if err == nil {
+			t.message("Preprocessing %v: loaded from %s", t, fileName)
+			return data, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	data, err := g.calc(p, t, in)
+	if err != nil {
+		return nil, err
+	}
+	t.message("Preprocessing %v: finished in %v", t, time.Since(start))
+	if fileName != "" {
+		if err := t.saveTemp(fileName, g, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// preprocTemp holds the results for a variable group and tile,
+// saved so that preprocessing can be resumed.
+type preprocTemp struct {
+	Group      string
+	J0, J1, Ny int
+	Shapes     [][]int
+	Elements   [][]float64
+}
+
+// tempFile returns the path of the file in dir where the results for
+// variable group g and tile t are saved.
+func (t preprocTile) tempFile(dir string, g preprocGroup) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_rows%d-%d.gob", g.vars[0].name, t.j0, t.j1))
+}
+
+// saveTemp saves data for variable group g and tile t to a gob file at
+// fileName, writing to a temporary file first so that an incomplete file
+// is not left behind if preprocessing is interrupted.
+func (t preprocTile) saveTemp(fileName string, g preprocGroup, data []*sparse.DenseArray) error {
+	tmp := preprocTemp{Group: g.name, J0: t.j0, J1: t.j1, Ny: t.ny}
+	for _, d := range data {
+		tmp.Shapes = append(tmp.Shapes, d.Shape)
+		tmp.Elements = append(tmp.Elements, d.Elements)
+	}
+	tmpName := fileName + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("inmap: preprocessing: creating intermediate file: %v", err)
+	}
+	if err := gob.NewEncoder(f).Encode(tmp); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: preprocessing: writing intermediate file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("inmap: preprocessing: writing intermediate file: %v", err)
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return fmt.Errorf("inmap: preprocessing: writing intermediate file: %v", err)
+	}
+	return nil
+}
+
+// loadTemp loads the data for variable group g and tile t that was
+// saved by saveTemp. An error satisfying os.IsNotExist is returned if
+// the file does not exist.
+func (t preprocTile) loadTemp(fileName string, g preprocGroup) ([]*sparse.DenseArray, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tmp preprocTemp
+	if err := gob.NewDecoder(f).Decode(&tmp); err != nil {
+		return nil, fmt.Errorf("inmap: preprocessing: reading intermediate file %s: %v", fileName, err)
+	}
+	if tmp.Group != g.name || tmp.J0 != t.j0 || tmp.J1 != t.j1 || tmp.Ny != t.ny || len(tmp.Shapes) != len(g.vars) {
+		return nil, fmt.Errorf("inmap: preprocessing: intermediate file %s does not match the current "+
+			"configuration; remove it to start over", fileName)
+	}
+	data := make([]*sparse.DenseArray, len(tmp.Shapes))
+	for i, shape := range tmp.Shapes {
+		data[i] = sparse.ZerosDense(shape...)
+		if len(tmp.Elements[i]) != len(data[i].Elements) {
+			return nil, fmt.Errorf("inmap: preprocessing: intermediate file %s is corrupted", fileName)
+		}
+		copy(data[i].Elements, tmp.Elements[i])
+	}
+	return data, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+// failTPreprocessor is a Preprocessor that fails when
+// temperature is read, for testing resuming preprocessing.
+type failTPreprocessor struct {
+	Preprocessor
+}
+
+func (failTPreprocessor) T() NextData {
+	return func() (*sparse.DenseArray, error) {
+		return nil, fmt.Errorf("testing interruption")
+	}
+}
+
+// collectMessages returns a channel that collects messages, and a
+// function that closes the channel and returns the messages.
+func collectMessages() (chan string, func() []string) {
+	msgChan := make(chan string)
+	done := make(chan struct{})
+	var msgs []string
+	go func() {
+		for m := range msgChan {
+			msgs = append(msgs, m)
+		}
+		close(done)
+	}()
+	return msgChan, func() []string {
+		close(msgChan)
+		<-done
+		return msgs
+	}
+}
+
+func TestPreprocessWithOptions(t *testing.T) {
+	const tolerance = 1.0e-10
+
+	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Preprocess(wrf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tiles", func(t *testing.T) {
+		msgChan, messages := collectMessages()
+		have, err := PreprocessWithOptions(wrf, PreprocessOptions{TileRows: 1, Concurrency: 2, MsgChan: msgChan})
+		msgs := messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareCTMData(want, have, tolerance, t)
+		var steps, finished bool
+		for _, m := range msgs {
+			steps = steps || strings.Contains(m, "wind speed (tile 1 of") && strings.Contains(m, "time step 1")
+			finished = finished || strings.Contains(m, "finished")
+		}
+		if !steps || !finished {
+			t.Errorf("missing progress messages: %v", msgs)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "inmap_preprocess")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		o := PreprocessOptions{TileRows: 1, TempDir: dir}
+		if _, err = PreprocessWithOptions(failTPreprocessor{wrf}, o); err == nil {
+			t.Fatal("expected an error")
+		}
+		saved, err := filepath.Glob(filepath.Join(dir, "*.gob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved) == 0 {
+			t.Fatal("no intermediate files were saved")
+		}
+
+		msgChan, messages := collectMessages()
+		o.MsgChan = msgChan
+		have, err := PreprocessWithOptions(wrf, o)
+		msgs := messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareCTMData(want, have, tolerance, t)
+		var loaded int
+		for _, m := range msgs {
+			if strings.Contains(m, "loaded from") {
+				loaded++
+			}
+		}
+		if loaded != len(saved) {
+			t.Errorf("loaded %d intermediate files but %d were saved", loaded, len(saved))
+		}
+		remaining, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(remaining) != 0 {
+			t.Errorf("intermediate files were not removed: %v", remaining)
+		}
+	})
+}
+
+func TestCropInsertRows(t *testing.T) {
+	d := sparse.ZerosDense(2, 5, 3)
+	for i := range d.Elements {
+		d.Elements[i] = float64(i)
+	}
+	o := sparse.ZerosDense(2, 5, 3)
+	for _, rows := range [][2]int{{0, 2}, {2, 4}, {4, 5}} {
+		c := cropRows(d, rows[0], rows[1])
+		if c.Shape[1] != rows[1]-rows[0] {
+			t.Errorf("rows %v: shape %v", rows, c.Shape)
+		}
+		if have, want := c.Get(1, 0, 2), d.Get(1, rows[0], 2); have != want {
+			t.Errorf("rows %v: have %g, want %g", rows, have, want)
+		}
+		insertRows(o, c, rows[0])
+	}
+	arrayCompare(o, d, 0, "insertRows", t)
+}
@@ -24,6 +24,7 @@ import (
 	"math"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 )
@@ -59,8 +60,10 @@ var baselinePolLabels = map[string]struct {
 	"BaselinePNO3":      {[]int{ipNO}, []float64{NtoNO3}},
 }
 
-// ResetCells clears concentration and emissions information from all of the
-// grid cells and boundary cells.
+// ResetCells clears concentration, emissions, and deposition information
+// from all of the grid cells and boundary cells, reapplies the boundary
+// conditions if they have been set (see SetBoundaryConditions), and restarts
+// the mass budget if it is being tracked.
 func ResetCells() DomainManipulator {
 	return func(d *InMAP) error {
 		for _, g := range []*cellList{d.cells, d.westBoundary, d.eastBoundary,
@@ -69,36 +72,84 @@ func ResetCells() DomainManipulator {
 				c.Ci = make([]float64, len(PolNames))
 				c.Cf = make([]float64, len(PolNames))
 				c.EmisFlux = make([]float64, len(PolNames))
+				c.emisFluxProfiles = nil
+				c.Deposition = nil
+				for i := range c.TagCi {
+					c.TagCi[i] = make([]float64, len(PolNames))
+					c.TagCf[i] = make([]float64, len(PolNames))
+					c.TagDeposition[i] = nil
+				}
+				for i := range c.TagEmisFlux {
+					c.TagEmisFlux[i] = make([]float64, len(PolNames))
+					c.tagEmisFluxProfiles[i] = nil
+				}
 			}
 		}
+		for _, g := range d.boundaries() {
+			for _, c := range *g {
+				d.setBoundaryConcentrations(c)
+			}
+		}
+		if d.budget != nil {
+			return TrackBudget(d.budget.m, d.budget.reportInterval)(d)
+		}
 		return nil
 	}
 }
 
 // Calculations returns a function that concurrently runs a series of calculations
 // on all of the model grid cells.
+//
+// The grid is divided into spatial partitions (see InMAP.partitions), which are
+// distributed among GOMAXPROCS goroutines. Concentrations are double-buffered:
+// calculators may read the initial concentrations (Ci) of any cell, but
+// may only modify the final concentrations (Cf) of the cell they are
+// operating on and of any boundary cells adjacent to it. Ci is only updated
+// to match Cf by AddEmissionsFlux, which must therefore be run in a separate
+// call to Calculations. Because each cell is only modified by a single
+// goroutine and never depends on values being modified by other goroutines,
+// no locking is required within a time step and the results do not depend on
+// the number of processors or the order in which the partitions are processed.
+//
+// If source tags are being tracked (see TrackTags), the calculations are
+// repeated for the concentrations and emissions of each tag.
 func Calculations(calculators ...CellManipulator) DomainManipulator {
 	nprocs := runtime.GOMAXPROCS(0) // number of processors
 	var wg sync.WaitGroup
 
 	return func(d *InMAP) error {
-		// Concurrently run all of the calculators on all of the cells.
-		wg.Add(nprocs)
-		for pp := 0; pp < nprocs; pp++ {
-			go func(pp int) {
-				for i := pp; i < d.cells.len(); i += nprocs {
-					c := (*d.cells)[i]
-					c.mutex.Lock() // Lock the cell to avoid race conditions
-					// run functions
-					for _, f := range calculators {
-						f(c.Cell, d.Dt)
+		d.cellLock.Lock()
+		defer d.cellLock.Unlock()
+
+		partitions := d.partitions()
+		calculate := func() {
+			var next int64 = -1 // index of the most recently started partition
+			wg.Add(nprocs)
+			for pp := 0; pp < nprocs; pp++ {
+				go func() {
+					for {
+						i := int(atomic.AddInt64(&next, 1))
+						if i >= len(partitions) {
+							break
+						}
+						for _, c := range partitions[i] {
+							for _, f := range calculators {
+								f(c, d.Dt)
+							}
+						}
 					}
-					c.mutex.Unlock() // Unlock the cell: we're done editing it
-				}
-				wg.Done()
-			}(pp)
+					wg.Done()
+				}()
+			}
+			wg.Wait()
+		}
+		calculate()
+		// Repeat the calculations for each source tag being tracked.
+		for t := range d.tags {
+			d.swapTag(t)
+			calculate()
+			d.swapTag(t)
 		}
-		wg.Wait()
 		return nil
 	}
 }
@@ -154,13 +205,6 @@ func SteadyStateConvergenceCheck(numIterations int, popGridColumn string, m Mech
 	const tolerance = 0.001         // tolerance for convergence
 	const checkPeriod = 60 * 60 * 3 // seconds, how often to check for convergence
 
-	// oldSum is the sum of mass or population-weighted concentration
-	// in the domain at the last check.
-	oldSum := make([]float64, m.Len()*2)
-
-	timeSinceLastCheck := 0.
-	iteration := 0
-
 	return func(d *InMAP) error {
 		popIndex := d.PopIndices[popGridColumn]
 
@@ -168,46 +212,42 @@ func SteadyStateConvergenceCheck(numIterations int, popGridColumn string, m Mech
 			return fmt.Errorf("inmap: timestep is zero")
 		}
 
-		timeSinceLastCheck += d.Dt
-		iteration++
+		// The convergence state is stored in d so that it can be
+		// saved in checkpoints.
+		if d.convergence == nil {
+			d.convergence = &convergenceState{OldSum: make([]float64, m.Len()*2)}
+		}
+		oldSum := d.convergence.OldSum
+
+		d.convergence.TimeSinceLastCheck += d.Dt
+		d.convergence.Iteration++
 		// If NumIterations has been set, used it to determine when to
 		// stop the model.
 		if numIterations > 0 {
-			if iteration >= numIterations {
+			if d.convergence.Iteration >= numIterations {
 				d.Done = true
 			}
 			// Otherwise, occasionally check to see if the pollutant
 			// concentrations have converged
-		} else if timeSinceLastCheck >= checkPeriod {
+		} else if d.convergence.TimeSinceLastCheck >= checkPeriod {
 			timeToQuit := true
-			timeSinceLastCheck = 0.
+			d.convergence.TimeSinceLastCheck = 0.
 
 			status := ConvergenceStatus{
 				data: make([]float64, m.Len()*2),
 				m:    m,
 			}
+			sums := d.concentrationSums(m, popIndex)
 			for ii := 0; ii < m.Len(); ii++ {
-				var sum, bias float64
-				var converged bool
-				// calculate total mass.
-				for _, c := range *d.cells {
-					sum += c.Cf[ii] * c.Volume
-				}
-				if bias, converged = checkConvergence(sum, oldSum[ii*2], tolerance); !converged {
-					timeToQuit = false
-				}
-				status.data[ii*2] = bias
-				oldSum[ii*2] = sum
-				sum = 0
-				// Calculate population-weighted concentration.
-				for _, c := range *d.cells {
-					sum += c.Cf[ii] * c.PopData[popIndex]
-				}
-				if bias, converged = checkConvergence(sum, oldSum[ii*2+1], tolerance); !converged {
-					timeToQuit = false
+				// Check total mass and population-weighted concentration.
+				for _, j := range []int{ii * 2, ii*2 + 1} {
+					bias, converged := checkConvergence(sums[j], oldSum[j], tolerance)
+					if !converged {
+						timeToQuit = false
+					}
+					status.data[j] = bias
+					oldSum[j] = sums[j]
 				}
-				status.data[ii*2+1] = bias
-				oldSum[ii*2+1] = sum
 			}
 			if c != nil {
 				c <- status
@@ -220,6 +260,20 @@ func SteadyStateConvergenceCheck(numIterations int, popGridColumn string, m Mech
 	}
 }
 
+// convergenceState holds the progress of SteadyStateConvergenceCheck.
+type convergenceState struct {
+	// Iteration is the number of time steps that have been completed.
+	Iteration int
+
+	// TimeSinceLastCheck is the simulation time in seconds since
+	// convergence was last checked.
+	TimeSinceLastCheck float64
+
+	// OldSum is the sum of mass or population-weighted concentration
+	// for each species in the domain at the last check.
+	OldSum []float64
+}
+
 func checkConvergence(newSum, oldSum, tolerance float64) (float64, bool) {
 	bias := (newSum - oldSum) / oldSum
 	if math.Abs(bias) > tolerance || math.IsInf(bias, 0) {
@@ -245,12 +299,24 @@ type SimulationStatus struct {
 
 	// Dt is the timestep in seconds.
 	Dt float64
+
+	// DtLimit describes the process and grid cell that limit Dt.
+	// It is empty if the time step was not set using SetTimestepCFL.
+	DtLimit TimestepLimit
+
+	// Budget is the mass budget of the domain. It is nil unless the
+	// budget is being tracked and is due to be reported (see TrackBudget).
+	Budget *MassBudget
 }
 
 func (s SimulationStatus) String() string {
-	return fmt.Sprintf("iteration %-4d  walltime=%6.3gh  Δwalltime=%4.2gs  "+
+	str := fmt.Sprintf("iteration %-4d  walltime=%6.3gh  Δwalltime=%4.2gs  "+
 		"timestep=%2.0fs  day=%.3g", s.Iteration, s.Walltime.Hours(),
 		s.StepWalltime.Seconds(), s.Dt, s.SimulationDays)
+	if s.DtLimit.Process != "" {
+		str += fmt.Sprintf("  limit=%s", s.DtLimit.Process)
+	}
+	return str
 }
 
 // Log sends simulation status messages to c.
@@ -267,13 +333,18 @@ func Log(c chan *SimulationStatus) DomainManipulator {
 		iteration++
 		nDaysRun += d.Dt * daysPerSecond
 
-		c <- &SimulationStatus{
+		status := &SimulationStatus{
 			Iteration:      iteration,
 			Walltime:       time.Since(startTime),
 			StepWalltime:   time.Since(timeStepTime),
 			Dt:             d.Dt,
 			SimulationDays: nDaysRun,
 		}
+		if limits := d.TimestepLimits(); len(limits) > 0 {
+			status.DtLimit = limits[0]
+		}
+		status.Budget = d.reportBudget(d.Dt)
+		c <- status
 		timeStepTime = time.Now()
 		return nil
 	}
@@ -108,6 +108,12 @@ func (d *InMAP) initFromCells(cells []*Cell, emis *Emissions, config *VarGridCon
 		d.mortIndices[m] = i
 	}
 	for _, c := range cells {
+		// Grids that were saved using a different chemical mechanism
+		// may have a different number of species.
+		if len(c.Ci) != m.Len() {
+			c.Ci = make([]float64, m.Len())
+			c.Cf = make([]float64, m.Len())
+		}
 		d.InsertCell(c, m)
 	}
 
@@ -0,0 +1,420 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package extendedchem contains a simplified atmospheric chemistry mechanism
+// that tracks more species than the mechanism in package simplechem.
+// Nitrogen oxides are tracked as separate NO, NO2, and HNO3 species,
+// so that particulate nitrate formation is limited by the oxidation of
+// NO2, and organic matter is split into anthropogenic and biogenic
+// precursor classes. The rates of the oxidation reactions can be scaled
+// to represent changes in the availability of oxidants such as ozone.
+package extendedchem
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/science/drydep/simpledrydep"
+	"github.com/spatialmodel/inmap/science/wetdep/emepwetdep"
+)
+
+// Mechanism fulfils the github.com/spatialmodel/inmap.Mechanism
+// and github.com/spatialmodel/inmap.DerivedVariableMechanism
+// interfaces.
+type Mechanism struct {
+	// OxidantScale is a factor by which the rates of the
+	// NO titration, NO2 oxidation, and SO2 oxidation
+	// reactions are multiplied, for example to represent
+	// a change in ozone concentrations relative to the baseline.
+	// If OxidantScale is zero, a factor of 1 will be used.
+	OxidantScale float64
+}
+
+func init() {
+	inmap.RegisterMechanism("extendedchem", Mechanism{})
+}
+
+// Configure fulfils the github.com/spatialmodel/inmap.ConfigurableMechanism
+// interface. The only setting is "OxidantScale", which must be positive.
+func (m Mechanism) Configure(settings map[string]string) (inmap.Mechanism, error) {
+	for name, v := range settings {
+		if !strings.EqualFold(name, "OxidantScale") {
+			return nil, fmt.Errorf("extendedchem: invalid setting '%s'; 'OxidantScale' is the only valid setting", name)
+		}
+		scale, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("extendedchem: invalid OxidantScale: %v", err)
+		}
+		if scale <= 0 {
+			return nil, fmt.Errorf("extendedchem: OxidantScale must be positive, not %g", scale)
+		}
+		m.OxidantScale = scale
+	}
+	return m, nil
+}
+
+// physical constants
+const (
+	// Molar masses [grams per mole]
+	mwNOx  = 46.0055 // as NO2
+	mwNO   = 30.0061
+	mwNO2  = 46.0055
+	mwHNO3 = 63.01284
+	mwN    = 14.0067 // g/mol, molar mass of nitrogen
+	mwNO3  = 62.00501
+	mwNH3  = 17.03056
+	mwNH4  = 18.03851
+	mwS    = 32.0655 // g/mol, molar mass of sulfur
+	mwSO2  = 64.0644
+	mwSO4  = 96.0632
+
+	// Chemical mass conversions [ratios]
+	NOxToN  = mwN / mwNOx
+	NOToN   = mwN / mwNO
+	NO2ToN  = mwN / mwNO2
+	NtoNO   = mwNO / mwN
+	NtoNO2  = mwNO2 / mwN
+	NtoHNO3 = mwHNO3 / mwN
+	NtoNO3  = mwNO3 / mwN
+	SOxToS  = mwSO2 / mwS
+	StoSO4  = mwS / mwSO4
+	NH3ToN  = mwN / mwNH3
+	NtoNH4  = mwNH4 / mwN
+
+	// depConversion converts deposition from μg/m²/s to kg/ha/yr.
+	depConversion = 1.e-9 * 1.e4 * 365.25 * 24 * 60 * 60
+)
+
+// Chemistry parameters
+const (
+	// noEmisFraction is the fraction of the nitrogen in NOx emissions
+	// that is emitted as NO, with the remainder emitted as NO2.
+	noEmisFraction = 0.9
+
+	// noLifetime is the lifetime [s] of NO with respect to titration by
+	// ozone to form NO2, at typical boundary layer ozone concentrations.
+	noLifetime = 50.
+
+	// no2OHRatio is the ratio of the rate constant for the
+	// reaction of NO2 with OH to the rate constant for the reaction
+	// of SO2 with OH, which is used to estimate the rate of HNO3 formation
+	// from the baseline SO2 oxidation rate.
+	no2OHRatio = 12.
+)
+
+// Indicies of individual pollutants in arrays.
+const (
+	igOrgA int = iota // anthropogenic VOC
+	ipOrgA            // anthropogenic SOA
+	igOrgB            // biogenic VOC
+	ipOrgB            // biogenic SOA
+	iPM2_5
+	igNH
+	ipNH
+	igS
+	ipS
+	iNO
+	iNO2
+	iHNO3
+	ipNO
+)
+
+// Len returns the number of chemical species in this mechanism (13).
+func (m Mechanism) Len() int {
+	return 13
+}
+
+// oxidantScale returns the factor by which oxidation rates should be multiplied.
+func (m Mechanism) oxidantScale() float64 {
+	if m.OxidantScale == 0 {
+		return 1
+	}
+	return m.OxidantScale
+}
+
+// emisConv lists the accepted names for emissions species, the array
+// indices they correspond to, and the
+// factors needed to convert [μg/s] of emitted species to [μg/s] of
+// model species.
+var emisConv = map[string][]struct {
+	i    int
+	conv float64
+}{
+	"VOC":   {{i: igOrgA, conv: 1}},
+	"BVOC":  {{i: igOrgB, conv: 1}},
+	"NOx":   {{i: iNO, conv: NOxToN * noEmisFraction}, {i: iNO2, conv: NOxToN * (1 - noEmisFraction)}},
+	"NO":    {{i: iNO, conv: NOToN}},
+	"NO2":   {{i: iNO2, conv: NO2ToN}},
+	"NH3":   {{i: igNH, conv: NH3ToN}},
+	"SOx":   {{i: igS, conv: SOxToS}},
+	"PM2_5": {{i: iPM2_5, conv: 1}},
+}
+
+// AddEmisFlux adds emissions flux to Cell c based on the given
+// pollutant name and amount in units of μg/s. The units of
+// the resulting flux are μg/m3/s. NOx emissions (in units of NO2 mass)
+// are split between NO and NO2; VOC emissions are assumed
+// to be anthropogenic, and biogenic VOC emissions can be specified
+// using the name "BVOC".
+func (m Mechanism) AddEmisFlux(c *inmap.Cell, name string, val float64) error {
+	fluxScale := 1. / c.Dx / c.Dy / c.Dz // μg/s /m/m/m = μg/m3/s
+	conv, ok := emisConv[name]
+	if !ok {
+		return fmt.Errorf("extendedchem: '%s' is not a valid emissions species; valid options are VOC, BVOC, NOx, NO, NO2, NH3, SOx, and PM2_5", name)
+	}
+	if c.EmisFlux == nil {
+		c.EmisFlux = make([]float64, m.Len())
+	}
+	for _, cv := range conv {
+		c.EmisFlux[cv.i] += val * cv.conv * fluxScale
+	}
+	return nil
+}
+
+// simpleDryDepIndices provides array indices for use with package simpledrydep.
+func simpleDryDepIndices() (simpledrydep.SOx, simpledrydep.NH3, simpledrydep.NOx, simpledrydep.VOC, simpledrydep.PM25) {
+	return simpledrydep.SOx{igS}, simpledrydep.NH3{igNH}, simpledrydep.NOx{iNO, iNO2, iHNO3},
+		simpledrydep.VOC{igOrgA, igOrgB}, simpledrydep.PM25{ipOrgA, ipOrgB, iPM2_5, ipNH, ipS, ipNO}
+}
+
+// DryDep returns a dry deposition function of the type indicated by
+// name that is compatible with this chemical mechanism.
+// Currently, the only valid option is "simple".
+func (m Mechanism) DryDep(name string) (inmap.CellManipulator, error) {
+	options := map[string]inmap.CellManipulator{
+		"simple": simpledrydep.DryDeposition(simpleDryDepIndices),
+	}
+	f, ok := options[name]
+	if !ok {
+		return nil, fmt.Errorf("extendedchem: invalid dry deposition option %s; 'simple' is the only valid option", name)
+	}
+	return f, nil
+}
+
+// emepWetDepIndices provides array indices for use with package emepwetdep.
+func emepWetDepIndices() (emepwetdep.SO2, emepwetdep.OtherGas, emepwetdep.PM25) {
+	return emepwetdep.SO2{igS}, emepwetdep.OtherGas{igNH, iNO, iNO2, iHNO3, igOrgA, igOrgB},
+		emepwetdep.PM25{ipOrgA, ipOrgB, iPM2_5, ipNH, ipS, ipNO}
+}
+
+// WetDep returns a wet deposition function of the type indicated by
+// name that is compatible with this chemical mechanism.
+// Currently, the only valid option is "emep".
+func (m Mechanism) WetDep(name string) (inmap.CellManipulator, error) {
+	options := map[string]inmap.CellManipulator{
+		"emep": emepwetdep.WetDeposition(emepWetDepIndices),
+	}
+	f, ok := options[name]
+	if !ok {
+		return nil, fmt.Errorf("extendedchem: invalid wet deposition option %s; 'emep' is the only valid option", name)
+	}
+	return f, nil
+}
+
+// Species returns the names of the emission and concentration pollutant
+// species that are used by this chemical mechanism, in the order they
+// are stored in the concentration arrays.
+func (m Mechanism) Species() []string {
+	return []string{
+		"AVOC",
+		"ASOA",
+		"BVOC",
+		"BSOA",
+		"PrimaryPM25",
+		"NH3",
+		"pNH4",
+		"SOx",
+		"pSO4",
+		"NO",
+		"NO2",
+		"HNO3",
+		"pNO3",
+	}
+}
+
+// DerivedVariables returns the names of variables that are
+// calculated from more than one species. They are named consistently
+// with the species and deposition variables in package simplechem so that
+// the same output variable expressions can be used with both mechanisms.
+func (m Mechanism) DerivedVariables() []string {
+	return []string{"VOC", "SOA", "NOx", "TotalPM25",
+		"SDryDep", "SWetDep", "SDep", "NDryDep", "NWetDep", "NDep"}
+}
+
+var emisLabels = map[string][]int{
+	"VOCEmissions":  {igOrgA},
+	"BVOCEmissions": {igOrgB},
+	"NOxEmissions":  {iNO, iNO2},
+	"NH3Emissions":  {igNH},
+	"SOxEmissions":  {igS},
+	"PM25Emissions": {iPM2_5},
+}
+
+// polLabels are labels and conversions for InMAP pollutants.
+var polLabels = map[string]struct {
+	index      []int     // index in concentration array
+	conversion []float64 // conversion from N to NH4, S to SO4, etc...
+}{
+	"TotalPM25": {[]int{iPM2_5, ipOrgA, ipOrgB, ipNH, ipS, ipNO},
+		[]float64{1, 1, 1, NtoNH4, StoSO4, NtoNO3}},
+	"VOC":         {[]int{igOrgA, igOrgB}, []float64{1, 1}},
+	"SOA":         {[]int{ipOrgA, ipOrgB}, []float64{1, 1}},
+	"AVOC":        {[]int{igOrgA}, []float64{1}},
+	"ASOA":        {[]int{ipOrgA}, []float64{1}},
+	"BVOC":        {[]int{igOrgB}, []float64{1}},
+	"BSOA":        {[]int{ipOrgB}, []float64{1}},
+	"PrimaryPM25": {[]int{iPM2_5}, []float64{1}},
+	"NH3":         {[]int{igNH}, []float64{1. / NH3ToN}},
+	"pNH4":        {[]int{ipNH}, []float64{NtoNH4}},
+	"SOx":         {[]int{igS}, []float64{1. / SOxToS}},
+	"pSO4":        {[]int{ipS}, []float64{StoSO4}},
+	"NOx":         {[]int{iNO, iNO2}, []float64{1. / NOxToN, 1. / NOxToN}},
+	"NO":          {[]int{iNO}, []float64{NtoNO}},
+	"NO2":         {[]int{iNO2}, []float64{NtoNO2}},
+	"HNO3":        {[]int{iHNO3}, []float64{NtoHNO3}},
+	"pNO3":        {[]int{ipNO}, []float64{NtoNO3}},
+}
+
+// depLabels are labels for the average rates of sulfur and nitrogen
+// deposition, which are the sums of the deposition of the species that
+// contain sulfur and nitrogen by the given processes.
+var depLabels = map[string]struct {
+	process []inmap.BudgetProcess
+	index   []int // index in concentration array
+}{
+	"SDryDep": {[]inmap.BudgetProcess{inmap.DryDepositionBudget}, []int{igS, ipS}},
+	"SWetDep": {[]inmap.BudgetProcess{inmap.WetDepositionBudget}, []int{igS, ipS}},
+	"SDep":    {[]inmap.BudgetProcess{inmap.DryDepositionBudget, inmap.WetDepositionBudget}, []int{igS, ipS}},
+	"NDryDep": {[]inmap.BudgetProcess{inmap.DryDepositionBudget}, []int{igNH, ipNH, iNO, iNO2, iHNO3, ipNO}},
+	"NWetDep": {[]inmap.BudgetProcess{inmap.WetDepositionBudget}, []int{igNH, ipNH, iNO, iNO2, iHNO3, ipNO}},
+	"NDep":    {[]inmap.BudgetProcess{inmap.DryDepositionBudget, inmap.WetDepositionBudget}, []int{igNH, ipNH, iNO, iNO2, iHNO3, ipNO}},
+}
+
+// Value returns the concentration, emissions, or deposition value of
+// the given variable in the given Cell. Deposition values are
+// average deposition rates over the course of the simulation in units of
+// kg of sulfur or nitrogen per hectare per year; for ground-level
+// cells, wet deposition includes the deposition from the cells above them
+// (see inmap.Cell.DepositionRate). It returns an
+// error if given an invalid variable name.
+func (m Mechanism) Value(c *inmap.Cell, variable string) (float64, error) {
+	if ii, ok := emisLabels[variable]; ok {
+		var val float64
+		if c.EmisFlux != nil {
+			for _, i := range ii {
+				val += c.EmisFlux[i]
+			}
+		}
+		return val, nil
+	}
+	if dep, ok := depLabels[variable]; ok {
+		var val float64
+		for _, p := range dep.process {
+			for _, i := range dep.index {
+				val += c.DepositionRate(p, i)
+			}
+		}
+		return val * depConversion, nil
+	}
+	conv, ok := polLabels[variable]
+	if !ok {
+		return math.NaN(), fmt.Errorf("extendedchem: invalid variable name %s; valid names are %v and %v",
+			variable, m.Species(), m.DerivedVariables())
+	}
+	var val float64
+	for ii, i := range conv.index {
+		val += c.Cf[i] * conv.conversion[ii]
+	}
+	return val, nil
+}
+
+// Units returns the units of the given variable, or an
+// error if the variable name is invalid.
+func (m Mechanism) Units(variable string) (string, error) {
+	if _, ok := emisLabels[variable]; ok {
+		return "μg/m³/s", nil
+	}
+	if _, ok := depLabels[variable]; ok {
+		return "kg/ha/yr", nil
+	}
+	if _, ok := polLabels[variable]; !ok {
+		return "", fmt.Errorf("extendedchem: invalid variable name %s; valid names are %v and %v",
+			variable, m.Species(), m.DerivedVariables())
+	}
+	return "μg/m³", nil
+}
+
+// Chemistry returns a function that calculates the secondary formation of PM2.5.
+// It explicitly calculates the formation of particulate sulfate
+// from gaseous and aqueous SO2, the titration of NO to NO2 by ozone, and
+// the oxidation of NO2 to HNO3, with the rates of all three reactions
+// multiplied by OxidantScale.
+// Particulate nitrate is formed from HNO3 based on the spatially explicit
+// partitioning of total nitrogen oxides in the baseline data,
+// but limited by the amount of HNO3 that is available.
+// Ammonia is partitioned between gaseous and particulate phase, and
+// anthropogenic and biogenic organic matter are each partitioned between
+// VOC and SOA, based on the spatially explicit partitioning present in the
+// baseline data.
+func (m Mechanism) Chemistry() inmap.CellManipulator {
+	ox := m.oxidantScale()
+	return func(c *inmap.Cell, Δt float64) {
+		// All SO4 forms particles, so sulfur particle formation is limited by the
+		// SO2 -> SO4 reaction.
+		transfer(c, igS, ipS, c.Cf[igS]*(1-math.Exp(-ox*c.SO2oxidation*Δt)))
+
+		// NH3 / pNH4 partitioning
+		partition(c, igNH, ipNH, c.NHPartitioning)
+
+		// NO + O3 -> NO2
+		transfer(c, iNO, iNO2, c.Cf[iNO]*(1-math.Exp(-ox*Δt/noLifetime)))
+
+		// NO2 + OH -> HNO3
+		transfer(c, iNO2, iHNO3, c.Cf[iNO2]*(1-math.Exp(-ox*no2OHRatio*c.SO2oxidation*Δt)))
+
+		// HNO3 / pNO3 partitioning
+		totalNO := c.Cf[iNO] + c.Cf[iNO2] + c.Cf[iHNO3] + c.Cf[ipNO]
+		nitrate := c.Cf[iHNO3] + c.Cf[ipNO]
+		transfer(c, iHNO3, ipNO, math.Min(totalNO*c.NOPartitioning, nitrate)-c.Cf[ipNO])
+
+		// VOC/SOA partitioning
+		partition(c, igOrgA, ipOrgA, c.AOrgPartitioning)
+		partition(c, igOrgB, ipOrgB, c.BOrgPartitioning)
+	}
+}
+
+// transfer moves mass Δ from the species with index from to the species
+// with index to in c, and records the change in mass of each species in
+// the mass budget of c.
+func transfer(c *inmap.Cell, from, to int, Δ float64) {
+	c.Cf[from] -= Δ
+	c.Cf[to] += Δ
+	c.AddToBudget(inmap.ChemistryBudget, from, -Δ)
+	c.AddToBudget(inmap.ChemistryBudget, to, Δ)
+}
+
+// partition partitions the total mass of the gas-phase species with index
+// ig and the particle-phase species with index ip in c so that fraction
+// particleFrac is in the particle phase, and records the change in
+// mass of each species in the mass budget of c.
+func partition(c *inmap.Cell, ig, ip int, particleFrac float64) {
+	transfer(c, ig, ip, (c.Cf[ig]+c.Cf[ip])*particleFrac-c.Cf[ip])
+}
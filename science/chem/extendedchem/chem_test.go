@@ -0,0 +1,233 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package extendedchem
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/spatialmodel/inmap"
+)
+
+const E = 1000000. // emissions
+
+// runChemistry runs nSteps time steps of emissions and chemistry
+// and returns the first grid cell.
+func runChemistry(t *testing.T, m Mechanism, nSteps int) (*inmap.InMAP, *inmap.Cell) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			inmap.TrackBudget(m, 0),
+			inmap.SetTimestepCFL(),
+		},
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.Calculations(m.Chemistry()),
+			inmap.SteadyStateConvergenceCheck(nSteps, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return d, d.Cells()[0]
+}
+
+// Test whether mass is conserved during chemical reactions.
+func TestChemistry(t *testing.T) {
+	const testTolerance = 1.e-8
+	m := Mechanism{}
+	d, c := runChemistry(t, m, 1)
+
+	sum := 0.
+	sum += c.Cf[igOrgA] + c.Cf[ipOrgA] + c.Cf[igOrgB] + c.Cf[ipOrgB]
+	sum += (c.Cf[iNO] + c.Cf[iNO2] + c.Cf[iHNO3] + c.Cf[ipNO]) / NOxToN
+	sum += (c.Cf[igNH] + c.Cf[ipNH]) / NH3ToN
+	sum += (c.Cf[igS] + c.Cf[ipS]) / SOxToS
+	sum += c.Cf[iPM2_5]
+	sum *= c.Volume
+
+	if c.Cf[ipOrgA] == 0 || c.Cf[ipS] == 0 || c.Cf[ipNH] == 0 || c.Cf[iNO2] == 0 || c.Cf[iHNO3]+c.Cf[ipNO] == 0 {
+		t.Error("chemistry appears not to have occured")
+	}
+	if different(sum, 5*E*d.Dt, testTolerance) {
+		t.Errorf("mass is not conserved: %g != %g", sum, 5*E*d.Dt)
+	}
+
+	// Derived variables should be the sum of their components.
+	for derived, components := range map[string][]string{
+		"VOC": {"AVOC", "BVOC"},
+		"SOA": {"ASOA", "BSOA"},
+	} {
+		v, err := m.Value(c, derived)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want float64
+		for _, comp := range components {
+			vv, err := m.Value(c, comp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want += vv
+		}
+		if v != want {
+			t.Errorf("%s: have %g, want %g", derived, v, want)
+		}
+	}
+	nox, err := m.Value(c, "NOx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (c.Cf[iNO] + c.Cf[iNO2]) / NOxToN; different(nox, want, testTolerance) {
+		t.Errorf("NOx: have %g, want %g", nox, want)
+	}
+	if _, err = m.Value(c, "xxxxx"); err == nil {
+		t.Error("should be an error")
+	}
+}
+
+// Test whether the changes caused by chemistry are recorded
+// in the mass budget.
+func TestChemistryBudget(t *testing.T) {
+	const testTolerance = 1.e-8
+	d, _ := runChemistry(t, Mechanism{}, 10)
+	b := d.Budget()
+	var totalEmis, totalChem float64
+	for i := range b.Species {
+		totalEmis += b.Emissions[i]
+		totalChem += b.Chemistry[i]
+	}
+	if totalEmis <= 0 {
+		t.Fatalf("emissions should be greater than zero: %g", totalEmis)
+	}
+	if math.Abs(totalChem) > totalEmis*testTolerance {
+		t.Errorf("chemistry should not change the total mass: %g", totalChem)
+	}
+	for _, i := range []int{ipS, ipNH, ipOrgA} {
+		if b.Chemistry[i] <= 0 {
+			t.Errorf("%s: chemical formation %g should be greater than zero", b.Species[i], b.Chemistry[i])
+		}
+	}
+	for _, i := range []int{igS, iNO} {
+		if b.Chemistry[i] >= 0 {
+			t.Errorf("%s: chemical loss %g should be less than zero", b.Species[i], b.Chemistry[i])
+		}
+	}
+	for i, s := range b.Species {
+		if math.Abs(b.Residual[i]) > totalEmis*testTolerance {
+			t.Errorf("%s: residual %g should be zero", s, b.Residual[i])
+		}
+	}
+}
+
+// Test whether increasing the oxidant concentration increases the formation
+// of HNO3 and particulate sulfate and decreases NO.
+func TestOxidantScale(t *testing.T) {
+	_, base := runChemistry(t, Mechanism{}, 10)
+	_, high := runChemistry(t, Mechanism{OxidantScale: 2}, 10)
+
+	for _, i := range []int{iHNO3, ipS} {
+		if high.Cf[i] <= base.Cf[i] {
+			t.Errorf("species %d: increased oxidants (%g) should cause greater concentration than baseline (%g)",
+				i, high.Cf[i], base.Cf[i])
+		}
+	}
+	if high.Cf[iNO] >= base.Cf[iNO] {
+		t.Errorf("increased oxidants should decrease NO: %g >= %g", high.Cf[iNO], base.Cf[iNO])
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	m, err := Mechanism{}.Configure(map[string]string{"oxidantscale": "1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := m.(Mechanism).OxidantScale; have != 1.5 {
+		t.Errorf("OxidantScale: have %g, want 1.5", have)
+	}
+	for _, settings := range []map[string]string{
+		{"OxidantScale": "0"},
+		{"OxidantScale": "x"},
+		{"NOxScale": "1"},
+	} {
+		if _, err := (Mechanism{}).Configure(settings); err == nil {
+			t.Errorf("%v: expected an error", settings)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	m, err := inmap.GetMechanism("extendedchem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(Mechanism); !ok {
+		t.Errorf("wrong mechanism type %T", m)
+	}
+	if _, err := inmap.GetMechanism("xxxx"); err == nil {
+		t.Error("should be an error")
+	}
+	if len(m.Species()) != m.Len() {
+		t.Errorf("number of species %d != %d", len(m.Species()), m.Len())
+	}
+}
+
+func TestUnits(t *testing.T) {
+	m := Mechanism{}
+	u, err := m.Units("NOxEmissions")
+	if err != nil {
+		t.Error(err)
+	}
+	if u != "μg/m³/s" {
+		t.Errorf("want: 'μg/m³/s'; have '%s'", u)
+	}
+	u, err = m.Units("HNO3")
+	if err != nil {
+		t.Error(err)
+	}
+	if u != "μg/m³" {
+		t.Errorf("want: 'μg/m³'; have '%s'", u)
+	}
+	_, err = m.Units("xxxx")
+	if err == nil {
+		t.Error("should be an error")
+	}
+}
+
+func different(a, b, tolerance float64) bool {
+	if 2*math.Abs(a-b)/math.Abs(a+b) > tolerance || math.IsNaN(a) || math.IsNaN(b) {
+		return true
+	}
+	return false
+}
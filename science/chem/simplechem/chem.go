@@ -29,9 +29,14 @@ import (
 )
 
 // Mechanism fulfils the github.com/spatialmodel/inmap.Mechanism
-// interface.
+// and github.com/spatialmodel/inmap.DerivedVariableMechanism
+// interfaces.
 type Mechanism struct{}
 
+func init() {
+	inmap.RegisterMechanism("simplechem", Mechanism{})
+}
+
 // physical constants
 const (
 	// Molar masses [grams per mole]
@@ -51,6 +56,9 @@ const (
 	StoSO4 = mwS / mwSO4
 	NH3ToN = mwN / mwNH3
 	NtoNH4 = mwNH4 / mwN
+
+	// depConversion converts deposition from μg/m²/s to kg/ha/yr.
+	depConversion = 1.e-9 * 1.e4 * 365.25 * 24 * 60 * 60
 )
 
 // Indicies of individual pollutants in arrays.
@@ -162,6 +170,13 @@ func (m Mechanism) Species() []string {
 	}
 }
 
+// DerivedVariables returns the names of the sulfur and nitrogen deposition
+// variables, which are calculated from the deposition of more than one
+// species.
+func (m Mechanism) DerivedVariables() []string {
+	return []string{"SDryDep", "SWetDep", "SDep", "NDryDep", "NWetDep", "NDep"}
+}
+
 var emisLabels = map[string]int{
 	"VOCEmissions":  igOrg,
 	"NOxEmissions":  igNO,
@@ -188,8 +203,27 @@ var polLabels = map[string]struct {
 	"pNO3":        {[]int{ipNO}, []float64{NtoNO3}},
 }
 
-// Value returns the concentration or emissions value of
-// the given variable in the given Cell. It returns an
+// depLabels are labels for the average rates of sulfur and nitrogen
+// deposition, which are the sums of the deposition of the species that
+// contain sulfur and nitrogen by the given processes.
+var depLabels = map[string]struct {
+	process []inmap.BudgetProcess
+	index   []int // index in concentration array
+}{
+	"SDryDep": {[]inmap.BudgetProcess{inmap.DryDepositionBudget}, []int{igS, ipS}},
+	"SWetDep": {[]inmap.BudgetProcess{inmap.WetDepositionBudget}, []int{igS, ipS}},
+	"SDep":    {[]inmap.BudgetProcess{inmap.DryDepositionBudget, inmap.WetDepositionBudget}, []int{igS, ipS}},
+	"NDryDep": {[]inmap.BudgetProcess{inmap.DryDepositionBudget}, []int{igNH, ipNH, igNO, ipNO}},
+	"NWetDep": {[]inmap.BudgetProcess{inmap.WetDepositionBudget}, []int{igNH, ipNH, igNO, ipNO}},
+	"NDep":    {[]inmap.BudgetProcess{inmap.DryDepositionBudget, inmap.WetDepositionBudget}, []int{igNH, ipNH, igNO, ipNO}},
+}
+
+// Value returns the concentration, emissions, or deposition value of
+// the given variable in the given Cell. Deposition values are
+// average deposition rates over the course of the simulation in units of
+// kg of sulfur or nitrogen per hectare per year; for ground-level
+// cells, wet deposition includes the deposition from the cells above them
+// (see inmap.Cell.DepositionRate). It returns an
 // error if given an invalid variable name.
 func (m Mechanism) Value(c *inmap.Cell, variable string) (float64, error) {
 	i, ok := emisLabels[variable]
@@ -199,9 +233,19 @@ func (m Mechanism) Value(c *inmap.Cell, variable string) (float64, error) {
 		}
 		return 0, nil
 	}
+	if dep, ok := depLabels[variable]; ok {
+		var val float64
+		for _, p := range dep.process {
+			for _, i := range dep.index {
+				val += c.DepositionRate(p, i)
+			}
+		}
+		return val * depConversion, nil
+	}
 	conv, ok := polLabels[variable]
 	if !ok {
-		return math.NaN(), fmt.Errorf("simplechem: invalid variable name %s; valid names are %v", variable, m.Species())
+		return math.NaN(), fmt.Errorf("simplechem: invalid variable name %s; valid names are %v and %v",
+			variable, m.Species(), m.DerivedVariables())
 	}
 	var val float64
 	for ii, i := range conv.index {
@@ -216,8 +260,12 @@ func (m Mechanism) Units(variable string) (string, error) {
 	if _, ok := emisLabels[variable]; ok {
 		return "μg/m³/s", nil
 	}
+	if _, ok := depLabels[variable]; ok {
+		return "kg/ha/yr", nil
+	}
 	if _, ok := polLabels[variable]; !ok {
-		return "", fmt.Errorf("simplechem: invalid variable name %s; valid names are %v", variable, m.Species())
+		return "", fmt.Errorf("simplechem: invalid variable name %s; valid names are %v and %v",
+			variable, m.Species(), m.DerivedVariables())
 	}
 	return "μg/m³", nil
 }
@@ -237,19 +285,29 @@ func (m Mechanism) Chemistry() inmap.CellManipulator {
 		ΔS := c.SO2oxidation * c.Cf[igS] * Δt
 		c.Cf[ipS] += ΔS
 		c.Cf[igS] -= ΔS
+		c.AddToBudget(inmap.ChemistryBudget, ipS, ΔS)
+		c.AddToBudget(inmap.ChemistryBudget, igS, -ΔS)
+
 		// NH3 / pNH4 partitioning
-		totalNH := c.Cf[igNH] + c.Cf[ipNH]
-		c.Cf[ipNH] = totalNH * c.NHPartitioning
-		c.Cf[igNH] = totalNH * (1 - c.NHPartitioning)
+		partition(c, igNH, ipNH, c.NHPartitioning)
 
 		// NOx / pN0 partitioning
-		totalNO := c.Cf[igNO] + c.Cf[ipNO]
-		c.Cf[ipNO] = totalNO * c.NOPartitioning
-		c.Cf[igNO] = totalNO * (1 - c.NOPartitioning)
+		partition(c, igNO, ipNO, c.NOPartitioning)
 
 		// VOC/SOA partitioning
-		totalOrg := c.Cf[igOrg] + c.Cf[ipOrg]
-		c.Cf[ipOrg] = totalOrg * c.AOrgPartitioning
-		c.Cf[igOrg] = totalOrg * (1 - c.AOrgPartitioning)
+		partition(c, igOrg, ipOrg, c.AOrgPartitioning)
 	}
 }
+
+// partition partitions the total mass of the gas-phase species with index
+// ig and the particle-phase species with index ip in c so that fraction
+// particleFrac is in the particle phase, and records the change in
+// mass of each species in the mass budget of c.
+func partition(c *inmap.Cell, ig, ip int, particleFrac float64) {
+	g0, p0 := c.Cf[ig], c.Cf[ip]
+	total := g0 + p0
+	c.Cf[ip] = total * particleFrac
+	c.Cf[ig] = total * (1 - particleFrac)
+	c.AddToBudget(inmap.ChemistryBudget, ip, c.Cf[ip]-p0)
+	c.AddToBudget(inmap.ChemistryBudget, ig, c.Cf[ig]-g0)
+}
@@ -153,6 +153,52 @@ func TestUnits(t *testing.T) {
 	}
 }
 
+func TestDepositionValue(t *testing.T) {
+	const year = 365.25 * 24 * 60 * 60 // seconds
+	m := Mechanism{}
+	dep := &inmap.Deposition{
+		Dry:     make([]float64, m.Len()),
+		Wet:     make([]float64, m.Len()),
+		DryTime: year,
+		WetTime: year,
+	}
+	// 1 kg/ha = 1.e5 μg/m²
+	dep.Dry[igS] = 1.e5
+	dep.Dry[ipS] = 2.e5
+	dep.Wet[ipS] = 4.e5
+	dep.Wet[igNH] = 1.e5
+	dep.Wet[ipNO] = 1.e5
+	c := &inmap.Cell{Deposition: dep}
+
+	for v, want := range map[string]float64{
+		"SDryDep": 3,
+		"SWetDep": 4,
+		"SDep":    7,
+		"NDryDep": 0,
+		"NWetDep": 2,
+		"NDep":    2,
+	} {
+		have, err := m.Value(c, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == 0 && have != 0 || want != 0 && different(have, want, 1.e-10) {
+			t.Errorf("%s: have %g, want %g", v, have, want)
+		}
+		u, err := m.Units(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != "kg/ha/yr" {
+			t.Errorf("%s units: want 'kg/ha/yr'; have '%s'", v, u)
+		}
+	}
+
+	if v, err := m.Value(&inmap.Cell{}, "SDep"); err != nil || v != 0 {
+		t.Errorf("a cell without deposition should have zero deposition: %g, %v", v, err)
+	}
+}
+
 func different(a, b, tolerance float64) bool {
 	if 2*math.Abs(a-b)/math.Abs(a+b) > tolerance || math.IsNaN(a) || math.IsNaN(b) {
 		return true
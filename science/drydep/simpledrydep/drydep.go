@@ -40,6 +40,7 @@ type PM25 []int
 // DryDeposition returns a function that calculates particle removal by dry deposition.
 // The function arguments represent array indices of the chemical species.
 // Each species can be associated with more than one array index.
+// The deposited mass is recorded in each cell using Cell.AddDeposition.
 func DryDeposition(indices func() (SOx, NH3, NOx, VOC, PM25)) inmap.CellManipulator {
 	sox, nh3, nox, voc, pm25 := indices()
 	return func(c *inmap.Cell, Δt float64) {
@@ -52,19 +53,25 @@ func DryDeposition(indices func() (SOx, NH3, NOx, VOC, PM25)) inmap.CellManipula
 			pm25fac := c.ParticleDryDep * fac
 			for _, i := range voc {
 				c.Cf[i] -= c.Ci[i] * vocfac
+				c.AddDeposition(inmap.DryDepositionBudget, i, c.Ci[i]*vocfac)
 			}
 			for _, i := range pm25 {
 				c.Cf[i] -= c.Ci[i] * pm25fac
+				c.AddDeposition(inmap.DryDepositionBudget, i, c.Ci[i]*pm25fac)
 			}
 			for _, i := range nh3 {
 				c.Cf[i] -= c.Ci[i] * nh3fac
+				c.AddDeposition(inmap.DryDepositionBudget, i, c.Ci[i]*nh3fac)
 			}
 			for _, i := range sox {
 				c.Cf[i] -= c.Ci[i] * so2fac
+				c.AddDeposition(inmap.DryDepositionBudget, i, c.Ci[i]*so2fac)
 			}
 			for _, i := range nox {
 				c.Cf[i] -= c.Ci[i] * noxfac
+				c.AddDeposition(inmap.DryDepositionBudget, i, c.Ci[i]*noxfac)
 			}
+			c.AddDepositionTime(inmap.DryDepositionBudget, Δt)
 		}
 	}
 }
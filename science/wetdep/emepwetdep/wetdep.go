@@ -34,6 +34,7 @@ type PM25 []int
 // WetDeposition returns a function that calculates particle removal by wet deposition.
 // The function arguments represent array indices of the chemical species.
 // Each species can be associated with more than one array index.
+// The deposited mass is recorded in each cell using Cell.AddDeposition.
 func WetDeposition(indices func() (SO2, OtherGas, PM25)) inmap.CellManipulator {
 	so2, otherGas, pm25 := indices()
 	return func(c *inmap.Cell, Δt float64) {
@@ -42,12 +43,16 @@ func WetDeposition(indices func() (SO2, OtherGas, PM25)) inmap.CellManipulator {
 		otherGasFrac := c.OtherGasWetDep * Δt
 		for _, i := range so2 {
 			c.Cf[i] -= c.Ci[i] * SO2Frac
+			c.AddDeposition(inmap.WetDepositionBudget, i, c.Ci[i]*SO2Frac)
 		}
 		for _, i := range otherGas {
 			c.Cf[i] -= c.Ci[i] * otherGasFrac
+			c.AddDeposition(inmap.WetDepositionBudget, i, c.Ci[i]*otherGasFrac)
 		}
 		for _, i := range pm25 {
 			c.Cf[i] -= c.Ci[i] * particleFrac
+			c.AddDeposition(inmap.WetDepositionBudget, i, c.Ci[i]*particleFrac)
 		}
+		c.AddDepositionTime(inmap.WetDepositionBudget, Δt)
 	}
 }
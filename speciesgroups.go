@@ -0,0 +1,384 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/sparse"
+)
+
+// SpeciesGroupNames are the names of the chemical species groups that
+// preprocessors calculate from chemical transport model (CTM) species.
+var SpeciesGroupNames = []string{"AVOC", "BVOC", "ASOA", "BSOA", "NOx", "PNO", "SOx", "PS", "NH3", "PNH", "TotalPM25"}
+
+// Species specifies how the concentration of a CTM species is
+// converted into its contribution to a chemical species group.
+type Species struct {
+	// Units are the units of the species concentration in the CTM output.
+	// Valid options are "ppmv", "ppbv", "ppbC" (parts per billion carbon),
+	// "ug/kg" (micrograms per kilogram dry air), and "ug/m3".
+	Units string
+
+	// MW is the molecular weight of the species [g/mol], which is
+	// required for concentrations in ppmv, ppbv, and ppbC. For the NOx,
+	// SOx, and NH3 groups, which only track the mass of Nitrogen or Sulfur,
+	// it should be the molecular weight of Nitrogen or Sulfur.
+	MW float64
+
+	// Carbons is the number of carbon atoms in each molecule of the species,
+	// which is required for concentrations in ppbC.
+	Carbons float64
+
+	// Factor is an additional factor to multiply the concentration by,
+	// for example the Nitrogen fraction of the mass of particulate nitrate.
+	// If it is zero, it is treated as one.
+	Factor float64
+}
+
+// factor returns the factor that converts the concentration of s
+// to a mass fraction [μg/kg dry air], or, if massFraction is false,
+// to a concentration [μg/m3].
+func (s Species) factor() (factor float64, massFraction bool, err error) {
+	needMW := func() error {
+		if s.MW <= 0 {
+			return fmt.Errorf("molecular weight must be greater than zero for units of %s", s.Units)
+		}
+		return nil
+	}
+	switch s.Units {
+	case "ppmv":
+		err = needMW()
+		factor, massFraction = ppmvToUgKg(s.MW), true
+	case "ppbv":
+		err = needMW()
+		factor, massFraction = ppbvToUgKg(s.MW), true
+	case "ppbC":
+		err = needMW()
+		if err == nil && s.Carbons <= 0 {
+			err = fmt.Errorf("number of carbons must be greater than zero for units of ppbC")
+		}
+		factor, massFraction = ppbcToUgKg(s.MW, s.Carbons), true
+	case "ug/kg":
+		factor, massFraction = 1, true
+	case "ug/m3":
+		factor, massFraction = 1, false
+	default:
+		err = fmt.Errorf("invalid units '%s'; valid options are ppmv, ppbv, ppbC, ug/kg, and ug/m3", s.Units)
+	}
+	if s.Factor < 0 {
+		err = fmt.Errorf("factor must not be negative")
+	} else if s.Factor != 0 {
+		factor *= s.Factor
+	}
+	return
+}
+
+// SpeciesGroups specifies the CTM species that make up each of the
+// chemical species groups in SpeciesGroupNames. The keys are group names
+// and species names, respectively.
+type SpeciesGroups map[string]map[string]Species
+
+// Check checks whether g includes all of the species groups and
+// whether the information for each species is valid.
+func (g SpeciesGroups) Check() error {
+	for group := range g {
+		if !isSpeciesGroup(group) {
+			return fmt.Errorf("inmap: invalid species group '%s'; valid groups are %v", group, SpeciesGroupNames)
+		}
+	}
+	for _, group := range SpeciesGroupNames {
+		if len(g[group]) == 0 {
+			return fmt.Errorf("inmap: species group %s is missing or empty", group)
+		}
+		for name, s := range g[group] {
+			if _, _, err := s.factor(); err != nil {
+				return fmt.Errorf("inmap: species group %s, species %s: %v", group, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isSpeciesGroup(group string) bool {
+	for _, n := range SpeciesGroupNames {
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// factors returns the factors that convert the concentrations of the
+// species in the given group to mass fractions [μg/kg dry air] (massFraction)
+// or to concentrations [μg/m3] (conc). The keys of the returned maps are
+// the CTM variable names, which are calculated from the species names
+// using varName. It assumes that g has been checked.
+func (g SpeciesGroups) factors(group string, varName func(string) string) (massFraction, conc map[string]float64) {
+	massFraction, conc = make(map[string]float64), make(map[string]float64)
+	for name, s := range g[group] {
+		f, isMassFraction, _ := s.factor()
+		if isMassFraction {
+			massFraction[varName(name)] = f
+		} else {
+			conc[varName(name)] = f
+		}
+	}
+	return
+}
+
+// checkVariables returns an error listing any species in g whose
+// variables, calculated from the species names using varName, are not
+// in the NetCDF file fileName.
+func (g SpeciesGroups) checkVariables(fileName string, f *cdf.File, varName func(string) string) error {
+	vars := make(map[string]bool)
+	for _, v := range f.Header.Variables() {
+		vars[v] = true
+	}
+	var missing []string
+	for _, group := range SpeciesGroupNames {
+		for name := range g[group] {
+			if v := varName(name); !vars[v] {
+				missing = append(missing, fmt.Sprintf("%s (%s)", v, group))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("inmap: preprocessor: the following species group variables are not in file %s: %s",
+			fileName, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// sameName returns name; it is for use with SpeciesGroups.factors
+// and SpeciesGroups.checkVariables when species names and CTM
+// variable names are the same.
+func sameName(name string) string { return name }
+
+// readSpeciesGroup reads a species group using readGroup for the species
+// with concentrations in [μg/m3] and readGroupAlt, which divides by
+// inverse density, for the species with mass fractions [μg/kg dry air],
+// and returns the sum in [μg/m3].
+func readSpeciesGroup(massFraction, conc map[string]float64, readGroupAlt, readGroup func(map[string]float64) NextData) NextData {
+	if len(conc) == 0 {
+		return readGroupAlt(massFraction)
+	}
+	if len(massFraction) == 0 {
+		return readGroup(conc)
+	}
+	massFractionFunc, concFunc := readGroupAlt(massFraction), readGroup(conc)
+	return func() (*sparse.DenseArray, error) {
+		a, err := massFractionFunc()
+		if err != nil {
+			return nil, err
+		}
+		b, err := concFunc()
+		if err != nil {
+			return nil, err
+		}
+		out := a.Copy()
+		out.AddDense(b)
+		return out, nil
+	}
+}
+
+// LoadSpeciesGroups reads species groups from a TOML file (with
+// extension ".toml") or a CSV file (with extension ".csv") and checks
+// them using SpeciesGroups.Check.
+//
+// In a TOML file, each species group is a table, and each species is an
+// inline table with fields units, mw, carbons, and factor, which
+// correspond to the fields of the Species type, e.g.:
+//
+//	[NOx]
+//	no = {units = "ppmv", mw = 14.0067}
+//	no2 = {units = "ppmv", mw = 14.0067}
+//
+// A CSV file has a header row and then one row for each species, with
+// columns group, species, units, mw, carbons, and factor. Empty
+// values in the mw, carbons, and factor columns are treated as zero.
+func LoadSpeciesGroups(fileName string) (SpeciesGroups, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: loading species groups: %v", err)
+	}
+	defer f.Close()
+	var g SpeciesGroups
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".toml":
+		g, err = readSpeciesGroupsTOML(f)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: loading species groups from %s: %v", fileName, err)
+		}
+	case ".csv":
+		g, err = readSpeciesGroupsCSV(f)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: loading species groups from %s: %v", fileName, err)
+		}
+	default:
+		return nil, fmt.Errorf("inmap: species group file %s must have extension .toml or .csv", fileName)
+	}
+	if err = g.Check(); err != nil {
+		return nil, fmt.Errorf("%v (in %s)", err, fileName)
+	}
+	return g, nil
+}
+
+// readSpeciesGroupsTOML reads species groups in the TOML format
+// described in LoadSpeciesGroups. Numbers can be written as
+// integers or floating point numbers.
+func readSpeciesGroupsTOML(r io.Reader) (SpeciesGroups, error) {
+	var data map[string]map[string]map[string]interface{}
+	if _, err := toml.DecodeReader(r, &data); err != nil {
+		return nil, err
+	}
+	g := make(SpeciesGroups)
+	for group, species := range data {
+		g[group] = make(map[string]Species)
+		for name, fields := range species {
+			var s Species
+			for field, v := range fields {
+				var f *float64
+				switch field {
+				case "units":
+					u, ok := v.(string)
+					if !ok {
+						return nil, fmt.Errorf("species group %s, species %s: units must be a string", group, name)
+					}
+					s.Units = u
+					continue
+				case "mw":
+					f = &s.MW
+				case "carbons":
+					f = &s.Carbons
+				case "factor":
+					f = &s.Factor
+				default:
+					return nil, fmt.Errorf("species group %s, species %s: invalid field '%s'", group, name, field)
+				}
+				switch vv := v.(type) {
+				case float64:
+					*f = vv
+				case int64:
+					*f = float64(vv)
+				default:
+					return nil, fmt.Errorf("species group %s, species %s: %s must be a number", group, name, field)
+				}
+			}
+			g[group][name] = s
+		}
+	}
+	return g, nil
+}
+
+// readSpeciesGroupsCSV reads species groups in the CSV format
+// described in LoadSpeciesGroups.
+func readSpeciesGroupsCSV(r io.Reader) (SpeciesGroups, error) {
+	c := csv.NewReader(r)
+	c.TrimLeadingSpace = true
+	c.FieldsPerRecord = 6
+	records, err := c.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header row")
+	}
+	g := make(SpeciesGroups)
+	for i, rec := range records[1:] {
+		var vals [3]float64
+		for j, v := range rec[3:] {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if vals[j], err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+2, err)
+			}
+		}
+		group, name := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		if g[group] == nil {
+			g[group] = make(map[string]Species)
+		}
+		if _, ok := g[group][name]; ok {
+			return nil, fmt.Errorf("line %d: species %s is listed more than once in group %s", i+2, name, group)
+		}
+		g[group][name] = Species{Units: strings.TrimSpace(rec[2]), MW: vals[0], Carbons: vals[1], Factor: vals[2]}
+	}
+	return g, nil
+}
+
+// speciesGroupPresets holds the built-in species groups.
+var speciesGroupPresets = map[string]func() SpeciesGroups{
+	"WRF-Chem:RACM_SOA_VBS":            wrfChemRACMSOAVBS,
+	"WRF-Chem:RADM2SORG":               func() SpeciesGroups { return wrfChemSORGAM(false) },
+	"WRF-Chem:RACMSORG":                func() SpeciesGroups { return wrfChemSORGAM(true) },
+	"WRF-Chem:MOZART_MOSAIC_4BIN_VBS0": wrfChemMOZARTMOSAIC,
+	"GEOS-Chem:v10":                    func() SpeciesGroups { return geosChemSpeciesGroups(false) },
+	"GEOS-Chem:v11":                    func() SpeciesGroups { return geosChemSpeciesGroups(true) },
+	"CMAQ:AERO6":                       cmaqAERO6,
+}
+
+// SpeciesGroupPreset returns the built-in species groups with the given
+// name. The available presets are listed by SpeciesGroupPresets.
+func SpeciesGroupPreset(name string) (SpeciesGroups, error) {
+	f, ok := speciesGroupPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("inmap: invalid species group preset '%s'; valid presets are %v", name, SpeciesGroupPresets())
+	}
+	return f(), nil
+}
+
+// SpeciesGroupPresets returns the names of the built-in species groups:
+//
+// "WRF-Chem:RACM_SOA_VBS" is for WRF-Chem simulations using the RACM
+// gas-phase mechanism with the MADE/VBS aerosol module (chem_opt = 108),
+// and is the default for WRF-Chem.
+//
+// "WRF-Chem:RADM2SORG" and "WRF-Chem:RACMSORG" are for WRF-Chem simulations
+// using the RADM2 (e.g., chem_opt = 2) or RACM gas-phase mechanisms with
+// the MADE/SORGAM aerosol module.
+//
+// "WRF-Chem:MOZART_MOSAIC_4BIN_VBS0" is for WRF-Chem simulations using the
+// MOZART gas-phase mechanism with the 4-bin MOSAIC aerosol module and
+// VBS SOA (chem_opt = 201).
+//
+// "GEOS-Chem:v11" is for GEOS-Chem versions 11 and later, which include
+// complex SOA from isoprene, and is the default for GEOS-Chem.
+// "GEOS-Chem:v10" is for earlier versions.
+//
+// "CMAQ:AERO6" is for CMAQ simulations using the AERO6 aerosol module,
+// and is the default for CMAQ.
+func SpeciesGroupPresets() []string {
+	names := make([]string, 0, len(speciesGroupPresets))
+	for n := range speciesGroupPresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/cdf"
+)
+
+func TestSpeciesGroupPresets(t *testing.T) {
+	for _, name := range SpeciesGroupPresets() {
+		g, err := SpeciesGroupPreset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Check(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := SpeciesGroupPreset("xxx"); err == nil {
+		t.Error("expected an error for an invalid preset")
+	}
+}
+
+func TestSpeciesFactor(t *testing.T) {
+	for _, test := range []struct {
+		s            Species
+		factor       float64
+		massFraction bool
+		err          bool
+	}{
+		{s: Species{Units: "ppmv", MW: 64}, factor: ppmvToUgKg(64), massFraction: true},
+		{s: Species{Units: "ppbv", MW: 150, Factor: 1.33}, factor: ppbvToUgKg(150) * 1.33, massFraction: true},
+		{s: Species{Units: "ppbC", MW: 78.11, Carbons: 6}, factor: ppbcToUgKg(78.11, 6), massFraction: true},
+		{s: Species{Units: "ug/kg", Factor: 0.5}, factor: 0.5, massFraction: true},
+		{s: Species{Units: "ug/m3"}, factor: 1},
+		{s: Species{Units: "ppmv"}, err: true},
+		{s: Species{Units: "ppbC", MW: 78.11}, err: true},
+		{s: Species{Units: "ug/m3", Factor: -1}, err: true},
+		{s: Species{Units: "mol/mol"}, err: true},
+	} {
+		factor, massFraction, err := test.s.factor()
+		if (err != nil) != test.err {
+			t.Errorf("%+v: error: %v", test.s, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if factor != test.factor || massFraction != test.massFraction {
+			t.Errorf("%+v: have %g, %v; want %g, %v", test.s, factor, massFraction, test.factor, test.massFraction)
+		}
+	}
+}
+
+func TestLoadSpeciesGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inmap_speciesgroups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := wrfChemRACMSOAVBS()
+	want["NOx"] = map[string]Species{"no2": {Units: "ppmv", MW: mwN}}
+	want["TotalPM25"] = map[string]Species{"PM2_5_DRY": {Units: "ug/m3", Factor: 0.9}}
+
+	var tomlFile, csvFile strings.Builder
+	csvFile.WriteString("group,species,units,mw,carbons,factor\n")
+	for _, group := range SpeciesGroupNames {
+		tomlFile.WriteString("[" + group + "]\n")
+		for name, s := range want[group] {
+			tomlFile.WriteString(name + " = {units = \"" + s.Units + "\"")
+			if s.MW != 0 {
+				tomlFile.WriteString(", mw = " + formatFloat(s.MW))
+			}
+			if s.Factor != 0 {
+				tomlFile.WriteString(", factor = " + formatFloat(s.Factor))
+			}
+			tomlFile.WriteString("}\n")
+			csvFile.WriteString(strings.Join([]string{group, name, s.Units, formatFloat(s.MW), "", formatFloat(s.Factor)}, ",") + "\n")
+		}
+	}
+	for ext, contents := range map[string]string{".toml": tomlFile.String(), ".csv": csvFile.String()} {
+		fileName := filepath.Join(dir, "groups"+ext)
+		if err := ioutil.WriteFile(fileName, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		g, err := LoadSpeciesGroups(fileName)
+		if err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		if !reflect.DeepEqual(g, want) {
+			t.Errorf("%s: have %v, want %v", ext, g, want)
+		}
+	}
+
+	for name, contents := range map[string]string{
+		"missing.toml":  "[NOx]\nno2 = {units = \"ppmv\", mw = 14}\n",
+		"badunits.csv":  strings.Replace(csvFile.String(), ",ppmv,", ",ppm,", 1),
+		"badfield.toml": strings.Replace(tomlFile.String(), "mw =", "mv =", 1),
+		"duplicate.csv": csvFile.String() + "NOx,no2,ppmv,14,,\n",
+		"groups.txt":    csvFile.String(),
+	} {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSpeciesGroups(fileName); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSpeciesGroupsCheckVariables(t *testing.T) {
+	g := wrfChemRACMSOAVBS()
+	if _, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", g, nil); err != nil {
+		t.Fatal(err)
+	}
+	g["BVOC"]["xxx"] = Species{Units: "ppmv", MW: 100}
+	_, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", g, nil)
+	if err == nil || !strings.Contains(err.Error(), "xxx (BVOC)") {
+		t.Errorf("expected an error for a missing variable, got %v", err)
+	}
+}
+
+func TestWRFChemMOZARTMOSAIC(t *testing.T) {
+	g, err := SpeciesGroupPreset("WRF-Chem:MOZART_MOSAIC_4BIN_VBS0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// Chemical variables in WRF-Chem output for chem_opt = 201.
+	vars := strings.Fields(`no no2 so2 sulf nh3 bigalk bigene c3h6 tol benzene xyl
+		isopr c10h16 cvasoa1 cvasoa2 cvasoa3 cvasoa4 cvbsoa1 cvbsoa2 cvbsoa3 cvbsoa4
+		PM2_5_DRY ALT`)
+	for _, bin := range []string{"_a01", "_a02", "_a03", "_a04"} {
+		for _, s := range []string{"so4", "no3", "nh4", "asoa1", "asoa2", "asoa3", "asoa4",
+			"bsoa1", "bsoa2", "bsoa3", "bsoa4", "oc", "bc", "na", "cl", "oin", "num"} {
+			vars = append(vars, s+bin)
+		}
+	}
+	h := cdf.NewHeader([]string{"Time"}, []int{1})
+	for _, v := range vars {
+		h.AddVariable(v, []string{"Time"}, []float32{0})
+	}
+	h.Define()
+	f, err := ioutil.TempFile("", "inmap_mozart_mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	ff, err := cdf.Create(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.checkVariables(f.Name(), ff, sameName); err != nil {
+		t.Error(err)
+	}
+	for _, group := range []string{"PNO", "PS", "PNH", "ASOA", "BSOA"} {
+		for name := range g[group] {
+			if strings.HasSuffix(name, "_a04") {
+				t.Errorf("%s: species %s is larger than 2.5 μm", group, name)
+			}
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
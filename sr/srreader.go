@@ -384,12 +384,18 @@ func (sr *Reader) SetConcentrations(c *Concentrations) error {
 // SetConcentrations.
 // Note that because the SR matrix does not save gas-phase concentrations,
 // attempts to output gas-phase equations will result in all zeros.
-func (sr *Reader) Output(shapefilePath string, variables map[string]string, funcs map[string]govaluate.ExpressionFunction, sRef *proj.SR) error {
+// sRef is the spatial reference of the model grid, and outputSR is the
+// spatial reference the output should be written in. If outputSR is nil,
+// the output will be in the spatial reference of the grid.
+func (sr *Reader) Output(shapefilePath string, variables map[string]string, funcs map[string]govaluate.ExpressionFunction, sRef, outputSR *proj.SR) error {
 	m := simplechem.Mechanism{}
 	o, err := inmap.NewOutputter(shapefilePath, false, variables, funcs, m)
 	if err != nil {
 		return err
 	}
+	if outputSR != nil {
+		o.ReprojectOutput(outputSR)
+	}
 	if err := o.CheckOutputVars(m)(&sr.d); err != nil {
 		return err
 	}
@@ -441,7 +441,7 @@ func TestOutput(t *testing.T) {
 		"SOA":        "SOA",
 		"BasePM25":   "BaselineTotalPM25",
 		"WindSpeed":  "WindSpeed"},
-		nil, sRef); err != nil {
+		nil, sRef, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -0,0 +1,118 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "fmt"
+
+// TrackTags returns a function that sets up the simulation to separately
+// track the concentrations caused by the emissions records in emis
+// with each of the given source tags (see EmisRecord.Tag), in addition
+// to the concentrations caused by all emissions. The concentrations for
+// each tag are stored in the TagCi and TagCf fields of each Cell, in the
+// same order as tags, so memory use increases in proportion to the number
+// of tags. Emissions without one of the given tags are included in the
+// total concentrations but are not tracked separately.
+//
+// The CellManipulators passed to Calculations are run for each tag
+// in the same way as for the total concentrations, so the concentrations
+// for each tag are only meaningful when the science processes are
+// linear with respect to concentration, as they are in the
+// simplechem mechanism. TrackTags should be run after the grid has been
+// created, and it can not be used in distributed simulations.
+func TrackTags(emis *Emissions, m Mechanism, tags ...string) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.cluster != nil {
+			return fmt.Errorf("inmap: source tags can not be tracked in distributed simulations")
+		}
+		seen := make(map[string]bool)
+		for _, t := range tags {
+			if seen[t] {
+				return fmt.Errorf("inmap: duplicate source tag '%s'", t)
+			}
+			seen[t] = true
+		}
+		d.tags = tags
+		for _, g := range []*cellList{d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary} {
+			for _, c := range *g {
+				c.setTags(tags, m)
+			}
+		}
+		for _, c := range *d.cells {
+			c.setTags(tags, m)
+			if err := c.setEmissionsFlux(emis, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Tags returns the source tags that are being tracked, as set by TrackTags.
+func (d *InMAP) Tags() []string { return d.tags }
+
+// setTags sets the source tags tracked by c, creating the arrays
+// that hold the concentrations for each tag unless they already
+// have the correct dimensions, as they would when c has been loaded
+// from a checkpoint.
+func (c *Cell) setTags(tags []string, m Mechanism) {
+	c.tags = tags
+	if len(c.TagDeposition) != len(tags) {
+		c.TagDeposition = make([]*Deposition, len(tags))
+	}
+	if len(c.TagCi) == len(tags) && len(c.TagCf) == len(tags) {
+		return
+	}
+	c.TagCi = make([][]float64, len(tags))
+	c.TagCf = make([][]float64, len(tags))
+	for i := range tags {
+		c.TagCi[i] = make([]float64, m.Len())
+		c.TagCf[i] = make([]float64, m.Len())
+	}
+}
+
+// swapTag swaps the total concentrations, emissions, and deposition
+// of each grid cell and boundary cell with those for the tag with index i, so that
+// the science processes and output calculations that use Ci, Cf, and
+// EmisFlux operate on tag i instead. Calling swapTag again with the same
+// index swaps them back. The caller is responsible for
+// holding d.cellLock.
+func (d *InMAP) swapTag(i int) {
+	for _, g := range []*cellList{d.cells, d.westBoundary, d.eastBoundary,
+		d.northBoundary, d.southBoundary, d.topBoundary} {
+		for _, c := range *g {
+			c.swapTag(i)
+		}
+	}
+}
+
+// swapTag swaps the total concentrations, emissions, and deposition of c
+// with those for the tag with index i. Boundary cells do not have emissions,
+// so only their concentrations are swapped. The mass budget is not tracked
+// for tags, so it is set aside until the concentrations are swapped back.
+func (c *Cell) swapTag(i int) {
+	c.Ci, c.TagCi[i] = c.TagCi[i], c.Ci
+	c.Cf, c.TagCf[i] = c.TagCf[i], c.Cf
+	c.Budget, c.tagBudget = c.tagBudget, c.Budget
+	c.Deposition, c.TagDeposition[i] = c.TagDeposition[i], c.Deposition
+	if i < len(c.TagEmisFlux) {
+		c.EmisFlux, c.TagEmisFlux[i] = c.TagEmisFlux[i], c.EmisFlux
+		c.emisFluxProfiles, c.tagEmisFluxProfiles[i] = c.tagEmisFluxProfiles[i], c.emisFluxProfiles
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/spatialmodel/inmap"
+	"github.com/spatialmodel/inmap/science/chem/simplechem"
+)
+
+// Test whether the concentrations from each source tag add up to the
+// total concentrations when all of the emissions are tagged.
+func TestTrackTags(t *testing.T) {
+	const (
+		testTolerance      = 1.e-8
+		gridMutateInterval = 3600. // interval between grid mutations in seconds.
+	)
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+		Tag:  "a",
+	}) // ground level emissions
+	emis.Add(&inmap.EmisRecord{
+		SOx:    E,
+		NOx:    E,
+		PM25:   E,
+		VOC:    E,
+		NH3:    E,
+		Height: 20,
+		Geom:   geom.Point{X: 1000, Y: 1000.},
+		Tag:    "b",
+	}) // elevated emissions
+
+	popConcMutator := inmap.NewPopConcMutator(cfg, popIndices)
+	var m simplechem.Mechanism
+	drydep, err := m.DryDep("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wetdep, err := m.WetDep("emep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			inmap.TrackTags(emis, m, "a", "b"),
+			inmap.SetTimestepCFL(),
+		},
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.Calculations(
+				inmap.UpwindAdvection(),
+				inmap.Mixing(),
+				inmap.MeanderMixing(),
+				drydep,
+				wetdep,
+				m.Chemistry(),
+			),
+			inmap.RunPeriodically(gridMutateInterval,
+				cfg.MutateGrid(popConcMutator.Mutate(), ctmdata, pop, mr, emis, m, nil)),
+			inmap.RunPeriodically(gridMutateInterval, inmap.SetTimestepCFL()),
+			inmap.SteadyStateConvergenceCheck(-1, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err = d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sumA, sumB float64
+	for i, c := range d.Cells() {
+		if len(c.TagCf) != 2 {
+			t.Fatalf("cell %d has %d tags", i, len(c.TagCf))
+		}
+		for j, total := range c.Cf {
+			a, b := c.TagCf[0][j], c.TagCf[1][j]
+			sumA += a
+			sumB += b
+			if different(a+b, total, testTolerance) {
+				t.Errorf("cell %d species %d: %g + %g != %g", i, j, a, b, total)
+			}
+		}
+	}
+	if sumA == 0 || sumB == 0 {
+		t.Errorf("the concentrations from both tags should be greater than zero: a=%g, b=%g", sumA, sumB)
+	}
+
+	o, err := inmap.NewOutputter("", false, map[string]string{
+		"PrimPM25": "PrimaryPM25",
+		"SumPM25":  "{sum(PrimaryPM25)}",
+		"TotalPop": "TotalPop",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.TagOutput(d.Tags(), "PrimPM25", "SumPM25"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"PrimPM25", "SumPM25", "TotalPop", "PrimPM25_a", "PrimPM25_b", "SumPM25_a", "SumPM25_b"} {
+		if _, ok := r[v]; !ok {
+			t.Errorf("missing output variable %s", v)
+		}
+	}
+	if _, ok := r["TotalPop_a"]; ok {
+		t.Error("TotalPop_a should not be output")
+	}
+	for i, total := range r["PrimPM25"] {
+		if a, b := r["PrimPM25_a"][i], r["PrimPM25_b"][i]; different(a+b, total, testTolerance) {
+			t.Errorf("PrimPM25 cell %d: %g + %g != %g", i, a, b, total)
+		}
+	}
+	if a, b, total := r["SumPM25_a"][0], r["SumPM25_b"][0], r["SumPM25"][0]; different(a+b, total, testTolerance) {
+		t.Errorf("SumPM25: %g + %g != %g", a, b, total)
+	}
+
+	if err := o.TagOutput(d.Tags(), "CO"); err == nil {
+		t.Error("expected an error for an invalid output variable")
+	}
+	if err := o.TagOutput([]string{"a_long_tag"}, "PrimPM25"); err == nil {
+		t.Error("expected an error for an output variable name that is too long")
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ctessum/geom/proj"
+)
+
+// TimeSeriesDateFormat is the format used to replace the [DATE]
+// wildcard in the names of files that are part of a time series, such as
+// preprocessed meteorology snapshots and time-resolved output files.
+const TimeSeriesDateFormat = inDateHourFormat
+
+// TimeWindows splits the period between start and end into windows
+// of length interval and returns the beginning time of each window.
+// The last window is shortened if interval does not evenly divide the period.
+func TimeWindows(start, end time.Time, interval time.Duration) ([]time.Time, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("inmap: time series interval must be positive, not %v", interval)
+	}
+	if !start.Before(end) {
+		return nil, fmt.Errorf("inmap: time series start %v is not before end %v", start, end)
+	}
+	var o []time.Time
+	for t := start; t.Before(end); t = t.Add(interval) {
+		o = append(o, t)
+	}
+	return o, nil
+}
+
+// TimeSeriesFileName returns the name of the file in a time series
+// that corresponds to time t. If fileName contains the wildcard
+// [DATE], it will be replaced by t; otherwise t will be added
+// before the file extension.
+func TimeSeriesFileName(fileName string, t time.Time) string {
+	date := t.Format(TimeSeriesDateFormat)
+	if strings.Contains(fileName, "[DATE]") {
+		return strings.Replace(fileName, "[DATE]", date, -1)
+	}
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "_" + date + ext
+}
+
+// Clock keeps track of the simulation date and time in
+// time-resolved (transient) simulations.
+type Clock struct {
+	start   time.Time
+	elapsed float64 // seconds since start
+}
+
+// NewClock returns a new clock beginning at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{start: start}
+}
+
+// Time returns the simulation time at the beginning of the current time step.
+func (c *Clock) Time() time.Time {
+	return c.start.Add(time.Duration(c.elapsed * float64(time.Second)))
+}
+
+// Elapsed returns the simulation time since the start of the simulation [s].
+func (c *Clock) Elapsed() float64 { return c.elapsed }
+
+// Advance returns a function that advances the clock by the model
+// time step and sets d.Done to true once the end time
+// has been reached. It should be the last of the functions
+// that determine the simulation state in d.RunFuncs.
+func (c *Clock) Advance(end time.Time) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.Dt == 0 {
+			return fmt.Errorf("timestep is zero")
+		}
+		c.elapsed += d.Dt
+		if !c.Time().Before(end) {
+			d.Done = true
+		}
+		return nil
+	}
+}
+
+// MeteorologySeries returns a function that replaces the meteorology
+// of each grid cell as the clock advances through a time series of
+// meteorology snapshots. times gives the beginning time of
+// each snapshot, in ascending order, and load reads the data for
+// the snapshot that begins at the given time.
+// The model is assumed to be initialized with the data
+// from the first snapshot. Cell layer heights and thicknesses
+// are kept from the initial snapshot so that grid cell volumes, and therefore
+// pollutant mass, do not change when the meteorology changes.
+// After each change, the time step is recalculated using SetTimestepCFL.
+func (config *VarGridConfig) MeteorologySeries(clock *Clock, times []time.Time, load func(time.Time) (*CTMData, error)) DomainManipulator {
+	current := 0
+	setTimestep := SetTimestepCFL()
+	return func(d *InMAP) error {
+		now := clock.Time()
+		next := current
+		for next+1 < len(times) && !now.Before(times[next+1]) {
+			next++
+		}
+		if next == current {
+			return nil
+		}
+		data, err := load(times[next])
+		if err != nil {
+			return fmt.Errorf("inmap: loading meteorology for %v: %v", times[next], err)
+		}
+		for _, c := range *d.cells {
+			if err := c.updateMeteorology(data); err != nil {
+				return err
+			}
+		}
+		for _, c := range *d.cells {
+			c.updateNeighborDiffusivity()
+		}
+		current = next
+		return setTimestep(d)
+	}
+}
+
+// updateMeteorology replaces the meteorology and baseline concentrations
+// in c with those in data, but leaves the layer height and thickness unchanged.
+// The meteorology of any boundary cells adjacent to c is also updated.
+func (c *Cell) updateMeteorology(data *CTMData) error {
+	layerHeight, dz := c.LayerHeight, c.Dz
+
+	c.UAvg, c.VAvg, c.WAvg = 0, 0, 0
+	c.UDeviation, c.VDeviation = 0, 0
+	c.AOrgPartitioning, c.BOrgPartitioning = 0, 0
+	c.NOPartitioning, c.SPartitioning, c.NHPartitioning = 0, 0, 0
+	c.SO2oxidation = 0
+	c.ParticleDryDep, c.SO2DryDep, c.NOxDryDep, c.NH3DryDep, c.VOCDryDep = 0, 0, 0, 0, 0
+	c.Kxxyy, c.Kzz, c.M2u, c.M2d = 0, 0, 0, 0
+	c.LayerHeight, c.Dz = 0, 0
+	c.ParticleWetDep, c.SO2WetDep, c.OtherGasWetDep = 0, 0, 0
+	c.WindSpeed, c.WindSpeedInverse = 0, 0
+	c.WindSpeedMinusThird, c.WindSpeedMinusOnePointFour = 0, 0
+	c.Temperature, c.S1, c.SClass = 0, 0, 0
+	for i := range c.CBaseline {
+		c.CBaseline[i] = 0
+	}
+
+	if err := c.loadData(data, c.Layer); err != nil {
+		return err
+	}
+	c.LayerHeight, c.Dz = layerHeight, dz
+
+	for _, l := range []*cellList{c.west, c.east, c.south, c.north, c.above} {
+		for _, b := range *l {
+			if !b.boundary {
+				continue
+			}
+			b.UAvg, b.VAvg, b.WAvg = c.UAvg, c.VAvg, c.WAvg
+			b.UDeviation, b.VDeviation = c.UDeviation, c.VDeviation
+			b.Kxxyy, b.Kzz = c.Kxxyy, c.Kzz
+			b.M2u, b.M2d = c.M2u, c.M2d
+		}
+	}
+	return nil
+}
+
+// updateNeighborDiffusivity recalculates the diffusivity between c and
+// each of its neighbors after the meteorology has changed.
+func (c *Cell) updateNeighborDiffusivity() {
+	for _, l := range []*cellList{c.west, c.east, c.south, c.north} {
+		for _, n := range *l {
+			if n.boundary {
+				n.info.diff = n.Kxxyy
+			} else {
+				n.info.diff = harmonicMean(n.Kxxyy, c.Kxxyy)
+			}
+		}
+	}
+	for _, l := range []*cellList{c.above, c.below} {
+		for _, n := range *l {
+			if n.boundary || n.Cell == c {
+				n.info.diff = n.Kzz
+			} else {
+				n.info.diff = harmonicMean(n.Kzz, c.Kzz)
+			}
+		}
+	}
+}
+
+// TimeSeriesOutput returns a function that writes the simulation results
+// each time the clock passes a whole multiple of interval
+// after the beginning of the simulation, and also at the end of the
+// simulation (when d.Done is true) so that the final results are written
+// even if the length of the simulation is not a multiple of interval.
+// The name of each output file is created from the Outputter file name using
+// TimeSeriesFileName with the time at which the output is written.
+// If rename is not nil, it is used to change each file name before the
+// file is written, for example to write the file to a temporary location.
+// sr is the spatial reference of the model grid.
+func (o *Outputter) TimeSeriesOutput(clock *Clock, interval time.Duration, sr *proj.SR, rename func(fileName string) (string, error)) DomainManipulator {
+	next := interval
+	return func(d *InMAP) error {
+		if interval <= 0 {
+			return fmt.Errorf("inmap: output interval must be positive, not %v", interval)
+		}
+		elapsed := time.Duration(clock.Elapsed() * float64(time.Second))
+		if elapsed < next && !d.Done {
+			return nil
+		}
+		for next <= elapsed {
+			next += interval
+		}
+		o2 := *o
+		o2.fileName = TimeSeriesFileName(o.fileName, clock.Time())
+		if rename != nil {
+			var err error
+			if o2.fileName, err = rename(o2.fileName); err != nil {
+				return err
+			}
+		}
+		return o2.Output(sr)(d)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2019 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/sparse"
+)
+
+func TestTimeWindows(t *testing.T) {
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(30 * time.Hour)
+	w, err := TimeWindows(start, end, 12*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{start, start.Add(12 * time.Hour), start.Add(24 * time.Hour)}
+	if len(w) != len(want) {
+		t.Fatalf("have %d windows, want %d", len(w), len(want))
+	}
+	for i, ww := range want {
+		if !w[i].Equal(ww) {
+			t.Errorf("window %d: %v != %v", i, w[i], ww)
+		}
+	}
+	if _, err := TimeWindows(start, end, 0); err == nil {
+		t.Error("zero interval should cause an error")
+	}
+}
+
+func TestTimeSeriesFileName(t *testing.T) {
+	d := time.Date(2005, time.January, 2, 5, 0, 0, 0, time.UTC)
+	for _, test := range []struct{ in, out string }{
+		{in: "out_[DATE].shp", out: "out_20050102T05.shp"},
+		{in: "dir/out.shp", out: "dir/out_20050102T05.shp"},
+	} {
+		if have := TimeSeriesFileName(test.in, d); have != test.out {
+			t.Errorf("%s: %s != %s", test.in, have, test.out)
+		}
+	}
+}
+
+func TestFileStart(t *testing.T) {
+	d := time.Date(2005, time.January, 2, 5, 0, 0, 0, time.UTC)
+	fs, i := fileStart(d, 24*time.Hour, time.Hour)
+	if want := time.Date(2005, time.January, 2, 0, 0, 0, 0, time.UTC); !fs.Equal(want) || i != 5 {
+		t.Errorf("daily file: %v, %d; want %v, 5", fs, i, want)
+	}
+	fs, i = fileStart(d, 3*time.Hour, time.Hour)
+	if want := time.Date(2005, time.January, 2, 3, 0, 0, 0, time.UTC); !fs.Equal(want) || i != 2 {
+		t.Errorf("3-hour file: %v, %d; want %v, 2", fs, i, want)
+	}
+	fs, i = fileStart(d, 31*24*time.Hour, 24*time.Hour)
+	if !fs.Equal(d) || i != 0 {
+		t.Errorf("monthly file: %v, %d; want %v, 0", fs, i, d)
+	}
+}
+
+func TestMeteorologySeries(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	var m Mech
+
+	// The second snapshot has twice the wind speed of the first.
+	ctmdata2 := &CTMData{gridTree: ctmdata.gridTree}
+	for name, v := range ctmdata.Data {
+		data := sparse.ZerosDense(v.Data.Shape...)
+		copy(data.Elements, v.Data.Elements)
+		if name == "UAvg" {
+			for i, val := range data.Elements {
+				data.Elements[i] = val * 2
+			}
+		}
+		ctmdata2.AddVariable(name, v.Dims, v.Description, v.Units, data)
+	}
+
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+	times, err := TimeWindows(start, end, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(t time.Time) (*CTMData, error) {
+		if t.Equal(start) {
+			return ctmdata, nil
+		}
+		return ctmdata2, nil
+	}
+	clock := NewClock(start)
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			cfg.MeteorologySeries(clock, times, load),
+			clock.Advance(end),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	uAvg := make([]float64, d.cells.len())
+	volume := make([]float64, d.cells.len())
+	for i, c := range *d.cells {
+		uAvg[i] = c.UAvg
+		volume[i] = c.Volume
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if clock.Time().Before(end) {
+		t.Errorf("simulation ended at %v, before %v", clock.Time(), end)
+	}
+	for i, c := range *d.cells {
+		if different(c.UAvg, uAvg[i]*2, 1.e-10) {
+			t.Errorf("cell %d UAvg: %g != %g", i, c.UAvg, uAvg[i]*2)
+		}
+		if c.Volume != volume[i] {
+			t.Errorf("cell %d volume changed: %g != %g", i, c.Volume, volume[i])
+		}
+	}
+}
+
+// halfDayProfile doubles emissions in the morning and eliminates them
+// in the afternoon.
+type halfDayProfile struct{}
+
+func (halfDayProfile) Factor(t time.Time) float64 {
+	if t.Hour() < 12 {
+		return 2
+	}
+	return 0
+}
+
+func TestTemporalEmissionsFlux(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	var m Mech
+	const E = 1000000.0 // emissions
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	emis.AddWithProfile(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}, halfDayProfile{})
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var c *Cell
+	for _, cc := range *d.cells {
+		if cc.EmisFlux[iPM2_5] != 0 {
+			c = cc.Cell
+			break
+		}
+	}
+	if c == nil {
+		t.Fatal("no emissions in grid")
+	}
+	avg := c.EmisFlux[iPM2_5]
+
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		hour   int
+		factor float64
+	}{
+		{hour: 6, factor: 1.5},
+		{hour: 18, factor: 0.5},
+	} {
+		clock := NewClock(start.Add(time.Duration(test.hour) * time.Hour))
+		TemporalEmissionsFlux(clock)(c, 1)
+		if want := avg * test.factor; different(c.EmisFlux[iPM2_5], want, 1.e-10) {
+			t.Errorf("hour %d: have %g, want %g", test.hour, c.EmisFlux[iPM2_5], want)
+		}
+	}
+}
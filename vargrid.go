@@ -73,6 +73,18 @@ type VarGridConfig struct {
 	// should be used for population-weighting each mortality rate.
 	MortalityRateColumns map[string]string
 
+	// RefinementFiles are paths to shapefiles containing polygons, lines,
+	// or points (for example, community boundaries, road corridors,
+	// or facility locations) where the grid should have high resolution
+	// regardless of population. See RegionMutator for more information.
+	RefinementFiles []string
+
+	// RefinementNestLevel is the number of nest levels (including the
+	// outermost level) that grid cells intersecting the shapes in
+	// RefinementFiles should be divided to. If it is zero, the cells will
+	// be divided to the highest nest level.
+	RefinementNestLevel int
+
 	GridProj string // projection info for CTM grid; Proj4 format
 }
 
@@ -402,8 +414,8 @@ func (d *InMAP) totalMassPopulation(popGridColumn string) (totalMass, totalPopul
 // MutateGrid returns a function that creates a static variable
 // resolution grid (i.e., one that does not change during the simulation)
 // by dividing cells as determined by divideRule. Cells where divideRule is
-// true are divided to the next nest level (up to the maximum nest level), and
-// cells where divideRule is false are combined (down to the baseline nest level).
+// true are divided to the next nest level (up to the maximum nest level).
+// CoarsenGrid can be used to combine cells that have been divided.
 // Log messages are written to logChan if it is not nil.
 func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, pop *Population, mortRates *MortalityRates, emis *Emissions, m Mechanism, logChan chan string) DomainManipulator {
 	return func(d *InMAP) error {
@@ -429,6 +441,9 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 			var newCellIndices [][][2]int
 			var newCellLayers []int
 			var newCellConc [][]float64
+			var newCellTagConc [][][]float64
+			var newCellDep []*Deposition
+			var newCellTagDep [][]*Deposition
 			var cellsToDelete []*cellRef
 			for _, cell := range *d.cells {
 				if len(cell.Index) < len(config.Xnests) {
@@ -450,6 +465,9 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 								newCellIndices = append(newCellIndices, newIndex)
 								newCellLayers = append(newCellLayers, cell.Layer)
 								newCellConc = append(newCellConc, cell.Cf)
+								newCellTagConc = append(newCellTagConc, cell.TagCf)
+								newCellDep = append(newCellDep, cell.Deposition)
+								newCellTagDep = append(newCellTagDep, cell.TagDeposition)
 							}
 						}
 					}
@@ -459,12 +477,27 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 			// Delete the grid cells.
 			for _, cell := range cellsToDelete {
 				d.cells.delete(cell)
+				d.cellPartitions = nil
 				d.index.Delete(cell.Cell)
 				cell.dereferenceNeighbors(d)
 			}
 
 			// Add new cells.
-			err = d.addCells(config, newCellIndices, newCellLayers, newCellConc,
+			setConc := func(i int, c *Cell) {
+				copy(c.Cf, newCellConc[i])
+				copy(c.Ci, newCellConc[i])
+				for t, conc := range newCellTagConc[i] {
+					copy(c.TagCf[t], conc)
+					copy(c.TagCi[t], conc)
+				}
+				// Deposition is per unit area, so the new cells
+				// inherit the deposition of the cell they replace.
+				c.Deposition = newCellDep[i].clone()
+				for t, dep := range newCellTagDep[i] {
+					c.TagDeposition[t] = dep.clone()
+				}
+			}
+			err = d.addCells(config, newCellIndices, newCellLayers, setConc,
 				data, pop, mortRates, emis, webMapTrans, m, notMeters)
 			if err != nil {
 				return err
@@ -481,8 +514,152 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 	}
 }
 
+// A GridCoarsener is a function that determines whether a group of sibling
+// grid cells—cells in the same layer that were created by dividing the same
+// parent cell—should be combined back into the parent cell, where totalMass
+// and totalPopulation are as in GridMutator.
+type GridCoarsener func(siblings []*Cell, totalMass, totalPopulation float64) bool
+
+// CoarsenGrid returns a function that combines groups of sibling grid cells
+// into their parent cell where mergeRule is true, which is the
+// complement of MutateGrid. Only complete groups of siblings that have not
+// been further divided are combined, so cells are coarsened by at most one
+// nest level each time the function is run. The initial and final
+// concentrations of the combined cell are set so that the total pollutant
+// mass in the siblings is conserved.
+// Log messages are written to logChan if it is not nil.
+func (config *VarGridConfig) CoarsenGrid(mergeRule GridCoarsener, data *CTMData, pop *Population, mortRates *MortalityRates, emis *Emissions, m Mechanism, logChan chan string) DomainManipulator {
+	return func(d *InMAP) error {
+		if logChan != nil {
+			logChan <- fmt.Sprint("Combining grid cells...")
+		}
+
+		beginCells := d.cells.len()
+
+		totalMass, totalPopulation, err := d.totalMassPopulation(config.PopGridColumn)
+		if err != nil {
+			return err
+		}
+
+		webMapTrans, notMeters, err := config.webMapTrans()
+		if err != nil {
+			return err
+		}
+
+		// Group the cells by layer and the nest index of their parent cell.
+		type parentKey struct {
+			layer int
+			index string
+		}
+		groups := make(map[parentKey][]*cellRef)
+		var keys []parentKey
+		for _, cell := range *d.cells {
+			if len(cell.Index) < 2 {
+				continue // This cell is not nested.
+			}
+			k := parentKey{layer: cell.Layer, index: fmt.Sprint(cell.Index[:len(cell.Index)-1])}
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], cell)
+		}
+
+		var newCellIndices [][][2]int
+		var newCellLayers []int
+		var massI, massF [][]float64
+		var tagMassI, tagMassF [][][]float64
+		var deps []*Deposition
+		var tagDeps [][]*Deposition
+		var cellsToDelete []*cellRef
+		for _, k := range keys {
+			group := groups[k]
+			nest := len(group[0].Index) - 1
+			if len(group) != config.Xnests[nest]*config.Ynests[nest] {
+				continue // Some of the siblings have been further divided.
+			}
+			siblings := make([]*Cell, len(group))
+			for i, c := range group {
+				siblings[i] = c.Cell
+			}
+			if !mergeRule(siblings, totalMass, totalPopulation) {
+				continue
+			}
+			mi := make([]float64, m.Len())
+			mf := make([]float64, m.Len())
+			tmi := make([][]float64, len(d.tags))
+			tmf := make([][]float64, len(d.tags))
+			for t := range d.tags {
+				tmi[t] = make([]float64, m.Len())
+				tmf[t] = make([]float64, m.Len())
+			}
+			for _, c := range siblings {
+				for i := range mi {
+					mi[i] += c.Ci[i] * c.Volume
+					mf[i] += c.Cf[i] * c.Volume
+					for t := range d.tags {
+						tmi[t][i] += c.TagCi[t][i] * c.Volume
+						tmf[t][i] += c.TagCf[t][i] * c.Volume
+					}
+				}
+			}
+			newIndex := make([][2]int, nest)
+			copy(newIndex, group[0].Index[:nest])
+			newCellIndices = append(newCellIndices, newIndex)
+			newCellLayers = append(newCellLayers, k.layer)
+			massI = append(massI, mi)
+			massF = append(massF, mf)
+			tagMassI = append(tagMassI, tmi)
+			tagMassF = append(tagMassF, tmf)
+			deps = append(deps, mergeDeposition(siblings, func(c *Cell) *Deposition { return c.Deposition }))
+			td := make([]*Deposition, len(d.tags))
+			for t := range d.tags {
+				td[t] = mergeDeposition(siblings, func(c *Cell) *Deposition { return c.TagDeposition[t] })
+			}
+			tagDeps = append(tagDeps, td)
+			cellsToDelete = append(cellsToDelete, group...)
+		}
+
+		// Delete the grid cells.
+		for _, cell := range cellsToDelete {
+			d.cells.delete(cell)
+			d.cellPartitions = nil
+			d.index.Delete(cell.Cell)
+			cell.dereferenceNeighbors(d)
+		}
+
+		// Add the combined cells.
+		setConc := func(i int, c *Cell) {
+			for j := range c.Ci {
+				c.Ci[j] = massI[i][j] / c.Volume
+				c.Cf[j] = massF[i][j] / c.Volume
+				for t := range tagMassI[i] {
+					c.TagCi[t][j] = tagMassI[i][t][j] / c.Volume
+					c.TagCf[t][j] = tagMassF[i][t][j] / c.Volume
+				}
+			}
+			c.Deposition = deps[i]
+			copy(c.TagDeposition, tagDeps[i])
+		}
+		err = d.addCells(config, newCellIndices, newCellLayers, setConc,
+			data, pop, mortRates, emis, webMapTrans, m, notMeters)
+		if err != nil {
+			return err
+		}
+
+		endCells := d.cells.len()
+		if logChan != nil {
+			logChan <- fmt.Sprintf("Removed %d grid cells; there are now %d cells total",
+				beginCells-endCells, endCells)
+		}
+		return nil
+	}
+}
+
+// addCells creates and adds grid cells with the given nest indices and
+// layers. If setConc is not nil, it is called to set the concentrations
+// of the new cell created from newCellIndices[i].
 func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
-	newCellLayers []int, conc [][]float64, data *CTMData, pop *Population,
+	newCellLayers []int, setConc func(i int, c *Cell), data *CTMData, pop *Population,
 	mortRates *MortalityRates, emis *Emissions, webMapTrans proj.Transformer,
 	m Mechanism, notMeters bool) error {
 	type cellErr struct {
@@ -497,12 +674,14 @@ func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
 		go func(p int) {
 			for i := p; i < len(newCellIndices); i += nprocs {
 				ii := newCellIndices[i]
-				var conci []float64
-				if conc != nil {
-					conci = conc[i]
-				}
 				cell, err2 := config.createCell(data, pop, d.PopIndices, mortRates, d.mortIndices, ii,
-					newCellLayers[i], conci, webMapTrans, m, notMeters)
+					newCellLayers[i], webMapTrans, m, notMeters)
+				if err2 == nil && len(d.tags) > 0 {
+					cell.setTags(d.tags, m)
+				}
+				if err2 == nil && setConc != nil {
+					setConc(i, cell)
+				}
 				cellErrChan <- cellErr{cell: cell, err: err2}
 			}
 		}(p)
@@ -552,7 +731,14 @@ func (d *InMAP) InsertCell(c *Cell, m Mechanism) {
 		d.nlayers = c.Layer + 1
 	}
 	d.cells.add(c)
+	d.cellPartitions = nil
 	d.index.Insert(c)
+	if len(d.tags) > 0 {
+		c.setTags(d.tags, m)
+	}
+	if d.budget != nil && c.Budget == nil {
+		c.Budget = newCellBudget(m.Len())
+	}
 	d.setNeighbors(c, m)
 }
 
@@ -589,6 +775,160 @@ func PopulationMutator(config *VarGridConfig, popIndices PopIndices) (GridMutato
 	}, nil
 }
 
+// RegionMutator holds an algorithm for dividing grid cells that intersect
+// user-specified shapes (for example, community boundaries, road corridors,
+// or facility locations) so that the grid has high resolution in those
+// areas regardless of population. Refer to the methods for additional
+// documentation.
+type RegionMutator struct {
+	config    *VarGridConfig
+	nestLevel int
+	regions   *rtree.Rtree
+}
+
+// NewRegionMutator initializes a new RegionMutator using the shapes in
+// config.RefinementFiles, which are reprojected to config.GridProj.
+func NewRegionMutator(config *VarGridConfig) (*RegionMutator, error) {
+	r := &RegionMutator{
+		config:    config,
+		nestLevel: config.RefinementNestLevel,
+		regions:   rtree.NewTree(25, 50),
+	}
+	if r.nestLevel == 0 {
+		r.nestLevel = len(config.Xnests)
+	}
+	if r.nestLevel < 1 || r.nestLevel > len(config.Xnests) {
+		return nil, fmt.Errorf("inmap: RefinementNestLevel=%d but it needs to be between 1 and the number of nest levels (%d)",
+			config.RefinementNestLevel, len(config.Xnests))
+	}
+	gridSR, err := proj.Parse(config.GridProj)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: while parsing GridProj: %v", err)
+	}
+	for _, fname := range config.RefinementFiles {
+		f, err := shp.NewDecoder(fname)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: opening refinement shapefile: %v", err)
+		}
+		sr, err := f.SR()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("inmap: reading projection of refinement shapefile %s: %v", fname, err)
+		}
+		trans, err := sr.NewTransform(gridSR)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("inmap: reprojecting refinement shapefile %s: %v", fname, err)
+		}
+		for {
+			g, _, more := f.DecodeRowFields()
+			if !more {
+				break
+			}
+			gg, err := g.Transform(trans)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("inmap: reprojecting refinement shapefile %s: %v", fname, err)
+			}
+			r.regions.Insert(gg)
+		}
+		f.Close()
+		if err := f.Error(); err != nil {
+			return nil, fmt.Errorf("inmap: reading refinement shapefile %s: %v", fname, err)
+		}
+	}
+	return r, nil
+}
+
+// inRegion returns whether cell intersects any of the refinement shapes.
+func (r *RegionMutator) inRegion(cell *Cell) bool {
+	for _, g := range r.regions.SearchIntersect(cell.Bounds()) {
+		if intersects(g.(geom.Geom), cell.Polygonal) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mutate returns a function that determines whether a grid cell
+// should be divided because it intersects any of the refinement shapes
+// and has not yet been divided to config.RefinementNestLevel.
+// As with PopulationMutator, only cells below config.HiResLayers are divided.
+// It can be combined with other GridMutators using CombineMutators.
+func (r *RegionMutator) Mutate() GridMutator {
+	return func(cell *Cell, _, _ float64) bool {
+		if cell.Layer >= r.config.HiResLayers || len(cell.Index) >= r.nestLevel {
+			return false
+		}
+		return r.inRegion(cell)
+	}
+}
+
+// Coarsen returns a function that prevents groups of sibling grid cells from
+// being combined if the combined cell would be divided by the function
+// returned by Mutate. It can be combined with other GridCoarseners
+// using CombineCoarseners.
+func (r *RegionMutator) Coarsen() GridCoarsener {
+	return func(siblings []*Cell, _, _ float64) bool {
+		for _, cell := range siblings {
+			// The combined cell will be one nest level lower than the siblings.
+			if cell.Layer < r.config.HiResLayers && len(cell.Index)-1 < r.nestLevel && r.inRegion(cell) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// intersects returns whether g overlaps the interior or edge of p.
+func intersects(g geom.Geom, p geom.Polygonal) bool {
+	switch t := g.(type) {
+	case geom.Point:
+		return t.Within(p) != geom.Outside
+	case geom.MultiPoint:
+		for _, pt := range t {
+			if pt.Within(p) != geom.Outside {
+				return true
+			}
+		}
+		return false
+	case geom.Polygonal:
+		isect := t.Intersection(p)
+		return isect != nil && isect.Area() > 0
+	case geom.Linear:
+		isect := t.Clip(p)
+		return isect != nil && isect.Length() > 0
+	default:
+		return false
+	}
+}
+
+// CombineMutators returns a GridMutator that divides a grid cell
+// if any of mutators would divide it.
+func CombineMutators(mutators ...GridMutator) GridMutator {
+	return func(cell *Cell, totalMass, totalPopulation float64) bool {
+		for _, m := range mutators {
+			if m(cell, totalMass, totalPopulation) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CombineCoarseners returns a GridCoarsener that combines a group of sibling
+// grid cells only if all of coarseners would combine them.
+func CombineCoarseners(coarseners ...GridCoarsener) GridCoarsener {
+	return func(siblings []*Cell, totalMass, totalPopulation float64) bool {
+		for _, c := range coarseners {
+			if !c(siblings, totalMass, totalPopulation) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
 // PopConcMutator is a holds an algorithm for dividing grid cells based on
 // gradients in population density and concentration. Refer to the methods
 // for additional documentation.
@@ -645,6 +985,69 @@ func (p *PopConcMutator) Mutate() GridMutator {
 	}
 }
 
+// Coarsen returns a function that takes a group of sibling grid cells and
+// returns whether they should be combined, which is the case when
+// the combined cell would not be divided by the function returned by Mutate.
+// That is, Σ(|ΔConcentration|)*combinedVolume*|ΔPopulation| / {Σ(|totalMass|)*totalPopulation}
+// must not be greater than the threshold between the combined cell and any
+// of its horizontal neighbors, where the concentrations in the combined cell are
+// the volume-weighted average concentrations in the siblings
+// and the population of the combined cell is the total population of the siblings.
+func (p *PopConcMutator) Coarsen() GridCoarsener {
+	iPop := p.popIndices[p.config.PopGridColumn]
+	return func(siblings []*Cell, totalMass, totalPopulation float64) bool {
+		if totalMass == 0. || totalPopulation == 0 {
+			return true
+		}
+		inGroup := make(map[*Cell]bool)
+		var volume float64
+		conc := make([]float64, len(siblings[0].Cf))
+		for _, c := range siblings {
+			inGroup[c] = true
+			volume += c.Volume
+			for i, v := range c.Cf {
+				conc[i] += v * c.Volume
+			}
+		}
+		for i := range conc {
+			conc[i] /= volume
+		}
+		var groundCellPop float64
+		groundCells := make(map[*Cell]bool)
+		for _, c := range siblings {
+			for _, gc := range *c.groundLevel {
+				if !groundCells[gc.Cell] {
+					groundCells[gc.Cell] = true
+					groundCellPop += gc.PopData[iPop]
+				}
+			}
+		}
+		totalMassPop := totalMass * totalPopulation
+		for _, c := range siblings {
+			for _, group := range []*cellList{c.west, c.east, c.north, c.south} {
+				for _, neighbor := range *group {
+					if inGroup[neighbor.Cell] {
+						continue
+					}
+					var groundNeighborPop float64
+					for _, gc := range *neighbor.groundLevel {
+						groundNeighborPop += gc.PopData[iPop]
+					}
+					ΣΔC := 0.
+					for i, nc := range neighbor.Cf {
+						ΣΔC += math.Abs(nc - conc[i])
+					}
+					ΔP := math.Abs(groundCellPop - groundNeighborPop)
+					if ΣΔC*(volume+neighbor.Volume)*ΔP/totalMassPop > p.config.PopConcThreshold {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}
+}
+
 // cellGeometry returns the geometry of a cell with the give index.
 func (config *VarGridConfig) cellGeometry(index [][2]int) geom.Polygonal {
 	xResFac, yResFac := 1., 1.
@@ -666,11 +1069,10 @@ func (config *VarGridConfig) cellGeometry(index [][2]int) geom.Polygonal {
 // createCell creates a new grid cell. If any of the census shapes
 // that intersect the cell are above the population density threshold,
 // then the grid cell is also set to being above the density threshold.
-// If conc != nil, the concentration data for the new cell will be set to conc.
 // notMeters should be set to true if the units of the grid are not
 // in meters.
 func (config *VarGridConfig) createCell(data *CTMData, pop *Population, popIndices PopIndices,
-	mortRates *MortalityRates, mortIndices MortIndices, index [][2]int, layer int, conc []float64, webMapTrans proj.Transformer, m Mechanism, notMeters bool) (*Cell, error) {
+	mortRates *MortalityRates, mortIndices MortIndices, index [][2]int, layer int, webMapTrans proj.Transformer, m Mechanism, notMeters bool) (*Cell, error) {
 
 	cell := new(Cell)
 	cell.PopData = make([]float64, len(popIndices))
@@ -705,11 +1107,6 @@ func (config *VarGridConfig) createCell(data *CTMData, pop *Population, popIndic
 	}
 	cell.Volume = cell.Dx * cell.Dy * cell.Dz
 
-	if conc != nil {
-		copy(cell.Cf, conc)
-		copy(cell.Ci, conc)
-	}
-
 	return cell, nil
 }
 
@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
 	"github.com/ctessum/geom/index/rtree"
 )
 
@@ -871,6 +872,110 @@ func TestReadWriteCTMData(t *testing.T) {
 	os.Remove(TestCTMDataFile)
 }
 
+func TestRegionMutator(t *testing.T) {
+	const regionFile = "testRegion.shp"
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+
+	// Write a shapefile with a small polygon in the north-east corner
+	// of the domain.
+	type regionHolder struct {
+		geom.Polygon
+	}
+	region := geom.Polygon{{
+		geom.Point{X: 1000, Y: 1000},
+		geom.Point{X: 1100, Y: 1000},
+		geom.Point{X: 1100, Y: 1100},
+		geom.Point{X: 1000, Y: 1100},
+	}}
+	e, err := shp.NewEncoder(regionFile, regionHolder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Encode(regionHolder{Polygon: region}); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	defer func() {
+		for _, ext := range []string{".shp", ".shx", ".dbf", ".prj"} {
+			os.Remove("testRegion" + ext)
+		}
+	}()
+	f, err := os.Create("testRegion.prj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(TestGridSR)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfg.RefinementFiles = []string{regionFile}
+	regions, err := NewRegionMutator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			cfg.MutateGrid(regions.Mutate(), ctmdata, pop, mr, nil, m, nil),
+		},
+	}
+	if err = d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	checkGrid := func() {
+		var nRefined int
+		for _, c := range *d.cells {
+			isect := c.Intersection(region)
+			inRegion := isect != nil && isect.Area() > 0
+			switch {
+			case c.Layer >= cfg.HiResLayers && len(c.Index) != 1:
+				t.Errorf("layer %d cell %v should not be divided", c.Layer, c.Index)
+			case c.Layer < cfg.HiResLayers && inRegion && len(c.Index) != len(cfg.Xnests):
+				t.Errorf("cell %v intersects the region but is not divided to the highest nest level", c.Index)
+			case !inRegion && len(c.Index) == len(cfg.Xnests):
+				t.Errorf("cell %v does not intersect the region but is divided to the highest nest level", c.Index)
+			}
+			if c.Layer == 0 && len(c.Index) > 1 {
+				nRefined++
+			}
+		}
+		// The refined outermost cell is divided into 4 cells, and one of
+		// those is divided into 4 more.
+		if nRefined != 7 {
+			t.Errorf("there should be 7 refined cells but there are %d", nRefined)
+		}
+	}
+	checkGrid()
+
+	// The refined cells should not be coarsened.
+	always := func([]*Cell, float64, float64) bool { return true }
+	coarsen := cfg.CoarsenGrid(CombineCoarseners(always, regions.Coarsen()), ctmdata, pop, mr, nil, m, nil)
+	if err = coarsen(d); err != nil {
+		t.Fatal(err)
+	}
+	checkGrid()
+
+	// Test a lower nest level.
+	cfg.RefinementNestLevel = 2
+	regions, err = NewRegionMutator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator := regions.Mutate()
+	for _, c := range *d.cells {
+		if mutator(c.Cell, 0, 0) {
+			t.Errorf("cell %v should not be divided with RefinementNestLevel=2", c.Index)
+		}
+	}
+
+	cfg.RefinementNestLevel = len(cfg.Xnests) + 1
+	if _, err = NewRegionMutator(cfg); err == nil {
+		t.Error("invalid nest level should cause an error")
+	}
+}
+
 func different(a, b, tolerance float64) bool {
 	if 2*math.Abs(a-b)/math.Abs(a+b) > tolerance || math.IsNaN(a) || math.IsNaN(b) {
 		return true
@@ -21,6 +21,7 @@ package inmap
 import (
 	"fmt"
 	"math"
+	"strconv"
 	"time"
 
 	"github.com/ctessum/atmos/seinfeld"
@@ -40,7 +41,7 @@ const wrfFormat = "2006-01-02_15_04_05"
 
 // WRFChem is an InMAP preprocessor for WRF-Chem output.
 type WRFChem struct {
-	aVOC, bVOC, aSOA, bSOA, nox, no, no2, pNO, sox, pS, nh3, pNH, totalPM25 map[string]float64
+	groups SpeciesGroups
 
 	start, end time.Time
 
@@ -56,85 +57,191 @@ type WRFChem struct {
 // WRFOut is the location of WRF-Chem output files.
 // [DATE] should be used as a wild card for the simulation date.
 // startDate and endDate are the dates of the beginning and end of the
-// simulation, respectively, in the format "YYYYMMDD".
+// simulation, respectively, in the format "YYYYMMDD" or "YYYYMMDDTHH".
+// groups specifies the WRF-Chem variables that make up the chemical
+// species groups. If it is nil, the "WRF-Chem:RACM_SOA_VBS" preset
+// will be used (see SpeciesGroupPresets). It is an error if any of the
+// variables are not in the first WRF-Chem output file.
 // If msgChan is not nil, status messages will be sent to it.
-func NewWRFChem(WRFOut, startDate, endDate string, msgChan chan string) (*WRFChem, error) {
+func NewWRFChem(WRFOut, startDate, endDate string, groups SpeciesGroups, msgChan chan string) (*WRFChem, error) {
 	w := WRFChem{
-		// These maps contain the WRF-Chem variables that make
-		// up the chemical species groups, as well as the
-		// multiplication factors required to convert concentrations
-		// to mass fractions [μg/kg dry air].
+		wrfOut:  WRFOut,
+		msgChan: msgChan,
+	}
+
+	var err error
+	w.start, err = ParseDate(startDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor start time: %v", err)
+	}
+	w.end, err = ParseDate(endDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor end time: %v", err)
+	}
+
+	w.recordDelta, err = time.ParseDuration("1h")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor recordDelta: %v", err)
+	}
+	w.fileDelta, err = time.ParseDuration("24h")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor fileDelta: %v", err)
+	}
+
+	if groups == nil {
+		groups = wrfChemRACMSOAVBS()
+	}
+	if err = groups.Check(); err != nil {
+		return nil, err
+	}
+	date, _ := fileStart(w.start, w.fileDelta, w.recordDelta)
+	f, ff, err := ncfFromTemplate(w.wrfOut, wrfFormat, date)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor: %v", err)
+	}
+	defer f.Close()
+	if err = groups.checkVariables(f.Name(), ff, sameName); err != nil {
+		return nil, err
+	}
+	w.groups = groups
+	return &w, nil
+}
 
+// wrfChemRACMSOAVBS returns the species groups for WRF-Chem
+// simulations using the RACM gas-phase mechanism with the
+// MADE/VBS aerosol module.
+func wrfChemRACMSOAVBS() SpeciesGroups {
+	ppmv := func(mw float64) Species { return Species{Units: "ppmv", MW: mw} }
+	ugkg := func(factor float64) Species { return Species{Units: "ug/kg", Factor: factor} }
+	return SpeciesGroups{
 		// RACM VOC species and molecular weights (g/mol);
 		// Only includes anthropogenic precursors to SOA from
 		// anthropogenic (aSOA) and biogenic (bSOA) sources as
 		// in Ahmadov et al. (2012)
 		// Assume condensable vapor from SOA has molar mass of 70
-		aVOC: map[string]float64{
-			"hc5": ppmvToUgKg(72), "hc8": ppmvToUgKg(114),
-			"olt": ppmvToUgKg(42), "oli": ppmvToUgKg(68), "tol": ppmvToUgKg(92),
-			"xyl": ppmvToUgKg(106), "csl": ppmvToUgKg(108),
-			"cvasoa1": ppmvToUgKg(70), "cvasoa2": ppmvToUgKg(70),
-			"cvasoa3": ppmvToUgKg(70), "cvasoa4": ppmvToUgKg(70),
+		"AVOC": {
+			"hc5": ppmv(72), "hc8": ppmv(114),
+			"olt": ppmv(42), "oli": ppmv(68), "tol": ppmv(92),
+			"xyl": ppmv(106), "csl": ppmv(108),
+			"cvasoa1": ppmv(70), "cvasoa2": ppmv(70),
+			"cvasoa3": ppmv(70), "cvasoa4": ppmv(70),
 		},
-		bVOC: map[string]float64{
-			"iso": ppmvToUgKg(68), "api": ppmvToUgKg(136), "sesq": ppmvToUgKg(84.2),
-			"lim": ppmvToUgKg(136), "cvbsoa1": ppmvToUgKg(70), "cvbsoa2": ppmvToUgKg(70),
-			"cvbsoa3": ppmvToUgKg(70), "cvbsoa4": ppmvToUgKg(70),
+		"BVOC": {
+			"iso": ppmv(68), "api": ppmv(136), "sesq": ppmv(84.2),
+			"lim": ppmv(136), "cvbsoa1": ppmv(70), "cvbsoa2": ppmv(70),
+			"cvbsoa3": ppmv(70), "cvbsoa4": ppmv(70),
 		},
 		// VBS SOA species (anthropogenic only) [μg/kg dry air].
-		aSOA: map[string]float64{"asoa1i": 1, "asoa1j": 1, "asoa2i": 1,
-			"asoa2j": 1, "asoa3i": 1, "asoa3j": 1, "asoa4i": 1, "asoa4j": 1},
+		"ASOA": {"asoa1i": ugkg(1), "asoa1j": ugkg(1), "asoa2i": ugkg(1),
+			"asoa2j": ugkg(1), "asoa3i": ugkg(1), "asoa3j": ugkg(1), "asoa4i": ugkg(1), "asoa4j": ugkg(1)},
 		// VBS SOA species (biogenic only) [μg/kg dry air].
-		bSOA: map[string]float64{"bsoa1i": 1, "bsoa1j": 1, "bsoa2i": 1,
-			"bsoa2j": 1, "bsoa3i": 1, "bsoa3j": 1, "bsoa4i": 1, "bsoa4j": 1},
+		"BSOA": {"bsoa1i": ugkg(1), "bsoa1j": ugkg(1), "bsoa2i": ugkg(1),
+			"bsoa2j": ugkg(1), "bsoa3i": ugkg(1), "bsoa3j": ugkg(1), "bsoa4i": ugkg(1), "bsoa4j": ugkg(1)},
 		// NOx is RACM NOx species. We are only interested in the mass
 		// of Nitrogen, rather than the mass of the whole molecule, so
 		// we use the molecular weight of Nitrogen.
-		nox: map[string]float64{"no": ppmvToUgKg(mwN), "no2": ppmvToUgKg(mwN)},
+		"NOx": {"no": ppmv(mwN), "no2": ppmv(mwN)},
 		// pNO is the Nitrogen fraction of MADE particulate
 		// NO species [μg/kg dry air].
-		pNO: map[string]float64{"no3ai": mwN / mwNO3, "no3aj": mwN / mwNO3},
+		"PNO": {"no3ai": ugkg(mwN / mwNO3), "no3aj": ugkg(mwN / mwNO3)},
 		// SOx is the RACM SOx species. We are only interested in the mass
 		// of Sulfur, rather than the mass of the whole molecule, so
 		// we use the molecular weight of Sulfur.
-		sox: map[string]float64{"so2": ppmvToUgKg(mwS), "sulf": ppmvToUgKg(mwS)},
+		"SOx": {"so2": ppmv(mwS), "sulf": ppmv(mwS)},
 		// pS is the Sulfur fraction of the MADE particulate
 		// Sulfur species [μg/kg dry air].
-		pS: map[string]float64{"so4ai": mwS / mwSO4, "so4aj": mwS / mwSO4},
+		"PS": {"so4ai": ugkg(mwS / mwSO4), "so4aj": ugkg(mwS / mwSO4)},
 		// NH3 is ammonia. We are only interested in the mass
 		// of Nitrogen, rather than the mass of the whole molecule, so
 		// we use the molecular weight of Nitrogen.
-		nh3: map[string]float64{"nh3": ppmvToUgKg(mwN)},
+		"NH3": {"nh3": ppmv(mwN)},
 		// pNH is the Nitrogen fraction of the MADE particulate
 		// ammonia species [μg/kg dry air].
-		pNH: map[string]float64{"nh4ai": mwN / mwNH4, "nh4aj": mwN / mwNH4},
+		"PNH": {"nh4ai": ugkg(mwN / mwNH4), "nh4aj": ugkg(mwN / mwNH4)},
 		// totalPM25 is total mass of PM2.5  [μg/m3].
-		totalPM25: map[string]float64{"PM2_5_DRY": 1.},
-
-		wrfOut:  WRFOut,
-		msgChan: msgChan,
+		"TotalPM25": {"PM2_5_DRY": {Units: "ug/m3"}},
 	}
+}
 
-	var err error
-	w.start, err = time.Parse(inDateFormat, startDate)
-	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor start time: %v", err)
+// wrfChemSORGAM returns the species groups for WRF-Chem
+// simulations using the RADM2 gas-phase mechanism, or the RACM
+// mechanism if racm is true, with the MADE/SORGAM aerosol module.
+func wrfChemSORGAM(racm bool) SpeciesGroups {
+	g := wrfChemRACMSOAVBS()
+	ppmv := func(mw float64) Species { return Species{Units: "ppmv", MW: mw} }
+	ugkg := Species{Units: "ug/kg"}
+	// Anthropogenic SORGAM SOA precursors: alkanes, olefins, and aromatics.
+	g["AVOC"] = map[string]Species{
+		"hc8": ppmv(114), "olt": ppmv(42), "oli": ppmv(68),
+		"tol": ppmv(92), "xyl": ppmv(106), "csl": ppmv(108),
 	}
-	w.end, err = time.Parse(inDateFormat, endDate)
-	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor end time: %v", err)
+	g["BVOC"] = map[string]Species{"iso": ppmv(68)}
+	if racm {
+		g["BVOC"]["api"] = ppmv(136)
+		g["BVOC"]["lim"] = ppmv(136)
+	}
+	g["ASOA"] = map[string]Species{
+		"orgaro1i": ugkg, "orgaro1j": ugkg, "orgaro2i": ugkg, "orgaro2j": ugkg,
+		"orgalk1i": ugkg, "orgalk1j": ugkg, "orgole1i": ugkg, "orgole1j": ugkg,
 	}
+	g["BSOA"] = map[string]Species{
+		"orgba1i": ugkg, "orgba1j": ugkg, "orgba2i": ugkg, "orgba2j": ugkg,
+		"orgba3i": ugkg, "orgba3j": ugkg, "orgba4i": ugkg, "orgba4j": ugkg,
+	}
+	return g
+}
 
-	w.recordDelta, err = time.ParseDuration("1h")
-	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor recordDelta: %v", err)
+// wrfChemMOZARTMOSAIC returns the species groups for WRF-Chem
+// simulations using the MOZART gas-phase mechanism with the 4-bin
+// MOSAIC aerosol module and VBS SOA (chem_opt = 201). Only the first
+// three MOSAIC size bins, which are smaller than 2.5 μm, are included
+// in the particulate species groups.
+func wrfChemMOZARTMOSAIC() SpeciesGroups {
+	ppmv := func(mw float64) Species { return Species{Units: "ppmv", MW: mw} }
+	ugkg := func(factor float64) Species { return Species{Units: "ug/kg", Factor: factor} }
+	bins := func(prefix string, s Species) map[string]Species {
+		o := make(map[string]Species)
+		for _, bin := range []string{"_a01", "_a02", "_a03"} {
+			o[prefix+bin] = s
+		}
+		return o
 	}
-	w.fileDelta, err = time.ParseDuration("24h")
-	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor fileDelta: %v", err)
+	g := SpeciesGroups{
+		// MOZART anthropogenic SOA precursors and condensable vapors.
+		"AVOC": {
+			"bigalk": ppmv(72), "bigene": ppmv(56), "c3h6": ppmv(42),
+			"tol": ppmv(92), "benzene": ppmv(78), "xyl": ppmv(106),
+			"cvasoa1": ppmv(70), "cvasoa2": ppmv(70),
+			"cvasoa3": ppmv(70), "cvasoa4": ppmv(70),
+		},
+		// MOZART biogenic SOA precursors (isoprene and monoterpenes)
+		// and condensable vapors.
+		"BVOC": {
+			"isopr": ppmv(68), "c10h16": ppmv(136),
+			"cvbsoa1": ppmv(70), "cvbsoa2": ppmv(70),
+			"cvbsoa3": ppmv(70), "cvbsoa4": ppmv(70),
+		},
+		"ASOA":      make(map[string]Species),
+		"BSOA":      make(map[string]Species),
+		"NOx":       {"no": ppmv(mwN), "no2": ppmv(mwN)},
+		"PNO":       bins("no3", ugkg(mwN/mwNO3)),
+		"SOx":       {"so2": ppmv(mwS), "sulf": ppmv(mwS)},
+		"PS":        bins("so4", ugkg(mwS/mwSO4)),
+		"NH3":       {"nh3": ppmv(mwN)},
+		"PNH":       bins("nh4", ugkg(mwN/mwNH4)),
+		"TotalPM25": {"PM2_5_DRY": {Units: "ug/m3"}},
 	}
-	return &w, nil
+	// VBS SOA species [μg/kg dry air].
+	for i := 1; i <= 4; i++ {
+		n := strconv.Itoa(i)
+		for name, s := range bins("asoa"+n, ugkg(1)) {
+			g["ASOA"][name] = s
+		}
+		for name, s := range bins("bsoa"+n, ugkg(1)) {
+			g["BSOA"][name] = s
+		}
+	}
+	return g
 }
 
 // ppmvToUgKg returns a multiplier to convert a concentration in
@@ -156,6 +263,11 @@ func (w *WRFChem) readGroup(varGroup map[string]float64) NextData {
 	return nextDataGroupNCF(w.wrfOut, wrfFormat, varGroup, w.start, w.end, w.recordDelta, w.fileDelta, readNCF, w.msgChan)
 }
 
+func (w *WRFChem) readSpeciesGroup(group string) NextData {
+	massFraction, conc := w.groups.factors(group, sameName)
+	return readSpeciesGroup(massFraction, conc, w.readGroupAlt, w.readGroup)
+}
+
 // Nx helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the West-East direction.
 func (w *WRFChem) Nx() (int, error) {
@@ -246,37 +358,37 @@ func (w *WRFChem) V() NextData { return w.read("V") }
 func (w *WRFChem) W() NextData { return w.read("W") }
 
 // AVOC helps fulfill the Preprocessor interface.
-func (w *WRFChem) AVOC() NextData { return w.readGroupAlt(w.aVOC) }
+func (w *WRFChem) AVOC() NextData { return w.readSpeciesGroup("AVOC") }
 
 // BVOC helps fulfill the Preprocessor interface.
-func (w *WRFChem) BVOC() NextData { return w.readGroupAlt(w.bVOC) }
+func (w *WRFChem) BVOC() NextData { return w.readSpeciesGroup("BVOC") }
 
 // NOx helps fulfill the Preprocessor interface.
-func (w *WRFChem) NOx() NextData { return w.readGroupAlt(w.nox) }
+func (w *WRFChem) NOx() NextData { return w.readSpeciesGroup("NOx") }
 
 // SOx helps fulfill the Preprocessor interface.
-func (w *WRFChem) SOx() NextData { return w.readGroupAlt(w.sox) }
+func (w *WRFChem) SOx() NextData { return w.readSpeciesGroup("SOx") }
 
 // NH3 helps fulfill the Preprocessor interface.
-func (w *WRFChem) NH3() NextData { return w.readGroupAlt(w.nh3) }
+func (w *WRFChem) NH3() NextData { return w.readSpeciesGroup("NH3") }
 
 // ASOA helps fulfill the Preprocessor interface.
-func (w *WRFChem) ASOA() NextData { return w.readGroupAlt(w.aSOA) }
+func (w *WRFChem) ASOA() NextData { return w.readSpeciesGroup("ASOA") }
 
 // BSOA helps fulfill the Preprocessor interface.
-func (w *WRFChem) BSOA() NextData { return w.readGroupAlt(w.bSOA) }
+func (w *WRFChem) BSOA() NextData { return w.readSpeciesGroup("BSOA") }
 
 // PNO helps fulfill the Preprocessor interface.
-func (w *WRFChem) PNO() NextData { return w.readGroupAlt(w.pNO) }
+func (w *WRFChem) PNO() NextData { return w.readSpeciesGroup("PNO") }
 
 // PS helps fulfill the Preprocessor interface.
-func (w *WRFChem) PS() NextData { return w.readGroupAlt(w.pS) }
+func (w *WRFChem) PS() NextData { return w.readSpeciesGroup("PS") }
 
 // PNH helps fulfill the Preprocessor interface.
-func (w *WRFChem) PNH() NextData { return w.readGroupAlt(w.pNH) }
+func (w *WRFChem) PNH() NextData { return w.readSpeciesGroup("PNH") }
 
 // TotalPM25 helps fulfill the Preprocessor interface.
-func (w *WRFChem) TotalPM25() NextData { return w.readGroup(w.totalPM25) }
+func (w *WRFChem) TotalPM25() NextData { return w.readSpeciesGroup("TotalPM25") }
 
 // SurfaceHeatFlux helps fulfill the Preprocessor interface
 // by returning heat flux at the surface [W/m2].